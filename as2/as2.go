@@ -0,0 +1,196 @@
+// Package as2 exchanges files with trading partners over AS2 (RFC 4130).
+// Messages are MIME entities, signed with S/MIME detached signatures and
+// encrypted as PKCS #7 enveloped data, and are acknowledged with Message
+// Disposition Notifications (MDNs) carrying a hash of what was received, the
+// MIC. Messages from a partner, identified by its AS2 ID, are stored in the
+// inbound folder of its group; files are sent to its URL by the as2_send rule
+// action or the admin API. Both directions are recorded in the message log.
+package as2
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // Version is the AS2-Version we speak: 1.2 allows compression, which we
+    // do not use, and tells partners we understand the headers of 1.1.
+    Version   = "1.2"
+    userAgent = "LunaTransfer AS2"
+
+    maxMessageBytes = 512 << 20
+)
+
+var (
+    ErrDisabled = errors.New("AS2 is disabled")
+
+    stationMutex sync.Mutex
+    station      *Station
+
+    // Redirects are not followed: messages and MDNs only go to the URLs on
+    // the partner's profile.
+    httpClient = &http.Client{
+        Timeout: 5 * time.Minute,
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+        Transport: &http.Transport{
+            Proxy:               http.ProxyFromEnvironment,
+            TLSHandshakeTimeout: 30 * time.Second,
+            TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+        },
+    }
+)
+
+// Station is this server's AS2 identity.
+type Station struct {
+    ID          string
+    URL         string
+    Certificate *x509.Certificate
+    Key         *rsa.PrivateKey
+}
+
+// CertificatePEM is the certificate to hand to partners.
+func (s *Station) CertificatePEM() string {
+    return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate.Raw}))
+}
+
+// Fingerprint is the SHA-256 fingerprint of the certificate, which partners
+// compare when they import it.
+func (s *Station) Fingerprint() string {
+    sum := sha256.Sum256(s.Certificate.Raw)
+    parts := make([]string, len(sum))
+    for i, b := range sum {
+        parts[i] = fmt.Sprintf("%02X", b)
+    }
+    return strings.Join(parts, ":")
+}
+
+// LoadStation returns the station, reading its certificate once and
+// generating a self-signed one on first use when none was configured.
+func LoadStation() (*Station, error) {
+    stationMutex.Lock()
+    defer stationMutex.Unlock()
+
+    if station != nil {
+        return station, nil
+    }
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return nil, err
+    }
+    cfg := appConfig.AS2
+    if !cfg.Enabled {
+        return nil, ErrDisabled
+    }
+
+    if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) {
+        if err := generateCertificate(cfg.ID, cfg.CertFile, cfg.KeyFile); err != nil {
+            return nil, fmt.Errorf("failed to generate AS2 certificate: %w", err)
+        }
+        utils.LogSystem("AS2_CERT_CREATED", "system", "localhost",
+            fmt.Sprintf("Generated self-signed AS2 certificate %s", cfg.CertFile))
+    }
+
+    pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load AS2 certificate: %w", err)
+    }
+    key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("the AS2 key must be an RSA key")
+    }
+    cert, err := x509.ParseCertificate(pair.Certificate[0])
+    if err != nil {
+        return nil, err
+    }
+
+    station = &Station{ID: cfg.ID, URL: cfg.PublicURL, Certificate: cert, Key: key}
+    return station, nil
+}
+
+// generateCertificate creates an RSA certificate, which unlike ECDSA every
+// AS2 product can encrypt to.
+func generateCertificate(id, certFile, keyFile string) error {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return err
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return err
+    }
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: id, Organization: []string{"LunaTransfer"}},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().AddDate(5, 0, 0),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+        return err
+    }
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+    if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+        return err
+    }
+    return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// newMessageID returns a Message-ID without its angle brackets.
+func newMessageID(stationID string) string {
+    host := strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+            return r
+        }
+        return '-'
+    }, stationID)
+    return fmt.Sprintf("%s@%s", utils.GenerateUUID(), host)
+}
+
+// quoteID quotes an AS2 name for the AS2-From and AS2-To headers when it
+// contains spaces, as RFC 4130 requires.
+func quoteID(id string) string {
+    if strings.ContainsAny(id, " \t") {
+        return `"` + id + `"`
+    }
+    return id
+}
+
+func unquoteID(id string) string {
+    id = strings.TrimSpace(id)
+    if len(id) >= 2 && id[0] == '"' && id[len(id)-1] == '"' {
+        return id[1 : len(id)-1]
+    }
+    return id
+}
+
+func trimMessageID(id string) string {
+    return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+}
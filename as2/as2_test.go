@@ -0,0 +1,450 @@
+package as2
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const testAdmin = "as2admin"
+
+// testServer is the station's /as2 endpoint on loopback. Partners whose URL
+// points at it exchange messages with the station itself.
+var testServer *httptest.Server
+
+func TestMain(m *testing.M) {
+    os.Setenv("LUNA_AS2_ENABLED", "true")
+    os.Setenv("LUNA_AS2_ID", "LUNATEST")
+    testenv.Main(m, []testenv.User{
+        {Username: testAdmin, Password: "Admin12345", Email: "as2@example.com", Role: auth.RoleAdmin},
+    }, func() error {
+        testServer = httptest.NewServer(Handler())
+        st, err := LoadStation()
+        if err != nil {
+            return err
+        }
+        st.URL = testServer.URL + "/as2"
+        return nil
+    })
+}
+
+func testStation(t *testing.T) *Station {
+    t.Helper()
+    st, err := LoadStation()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return st
+}
+
+// newPartner creates a partner with settings, removed again when the test
+// ends.
+func newPartner(t *testing.T, settings partners.AS2Settings) partners.Partner {
+    t.Helper()
+    p := partners.Partner{
+        Name:      "Partner " + utils.GenerateUUID()[:8],
+        CreatedBy: testAdmin,
+        AS2:       &settings,
+    }
+    p.ID = utils.GenerateUUID()
+    p.Normalize()
+    if err := p.Validate(); err != nil {
+        t.Fatalf("invalid partner: %v", err)
+    }
+    if err := partners.CreatePartner(&p, testAdmin); err != nil {
+        t.Fatalf("CreatePartner: %v", err)
+    }
+    t.Cleanup(func() { partners.DeletePartner(p.ID) })
+    return p
+}
+
+// loopbackPartner is the station itself, reached over testServer.
+func loopbackPartner(t *testing.T, settings partners.AS2Settings) partners.Partner {
+    st := testStation(t)
+    settings.ID = st.ID
+    settings.URL = testServer.URL + "/as2"
+    settings.Certificate = st.CertificatePEM()
+    return newPartner(t, settings)
+}
+
+func inbound(t *testing.T, partnerID, messageID string) Message {
+    t.Helper()
+    messages, err := ListMessages(partnerID, DirectionInbound, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range messages {
+        if m.MessageID == messageID {
+            return m
+        }
+    }
+    t.Fatalf("inbound message %s not logged", messageID)
+    return Message{}
+}
+
+func storedContent(t *testing.T, p partners.Partner, file string) string {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join("storage", filepath.FromSlash(file)))
+    if err != nil {
+        t.Fatalf("reading stored payload: %v", err)
+    }
+    if want := "groups/" + p.GroupID + "/" + p.InboundFolder + "/"; !strings.HasPrefix(file, want) {
+        t.Errorf("payload stored as %s, want below %s", file, want)
+    }
+    return string(data)
+}
+
+func TestSendSyncMDN(t *testing.T) {
+    cases := []struct {
+        name          string
+        sign, encrypt bool
+        signedMDN     bool
+    }{
+        {"plain", false, false, false},
+        {"signed", true, false, true},
+        {"encrypted", false, true, false},
+        {"signed and encrypted", true, true, true},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            p := loopbackPartner(t, partners.AS2Settings{
+                Sign:             c.sign,
+                Encrypt:          c.encrypt,
+                MDN:              partners.MDNSync,
+                SignedMDN:        c.signedMDN,
+                RequireSigned:    c.sign,
+                RequireEncrypted: c.encrypt,
+                ContentType:      "application/edi-x12",
+            })
+
+            content := "ISA*00*~GS*PO*~ST*850*0001~\r\n"
+            msg, err := Send(p, "order.x12", strings.NewReader(content), testAdmin)
+            if err != nil {
+                t.Fatalf("Send: %v", err)
+            }
+            if msg.Status != StatusAcknowledged {
+                t.Fatalf("status %s: %s", msg.Status, msg.Error)
+            }
+
+            in := inbound(t, p.ID, msg.MessageID)
+            if in.Status != StatusReceived || in.Signed != c.sign || in.Encrypted != c.encrypt {
+                t.Errorf("inbound %s signed %t encrypted %t", in.Status, in.Signed, in.Encrypted)
+            }
+            if !sameMIC(in.MIC, msg.MIC) {
+                t.Errorf("receiver MIC %q, sender MIC %q", in.MIC, msg.MIC)
+            }
+            if in.MDN != partners.MDNSync || in.MDNSigned != c.signedMDN {
+                t.Errorf("inbound MDN %s signed %t", in.MDN, in.MDNSigned)
+            }
+            if got := storedContent(t, p, in.File); got != content {
+                t.Errorf("stored %q", got)
+            }
+
+            // The same message again is acknowledged but not stored twice.
+            if _, err := Send(p, "order.x12", strings.NewReader(content), testAdmin); err != nil {
+                t.Fatalf("second Send: %v", err)
+            }
+        })
+    }
+}
+
+func TestSendAsyncMDN(t *testing.T) {
+    p := loopbackPartner(t, partners.AS2Settings{Sign: true, Encrypt: true, MDN: partners.MDNAsync, SignedMDN: true})
+
+    msg, err := Send(p, "invoice.xml", strings.NewReader("<invoice/>"), testAdmin)
+    if err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+    if msg.Status != StatusAwaitingMDN && msg.Status != StatusAcknowledged {
+        t.Fatalf("status %s: %s", msg.Status, msg.Error)
+    }
+
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        messages, err := ListMessages(p.ID, DirectionOutbound, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(messages) != 1 {
+            t.Fatalf("%d outbound messages", len(messages))
+        }
+        if messages[0].Status == StatusAcknowledged {
+            if messages[0].Disposition == "" {
+                t.Error("disposition of the MDN not recorded")
+            }
+            break
+        }
+        if messages[0].Status != StatusAwaitingMDN || time.Now().After(deadline) {
+            t.Fatalf("status %s: %s", messages[0].Status, messages[0].Error)
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if in := inbound(t, p.ID, msg.MessageID); in.MDN != partners.MDNAsync {
+        t.Errorf("inbound MDN %s, want async", in.MDN)
+    }
+}
+
+// recorder stands in for a host an asynchronous MDN must not reach unless
+// the partner profile allows it.
+type recorder struct {
+    mu    sync.Mutex
+    posts int
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    r.mu.Lock()
+    r.posts++
+    r.mu.Unlock()
+}
+
+func (r *recorder) count() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.posts
+}
+
+// postMessage sends content from the partner with AS2 ID from to the station,
+// signed by signer when set, asking for an MDN to async or, without it, in
+// the response.
+func postMessage(t *testing.T, from string, signer *Station, content, async string) (*http.Response, []byte, string) {
+    t.Helper()
+    st := testStation(t)
+    body := []byte("Content-Type: text/plain\r\nContent-Disposition: attachment; filename=\"note.txt\"\r\n\r\n" + content)
+    if signer != nil {
+        var err error
+        if body, err = sign(signer, body, "sha-256"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    e, err := parseEntity(body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req, err := http.NewRequest(http.MethodPost, testServer.URL+"/as2", bytes.NewReader(e.body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    messageID := newMessageID(from)
+    setHeaders(req.Header, e, from, st.ID, messageID)
+    req.Header.Set("Disposition-Notification-To", "edi@partner.example")
+    if async != "" {
+        req.Header.Set("Receipt-Delivery-Option", async)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(resp.Body)
+    return resp, data, messageID
+}
+
+func syncMDN(t *testing.T, cert *x509.Certificate, resp *http.Response, body []byte) mdnFields {
+    t.Helper()
+    fields, _, err := parseMDN(testStation(t), cert, entityFromHTTP(resp.Header, body))
+    if err != nil {
+        t.Fatalf("no MDN in the response (%s): %v", resp.Status, err)
+    }
+    return fields
+}
+
+func waitForPosts(r *recorder, want int) int {
+    deadline := time.Now().Add(time.Second)
+    for r.count() < want && time.Now().Before(deadline) {
+        time.Sleep(20 * time.Millisecond)
+    }
+    return r.count()
+}
+
+func TestAsyncMDNTarget(t *testing.T) {
+    st := testStation(t)
+    target := &recorder{}
+    targetServer := httptest.NewServer(target)
+    defer targetServer.Close()
+
+    // The partner's endpoint is elsewhere, so the recorder is not on its host.
+    p := loopbackPartner(t, partners.AS2Settings{MDN: partners.MDNSync})
+    p.AS2.URL = "https://as2.partner.example/receive"
+    if err := partners.UpdatePartner(&p, testAdmin); err != nil {
+        t.Fatal(err)
+    }
+
+    t.Run("unsigned", func(t *testing.T) {
+        resp, body, messageID := postMessage(t, st.ID, nil, "unsigned", targetServer.URL+"/mdn")
+        if fields := syncMDN(t, st.Certificate, resp, body); fields.originalMessageID != messageID || fields.failure() != "" {
+            t.Errorf("MDN %+v", fields)
+        }
+        if in := inbound(t, p.ID, messageID); in.MDN != partners.MDNSync {
+            t.Errorf("inbound MDN %s, want sync", in.MDN)
+        }
+    })
+
+    t.Run("not on the profile", func(t *testing.T) {
+        resp, body, messageID := postMessage(t, st.ID, st, "other host", targetServer.URL+"/mdn")
+        if fields := syncMDN(t, st.Certificate, resp, body); fields.originalMessageID != messageID {
+            t.Errorf("MDN %+v", fields)
+        }
+    })
+
+    t.Run("bad signature", func(t *testing.T) {
+        other := newPartner(t, partners.AS2Settings{
+            ID:          "OTHER",
+            URL:         targetServer.URL + "/as2",
+            Certificate: otherCertificate(t),
+        })
+        // Signed by the station, not by the partner's key.
+        resp, body, messageID := postMessage(t, "OTHER", st, "forged", targetServer.URL+"/mdn")
+        in := inbound(t, other.ID, messageID)
+        if in.Status != StatusFailed || !strings.Contains(in.Disposition, "authentication-failed") {
+            t.Errorf("inbound %s %q", in.Status, in.Disposition)
+        }
+        if resp.StatusCode != http.StatusOK || len(body) == 0 {
+            t.Errorf("no MDN in the response: %s", resp.Status)
+        }
+    })
+
+    if posts := waitForPosts(target, 1); posts != 0 {
+        t.Fatalf("%d MDNs posted to a host the partner profile does not allow", posts)
+    }
+
+    t.Run("mdn_url", func(t *testing.T) {
+        p.AS2.MDNURL = targetServer.URL + "/mdn"
+        if err := partners.UpdatePartner(&p, testAdmin); err != nil {
+            t.Fatal(err)
+        }
+        resp, body, messageID := postMessage(t, st.ID, st, "allowed", targetServer.URL+"/mdn")
+        if resp.StatusCode != http.StatusOK || len(body) != 0 {
+            t.Errorf("response %s with %d bytes, want an empty 200", resp.Status, len(body))
+        }
+        if posts := waitForPosts(target, 1); posts != 1 {
+            t.Errorf("%d MDNs posted, want 1", posts)
+        }
+        if in := inbound(t, p.ID, messageID); in.MDN != partners.MDNAsync {
+            t.Errorf("inbound MDN %s, want async", in.MDN)
+        }
+    })
+}
+
+// otherCertificate is a certificate whose key the station does not have.
+func otherCertificate(t *testing.T) string {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "OTHER"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// fakePartner answers every message with the MDN mdn builds for it.
+func fakePartner(t *testing.T, mdn func(st *Station, messageID string) []byte) string {
+    t.Helper()
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(io.Discard, r.Body)
+        st, _ := LoadStation()
+        e, err := parseEntity(mdn(st, trimMessageID(r.Header.Get("Message-ID"))))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        setHeaders(w.Header(), e, st.ID, st.ID, newMessageID(st.ID))
+        w.Write(e.body)
+    }))
+    t.Cleanup(server.Close)
+    return server.URL + "/as2"
+}
+
+func TestMDNChecks(t *testing.T) {
+    cases := []struct {
+        name      string
+        signedMDN bool
+        mdn       func(st *Station, messageID string) []byte
+        want      string
+    }{
+        {"MIC mismatch", false, func(st *Station, messageID string) []byte {
+            mdn, _ := buildMDN(st, messageID, computeMIC([]byte("something else"), "sha-256"), "", "", "ok", false, "")
+            return mdn
+        }, "MIC mismatch"},
+        {"missing MIC", false, func(st *Station, messageID string) []byte {
+            mdn, _ := buildMDN(st, messageID, "", "", "", "ok", false, "")
+            return mdn
+        }, "MIC mismatch"},
+        {"unsigned MDN", true, func(st *Station, messageID string) []byte {
+            mdn, _ := buildMDN(st, messageID, "", "", "", "ok", false, "")
+            return mdn
+        }, "not signed"},
+        {"error disposition", false, func(st *Station, messageID string) []byte {
+            mdn, _ := buildMDN(st, messageID, "", "decryption-failed", "", "failed", false, "")
+            return mdn
+        }, "decryption-failed"},
+        {"other message", false, func(st *Station, messageID string) []byte {
+            mdn, _ := buildMDN(st, "someone-else@partner", "", "", "", "ok", false, "")
+            return mdn
+        }, "MDN is for message"},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            st := testStation(t)
+            p := newPartner(t, partners.AS2Settings{
+                ID:          "FAKE",
+                URL:         fakePartner(t, c.mdn),
+                Certificate: st.CertificatePEM(),
+                Sign:        true,
+                MDN:         partners.MDNSync,
+                SignedMDN:   c.signedMDN,
+            })
+            msg, err := Send(p, "data.bin", strings.NewReader("payload"), testAdmin)
+            if err == nil || !strings.Contains(err.Error(), c.want) {
+                t.Fatalf("Send error %v, want %q", err, c.want)
+            }
+            if msg.Status != StatusFailed {
+                t.Errorf("status %s", msg.Status)
+            }
+        })
+    }
+}
+
+func TestReplayedAsyncMDNIsRefused(t *testing.T) {
+    p := loopbackPartner(t, partners.AS2Settings{MDN: partners.MDNSync})
+    msg, err := Send(p, "once.txt", strings.NewReader("once"), testAdmin)
+    if err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+
+    // An MDN for a message that was already settled changes nothing.
+    _, err = completeOutbound(p.ID, msg.MessageID, func(m *Message) { m.Status = StatusFailed })
+    if err == nil || !strings.Contains(err.Error(), "not awaiting") {
+        t.Fatalf("completeOutbound: %v", err)
+    }
+    messages, _ := ListMessages(p.ID, DirectionOutbound, 1)
+    if len(messages) != 1 || messages[0].Status != StatusAcknowledged {
+        t.Errorf("outbound %+v", messages)
+    }
+}
@@ -0,0 +1,193 @@
+package as2
+
+import (
+    "bytes"
+    "crypto/x509"
+    "fmt"
+    "net/http"
+    "net/textproto"
+    "strings"
+    "time"
+)
+
+// notificationOptions is what a sender asked for in the
+// Disposition-Notification-* and Receipt-Delivery-Option headers.
+type notificationOptions struct {
+    requested bool
+    signed    bool
+    micalg    string
+    asyncURL  string
+}
+
+// parseNotificationOptions reads headers such as
+//
+//     Disposition-Notification-Options: signed-receipt-protocol=optional, pkcs7-signature;
+//         signed-receipt-micalg=optional, sha-256, sha1
+func parseNotificationOptions(h http.Header) notificationOptions {
+    options := notificationOptions{
+        requested: h.Get("Disposition-Notification-To") != "",
+        asyncURL:  strings.TrimSpace(h.Get("Receipt-Delivery-Option")),
+    }
+    for _, parameter := range strings.Split(h.Get("Disposition-Notification-Options"), ";") {
+        name, value, ok := strings.Cut(parameter, "=")
+        if !ok {
+            continue
+        }
+        // The first value is the importance, required or optional.
+        values := strings.Split(value, ",")
+        switch strings.ToLower(strings.TrimSpace(name)) {
+        case "signed-receipt-protocol":
+            for _, v := range values[1:] {
+                if strings.EqualFold(strings.TrimSpace(v), "pkcs7-signature") {
+                    options.signed = true
+                }
+            }
+        case "signed-receipt-micalg":
+            for _, v := range values[1:] {
+                v = strings.ToLower(strings.TrimSpace(v))
+                if _, ok := micAlgorithms[v]; ok {
+                    options.micalg = v
+                    break
+                }
+            }
+        }
+    }
+    return options
+}
+
+// mdnFields are the fields of a message/disposition-notification part.
+type mdnFields struct {
+    originalMessageID string
+    disposition       string
+    mic               string
+}
+
+// failure returns the error or failure modifier of a disposition such as
+// "automatic-action/MDN-sent-automatically; processed/error: decryption-failed",
+// or "" when the message was processed.
+func (f mdnFields) failure() string {
+    _, disposition, _ := strings.Cut(f.disposition, ";")
+    disposition = strings.TrimSpace(disposition)
+    if disposition == "" {
+        return "no disposition"
+    }
+    if strings.HasPrefix(strings.ToLower(disposition), "processed") && !strings.Contains(strings.ToLower(disposition), "error") &&
+        !strings.Contains(strings.ToLower(disposition), "failure") {
+        return ""
+    }
+    return disposition
+}
+
+// buildMDN writes the MDN for originalID, signed by the station when signed
+// is set. failure is an RFC 4130 error modifier, or "" when the message was
+// processed; warning adds a warning modifier to a processed message.
+func buildMDN(st *Station, originalID, mic, failure, warning, text string, signed bool, micalg string) ([]byte, error) {
+    disposition := "automatic-action/MDN-sent-automatically; processed"
+    if failure != "" {
+        disposition += "/error: " + failure
+    } else if warning != "" {
+        disposition += "/warning: " + warning
+    }
+
+    boundary := newBoundary()
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=disposition-notification; boundary=\"%s\"\r\n\r\n", boundary)
+    fmt.Fprintf(&b, "--%s\r\n", boundary)
+    b.WriteString("Content-Type: text/plain; charset=us-ascii\r\nContent-Transfer-Encoding: 7bit\r\n\r\n")
+    b.WriteString(text + "\r\n")
+    fmt.Fprintf(&b, "--%s\r\n", boundary)
+    b.WriteString("Content-Type: message/disposition-notification\r\nContent-Transfer-Encoding: 7bit\r\n\r\n")
+    fmt.Fprintf(&b, "Reporting-UA: %s\r\n", userAgent)
+    fmt.Fprintf(&b, "Original-Recipient: rfc822; %s\r\n", quoteID(st.ID))
+    fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", quoteID(st.ID))
+    fmt.Fprintf(&b, "Original-Message-ID: <%s>\r\n", originalID)
+    if mic != "" && failure == "" {
+        fmt.Fprintf(&b, "Received-Content-MIC: %s\r\n", mic)
+    }
+    fmt.Fprintf(&b, "Disposition: %s\r\n", disposition)
+    fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+    if !signed {
+        return b.Bytes(), nil
+    }
+    if micalg == "" {
+        micalg = "sha-256"
+    }
+    return sign(st, b.Bytes(), micalg)
+}
+
+// parseMDN reads an MDN, checking its signature against cert when it is
+// signed.
+func parseMDN(st *Station, cert *x509.Certificate, e *entity) (mdnFields, bool, error) {
+    u, err := unwrap(st, cert, e)
+    if err != nil {
+        return mdnFields{}, false, err
+    }
+    mediaType, params := u.entity.mediaType()
+    if mediaType != "multipart/report" {
+        return mdnFields{}, u.signed, fmt.Errorf("expected multipart/report, got %s", mediaType)
+    }
+    parts, err := splitMultipart(u.entity.body, params["boundary"])
+    if err != nil {
+        return mdnFields{}, u.signed, err
+    }
+    for _, raw := range parts {
+        part, err := parseEntity(raw)
+        if err != nil {
+            continue
+        }
+        if partType, _ := part.mediaType(); partType != "message/disposition-notification" {
+            continue
+        }
+        body, err := part.decodedBody()
+        if err != nil {
+            return mdnFields{}, u.signed, err
+        }
+        fields, err := parseEntity(append(bytes.TrimLeft(body, "\r\n"), "\r\n\r\n"...))
+        if err != nil {
+            return mdnFields{}, u.signed, err
+        }
+        return mdnFields{
+            originalMessageID: trimMessageID(fields.header.Get("Original-Message-ID")),
+            disposition:       strings.TrimSpace(fields.header.Get("Disposition")),
+            mic:               strings.TrimSpace(fields.header.Get("Received-Content-MIC")),
+        }, u.signed, nil
+    }
+    return mdnFields{}, u.signed, fmt.Errorf("MDN has no disposition notification")
+}
+
+// isReport tells an MDN from a message carrying a file.
+func isReport(e *entity) bool {
+    mediaType, _ := e.mediaType()
+    return mediaType == "multipart/report"
+}
+
+// setHeaders moves the MIME header of e to the HTTP header h and adds the
+// AS2 headers.
+func setHeaders(h http.Header, e *entity, from, to, messageID string) {
+    for name, values := range e.header {
+        h[textproto.CanonicalMIMEHeaderKey(name)] = values
+    }
+    h.Set("AS2-Version", Version)
+    h.Set("AS2-From", quoteID(from))
+    h.Set("AS2-To", quoteID(to))
+    h.Set("Message-ID", "<"+messageID+">")
+    h.Set("Mime-Version", "1.0")
+    h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+}
+
+// entityFromHTTP rebuilds the MIME entity an HTTP message carries. AS2 puts
+// the entity's header in the HTTP header.
+func entityFromHTTP(h http.Header, body []byte) *entity {
+    header := textproto.MIMEHeader{}
+    var raw bytes.Buffer
+    for _, name := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+        if value := h.Get(name); value != "" {
+            header.Set(name, value)
+            fmt.Fprintf(&raw, "%s: %s\r\n", name, value)
+        }
+    }
+    raw.WriteString("\r\n")
+    raw.Write(body)
+    return &entity{header: header, body: body, raw: raw.Bytes()}
+}
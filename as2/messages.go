@@ -0,0 +1,161 @@
+package as2
+
+import (
+    database "LunaTransfer/store"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+)
+
+const maxMessages = 5000
+
+const (
+    DirectionInbound  = "inbound"
+    DirectionOutbound = "outbound"
+
+    // Inbound messages are received or failed; a duplicate was received
+    // before and is acknowledged again without being stored twice.
+    StatusReceived  = "received"
+    StatusDuplicate = "duplicate"
+    // Outbound messages are sent when no MDN was asked for, awaiting_mdn
+    // until an asynchronous MDN arrives, and acknowledged once an MDN
+    // confirmed them with a matching MIC.
+    StatusSent         = "sent"
+    StatusAwaitingMDN  = "awaiting_mdn"
+    StatusAcknowledged = "acknowledged"
+    StatusFailed       = "failed"
+)
+
+var (
+    ErrMessageNotFound = errors.New("AS2 message not found")
+
+    messagesMutex sync.Mutex
+)
+
+// Message is one AS2 message in the log. MIC is "<base64 digest>, <algorithm>"
+// as carried in MDNs; Disposition is the disposition of the MDN we sent or
+// received.
+type Message struct {
+    ID          string     `json:"id"`
+    MessageID   string     `json:"message_id"`
+    Direction   string     `json:"direction"`
+    PartnerID   string     `json:"partner_id"`
+    PartnerName string     `json:"partner_name"`
+    File        string     `json:"file,omitempty"`
+    Size        int64      `json:"size"`
+    Signed      bool       `json:"signed"`
+    Encrypted   bool       `json:"encrypted"`
+    MIC         string     `json:"mic,omitempty"`
+    MDN         string     `json:"mdn"`
+    MDNSigned   bool       `json:"mdn_signed"`
+    Status      string     `json:"status"`
+    Disposition string     `json:"disposition,omitempty"`
+    Error       string     `json:"error,omitempty"`
+    Actor       string     `json:"actor,omitempty"`
+    RemoteAddr  string     `json:"remote_addr,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+const messagesFile = "as2_messages.json"
+
+func loadMessages() ([]Message, error) {
+    messages := []Message{}
+    if err := database.ReadDataFile(messagesFile, &messages); err != nil {
+        return nil, err
+    }
+    return messages, nil
+}
+
+func saveMessages(messages []Message) error {
+    return database.WriteDataFile(messagesFile, messages)
+}
+
+// saveMessage adds m to the log or replaces the entry with its ID, dropping
+// the oldest entries beyond maxMessages.
+func saveMessage(m Message) error {
+    messagesMutex.Lock()
+    defer messagesMutex.Unlock()
+
+    messages, err := loadMessages()
+    if err != nil {
+        return err
+    }
+    for i := range messages {
+        if messages[i].ID == m.ID {
+            messages[i] = m
+            return saveMessages(messages)
+        }
+    }
+    messages = append(messages, m)
+    if len(messages) > maxMessages {
+        messages = messages[len(messages)-maxMessages:]
+    }
+    return saveMessages(messages)
+}
+
+// completeOutbound records the MDN for the outbound message messageID sent to
+// partnerID. MDNs for messages that are not awaiting one are refused so that
+// a replayed MDN cannot change a settled message.
+func completeOutbound(partnerID, messageID string, update func(*Message)) (Message, error) {
+    messagesMutex.Lock()
+    defer messagesMutex.Unlock()
+
+    messages, err := loadMessages()
+    if err != nil {
+        return Message{}, err
+    }
+    for i := len(messages) - 1; i >= 0; i-- {
+        m := &messages[i]
+        if m.Direction != DirectionOutbound || m.PartnerID != partnerID || m.MessageID != messageID {
+            continue
+        }
+        if m.Status != StatusAwaitingMDN {
+            return *m, fmt.Errorf("message %s is not awaiting an MDN", messageID)
+        }
+        update(m)
+        now := time.Now()
+        m.CompletedAt = &now
+        return *m, saveMessages(messages)
+    }
+    return Message{}, ErrMessageNotFound
+}
+
+// received reports whether messageID from partnerID was already stored.
+func received(partnerID, messageID string) (bool, error) {
+    messagesMutex.Lock()
+    defer messagesMutex.Unlock()
+
+    messages, err := loadMessages()
+    if err != nil {
+        return false, err
+    }
+    for _, m := range messages {
+        if m.Direction == DirectionInbound && m.PartnerID == partnerID &&
+            m.MessageID == messageID && m.Status == StatusReceived {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// ListMessages returns the log newest first, filtered by partner and
+// direction when given.
+func ListMessages(partnerID, direction string, limit int) ([]Message, error) {
+    messagesMutex.Lock()
+    defer messagesMutex.Unlock()
+
+    messages, err := loadMessages()
+    if err != nil {
+        return nil, err
+    }
+    result := []Message{}
+    for i := len(messages) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+        m := messages[i]
+        if (partnerID == "" || m.PartnerID == partnerID) && (direction == "" || m.Direction == direction) {
+            result = append(result, m)
+        }
+    }
+    return result, nil
+}
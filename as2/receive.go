@@ -0,0 +1,382 @@
+package as2
+
+import (
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "bytes"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+const (
+    asyncMDNAttempts = 3
+    asyncMDNDelay    = 10 * time.Second
+)
+
+// Handler receives AS2 messages and asynchronous MDNs. Partners are known by
+// their AS2-From and authenticated by their signatures, so the endpoint sits
+// outside the API's login.
+func Handler() http.Handler {
+    return http.HandlerFunc(receive)
+}
+
+func receive(w http.ResponseWriter, r *http.Request) {
+    st, err := LoadStation()
+    if err != nil {
+        utils.LogError("AS2_ERROR", err, "system", "AS2 station unavailable")
+        http.Error(w, "AS2 is not available", http.StatusServiceUnavailable)
+        return
+    }
+
+    from := unquoteID(r.Header.Get("AS2-From"))
+    to := unquoteID(r.Header.Get("AS2-To"))
+    messageID := trimMessageID(r.Header.Get("Message-ID"))
+    if from == "" || to == "" || messageID == "" {
+        http.Error(w, "AS2-From, AS2-To and Message-ID are required", http.StatusBadRequest)
+        return
+    }
+    if to != st.ID {
+        utils.LogSystem("AS2_REJECTED", from, r.RemoteAddr, fmt.Sprintf("Message %s is addressed to %s, not to us", messageID, to))
+        http.Error(w, "Unknown AS2-To", http.StatusNotFound)
+        return
+    }
+    partner, err := partners.PartnerByAS2ID(from)
+    if err != nil {
+        if !errors.Is(err, partners.ErrPartnerNotFound) {
+            utils.LogError("AS2_ERROR", err, from, "Failed to load partners")
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        utils.LogSystem("AS2_REJECTED", from, r.RemoteAddr, fmt.Sprintf("Message %s from unknown AS2 partner", messageID))
+        http.Error(w, "Unknown trading partnership", http.StatusForbidden)
+        return
+    }
+    if err := partners.CheckPartnerAccess(partner, partners.ProtocolAS2, r.RemoteAddr); err != nil {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
+    cert, err := partner.AS2.ParseCertificate()
+    if err != nil {
+        utils.LogError("AS2_ERROR", err, from, fmt.Sprintf("Certificate of partner %s is unusable", partner.Name))
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageBytes+1))
+    if err != nil {
+        http.Error(w, "Failed to read message", http.StatusBadRequest)
+        return
+    }
+    if len(body) > maxMessageBytes {
+        http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+        return
+    }
+
+    top := entityFromHTTP(r.Header, body)
+    u, unwrapErr := unwrap(st, cert, top)
+    if unwrapErr == nil && isReport(u.entity) {
+        receiveMDN(w, r, st, cert, partner, top)
+        return
+    }
+
+    options := parseNotificationOptions(r.Header)
+    micalg := options.micalg
+    if micalg == "" {
+        micalg = u.micalg
+    }
+    msg := Message{
+        ID:          utils.GenerateUUID(),
+        MessageID:   messageID,
+        Direction:   DirectionInbound,
+        PartnerID:   partner.ID,
+        PartnerName: partner.Name,
+        Signed:      u.signed,
+        Encrypted:   u.encrypted,
+        MIC:         computeMIC(u.micInput, micalg),
+        MDN:         partners.MDNNone,
+        MDNSigned:   options.requested && options.signed,
+        RemoteAddr:  r.RemoteAddr,
+        CreatedAt:   time.Now(),
+    }
+    // An asynchronous MDN is posted only for a message whose signature
+    // verified, and only to where the partner's profile allows, so that
+    // nobody can make us post to other hosts. Otherwise it is returned in the
+    // response.
+    if options.requested {
+        msg.MDN = partners.MDNSync
+        if options.asyncURL != "" {
+            switch {
+            case unwrapErr != nil || !u.signed:
+                utils.LogSystem("AS2_MDN_URL_REJECTED", "partner:"+partner.ID, r.RemoteAddr,
+                    fmt.Sprintf("Message %s asks for an asynchronous MDN but is not signed; answering synchronously", messageID))
+            case !partner.AS2.AllowsMDNURL(options.asyncURL):
+                utils.LogSystem("AS2_MDN_URL_REJECTED", "partner:"+partner.ID, r.RemoteAddr,
+                    fmt.Sprintf("Message %s asks for an asynchronous MDN to %s, which is not on the partner's profile; answering synchronously",
+                        messageID, options.asyncURL))
+            default:
+                msg.MDN = partners.MDNAsync
+            }
+        }
+    }
+
+    warning := ""
+    err = unwrapErr
+    if err == nil {
+        err = checkSecurity(partner, u)
+    }
+    if err == nil {
+        var duplicate bool
+        duplicate, err = received(partner.ID, messageID)
+        if err != nil {
+            err = failed("unexpected-processing-error", err)
+        } else if duplicate {
+            msg.Status = StatusDuplicate
+            warning = "duplicate-document"
+        }
+    }
+    if err == nil && msg.Status != StatusDuplicate {
+        msg.File, msg.Size, err = store(partner, u.entity, messageID, r.RemoteAddr)
+        if err != nil {
+            err = failed("unexpected-processing-error", err)
+        }
+    }
+
+    failure := ""
+    text := fmt.Sprintf("The AS2 message <%s> sent to %s was received and processed.", messageID, st.ID)
+    if err != nil {
+        failure = modifierOf(err)
+        msg.Status = StatusFailed
+        msg.Error = err.Error()
+        text = fmt.Sprintf("The AS2 message <%s> sent to %s could not be processed: %s", messageID, st.ID, err.Error())
+        utils.LogError("AS2_RECEIVE_FAILED", err, "partner:"+partner.ID, fmt.Sprintf("Message %s from %s", messageID, r.RemoteAddr))
+    } else if msg.Status == StatusDuplicate {
+        utils.LogSystem("AS2_DUPLICATE", "partner:"+partner.ID, r.RemoteAddr,
+            fmt.Sprintf("Message %s from %s was already received", messageID, partner.Name))
+    } else {
+        msg.Status = StatusReceived
+        utils.LogSystem("AS2_RECEIVED", "partner:"+partner.ID, r.RemoteAddr,
+            fmt.Sprintf("Message %s from %s stored as %s (%d bytes, signed %t, encrypted %t)",
+                messageID, partner.Name, msg.File, msg.Size, msg.Signed, msg.Encrypted))
+    }
+    if options.requested {
+        msg.Disposition = "processed"
+        if failure != "" {
+            msg.Disposition += "/error: " + failure
+        } else if warning != "" {
+            msg.Disposition += "/warning: " + warning
+        }
+    }
+    now := time.Now()
+    msg.CompletedAt = &now
+    if err := saveMessage(msg); err != nil {
+        utils.LogError("AS2_ERROR", err, "partner:"+partner.ID, "Failed to record AS2 message")
+    }
+
+    if !options.requested {
+        if failure != "" {
+            http.Error(w, text, http.StatusBadRequest)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    mdn, err := buildMDN(st, messageID, msg.MIC, failure, warning, text, options.signed, micalg)
+    if err != nil {
+        utils.LogError("AS2_ERROR", err, "partner:"+partner.ID, "Failed to build MDN")
+        http.Error(w, "Failed to build MDN", http.StatusInternalServerError)
+        return
+    }
+    mdnEntity, err := parseEntity(mdn)
+    if err != nil {
+        http.Error(w, "Failed to build MDN", http.StatusInternalServerError)
+        return
+    }
+
+    if msg.MDN == partners.MDNAsync {
+        go sendAsyncMDN(st, partner, options.asyncURL, mdnEntity, messageID)
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+    setHeaders(w.Header(), mdnEntity, st.ID, partner.AS2.ID, newMessageID(st.ID))
+    w.Header().Set("Server", userAgent)
+    w.WriteHeader(http.StatusOK)
+    w.Write(mdnEntity.body)
+}
+
+// checkSecurity refuses messages weaker than the partner is set up for.
+func checkSecurity(partner partners.Partner, u unwrapped) error {
+    if partner.AS2.RequireSigned && !u.signed {
+        return failed("insufficient-message-security", fmt.Errorf("the message must be signed"))
+    }
+    if partner.AS2.RequireEncrypted && !u.encrypted {
+        return failed("insufficient-message-security", fmt.Errorf("the message must be encrypted"))
+    }
+    return nil
+}
+
+// store writes the payload into the partner's inbound folder as the
+// partner's creator, so that rules, webhooks and the transfer log see it like
+// any other upload, and returns its storage path and size.
+func store(partner partners.Partner, e *entity, messageID, remoteAddr string) (string, int64, error) {
+    content, err := e.decodedBody()
+    if err != nil {
+        return "", 0, fmt.Errorf("invalid payload encoding: %w", err)
+    }
+
+    fs, err := vfs.New(partner.CreatedBy, remoteAddr, fmt.Sprintf("AS2 (%s)", partner.Name))
+    if err != nil {
+        return "", 0, fmt.Errorf("partner owner %s is not available: %w", partner.CreatedBy, err)
+    }
+    folder := path.Join("/", vfs.GroupsDir, partner.GroupID, partner.InboundFolder)
+    if err := fs.MkdirAll(folder); err != nil {
+        return "", 0, err
+    }
+
+    name := payloadName(e, messageID)
+    ext := path.Ext(name)
+    base := strings.TrimSuffix(name, ext)
+    for i := 0; i < 1000; i++ {
+        candidate := name
+        if i > 0 {
+            candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+        }
+        target := path.Join(folder, candidate)
+        file, err := fs.Create(target, os.O_EXCL)
+        if os.IsExist(err) {
+            continue
+        }
+        if err != nil {
+            return "", 0, err
+        }
+        if _, err := io.Copy(file, bytes.NewReader(content)); err != nil {
+            file.Close()
+            fs.Remove(target)
+            return "", 0, err
+        }
+        if err := file.Close(); err != nil {
+            return "", 0, err
+        }
+        return strings.TrimPrefix(target, "/"), int64(len(content)), nil
+    }
+    return "", 0, fmt.Errorf("no free name for %s", name)
+}
+
+// payloadName is the file name the partner sent, or one made from the
+// Message-ID and the content type.
+func payloadName(e *entity, messageID string) string {
+    name := path.Base(strings.ReplaceAll(e.fileName(), "\\", "/"))
+    name = strings.Map(func(r rune) rune {
+        if r < 0x20 || r == 0x7f {
+            return -1
+        }
+        return r
+    }, name)
+    if name != "" && name != "." && name != ".." && name != "/" {
+        return name
+    }
+
+    base := strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+            return r
+        }
+        return '_'
+    }, strings.SplitN(messageID, "@", 2)[0])
+    ext := ".bin"
+    mediaType, _ := e.mediaType()
+    switch mediaType {
+    case "application/edi-x12":
+        ext = ".x12"
+    case "application/edifact":
+        ext = ".edi"
+    case "application/xml", "text/xml":
+        ext = ".xml"
+    default:
+        if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+            ext = exts[0]
+        }
+    }
+    return "as2-" + base + ext
+}
+
+// receiveMDN settles the outbound message an asynchronous MDN refers to.
+func receiveMDN(w http.ResponseWriter, r *http.Request, st *Station, cert *x509.Certificate, partner partners.Partner, top *entity) {
+    fields, signed, err := parseMDN(st, cert, top)
+    if err != nil {
+        utils.LogError("AS2_MDN_FAILED", err, "partner:"+partner.ID, fmt.Sprintf("Unreadable MDN from %s", r.RemoteAddr))
+        http.Error(w, "Invalid MDN", http.StatusBadRequest)
+        return
+    }
+    msg, err := completeOutbound(partner.ID, fields.originalMessageID, func(m *Message) {
+        settle(m, fields, signed)
+    })
+    if errors.Is(err, ErrMessageNotFound) {
+        utils.LogSystem("AS2_MDN_UNMATCHED", "partner:"+partner.ID, r.RemoteAddr,
+            fmt.Sprintf("MDN for unknown message %s", fields.originalMessageID))
+        http.Error(w, "Unknown message", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("AS2_MDN_FAILED", err, "partner:"+partner.ID, "Failed to record MDN")
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    logOutcome(msg)
+    w.WriteHeader(http.StatusOK)
+}
+
+// settle applies an MDN to the outbound message it acknowledges.
+func settle(m *Message, fields mdnFields, signed bool) {
+    m.Disposition = fields.disposition
+    switch {
+    case fields.failure() != "":
+        m.Status, m.Error = StatusFailed, "partner reported "+fields.failure()
+    case m.MDNSigned && !signed:
+        m.Status, m.Error = StatusFailed, "the MDN was not signed"
+    case !sameMIC(m.MIC, fields.mic):
+        m.Status, m.Error = StatusFailed, fmt.Sprintf("MIC mismatch: sent %q, partner received %q", m.MIC, fields.mic)
+    default:
+        m.Status, m.Error = StatusAcknowledged, ""
+    }
+}
+
+// sendAsyncMDN posts the MDN to the URL the sender asked for, retrying a few
+// times.
+func sendAsyncMDN(st *Station, partner partners.Partner, target string, mdn *entity, originalID string) {
+    var err error
+    for attempt := 1; attempt <= asyncMDNAttempts; attempt++ {
+        if attempt > 1 {
+            time.Sleep(asyncMDNDelay)
+        }
+        var req *http.Request
+        req, err = http.NewRequest(http.MethodPost, target, bytes.NewReader(mdn.body))
+        if err != nil {
+            break
+        }
+        setHeaders(req.Header, mdn, st.ID, partner.AS2.ID, newMessageID(st.ID))
+        req.Header.Set("User-Agent", userAgent)
+        var resp *http.Response
+        resp, err = httpClient.Do(req)
+        if err != nil {
+            continue
+        }
+        io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+        resp.Body.Close()
+        if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+            utils.LogSystem("AS2_MDN_SENT", "partner:"+partner.ID, "localhost",
+                fmt.Sprintf("Asynchronous MDN for %s delivered to %s", originalID, target))
+            return
+        }
+        err = fmt.Errorf("%s answered %s", target, resp.Status)
+    }
+    utils.LogError("AS2_MDN_FAILED", err, "partner:"+partner.ID, fmt.Sprintf("Asynchronous MDN for %s not delivered", originalID))
+}
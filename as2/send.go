@@ -0,0 +1,191 @@
+package as2
+
+import (
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "time"
+)
+
+const maxMDNBytes = 1 << 20
+
+var ErrNoAS2 = errors.New("partner has no AS2 endpoint")
+
+// Send transmits the file read from r to partner under name, signed and
+// encrypted as the partner is set up for, and records it. With a
+// synchronous MDN the message is settled when Send returns; with an
+// asynchronous one it stays awaiting_mdn until the MDN arrives at /as2. An
+// error means the partner did not accept the message.
+func Send(partner partners.Partner, name string, r io.Reader, actor string) (Message, error) {
+    if partner.AS2 == nil || partner.AS2.URL == "" {
+        return Message{}, ErrNoAS2
+    }
+    if partner.Status == partners.StatusSuspended {
+        return Message{}, fmt.Errorf("partner %s is suspended", partner.Name)
+    }
+    if !partner.AllowsProtocol(partners.ProtocolAS2) {
+        return Message{}, fmt.Errorf("partner %s may not use %s", partner.Name, partners.ProtocolAS2)
+    }
+    st, err := LoadStation()
+    if err != nil {
+        return Message{}, err
+    }
+    cert, err := partner.AS2.ParseCertificate()
+    if err != nil {
+        return Message{}, err
+    }
+    content, err := io.ReadAll(io.LimitReader(r, maxMessageBytes+1))
+    if err != nil {
+        return Message{}, err
+    }
+    if len(content) > maxMessageBytes {
+        return Message{}, fmt.Errorf("file is larger than %d bytes", maxMessageBytes)
+    }
+
+    settings := partner.AS2
+    msg := Message{
+        ID:          utils.GenerateUUID(),
+        MessageID:   newMessageID(st.ID),
+        Direction:   DirectionOutbound,
+        PartnerID:   partner.ID,
+        PartnerName: partner.Name,
+        File:        name,
+        Size:        int64(len(content)),
+        Signed:      settings.Sign,
+        Encrypted:   settings.Encrypt,
+        MDN:         settings.MDN,
+        MDNSigned:   settings.MDN != partners.MDNNone && settings.SignedMDN,
+        Actor:       actor,
+        CreatedAt:   time.Now(),
+    }
+
+    var payload bytes.Buffer
+    fmt.Fprintf(&payload, "Content-Type: %s\r\n", settings.ContentType)
+    payload.WriteString("Content-Transfer-Encoding: binary\r\n")
+    fmt.Fprintf(&payload, "Content-Disposition: %s\r\n\r\n", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+    payload.Write(content)
+
+    body := payload.Bytes()
+    msg.MIC = computeMIC(body, "sha-256")
+    if !settings.Sign && !settings.Encrypt {
+        // A plain message's receiver only sees the body as a MIME entity.
+        msg.MIC = computeMIC(content, "sha-256")
+    }
+    if settings.Sign {
+        if body, err = sign(st, body, "sha-256"); err != nil {
+            return msg, err
+        }
+    }
+    if settings.Encrypt {
+        if body, err = encrypt(body, cert, settings.EncryptionAlgorithm); err != nil {
+            return msg, err
+        }
+    }
+    e, err := parseEntity(body)
+    if err != nil {
+        return msg, err
+    }
+
+    req, err := http.NewRequest(http.MethodPost, settings.URL, bytes.NewReader(e.body))
+    if err != nil {
+        return msg, err
+    }
+    setHeaders(req.Header, e, st.ID, settings.ID, msg.MessageID)
+    req.Header.Set("User-Agent", userAgent)
+    req.Header.Set("Subject", name)
+    if settings.MDN != partners.MDNNone {
+        req.Header.Set("Disposition-Notification-To", st.URL)
+        if settings.SignedMDN {
+            req.Header.Set("Disposition-Notification-Options",
+                "signed-receipt-protocol=optional, pkcs7-signature; signed-receipt-micalg=optional, sha-256")
+        }
+    }
+    if settings.MDN == partners.MDNAsync {
+        req.Header.Set("Receipt-Delivery-Option", st.URL)
+    }
+
+    // An asynchronous MDN may arrive before the partner has answered, so the
+    // message is recorded as awaiting it first.
+    if settings.MDN == partners.MDNAsync {
+        msg.Status = StatusAwaitingMDN
+        if err := saveMessage(msg); err != nil {
+            return msg, err
+        }
+    }
+    err = post(st, partner, req, &msg)
+    if err != nil {
+        msg.Status, msg.Error = StatusFailed, err.Error()
+    }
+    if msg.Status != StatusAwaitingMDN {
+        now := time.Now()
+        msg.CompletedAt = &now
+        if err := saveMessage(msg); err != nil {
+            utils.LogError("AS2_ERROR", err, actor, "Failed to record AS2 message")
+        }
+    }
+    logOutcome(msg)
+    if msg.Status == StatusFailed {
+        return msg, errors.New(msg.Error)
+    }
+    return msg, nil
+}
+
+// post sends req and reads the synchronous MDN, if one was asked for.
+func post(st *Station, partner partners.Partner, req *http.Request, msg *Message) error {
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxMDNBytes))
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        snippet := string(body)
+        if len(snippet) > 512 {
+            snippet = snippet[:512]
+        }
+        return fmt.Errorf("partner answered %s: %s", resp.Status, snippet)
+    }
+
+    switch msg.MDN {
+    case partners.MDNNone:
+        msg.Status = StatusSent
+        return nil
+    case partners.MDNAsync:
+        msg.Status = StatusAwaitingMDN
+        return nil
+    }
+
+    cert, err := partner.AS2.ParseCertificate()
+    if err != nil {
+        return err
+    }
+    fields, signed, err := parseMDN(st, cert, entityFromHTTP(resp.Header, body))
+    if err != nil {
+        return fmt.Errorf("invalid MDN: %w", err)
+    }
+    if fields.originalMessageID != msg.MessageID {
+        return fmt.Errorf("MDN is for message %s", fields.originalMessageID)
+    }
+    settle(msg, fields, signed)
+    if msg.Status == StatusFailed {
+        return errors.New(msg.Error)
+    }
+    return nil
+}
+
+func logOutcome(msg Message) {
+    summary := fmt.Sprintf("Message %s (%s, %d bytes) to %s: %s", msg.MessageID, msg.File, msg.Size, msg.PartnerName, msg.Status)
+    if msg.Status == StatusFailed {
+        utils.LogError("AS2_SEND_FAILED", errors.New(msg.Error), msg.Actor, summary)
+        return
+    }
+    utils.LogSystem("AS2_SENT", msg.Actor, "localhost", summary)
+}
@@ -0,0 +1,441 @@
+package as2
+
+import (
+    "bufio"
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "mime/quotedprintable"
+    "net/textproto"
+    "strings"
+    "sync"
+
+    _ "crypto/sha1"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+
+    "github.com/smallstep/pkcs7"
+)
+
+// entity is a MIME entity. raw is the entity exactly as it was transferred,
+// header included, which is what signatures and MICs cover.
+type entity struct {
+    header textproto.MIMEHeader
+    body   []byte
+    raw    []byte
+}
+
+// parseEntity splits raw into its header and body.
+func parseEntity(raw []byte) (*entity, error) {
+    if bytes.HasPrefix(raw, []byte("\r\n")) || bytes.HasPrefix(raw, []byte("\n")) {
+        return &entity{header: textproto.MIMEHeader{}, body: raw[bytes.IndexByte(raw, '\n')+1:], raw: raw}, nil
+    }
+    end, sep := len(raw), 0
+    if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+        end, sep = i, 4
+    }
+    if i := bytes.Index(raw, []byte("\n\n")); i >= 0 && i < end {
+        end, sep = i, 2
+    }
+    if sep == 0 {
+        return nil, fmt.Errorf("MIME entity has no header")
+    }
+
+    reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(raw[:end:end], "\r\n\r\n"...))))
+    header, err := reader.ReadMIMEHeader()
+    if err != nil {
+        return nil, fmt.Errorf("invalid MIME header: %w", err)
+    }
+    return &entity{header: header, body: raw[end+sep:], raw: raw}, nil
+}
+
+func (e *entity) mediaType() (string, map[string]string) {
+    mediaType, params, err := mime.ParseMediaType(e.header.Get("Content-Type"))
+    if err != nil {
+        return "text/plain", map[string]string{}
+    }
+    return mediaType, params
+}
+
+// decodedBody undoes the Content-Transfer-Encoding.
+func (e *entity) decodedBody() ([]byte, error) {
+    switch strings.ToLower(strings.TrimSpace(e.header.Get("Content-Transfer-Encoding"))) {
+    case "base64":
+        clean := strings.Map(func(r rune) rune {
+            if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+                return -1
+            }
+            return r
+        }, string(e.body))
+        return base64.StdEncoding.DecodeString(clean)
+    case "quoted-printable":
+        return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(e.body)))
+    }
+    return e.body, nil
+}
+
+// fileName is the name the sender gave the payload, if any.
+func (e *entity) fileName() string {
+    if _, params, err := mime.ParseMediaType(e.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+        return params["filename"]
+    }
+    if _, params := e.mediaType(); params["name"] != "" {
+        return params["name"]
+    }
+    return ""
+}
+
+// splitMultipart returns the raw parts of a multipart body. Each part keeps
+// its header and loses the line break that belongs to the next delimiter.
+func splitMultipart(body []byte, boundary string) ([][]byte, error) {
+    delimiter := []byte("--" + boundary)
+    find := func(from int) int {
+        for from <= len(body) {
+            i := bytes.Index(body[from:], delimiter)
+            if i < 0 {
+                return -1
+            }
+            i += from
+            if i == 0 || body[i-1] == '\n' {
+                return i
+            }
+            from = i + 1
+        }
+        return -1
+    }
+
+    parts := [][]byte{}
+    pos := find(0)
+    for pos >= 0 {
+        after := pos + len(delimiter)
+        if bytes.HasPrefix(body[after:], []byte("--")) {
+            return parts, nil
+        }
+        eol := bytes.IndexByte(body[after:], '\n')
+        if eol < 0 {
+            break
+        }
+        start := after + eol + 1
+        next := find(start)
+        if next < 0 {
+            break
+        }
+        end := next
+        if end >= start+2 && body[end-2] == '\r' {
+            end -= 2
+        } else if end > start {
+            end--
+        }
+        parts = append(parts, body[start:end])
+        pos = next
+    }
+    return nil, fmt.Errorf("multipart body is not terminated")
+}
+
+// canonicalize turns bare line feeds into CRLF, which some senders do
+// before signing text they keep with Unix line ends.
+func canonicalize(data []byte) []byte {
+    return bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+var micAlgorithms = map[string]crypto.Hash{
+    "sha1":    crypto.SHA1,
+    "sha-1":   crypto.SHA1,
+    "sha256":  crypto.SHA256,
+    "sha-256": crypto.SHA256,
+    "sha384":  crypto.SHA384,
+    "sha-384": crypto.SHA384,
+    "sha512":  crypto.SHA512,
+    "sha-512": crypto.SHA512,
+}
+
+var digestOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+    crypto.SHA1:   pkcs7.OIDDigestAlgorithmSHA1,
+    crypto.SHA256: pkcs7.OIDDigestAlgorithmSHA256,
+    crypto.SHA384: pkcs7.OIDDigestAlgorithmSHA384,
+    crypto.SHA512: pkcs7.OIDDigestAlgorithmSHA512,
+}
+
+// computeMIC returns the MIC of data as written in MDNs.
+func computeMIC(data []byte, algorithm string) string {
+    algorithm = strings.ToLower(algorithm)
+    hash, ok := micAlgorithms[algorithm]
+    if !ok {
+        algorithm, hash = "sha-256", crypto.SHA256
+    }
+    h := hash.New()
+    h.Write(data)
+    return base64.StdEncoding.EncodeToString(h.Sum(nil)) + ", " + algorithm
+}
+
+// sameMIC compares MICs, allowing the algorithm to be spelled differently.
+func sameMIC(a, b string) bool {
+    digestA, algA, _ := strings.Cut(a, ",")
+    digestB, algB, _ := strings.Cut(b, ",")
+    hashA, okA := micAlgorithms[strings.ToLower(strings.TrimSpace(algA))]
+    hashB, okB := micAlgorithms[strings.ToLower(strings.TrimSpace(algB))]
+    return okA && okB && hashA == hashB && strings.TrimSpace(digestA) == strings.TrimSpace(digestB)
+}
+
+func newBoundary() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return "----=_Part_" + hex.EncodeToString(b)
+}
+
+// base64Lines encodes data in lines of 76 characters.
+func base64Lines(data []byte) string {
+    encoded := base64.StdEncoding.EncodeToString(data)
+    var b strings.Builder
+    for len(encoded) > 76 {
+        b.WriteString(encoded[:76])
+        b.WriteString("\r\n")
+        encoded = encoded[76:]
+    }
+    b.WriteString(encoded)
+    return b.String()
+}
+
+// sign wraps the MIME entity content in a multipart/signed entity with a
+// detached signature by the station.
+func sign(st *Station, content []byte, micalg string) ([]byte, error) {
+    hash, ok := micAlgorithms[micalg]
+    if !ok {
+        return nil, fmt.Errorf("unsupported MIC algorithm %q", micalg)
+    }
+    signed, err := pkcs7.NewSignedData(content)
+    if err != nil {
+        return nil, err
+    }
+    signed.SetDigestAlgorithm(digestOIDs[hash])
+    if err := signed.AddSigner(st.Certificate, st.Key, pkcs7.SignerInfoConfig{}); err != nil {
+        return nil, fmt.Errorf("failed to sign: %w", err)
+    }
+    signed.Detach()
+    signature, err := signed.Finish()
+    if err != nil {
+        return nil, fmt.Errorf("failed to sign: %w", err)
+    }
+
+    boundary := newBoundary()
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=%s; boundary=\"%s\"\r\n\r\n", micalg, boundary)
+    fmt.Fprintf(&b, "--%s\r\n", boundary)
+    b.Write(content)
+    fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+    b.WriteString("Content-Type: application/pkcs7-signature; name=smime.p7s\r\n")
+    b.WriteString("Content-Transfer-Encoding: base64\r\n")
+    b.WriteString("Content-Disposition: attachment; filename=smime.p7s\r\n\r\n")
+    b.WriteString(base64Lines(signature))
+    fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+    return b.Bytes(), nil
+}
+
+// verify checks the detached signature in the signature part against
+// content. Only cert is trusted, whatever certificates the message carries,
+// so a message signed by anyone but the partner fails.
+func verify(content []byte, signaturePart *entity, cert *x509.Certificate) error {
+    der, err := signaturePart.decodedBody()
+    if err != nil {
+        return fmt.Errorf("invalid signature encoding: %w", err)
+    }
+    p7, err := pkcs7.Parse(der)
+    if err != nil {
+        return fmt.Errorf("invalid signature: %w", err)
+    }
+    p7.Certificates = []*x509.Certificate{cert}
+    p7.Content = content
+    err = p7.Verify()
+    if err != nil && bytes.Contains(content, []byte("\n")) {
+        p7.Content = canonicalize(content)
+        if p7.Verify() == nil {
+            return nil
+        }
+    }
+    return err
+}
+
+// verifyOpaque checks signed-data that carries its content and returns the
+// content.
+func verifyOpaque(der []byte, cert *x509.Certificate) ([]byte, error) {
+    p7, err := pkcs7.Parse(der)
+    if err != nil {
+        return nil, fmt.Errorf("invalid signed data: %w", err)
+    }
+    p7.Certificates = []*x509.Certificate{cert}
+    if err := p7.Verify(); err != nil {
+        return nil, err
+    }
+    return p7.Content, nil
+}
+
+var (
+    // pkcs7 takes the content cipher from package variables.
+    encryptMutex sync.Mutex
+
+    encryptionAlgorithms = map[string]int{
+        "aes128-cbc": pkcs7.EncryptionAlgorithmAES128CBC,
+        "aes256-cbc": pkcs7.EncryptionAlgorithmAES256CBC,
+        "aes128-gcm": pkcs7.EncryptionAlgorithmAES128GCM,
+        "aes256-gcm": pkcs7.EncryptionAlgorithmAES256GCM,
+    }
+)
+
+// encrypt envelopes content for cert and returns the application/pkcs7-mime
+// entity.
+func encrypt(content []byte, cert *x509.Certificate, algorithm string) ([]byte, error) {
+    cipher, ok := encryptionAlgorithms[algorithm]
+    if !ok {
+        return nil, fmt.Errorf("unsupported encryption algorithm %q", algorithm)
+    }
+
+    encryptMutex.Lock()
+    pkcs7.ContentEncryptionAlgorithm = cipher
+    // RSA PKCS #1 v1.5 key transport is what every AS2 product accepts.
+    pkcs7.KeyEncryptionAlgorithm = pkcs7.OIDEncryptionAlgorithmRSA
+    der, err := pkcs7.Encrypt(content, []*x509.Certificate{cert})
+    encryptMutex.Unlock()
+    if err != nil {
+        return nil, fmt.Errorf("failed to encrypt: %w", err)
+    }
+
+    var b bytes.Buffer
+    b.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n")
+    b.WriteString("Content-Transfer-Encoding: binary\r\n")
+    b.WriteString("Content-Disposition: attachment; filename=smime.p7m\r\n\r\n")
+    b.Write(der)
+    return b.Bytes(), nil
+}
+
+func decrypt(st *Station, e *entity) ([]byte, error) {
+    der, err := e.decodedBody()
+    if err != nil {
+        return nil, err
+    }
+    // Some senders base64 encode without saying so.
+    if len(der) > 0 && der[0] != 0x30 {
+        if decoded, err := (&entity{header: textproto.MIMEHeader{"Content-Transfer-Encoding": {"base64"}}, body: der}).decodedBody(); err == nil {
+            der = decoded
+        }
+    }
+    p7, err := pkcs7.Parse(der)
+    if err != nil {
+        return nil, err
+    }
+    return p7.Decrypt(st.Certificate, st.Key)
+}
+
+// dispositionError is a failure reported to the sender in an MDN with one of
+// the error modifiers of RFC 4130.
+type dispositionError struct {
+    modifier string
+    err      error
+}
+
+func (e *dispositionError) Error() string {
+    return e.modifier + ": " + e.err.Error()
+}
+
+func failed(modifier string, err error) error {
+    return &dispositionError{modifier: modifier, err: err}
+}
+
+func modifierOf(err error) string {
+    var de *dispositionError
+    if errors.As(err, &de) {
+        return de.modifier
+    }
+    return "unexpected-processing-error"
+}
+
+// unwrapped is what is left of a message once it is decrypted and its
+// signature checked: the innermost entity, whether it was signed and
+// encrypted, and the bytes its MIC covers.
+type unwrapped struct {
+    entity    *entity
+    signed    bool
+    encrypted bool
+    micInput  []byte
+    micalg    string
+}
+
+// unwrap decrypts and verifies e until a plain entity remains. Without a
+// signature the MIC covers the decrypted entity, or the body of a message
+// that was neither signed nor encrypted.
+func unwrap(st *Station, cert *x509.Certificate, e *entity) (unwrapped, error) {
+    u := unwrapped{entity: e, micInput: e.body}
+    for depth := 0; depth < 4; depth++ {
+        mediaType, params := u.entity.mediaType()
+        switch {
+        case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+            switch strings.ToLower(params["smime-type"]) {
+            case "", "enveloped-data":
+                if u.encrypted {
+                    return u, failed("decryption-failed", fmt.Errorf("message is encrypted twice"))
+                }
+                plain, err := decrypt(st, u.entity)
+                if err != nil {
+                    return u, failed("decryption-failed", err)
+                }
+                inner, err := parseEntity(plain)
+                if err != nil {
+                    return u, failed("decryption-failed", err)
+                }
+                u.entity, u.encrypted = inner, true
+                if !u.signed {
+                    u.micInput = plain
+                }
+            case "signed-data":
+                der, err := u.entity.decodedBody()
+                if err != nil {
+                    return u, failed("authentication-failed", err)
+                }
+                content, err := verifyOpaque(der, cert)
+                if err != nil {
+                    return u, failed("authentication-failed", err)
+                }
+                inner, err := parseEntity(content)
+                if err != nil {
+                    return u, failed("authentication-failed", err)
+                }
+                u.entity, u.signed, u.micInput = inner, true, content
+            case "compressed-data":
+                return u, failed("decompression-failed", fmt.Errorf("compressed messages are not supported"))
+            default:
+                return u, failed("unexpected-processing-error", fmt.Errorf("unknown smime-type %q", params["smime-type"]))
+            }
+        case mediaType == "multipart/signed":
+            if u.signed {
+                return u, failed("authentication-failed", fmt.Errorf("message is signed twice"))
+            }
+            parts, err := splitMultipart(u.entity.body, params["boundary"])
+            if err != nil || len(parts) != 2 {
+                return u, failed("authentication-failed", fmt.Errorf("multipart/signed must have two parts"))
+            }
+            signaturePart, err := parseEntity(parts[1])
+            if err != nil {
+                return u, failed("authentication-failed", err)
+            }
+            if err := verify(parts[0], signaturePart, cert); err != nil {
+                return u, failed("authentication-failed", err)
+            }
+            inner, err := parseEntity(parts[0])
+            if err != nil {
+                return u, failed("authentication-failed", err)
+            }
+            u.entity, u.signed, u.micInput = inner, true, parts[0]
+            u.micalg = strings.ToLower(params["micalg"])
+        default:
+            return u, nil
+        }
+    }
+    return u, failed("unexpected-processing-error", fmt.Errorf("message is nested too deeply"))
+}
@@ -3,6 +3,8 @@ package auth
 import (
 	"LunaTransfer/common"
 	"LunaTransfer/config"
+    "LunaTransfer/models"
+    "LunaTransfer/store"
     "LunaTransfer/utils"
     "encoding/json"
     "errors"
@@ -10,20 +12,19 @@ import (
     "net/http"
     "os"
     "path/filepath"
-    "sync"
+    "sort"
     "time"
     "github.com/gorilla/mux"
 )
 
 var (
-    groupsLock   sync.RWMutex
+    groupRepo    = store.NewRepository[Group](store.Groups)
+    memberRepo   = store.NewRepository[GroupMember](store.GroupMembers)
+    accessRepo   = store.NewRepository[FileAccess](store.FileAccess)
     ErrGroupExists = errors.New("group already exists")
     ErrGroupNotFound = errors.New("group not found")
     ErrUserAlreadyInGroup = errors.New("user already in group")
     ErrUserNotInGroup = errors.New("user not in group")
-    sharingLock sync.RWMutex
-    ErrAlreadyShared = errors.New("file is already shared with this group")
-    ErrShareNotFound = errors.New("share not found")
 )
 
 // Group role constants
@@ -66,38 +67,13 @@ type FileAccess struct {
     CreatedAt   time.Time `json:"created_at"`
 }
 
-type SharePermission string
-
-const (
-    SharePermissionRead     SharePermission = "read"
-    SharePermissionReadWrite SharePermission = "read_write"
-)
-
-type SharedFile struct {
-    ID          string         `json:"id"`
-    SourcePath  string         `json:"source_path"`
-    GroupID     string         `json:"group_id"`     // Group the file is shared with
-    SourceGroup string         `json:"source_group"` // Original group
-    SharedBy    string         `json:"shared_by"`
-    SharedAt    time.Time      `json:"shared_at"`
-    Permission  SharePermission `json:"permission"`  // Read or read/write
+// memberKey is the key of username's membership of groupID; the members of a
+// group share the prefix groupID + "/".
+func memberKey(groupID, username string) string {
+    return groupID + "/" + username
 }
 
 func CreateGroup(name, description, createdBy string) (*Group, error) {
-    groupsLock.Lock()
-    defer groupsLock.Unlock()
-
-    groups, err := LoadGroups()
-    if (err != nil) {
-        return nil, err
-    }
-
-    for _, group := range groups {
-        if group.Name == name {
-            return nil, ErrGroupExists
-        }
-    }
-
     newGroup := &Group{
         ID:          utils.GenerateUUID(),
         Name:        name,
@@ -106,9 +82,19 @@ func CreateGroup(name, description, createdBy string) (*Group, error) {
         CreatedAt:   time.Now(),
     }
 
-    groups = append(groups, *newGroup)
-
-    if err := saveGroups(groups); err != nil {
+    err := store.Update(func(tx *store.Tx) error {
+        groups, err := store.List(tx, groupRepo, "")
+        if err != nil {
+            return err
+        }
+        for _, group := range groups {
+            if group.Name == name {
+                return ErrGroupExists
+            }
+        }
+        return groupRepo.Put(tx, newGroup.ID, *newGroup)
+    })
+    if (err != nil) {
         return nil, err
     }
 
@@ -125,55 +111,22 @@ func CreateGroup(name, description, createdBy string) (*Group, error) {
     return newGroup, nil
 }
 
+// LoadGroups returns every group, oldest first.
 func LoadGroups() ([]Group, error) {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return nil, fmt.Errorf("failed to load config: %w", err)
-    }
-
-    groupsFile := filepath.Join(appConfig.GetDataDirectory(), "groups.json")
-    
-    if _, err := os.Stat(groupsFile); os.IsNotExist(err) {
-        return []Group{}, nil
-    }
-
-    data, err := os.ReadFile(groupsFile)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read groups file: %w", err)
-    }
-
     var groups []Group
-    if len(data) > 0 {
-        if err := json.Unmarshal(data, &groups); err != nil {
-            return nil, fmt.Errorf("failed to parse groups data: %w", err)
-        }
-    }
-
-    return groups, nil
-}
-
-func saveGroups(groups []Group) error {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return fmt.Errorf("failed to load config: %w", err)
-    }
-
-    data, err := json.MarshalIndent(groups, "", "  ")
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        groups, err = store.List(tx, groupRepo, "")
+        return err
+    })
     if err != nil {
-        return fmt.Errorf("failed to marshal groups data: %w", err)
+        return nil, fmt.Errorf("failed to load groups: %w", err)
     }
 
-    groupsFile := filepath.Join(appConfig.GetDataDirectory(), "groups.json")
-    
-    if err := os.MkdirAll(filepath.Dir(groupsFile), 0755); err != nil {
-        return fmt.Errorf("failed to create data directory: %w", err)
-    }
-
-    if err := os.WriteFile(groupsFile, data, 0644); err != nil {
-        return fmt.Errorf("failed to write groups file: %w", err)
-    }
-
-    return nil
+    sort.SliceStable(groups, func(i, j int) bool {
+        return groups[i].CreatedAt.Before(groups[j].CreatedAt)
+    })
+    return groups, nil
 }
 
 func AddUserToGroup(groupID, username, role, addedBy string) error {
@@ -181,27 +134,6 @@ func AddUserToGroup(groupID, username, role, addedBy string) error {
         role = GroupRoleReader
     }
 
-    _, err := GetUserByUsername(username)
-    if err != nil {
-        return err
-    }
-
-    _, err = GetGroupByID(groupID)
-    if err != nil {
-        return err
-    }
-
-    members, err := GetGroupMembers(groupID)
-    if err != nil {
-        return err
-    }
-
-    for _, member := range members {
-        if member.Username == username {
-            return ErrUserAlreadyInGroup
-        }
-    }
-
     newMember := GroupMember{
         GroupID:  groupID,
         Username: username,
@@ -210,96 +142,65 @@ func AddUserToGroup(groupID, username, role, addedBy string) error {
         AddedAt:  time.Now(),
     }
 
-    return saveGroupMember(newMember)
+    return store.Update(func(tx *store.Tx) error {
+        if _, exists, err := userRepo.Get(tx, username); err != nil || !exists {
+            if err == nil {
+                err = fmt.Errorf("user not found: %s", username)
+            }
+            return err
+        }
+        if _, exists, err := groupRepo.Get(tx, groupID); err != nil || !exists {
+            if err == nil {
+                err = ErrGroupNotFound
+            }
+            return err
+        }
+        key := memberKey(groupID, username)
+        if _, exists, err := memberRepo.Get(tx, key); err != nil || exists {
+            if err == nil {
+                err = ErrUserAlreadyInGroup
+            }
+            return err
+        }
+        return memberRepo.Put(tx, key, newMember)
+    })
 }
 
 func GetGroupByID(id string) (*Group, error) {
-    groups, err := LoadGroups()
+    var group Group
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        group, exists, err = groupRepo.Get(tx, id)
+        return err
+    })
     if err != nil {
-        return nil, err
+        return nil, fmt.Errorf("failed to load group: %w", err)
     }
-
-    for _, group := range groups {
-        if group.ID == id {
-            return &group, nil
-        }
+    if !exists {
+        return nil, ErrGroupNotFound
     }
 
-    return nil, ErrGroupNotFound
+    return &group, nil
 }
 
+// GetGroupMembers returns the members of groupID in the order they were
+// added.
 func GetGroupMembers(groupID string) ([]GroupMember, error) {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return nil, fmt.Errorf("failed to load config: %w", err)
-    }
-
-    membersFile := filepath.Join(appConfig.GetDataDirectory(), "group_members.json")
-    
-    if _, err := os.Stat(membersFile); os.IsNotExist(err) {
-        return []GroupMember{}, nil
-    }
-
-    data, err := os.ReadFile(membersFile)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read members file: %w", err)
-    }
-
-    var allMembers []GroupMember
-    if len(data) > 0 {
-        if err := json.Unmarshal(data, &allMembers); err != nil {
-            return nil, fmt.Errorf("failed to parse members data: %w", err)
-        }
-    }
-
     var groupMembers []GroupMember
-    for _, member := range allMembers {
-        if member.GroupID == groupID {
-            groupMembers = append(groupMembers, member)
-        }
-    }
-
-    return groupMembers, nil
-}
-
-func saveGroupMember(member GroupMember) error {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return fmt.Errorf("failed to load config: %w", err)
-    }
-
-    membersFile := filepath.Join(appConfig.GetDataDirectory(), "group_members.json")
-    
-    var members []GroupMember
-    if _, err := os.Stat(membersFile); !os.IsNotExist(err) {
-        data, err := os.ReadFile(membersFile)
-        if err != nil {
-            return fmt.Errorf("failed to read members file: %w", err)
-        }
-
-        if len(data) > 0 {
-            if err := json.Unmarshal(data, &members); err != nil {
-                return fmt.Errorf("failed to parse members data: %w", err)
-            }
-        }
-    }
-
-    members = append(members, member)
-
-    data, err := json.MarshalIndent(members, "", "  ")
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        groupMembers, err = store.List(tx, memberRepo, memberKey(groupID, ""))
+        return err
+    })
     if err != nil {
-        return fmt.Errorf("failed to marshal members data: %w", err)
-    }
-
-    if err := os.MkdirAll(filepath.Dir(membersFile), 0755); err != nil {
-        return fmt.Errorf("failed to create data directory: %w", err)
-    }
-
-    if err := os.WriteFile(membersFile, data, 0644); err != nil {
-        return fmt.Errorf("failed to write members file: %w", err)
+        return nil, fmt.Errorf("failed to load group members: %w", err)
     }
 
-    return nil
+    sort.SliceStable(groupMembers, func(i, j int) bool {
+        return groupMembers[i].AddedAt.Before(groupMembers[j].AddedAt)
+    })
+    return groupMembers, nil
 }
 
 func HasFileAccess(username, filePath string) (bool, error) {
@@ -341,79 +242,29 @@ func HasFileAccess(username, filePath string) (bool, error) {
 }
 
 func GetFileAccess(filePath string) (*FileAccess, error) {
-    appConfig, err := config.LoadConfig()
+    var access FileAccess
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        access, exists, err = accessRepo.Get(tx, filePath)
+        return err
+    })
     if err != nil {
-        return nil, fmt.Errorf("failed to load config: %w", err)
+        return nil, fmt.Errorf("failed to load file access data: %w", err)
     }
-
-    accessFile := filepath.Join(appConfig.GetDataDirectory(), "fileaccess.json")
-    
-    if _, err := os.Stat(accessFile); os.IsNotExist(err) {
+    if !exists {
         return nil, fmt.Errorf("no access control defined for path")
     }
 
-    data, err := os.ReadFile(accessFile)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read file access data: %w", err)
-    }
-
-    var accessList []FileAccess
-    if err := json.Unmarshal(data, &accessList); err != nil {
-        return nil, fmt.Errorf("failed to parse file access data: %w", err)
-    }
-
-    for _, access := range accessList {
-        if access.Path == filePath {
-            return &access, nil
-        }
-    }
-
-    return nil, fmt.Errorf("no access control defined for path")
+    return &access, nil
 }
 
 func SaveFileAccess(access FileAccess) error {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return fmt.Errorf("failed to load config: %w", err)
-    }
-
-    accessFile := filepath.Join(appConfig.GetDataDirectory(), "fileaccess.json")
-    
-    var accessList []FileAccess
-    
-    if _, err := os.Stat(accessFile); !os.IsNotExist(err) {
-        data, err := os.ReadFile(accessFile)
-        if err != nil {
-            return fmt.Errorf("failed to read file access data: %w", err)
-        }
-
-        if len(data) > 0 {
-            if err := json.Unmarshal(data, &accessList); err != nil {
-                return fmt.Errorf("failed to parse file access data: %w", err)
-            }
-        }
-    }
-
-    found := false
-    for i, a := range accessList {
-        if a.Path == access.Path {
-            accessList[i] = access
-            found = true
-            break
-        }
-    }
-
-    if !found {
-        accessList = append(accessList, access)
-    }
-
-    data, err := json.MarshalIndent(accessList, "", "  ")
+    err := store.Update(func(tx *store.Tx) error {
+        return accessRepo.Put(tx, access.Path, access)
+    })
     if err != nil {
-        return fmt.Errorf("failed to marshal file access data: %w", err)
-    }
-
-    if err := os.WriteFile(accessFile, data, 0644); err != nil {
-        return fmt.Errorf("failed to write file access data: %w", err)
+        return fmt.Errorf("failed to save file access data: %w", err)
     }
 
     return nil
@@ -425,46 +276,18 @@ func RemoveUserFromGroup(groupID, username, removedBy string) error {
         return err
     }
 
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return fmt.Errorf("failed to load config: %w", err)
-    }
-
-    membersFile := filepath.Join(appConfig.GetDataDirectory(), "group_members.json")
-    
-    if _, err := os.Stat(membersFile); os.IsNotExist(err) {
-        return ErrUserNotInGroup
-    }
-
-    data, err := os.ReadFile(membersFile)
-    if err != nil {
-        return fmt.Errorf("failed to read members file: %w", err)
-    }
-
-    var allMembers []GroupMember
-    if err := json.Unmarshal(data, &allMembers); err != nil {
-        return fmt.Errorf("failed to parse members data: %w", err)
-    }
-
-    found := false
-    var updatedMembers []GroupMember
-    for _, member := range allMembers {
-        if member.GroupID == groupID && member.Username == username {
-            found = true
-        } else {
-            updatedMembers = append(updatedMembers, member)
+    err = store.Update(func(tx *store.Tx) error {
+        key := memberKey(groupID, username)
+        if _, exists, err := memberRepo.Get(tx, key); err != nil || !exists {
+            if err == nil {
+                err = ErrUserNotInGroup
+            }
+            return err
         }
-    }
-
-    if !found {
-        return ErrUserNotInGroup
-    }
-    data, err = json.MarshalIndent(updatedMembers, "", "  ")
+        return memberRepo.Delete(tx, key)
+    })
     if err != nil {
-        return fmt.Errorf("failed to marshal members data: %w", err)
-    }
-    if err := os.WriteFile(membersFile, data, 0644); err != nil {
-        return fmt.Errorf("failed to write members file: %w", err)
+        return err
     }
 
     utils.LogSystem("GROUP_USER_REMOVED", removedBy, "", 
@@ -560,148 +383,10 @@ func AddUserToGroupHandler(w http.ResponseWriter, r *http.Request) {
     })
 }
 
-func LoadSharedFiles() ([]SharedFile, error) {
-    sharingLock.RLock()
-    defer sharingLock.RUnlock()
-    
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return nil, err
-    }
-    
-    sharesFile := filepath.Join(appConfig.GetDataDirectory(), "shared_files.json")
-    
-    if _, err := os.Stat(sharesFile); os.IsNotExist(err) {
-        return []SharedFile{}, nil
-    }
-    
-    data, err := os.ReadFile(sharesFile)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read shared files: %w", err)
-    }
-    
-    var shares []SharedFile
-    if err := json.Unmarshal(data, &shares); err != nil {
-        return nil, fmt.Errorf("failed to parse shared files data: %w", err)
-    }
-    
-    return shares, nil
-}
-
-func saveSharedFiles(shares []SharedFile) error {
-    appConfig, err := config.LoadConfig()
-    if err != nil {
-        return err
-    }
-    
-    sharesFile := filepath.Join(appConfig.GetDataDirectory(), "shared_files.json")
-    
-    data, err := json.MarshalIndent(shares, "", "  ")
-    if err != nil {
-        return fmt.Errorf("failed to marshal shared files data: %w", err)
-    }
-    
-    return os.WriteFile(sharesFile, data, 0644)
-}
-
-func ShareFileWithGroup(sourcePath, sourceGroup, targetGroupID, sharedBy string, permission SharePermission) (*SharedFile, error) {
-    sharingLock.Lock()
-    defer sharingLock.Unlock()
-    
-    if permission != SharePermissionRead && permission != SharePermissionReadWrite {
-        permission = SharePermissionRead
-    }
-    
-    if sourceGroup != "" {
-        if _, err := GetGroupByID(sourceGroup); err != nil {
-            return nil, fmt.Errorf("source group not found: %w", err)
-        }
-    }
-    
-    if _, err := GetGroupByID(targetGroupID); err != nil {
-        return nil, fmt.Errorf("target group not found: %w", err)
-    }
-    
-    if sourceGroup == targetGroupID {
-        return nil, errors.New("cannot share within the same group")
-    }
-    
-    shares, err := LoadSharedFiles()
-    if err != nil {
-        return nil, err
-    }
-    
-    for _, s := range shares {
-        if s.SourcePath == sourcePath && s.GroupID == targetGroupID {
-            return nil, ErrAlreadyShared
-        }
-    }
-    
-    newShare := &SharedFile{
-        ID:          utils.GenerateUUID(),
-        SourcePath:  sourcePath,
-        GroupID:     targetGroupID,
-        SourceGroup: sourceGroup,
-        SharedBy:    sharedBy,
-        SharedAt:    time.Now(),
-        Permission:  permission,
-    }
-    
-    shares = append(shares, *newShare)
-    if err := saveSharedFiles(shares); err != nil {
-        return nil, err
-    }
-    
-    return newShare, nil
-}
-
-func RemoveFileSharing(shareID, username string) error {
-    sharingLock.Lock()
-    defer sharingLock.Unlock()
-    
-    shares, err := LoadSharedFiles()
-    if err != nil {
-        return err
-    }
-    
-    found := false
-    var updatedShares []SharedFile
-    
-    for _, share := range shares {
-        if share.ID == shareID {
-            found = true
-            
-            if !IsUserAdmin(username) && share.SharedBy != username {
-                return errors.New("you can only remove your own shared files")
-            }
-        } else {
-            updatedShares = append(updatedShares, share)
-        }
-    }
-    
-    if !found {
-        return ErrShareNotFound
-    }
-    
-    return saveSharedFiles(updatedShares)
-}
-
-func GetFilesSharedWithGroup(groupID string) ([]SharedFile, error) {
-    allShares, err := LoadSharedFiles()
-    if err != nil {
-        return nil, err
-    }
-    
-    var groupShares []SharedFile
-    for _, share := range allShares {
-        if share.GroupID == groupID {
-            groupShares = append(groupShares, share)
-        }
-    }
-    
-    return groupShares, nil
-}
-
+// HasAccessToSharedFile reports whether username reaches filePath (relative to
+// the storage directory) through an active share with one of their groups,
+// either of the file itself or of a folder containing it. When writeAccess is
+// set only read-write shares count.
 func HasAccessToSharedFile(username, filePath string, writeAccess bool) (bool, error) {
     user, err := GetUserByUsername(username)
     if err != nil {
@@ -717,18 +402,19 @@ func HasAccessToSharedFile(username, filePath string, writeAccess bool) (bool, e
         return false, err
     }
     
-    shares, err := LoadSharedFiles()
+    shares, err := models.LoadFileShares()
     if err != nil {
         return false, err
     }
     
+    now := time.Now()
     for _, share := range shares {
-        if share.SourcePath == filePath {
-            for _, group := range userGroups {
-                if group.ID == share.GroupID {
-                    if writeAccess {
-                        return share.Permission == SharePermissionReadWrite, nil
-                    }
+        if !share.Covers(filePath) || share.IsExpired(now) {
+            continue
+        }
+        for _, group := range userGroups {
+            if group.ID == share.TargetGroup {
+                if !writeAccess || share.Permission == models.SharePermissionReadWrite {
                     return true, nil
                 }
             }
@@ -744,19 +430,23 @@ func GetUserGroups(username string) ([]Group, error) {
         return nil, err
     }
     
-    var userGroups []Group
-    
-    for _, group := range allGroups {
-        members, err := GetGroupMembers(group.ID)
-        if err != nil {
-            continue
-        }
-        
-        for _, member := range members {
+    memberOf := map[string]bool{}
+    err = store.View(func(tx *store.Tx) error {
+        return memberRepo.Scan(tx, "", func(key string, member GroupMember) error {
             if member.Username == username {
-                userGroups = append(userGroups, group)
-                break
+                memberOf[member.GroupID] = true
             }
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to load group members: %w", err)
+    }
+    
+    var userGroups []Group
+    for _, group := range allGroups {
+        if memberOf[group.ID] {
+            userGroups = append(userGroups, group)
         }
     }
     
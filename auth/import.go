@@ -0,0 +1,141 @@
+package auth
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "fmt"
+    "log"
+    "path/filepath"
+)
+
+// legacyUsersFile is where users were kept before the database, relative to
+// the working directory.
+const legacyUsersFile = "users.json"
+
+// ImportLegacyJSON moves users, groups, group memberships and file access
+// from the JSON files they were kept in before the database into it. Each
+// file is imported in one transaction and then renamed with a ".migrated"
+// suffix; records the database already has are kept. It returns the number
+// of records imported.
+func ImportLegacyJSON() (int, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return 0, fmt.Errorf("failed to load config: %w", err)
+    }
+    dataDir := appConfig.GetDataDirectory()
+
+    total := 0
+    imports := []struct {
+        file       string
+        importFile func(path string) (store.ImportStats, bool, error)
+    }{
+        {legacyUsersFile, importLegacyUsers},
+        {filepath.Join(dataDir, "groups.json"), importLegacyGroups},
+        {filepath.Join(dataDir, "group_members.json"), importLegacyMembers},
+        {filepath.Join(dataDir, "fileaccess.json"), importLegacyFileAccess},
+    }
+    for _, i := range imports {
+        stats, found, err := i.importFile(i.file)
+        if err != nil {
+            return total, fmt.Errorf("failed to import %s: %w", i.file, err)
+        }
+        if !found {
+            continue
+        }
+        if err := store.ArchiveLegacyFile(i.file); err != nil {
+            return total, err
+        }
+        log.Printf("Imported %s: %s", i.file, stats)
+        total += stats.Imported
+    }
+    return total, nil
+}
+
+// Users, groups, memberships and file access are referred to by their keys,
+// so records with the same key can't be told apart by giving one a new key:
+// the import fails instead.
+
+func importLegacyUsers(path string) (store.ImportStats, bool, error) {
+    var users []User
+    found, err := store.ReadLegacyFile(path, &users)
+    if err != nil || !found {
+        return store.ImportStats{}, found, err
+    }
+
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        added, s, err := store.ImportRecords(tx, userRepo, users, func(u User) string {
+            return u.Username
+        }, nil)
+        stats = s
+        if err != nil {
+            return err
+        }
+        for _, user := range added {
+            if user.APIKey != "" {
+                if err := putAPIKey(tx, user.APIKey, user.Username); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    })
+    return stats, true, err
+}
+
+func importLegacyGroups(path string) (store.ImportStats, bool, error) {
+    var groups []Group
+    found, err := store.ReadLegacyFile(path, &groups)
+    if err != nil || !found {
+        return store.ImportStats{}, found, err
+    }
+
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        var err error
+        _, stats, err = store.ImportRecords(tx, groupRepo, groups, func(g Group) string {
+            return g.ID
+        }, nil)
+        return err
+    })
+    return stats, true, err
+}
+
+func importLegacyMembers(path string) (store.ImportStats, bool, error) {
+    var members []GroupMember
+    found, err := store.ReadLegacyFile(path, &members)
+    if err != nil || !found {
+        return store.ImportStats{}, found, err
+    }
+
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        var err error
+        _, stats, err = store.ImportRecords(tx, memberRepo, members, func(m GroupMember) string {
+            if m.GroupID == "" || m.Username == "" {
+                return ""
+            }
+            return memberKey(m.GroupID, m.Username)
+        }, nil)
+        return err
+    })
+    return stats, true, err
+}
+
+func importLegacyFileAccess(path string) (store.ImportStats, bool, error) {
+    var accessList []FileAccess
+    found, err := store.ReadLegacyFile(path, &accessList)
+    if err != nil || !found {
+        return store.ImportStats{}, found, err
+    }
+
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        var err error
+        _, stats, err = store.ImportRecords(tx, accessRepo, accessList, func(a FileAccess) string {
+            return a.Path
+        }, nil)
+        return err
+    })
+    return stats, true, err
+}
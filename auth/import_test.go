@@ -0,0 +1,127 @@
+package auth_test
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// fixtures holds JSON files as servers kept them before the database. It is
+// made absolute before testenv moves the tests to a scratch directory.
+var fixtures = filepath.Join("testdata", "legacy")
+
+func TestMain(m *testing.M) {
+    if abs, err := filepath.Abs(fixtures); err == nil {
+        fixtures = abs
+    }
+    testenv.Main(m, nil, nil)
+}
+
+// copyFixture copies the fixture name to target.
+func copyFixture(t *testing.T, name, target string) {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join(fixtures, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(target, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestImportLegacyJSON(t *testing.T) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    dataDir := appConfig.GetDataDirectory()
+    files := []string{
+        "users.json",
+        filepath.Join(dataDir, "groups.json"),
+        filepath.Join(dataDir, "group_members.json"),
+        filepath.Join(dataDir, "fileaccess.json"),
+    }
+    for _, file := range files {
+        copyFixture(t, filepath.Base(file), file)
+    }
+
+    // 3 users (bob is listed twice), 2 groups, 3 memberships (one has no
+    // user) and 2 file access records.
+    imported, err := auth.ImportLegacyJSON()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if imported != 10 {
+        t.Errorf("imported %d records, want 10", imported)
+    }
+    for _, file := range files {
+        if _, err := os.Stat(file + ".migrated"); err != nil {
+            t.Errorf("%s was not archived: %v", file, err)
+        }
+    }
+
+    users, err := auth.LoadUsers()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(users) != 3 || users["alice"].Role != auth.RoleAdmin || users["carol"].Email != "carol@example.com" {
+        t.Errorf("got users %v", users)
+    }
+    if username, ok := auth.GetUserByAPIKey(users["alice"].APIKey); !ok || username != "alice" {
+        t.Errorf("alice's API key finds %q, %v", username, ok)
+    }
+    accessKeyID, secret, err := auth.S3Credentials("bob")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if username, s, ok := auth.LookupS3AccessKey(accessKeyID); !ok || username != "bob" || s != secret {
+        t.Errorf("bob's S3 access key finds %q, %v", username, ok)
+    }
+
+    groups, err := auth.LoadGroups()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(groups) != 2 {
+        t.Errorf("got %d groups, want 2", len(groups))
+    }
+    for group, want := range map[string]int{"finance": 2, "partners": 1} {
+        if members, err := auth.GetGroupMembers(group); err != nil || len(members) != want {
+            t.Errorf("%s: got %d members, %v; want %d", group, len(members), err, want)
+        }
+    }
+    for path, owner := range map[string]string{"bob/reports/q1.pdf": "bob", "alice/handbook.pdf": "alice"} {
+        if access, err := auth.GetFileAccess(path); err != nil || access.Owner != owner {
+            t.Errorf("%s: got %+v, %v", path, access, err)
+        }
+    }
+
+    // Archived files are not imported again.
+    if imported, err := auth.ImportLegacyJSON(); err != nil || imported != 0 {
+        t.Errorf("second import: got %d, %v", imported, err)
+    }
+}
+
+func TestImportLegacyJSONConflict(t *testing.T) {
+    users := `[{"username": "dave", "email": "one@example.com"}, {"username": "dave", "email": "two@example.com"}]`
+    if err := os.WriteFile("users.json", []byte(users), 0644); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Remove("users.json") })
+
+    if _, err := auth.ImportLegacyJSON(); err == nil {
+        t.Fatal("two different users with one name were imported")
+    }
+    if auth.UserExists("dave") {
+        t.Error("a user of the failed import was kept")
+    }
+    if _, err := os.Stat("users.json"); err != nil {
+        t.Errorf("the file of the failed import was archived: %v", err)
+    }
+}
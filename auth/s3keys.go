@@ -0,0 +1,102 @@
+package auth
+
+import (
+    "LunaTransfer/store"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base32"
+    "encoding/base64"
+    "fmt"
+)
+
+// S3 access keys are derived from the user's API key rather than stored, so
+// rotating the API key also revokes them. The access key IDs are indexed so
+// a request's key can be found without deriving every user's.
+
+var s3KeyRepo = store.NewRepository[string](store.S3AccessKeys)
+
+// S3Credentials returns the access key ID and secret key username signs S3
+// requests with.
+func S3Credentials(username string) (string, string, error) {
+    user, err := GetUserByUsername(username)
+    if err != nil {
+        return "", "", fmt.Errorf("user not found")
+    }
+    return s3AccessKeyID(user.APIKey), s3SecretKey(user.APIKey), nil
+}
+
+// LookupS3AccessKey finds the user an access key ID belongs to and returns
+// the matching secret key.
+func LookupS3AccessKey(accessKeyID string) (string, string, bool) {
+    var user User
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        username, found, err := s3KeyRepo.Get(tx, accessKeyID)
+        if err != nil || !found {
+            return err
+        }
+        user, exists, err = userRepo.Get(tx, username)
+        return err
+    })
+    if err != nil || !exists || user.APIKey == "" {
+        return "", "", false
+    }
+    if !hmac.Equal([]byte(s3AccessKeyID(user.APIKey)), []byte(accessKeyID)) {
+        return "", "", false
+    }
+    return user.Username, s3SecretKey(user.APIKey), true
+}
+
+// IndexS3AccessKeys adds the access key IDs of users the index does not
+// have yet, such as those created before it existed. It returns the number
+// added.
+func IndexS3AccessKeys() (int, error) {
+    added := 0
+    err := store.Update(func(tx *store.Tx) error {
+        var users []User
+        err := userRepo.Scan(tx, "", func(_ string, user User) error {
+            users = append(users, user)
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        for _, user := range users {
+            if user.APIKey == "" {
+                continue
+            }
+            accessKeyID := s3AccessKeyID(user.APIKey)
+            if _, exists, err := s3KeyRepo.Get(tx, accessKeyID); err != nil || exists {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := s3KeyRepo.Put(tx, accessKeyID, user.Username); err != nil {
+                return err
+            }
+            added++
+        }
+        return nil
+    })
+    if err != nil {
+        return added, fmt.Errorf("failed to index S3 access keys: %w", err)
+    }
+    return added, nil
+}
+
+func s3AccessKeyID(apiKey string) string {
+    sum := deriveFromAPIKey(apiKey, "LunaTransfer S3 access key ID")
+    return "LT" + base32.StdEncoding.EncodeToString(sum)[:18]
+}
+
+func s3SecretKey(apiKey string) string {
+    sum := deriveFromAPIKey(apiKey, "LunaTransfer S3 secret access key")
+    return base64.RawStdEncoding.EncodeToString(sum)[:40]
+}
+
+func deriveFromAPIKey(apiKey, purpose string) []byte {
+    mac := hmac.New(sha256.New, []byte(apiKey))
+    mac.Write([]byte(purpose))
+    return mac.Sum(nil)
+}
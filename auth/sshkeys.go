@@ -0,0 +1,99 @@
+package auth
+
+import (
+    "LunaTransfer/utils"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "golang.org/x/crypto/ssh"
+)
+
+var (
+    ErrInvalidSSHKey  = errors.New("invalid SSH public key")
+    ErrSSHKeyExists   = errors.New("SSH key already added")
+    ErrSSHKeyNotFound = errors.New("SSH key not found")
+)
+
+// SSHKey is a public key a user may log in with over SFTP.
+type SSHKey struct {
+    ID          string    `json:"id"`
+    Type        string    `json:"type"`
+    Fingerprint string    `json:"fingerprint"`
+    PublicKey   string    `json:"public_key"`
+    Comment     string    `json:"comment,omitempty"`
+    AddedAt     time.Time `json:"added_at"`
+}
+
+// AddAuthorizedKey parses line in authorized_keys format and stores it for
+// username.
+func AddAuthorizedKey(username, line string) (SSHKey, error) {
+    pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line)))
+    if err != nil {
+        return SSHKey{}, ErrInvalidSSHKey
+    }
+
+    key := SSHKey{
+        ID:          utils.GenerateUUID(),
+        Type:        pub.Type(),
+        Fingerprint: ssh.FingerprintSHA256(pub),
+        PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+        Comment:     comment,
+        AddedAt:     time.Now(),
+    }
+
+    _, err = updateUser(username, func(user *User) error {
+        for _, existing := range user.AuthorizedKeys {
+            if existing.Fingerprint == key.Fingerprint {
+                return ErrSSHKeyExists
+            }
+        }
+        user.AuthorizedKeys = append(user.AuthorizedKeys, key)
+        return nil
+    })
+    if err != nil {
+        return SSHKey{}, err
+    }
+    return key, nil
+}
+
+func RemoveAuthorizedKey(username, keyID string) error {
+    _, err := updateUser(username, func(user *User) error {
+        for i, key := range user.AuthorizedKeys {
+            if key.ID == keyID {
+                user.AuthorizedKeys = append(user.AuthorizedKeys[:i], user.AuthorizedKeys[i+1:]...)
+                return nil
+            }
+        }
+        return ErrSSHKeyNotFound
+    })
+    return err
+}
+
+func GetAuthorizedKeys(username string) ([]SSHKey, error) {
+    user, err := GetUserByUsername(username)
+    if err != nil {
+        return nil, fmt.Errorf("user not found")
+    }
+    return append([]SSHKey{}, user.AuthorizedKeys...), nil
+}
+
+// AuthenticatePublicKey reports whether pub is one of username's authorized
+// keys, recording the login like AuthenticateUser does.
+func AuthenticatePublicKey(username string, pub ssh.PublicKey) (User, error) {
+    fingerprint := ssh.FingerprintSHA256(pub)
+
+    user, err := GetUserByUsername(username)
+    if err != nil {
+        return User{}, ErrInvalidCredentials
+    }
+    for _, key := range user.AuthorizedKeys {
+        if key.Fingerprint == fingerprint {
+            if err := recordLogin(username); err != nil {
+                fmt.Printf("Failed to update last login time: %v\n", err)
+            }
+            return *user, nil
+        }
+    }
+    return User{}, ErrInvalidCredentials
+}
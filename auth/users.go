@@ -2,25 +2,24 @@ package auth
 
 import (
     "LunaTransfer/config"
+    "LunaTransfer/models"
+    "LunaTransfer/retention"
+    "LunaTransfer/store"
     "crypto/rand"
     "encoding/hex"
-    "encoding/json"
     "errors"
     "fmt"
     "log"
     "os"
     "path/filepath"
     "regexp"
-    "sync"
     "time"
     "golang.org/x/crypto/bcrypt"
 )
 
 var (
-    usersFile     = "users.json"
-    usersMutex    = &sync.RWMutex{}
-    users         = make(map[string]User)
-    apiKeyToUser  = make(map[string]string)
+    userRepo      = store.NewRepository[User](store.Users)
+    apiKeyRepo    = store.NewRepository[string](store.UserAPIKeys)
     ErrUserExists = errors.New("user already exists")
     ErrWeakPassword = errors.New("password must be at least 8 characters and contain numbers and letters")
     ErrInvalidCredentials = errors.New("invalid username or password")
@@ -36,6 +35,7 @@ type User struct {
     APIKey       string    `json:"api_key"`
     CreatedAt    time.Time `json:"created_at"`
     LastLogin    time.Time `json:"last_login"`
+    AuthorizedKeys []SSHKey `json:"authorized_keys,omitempty"`
 }
 
 func ValidatePassword(password string) bool {
@@ -56,10 +56,6 @@ func GenerateAPIKey() (string, error) {
 }
 
 func CreateUser(username, password, email, role string) (User, string, error) {
-    if UserExists(username) {
-        return User{}, "", fmt.Errorf("user already exists")
-    }
-    
     hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     if err != nil {
         return User{}, "", err
@@ -80,12 +76,19 @@ func CreateUser(username, password, email, role string) (User, string, error) {
         LastLogin:    time.Time{},
     }
     
-    usersMutex.Lock()
-    users[username] = user
-    apiKeyToUser[apiKey] = username
-    usersMutex.Unlock()
-    
-    if err := saveUsers(); err != nil {
+    err = store.Update(func(tx *store.Tx) error {
+        if _, exists, err := userRepo.Get(tx, username); err != nil || exists {
+            if err == nil {
+                err = fmt.Errorf("user already exists")
+            }
+            return err
+        }
+        if err := userRepo.Put(tx, username, user); err != nil {
+            return err
+        }
+        return putAPIKey(tx, apiKey, username)
+    })
+    if err != nil {
         return User{}, "", err
     }
     
@@ -93,24 +96,12 @@ func CreateUser(username, password, email, role string) (User, string, error) {
 }
 
 func Authenticate(username, password string) (string, error) {
-    usersMutex.RLock()
-    user, exists := users[username]
-    usersMutex.RUnlock()
-
-    if (!exists) {
-        return "", ErrInvalidCredentials
-    }
-
-    if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-        return "", ErrInvalidCredentials
+    user, err := checkPassword(username, password)
+    if err != nil {
+        return "", err
     }
 
-    usersMutex.Lock()
-    user.LastLogin = time.Now()
-    users[username] = user
-    usersMutex.Unlock()
-
-    if err := saveUsers(); err != nil {
+    if err := recordLogin(username); err != nil {
         return "", fmt.Errorf("error updating last login: %w", err)
     }
 
@@ -118,108 +109,135 @@ func Authenticate(username, password string) (string, error) {
 }
 
 func AuthenticateUser(username, password string) (User, string, error) {
-    usersMutex.RLock()
-    user, exists := users[username]
-    usersMutex.RUnlock()
-
-    if (!exists) {
-        return User{}, "", ErrInvalidCredentials
-    }
-
-    err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+    user, err := checkPassword(username, password)
     if err != nil {
-        return User{}, "", ErrInvalidCredentials
+        return User{}, "", err
     }
 
-    usersMutex.Lock()
-    user.LastLogin = time.Now()
-    users[username] = user
-    usersMutex.Unlock()
-
-    if err := saveUsers(); err != nil {
+    if err := recordLogin(username); err != nil {
         fmt.Printf("Failed to update last login time: %v\n", err)
     }
 
     return user, user.APIKey, nil
 }
 
-func GetUserByAPIKey(apiKey string) (string, bool) {
-    usersMutex.RLock()
-    defer usersMutex.RUnlock()
-    
-    username, exists := apiKeyToUser[apiKey]
-    return username, exists
-}
-
-func LoadUsers() (map[string]User, error) {
-    usersMutex.Lock()
-    defer usersMutex.Unlock()
-
-    if _, err := os.Stat(usersFile); os.IsNotExist(err) {
-        return users, nil
-    }
-
-    data, err := os.ReadFile(usersFile)
+// checkPassword checks username's password without recording a login.
+func checkPassword(username, password string) (User, error) {
+    user, err := GetUserByUsername(username)
     if err != nil {
-        return nil, fmt.Errorf("error reading users file: %w", err)
+        return User{}, ErrInvalidCredentials
     }
 
-    var loadedUsers []User
-    if err := json.Unmarshal(data, &loadedUsers); err != nil {
-        return nil, fmt.Errorf("error parsing users file: %w", err)
+    if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+        return User{}, ErrInvalidCredentials
     }
 
-    users = make(map[string]User)
-    apiKeyToUser = make(map[string]string)
-
-    for _, u := range loadedUsers {
-        users[u.Username] = u
-        apiKeyToUser[u.APIKey] = u.Username
-    }
+    return *user, nil
+}
 
-    return users, nil
+// recordLogin sets username's last login to now.
+func recordLogin(username string) error {
+    _, err := updateUser(username, func(user *User) error {
+        user.LastLogin = time.Now()
+        return nil
+    })
+    return err
 }
 
-func saveUsers() error {
-    usersList := []User{}
-    for _, user := range users {
-        usersList = append(usersList, user)
-    }
+// updateUser applies change to username's record and saves it, all in one
+// transaction, and returns the saved record.
+func updateUser(username string, change func(user *User) error) (User, error) {
+    var user User
+    err := store.Update(func(tx *store.Tx) error {
+        var exists bool
+        var err error
+        user, exists, err = userRepo.Get(tx, username)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            return fmt.Errorf("user not found")
+        }
+        if err := change(&user); err != nil {
+            return err
+        }
+        return userRepo.Put(tx, username, user)
+    })
+    return user, err
+}
 
-    data, err := json.MarshalIndent(usersList, "", "  ")
+func GetUserByAPIKey(apiKey string) (string, bool) {
+    var username string
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        username, exists, err = apiKeyRepo.Get(tx, apiKey)
+        return err
+    })
     if err != nil {
-        return fmt.Errorf("error encoding users: %w", err)
+        log.Printf("Error looking up API key: %v", err)
+        return "", false
     }
+    return username, exists
+}
 
-    tempFile := usersFile + ".tmp"
-    if err := os.WriteFile(tempFile, data, 0600); err != nil {
-        return fmt.Errorf("error writing users file: %w", err)
+// putAPIKey indexes apiKey and the S3 access key ID derived from it as
+// username's.
+func putAPIKey(tx *store.Tx, apiKey, username string) error {
+    if err := apiKeyRepo.Put(tx, apiKey, username); err != nil {
+        return err
     }
-
-    return os.Rename(tempFile, usersFile)
+    return s3KeyRepo.Put(tx, s3AccessKeyID(apiKey), username)
 }
 
-func RotateAPIKey(username string) (string, error) {
-    usersMutex.Lock()
-    defer usersMutex.Unlock()
+// deleteAPIKey removes apiKey and the S3 access key ID derived from it from
+// the indexes.
+func deleteAPIKey(tx *store.Tx, apiKey string) error {
+    if err := apiKeyRepo.Delete(tx, apiKey); err != nil {
+        return err
+    }
+    return s3KeyRepo.Delete(tx, s3AccessKeyID(apiKey))
+}
 
-    user, exists := users[username]
-    if (!exists) {
-        return "", fmt.Errorf("user not found")
+func LoadUsers() (map[string]User, error) {
+    users := make(map[string]User)
+    err := store.View(func(tx *store.Tx) error {
+        return userRepo.Scan(tx, "", func(username string, user User) error {
+            users[username] = user
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, fmt.Errorf("error loading users: %w", err)
     }
 
-    delete(apiKeyToUser, user.APIKey)
+    return users, nil
+}
 
+func RotateAPIKey(username string) (string, error) {
     newKey, err := GenerateAPIKey()
     if err != nil {
         return "", err
     }
 
-    user.APIKey = newKey
-    users[username] = user
-    apiKeyToUser[newKey] = username
-
-    if err := saveUsers(); err != nil {
+    err = store.Update(func(tx *store.Tx) error {
+        user, exists, err := userRepo.Get(tx, username)
+        if err != nil {
+            return err
+        }
+        if (!exists) {
+            return fmt.Errorf("user not found")
+        }
+        if err := deleteAPIKey(tx, user.APIKey); err != nil {
+            return err
+        }
+        user.APIKey = newKey
+        if err := userRepo.Put(tx, username, user); err != nil {
+            return err
+        }
+        return putAPIKey(tx, newKey, username)
+    })
+    if err != nil {
         return "", err
     }
 
@@ -227,35 +245,57 @@ func RotateAPIKey(username string) (string, error) {
 }
 
 func UserExists(username string) bool {
-    usersMutex.RLock()
-    _, exists := users[username]
-    usersMutex.RUnlock()
-    return exists
+    _, err := GetUserByUsername(username)
+    return err == nil
 }
 
-func DeleteUser(username string) error {
-    usersMutex.Lock()
-    defer usersMutex.Unlock()
-
+// DeleteUser removes username with their home folder. The user's API and S3
+// keys, group memberships and file access records, and the metadata and
+// shares of files in the home folder go in the same transaction; it returns
+// the shares it removed.
+func DeleteUser(username string) ([]models.FileShare, error) {
     // Check if user exists
-    user, exists := users[username]
-    if !exists {
-        return fmt.Errorf("user not found: %s", username)
+    if !UserExists(username) {
+        return nil, fmt.Errorf("user not found: %s", username)
+    }
+    // The home folder goes with the user, so whatever a legal hold or a
+    // retention policy keeps there keeps the user too.
+    if err := retention.CheckDelete(username); err != nil {
+        return nil, err
     }
 
-    // Remove user from maps
-    delete(users, username)
-    delete(apiKeyToUser, user.APIKey)
-
-    // Save changes to disk
-    if err := saveUsers(); err != nil {
-        return fmt.Errorf("failed to save users after deletion: %w", err)
+    var removedShares []models.FileShare
+    err := store.Update(func(tx *store.Tx) error {
+        user, exists, err := userRepo.Get(tx, username)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            return fmt.Errorf("user not found: %s", username)
+        }
+        if err := userRepo.Delete(tx, username); err != nil {
+            return err
+        }
+        if err := deleteAPIKey(tx, user.APIKey); err != nil {
+            return err
+        }
+        if err := deleteUserRecords(tx, username); err != nil {
+            return err
+        }
+        if err := models.RemoveFileMetadataUnderTx(tx, username); err != nil {
+            return err
+        }
+        removedShares, err = models.RemoveFileSharesUnderTx(tx, username)
+        return err
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to delete user: %w", err)
     }
 
     appConfig, err := config.LoadConfig()
     if err != nil {
         log.Printf("Warning: Failed to load config to delete user storage: %v", err)
-        return nil
+        return removedShares, nil
     }
 
     userStorageDir := filepath.Join(appConfig.StorageDirectory, username)
@@ -265,6 +305,43 @@ func DeleteUser(username string) error {
         }
     }
 
+    return removedShares, nil
+}
+
+// deleteUserRecords removes username's group memberships and the file access
+// records they own. Memberships are keyed by group, so all are scanned.
+func deleteUserRecords(tx *store.Tx, username string) error {
+    var memberships []string
+    err := memberRepo.Scan(tx, "", func(key string, member GroupMember) error {
+        if member.Username == username {
+            memberships = append(memberships, key)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, key := range memberships {
+        if err := memberRepo.Delete(tx, key); err != nil {
+            return err
+        }
+    }
+
+    var owned []string
+    err = accessRepo.Scan(tx, "", func(key string, access FileAccess) error {
+        if access.Owner == username {
+            owned = append(owned, key)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, key := range owned {
+        if err := accessRepo.Delete(tx, key); err != nil {
+            return err
+        }
+    }
     return nil
 }
 
@@ -287,7 +364,7 @@ func LogSetupStatus() {
         return
     }
     
-    log.Printf("Found %d users in users.json", len(users))
+    log.Printf("Found %d users in the database", len(users))
     i := 0
     for username, user := range users {
         log.Printf("User %d: %s (role: %s)", i+1, username, user.Role)
@@ -296,45 +373,37 @@ func LogSetupStatus() {
 }
 
 func GetUserByUsername(username string) (*User, error) {
-    users, err := LoadUsers()
+    var user User
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        user, exists, err = userRepo.Get(tx, username)
+        return err
+    })
     if (err != nil) {
         return nil, err
     }
-    for _, user := range users {
-        if user.Username == username {
-            return &user, nil
-        }
+    if !exists {
+        return nil, fmt.Errorf("user not found: %s", username)
     }
-    return nil, fmt.Errorf("user not found: %s", username)
+    return &user, nil
 }
 
 func DebugSetupStatus() map[string]interface{} {
-    fileExists := false
-    fileInfo, err := os.Stat(usersFile)
-    if err == nil {
-        fileExists = true
-    }
-
-    var fileContent []byte
-    var fileSize int64
-    if fileExists {
-        fileContent, _ = os.ReadFile(usersFile)
-        fileSize = fileInfo.Size()
-    }
-
     userMap, err := LoadUsers()
     loadError := ""
     if err != nil {
         loadError = err.Error()
     }
 
-    cwd, _ := os.Getwd()
+    databasePath := store.Path()
+    if absPath, err := filepath.Abs(databasePath); err == nil {
+        databasePath = absPath
+    }
     
     return map[string]interface{}{
-        "fileExists": fileExists,
-        "filePath": filepath.Join(cwd, usersFile),
-        "fileSize": fileSize,
-        "fileContent": string(fileContent),
+        "databasePath": databasePath,
+        "schemaVersion": store.SchemaVersion(),
         "userCount": len(userMap),
         "loadError": loadError,
         "setupCompleted": len(userMap) > 0,
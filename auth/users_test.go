@@ -0,0 +1,100 @@
+package auth_test
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/models"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestDeleteUser(t *testing.T) {
+    _, apiKey, err := auth.CreateUser("erin", "Erin12345", "erin@example.com", auth.RoleUser)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := auth.CreateUser("frank", "Frank12345", "frank@example.com", auth.RoleUser); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { auth.DeleteUser("frank") })
+    group, err := auth.CreateGroup("Erin's group", "", "frank")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, username := range []string{"erin", "frank"} {
+        if err := auth.AddUserToGroup(group.ID, username, auth.GroupRoleReader, "frank"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for path, owner := range map[string]string{"erin/notes.txt": "erin", "frank/notes.txt": "frank"} {
+        if err := auth.SaveFileAccess(auth.FileAccess{Path: path, Owner: owner, CreatedAt: time.Now()}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    home := filepath.Join(appConfig.StorageDirectory, "erin")
+    if err := os.MkdirAll(home, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(home, "notes.txt"), []byte("notes"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := models.SetPGPVerification("erin/notes.txt", models.PGPVerification{Signature: models.SignatureUnsigned}); err != nil {
+        t.Fatal(err)
+    }
+    share := models.FileShare{ID: "erin-share", SourcePath: "erin/notes.txt", TargetGroup: group.ID, SharedBy: "erin", SharedAt: time.Now()}
+    if err := models.SaveFileShare(share); err != nil {
+        t.Fatal(err)
+    }
+
+    accessKeyID, _, err := auth.S3Credentials("erin")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    removed, err := auth.DeleteUser("erin")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(removed) != 1 || removed[0].ID != share.ID {
+        t.Errorf("got removed shares %v, want %s", removed, share.ID)
+    }
+
+    if auth.UserExists("erin") {
+        t.Error("the user is still there")
+    }
+    if _, ok := auth.GetUserByAPIKey(apiKey); ok {
+        t.Error("the API key still finds the user")
+    }
+    if _, _, ok := auth.LookupS3AccessKey(accessKeyID); ok {
+        t.Error("the S3 access key still finds the user")
+    }
+    members, err := auth.GetGroupMembers(group.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(members) != 1 || members[0].Username != "frank" {
+        t.Errorf("got members %v, want only frank", members)
+    }
+    if _, err := auth.GetFileAccess("erin/notes.txt"); err == nil {
+        t.Error("the user's file access record is still there")
+    }
+    if _, err := auth.GetFileAccess("frank/notes.txt"); err != nil {
+        t.Errorf("another user's file access record went too: %v", err)
+    }
+    if _, ok := models.GetFileMetadata("erin/notes.txt"); ok {
+        t.Error("the metadata of the home folder is still there")
+    }
+    if _, err := models.GetFileShareByID(share.ID); err == nil {
+        t.Error("the share of a file in the home folder is still there")
+    }
+    if _, err := os.Stat(home); !os.IsNotExist(err) {
+        t.Errorf("the home folder is still there: %v", err)
+    }
+}
@@ -20,6 +20,30 @@ const (
     DefaultMaxUploadSize  = 32 << 20
     DefaultTokenExpiry    = 24 * time.Hour
     DefaultMaxConcurrent  = 5
+    DefaultShareSweepInterval = 5 * time.Minute
+    DefaultUserQuota      = 1024 * 1024 * 1024 // 1GB
+    DefaultMaxExtractSize = 1024 * 1024 * 1024 // 1GB
+    DefaultQuotaWarningPercent = 90
+    DefaultSMTPPort       = 587
+    DefaultSMTPMaxAttempts = 8
+    DefaultWebhookMaxAttempts = 8
+    DefaultWebSocketMaxConnections = 5
+    DefaultSFTPPort       = 2022
+    DefaultSFTPHostKeyFile = "sftp_host_ed25519_key"
+    DefaultFTPPort        = 2121
+    DefaultFTPPassivePortStart = 50000
+    DefaultFTPPassivePortEnd   = 50100
+    DefaultFTPCertFile    = "ftp_cert.pem"
+    DefaultFTPKeyFile     = "ftp_key.pem"
+    DefaultS3Port         = 9000
+    DefaultS3Region       = "us-east-1"
+    DefaultAS2ID          = "LUNATRANSFER"
+    DefaultAS2CertFile    = "as2_cert.pem"
+    DefaultAS2KeyFile     = "as2_key.pem"
+    DefaultReceiptKeyFile = "receipt_ed25519_key.pem"
+    DefaultScrubSchedule  = "0 3 * * *"
+    DefaultScrubBytesPerSecond = 16 << 20
+    DefaultDatabaseFile   = "lunatransfer.db"
 )
 
 var (
@@ -44,6 +68,120 @@ type AppConfig struct {
     MaxUploadSize  int64
     TokenExpiry    time.Duration
     MaxConcurrent  int
+    ShareSweepInterval Duration `json:"share_sweep_interval"`
+    UserQuota      int64  `json:"user_quota"`
+    MaxExtractSize int64  `json:"max_extract_size"`
+    QuotaWarningPercent int `json:"quota_warning_percent"`
+    SMTP           SMTPConfig `json:"smtp"`
+    WebhookMaxAttempts int `json:"webhook_max_attempts"`
+    WebSocketAllowedOrigins []string `json:"websocket_allowed_origins"`
+    WebSocketMaxConnections int `json:"websocket_max_connections"`
+    SFTP           SFTPConfig `json:"sftp"`
+    FTP            FTPConfig  `json:"ftp"`
+    S3             S3Config   `json:"s3"`
+    AS2            AS2Config  `json:"as2"`
+    // ReceiptKeyFile is the Ed25519 key that signs delivery receipts,
+    // generated in the data directory on first use when not set.
+    ReceiptKeyFile string `json:"receipt_key_file"`
+    // PGPKeySecret protects the private keys of PGP keyrings. It is kept
+    // here rather than in the data directory, next to the keys; without it
+    // keyrings only take public keys.
+    PGPKeySecret   string `json:"pgp_key_secret"`
+    Scrub          ScrubConfig `json:"scrub"`
+    // DatabaseFile holds users, groups, memberships, file access, file
+    // metadata, shares, receipts and checksums; in the data directory when
+    // not set.
+    DatabaseFile   string `json:"database_file"`
+}
+
+type SMTPConfig struct {
+    Enabled            bool   `json:"enabled"`
+    Host               string `json:"host"`
+    Port               int    `json:"port"`
+    Username           string `json:"username"`
+    Password           string `json:"password"`
+    From               string `json:"from"`
+    RequireStartTLS    bool   `json:"require_starttls"`
+    InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+    MaxAttempts        int    `json:"max_attempts"`
+}
+
+// SFTPConfig controls the built-in SFTP server. HostKeyFile defaults to a key
+// generated in the data directory on first start.
+type SFTPConfig struct {
+    Enabled             bool   `json:"enabled"`
+    Port                int    `json:"port"`
+    HostKeyFile         string `json:"host_key_file"`
+    DisablePasswordAuth bool   `json:"disable_password_auth"`
+}
+
+// FTPConfig controls the built-in FTP server. Clients must switch to TLS with
+// AUTH TLS and protect the data channel unless AllowPlain is set. Without a
+// certificate a self-signed one is generated in the data directory.
+type FTPConfig struct {
+    Enabled          bool   `json:"enabled"`
+    Port             int    `json:"port"`
+    PassivePortStart int    `json:"passive_port_start"`
+    PassivePortEnd   int    `json:"passive_port_end"`
+    PublicHost       string `json:"public_host"`
+    TLSCertFile      string `json:"tls_cert_file"`
+    TLSKeyFile       string `json:"tls_key_file"`
+    AllowPlain       bool   `json:"allow_plain"`
+}
+
+// S3Config controls the S3-compatible gateway. Region is what the gateway
+// reports as bucket location; requests signed for any region are accepted.
+type S3Config struct {
+    Enabled bool   `json:"enabled"`
+    Port    int    `json:"port"`
+    Region  string `json:"region"`
+}
+
+// AS2Config controls the AS2 endpoint at /as2 on the API port. ID is this
+// station's AS2 name. The certificate signs receipts and outgoing messages
+// and partners encrypt to it; without one a self-signed certificate is
+// generated in the data directory. PublicURL is the address partners reach
+// /as2 at, where they send asynchronous receipts.
+type AS2Config struct {
+    Enabled   bool   `json:"enabled"`
+    ID        string `json:"id"`
+    CertFile  string `json:"cert_file"`
+    KeyFile   string `json:"key_file"`
+    PublicURL string `json:"public_url"`
+}
+
+// ScrubConfig controls the integrity scrubber, which re-hashes stored files
+// on Schedule (a cron expression) reading at most MaxBytesPerSecond. Files
+// whose contents no longer match, or that are missing, are restored from
+// ReplicaDirectory, a copy of the storage directory, when it holds them
+// intact; with Quarantine, those that can't be are moved out of storage.
+type ScrubConfig struct {
+    Enabled           bool   `json:"enabled"`
+    Schedule          string `json:"schedule"`
+    MaxBytesPerSecond int64  `json:"max_bytes_per_second"`
+    Quarantine        bool   `json:"quarantine"`
+    ReplicaDirectory  string `json:"replica_directory"`
+}
+
+// Duration is a time.Duration written in the config file as a string such
+// as "5m" or "1h30m", like in the environment overrides.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var text string
+    if err := json.Unmarshal(data, &text); err != nil {
+        return fmt.Errorf("duration must be a string such as \"5m\": %w", err)
+    }
+    parsed, err := time.ParseDuration(text)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
 }
 
 var config *AppConfig
@@ -71,6 +209,35 @@ func LoadConfig() (*AppConfig, error) {
         MaxUploadSize:  DefaultMaxUploadSize,
         TokenExpiry:    DefaultTokenExpiry,
         MaxConcurrent:  DefaultMaxConcurrent,
+        ShareSweepInterval: Duration(DefaultShareSweepInterval),
+        UserQuota:      DefaultUserQuota,
+        MaxExtractSize: DefaultMaxExtractSize,
+        QuotaWarningPercent: DefaultQuotaWarningPercent,
+        SMTP: SMTPConfig{
+            Port:        DefaultSMTPPort,
+            MaxAttempts: DefaultSMTPMaxAttempts,
+        },
+        WebhookMaxAttempts: DefaultWebhookMaxAttempts,
+        WebSocketMaxConnections: DefaultWebSocketMaxConnections,
+        SFTP: SFTPConfig{
+            Port: DefaultSFTPPort,
+        },
+        FTP: FTPConfig{
+            Port:             DefaultFTPPort,
+            PassivePortStart: DefaultFTPPassivePortStart,
+            PassivePortEnd:   DefaultFTPPassivePortEnd,
+        },
+        S3: S3Config{
+            Port:   DefaultS3Port,
+            Region: DefaultS3Region,
+        },
+        AS2: AS2Config{
+            ID: DefaultAS2ID,
+        },
+        Scrub: ScrubConfig{
+            Schedule:          DefaultScrubSchedule,
+            MaxBytesPerSecond: DefaultScrubBytesPerSecond,
+        },
     }
 
     if _, err := os.Stat(DefaultConfigFile); err == nil {
@@ -127,6 +294,176 @@ func LoadConfig() (*AppConfig, error) {
         }
     }
 
+    if sweep := os.Getenv("LUNA_SHARE_SWEEP_INTERVAL"); sweep != "" {
+        if d, err := time.ParseDuration(sweep); err == nil {
+            config.ShareSweepInterval = Duration(d)
+        }
+    }
+
+    if quota := os.Getenv("LUNA_USER_QUOTA"); quota != "" {
+        if q, err := strconv.ParseInt(quota, 10, 64); err == nil {
+            config.UserQuota = q
+        }
+    }
+
+    if size := os.Getenv("LUNA_MAX_EXTRACT_SIZE"); size != "" {
+        if s, err := strconv.ParseInt(size, 10, 64); err == nil {
+            config.MaxExtractSize = s
+        }
+    }
+
+    if host := os.Getenv("LUNA_SMTP_HOST"); host != "" {
+        config.SMTP.Host = host
+        config.SMTP.Enabled = true
+    }
+
+    if port := os.Getenv("LUNA_SMTP_PORT"); port != "" {
+        if p, err := strconv.Atoi(port); err == nil {
+            config.SMTP.Port = p
+        }
+    }
+
+    if user := os.Getenv("LUNA_SMTP_USERNAME"); user != "" {
+        config.SMTP.Username = user
+    }
+
+    if password := os.Getenv("LUNA_SMTP_PASSWORD"); password != "" {
+        config.SMTP.Password = password
+    }
+
+    if from := os.Getenv("LUNA_SMTP_FROM"); from != "" {
+        config.SMTP.From = from
+    }
+
+    if origins := os.Getenv("LUNA_WS_ALLOWED_ORIGINS"); origins != "" {
+        config.WebSocketAllowedOrigins = strings.Split(origins, ",")
+    }
+
+    if maxConns := os.Getenv("LUNA_WS_MAX_CONNECTIONS"); maxConns != "" {
+        if c, err := strconv.Atoi(maxConns); err == nil {
+            config.WebSocketMaxConnections = c
+        }
+    }
+
+    if enabled := os.Getenv("LUNA_SFTP_ENABLED"); enabled != "" {
+        config.SFTP.Enabled = enabled == "true" || enabled == "1"
+    }
+
+    if port := os.Getenv("LUNA_SFTP_PORT"); port != "" {
+        if p, err := strconv.Atoi(port); err == nil {
+            config.SFTP.Port = p
+        }
+    }
+
+    if hostKey := os.Getenv("LUNA_SFTP_HOST_KEY"); hostKey != "" {
+        config.SFTP.HostKeyFile = hostKey
+    }
+
+    if enabled := os.Getenv("LUNA_FTP_ENABLED"); enabled != "" {
+        config.FTP.Enabled = enabled == "true" || enabled == "1"
+    }
+
+    if port := os.Getenv("LUNA_FTP_PORT"); port != "" {
+        if p, err := strconv.Atoi(port); err == nil {
+            config.FTP.Port = p
+        }
+    }
+
+    if ports := os.Getenv("LUNA_FTP_PASSIVE_PORTS"); ports != "" {
+        start, end, found := strings.Cut(ports, "-")
+        if s, err := strconv.Atoi(start); err == nil {
+            config.FTP.PassivePortStart = s
+            config.FTP.PassivePortEnd = s
+        }
+        if e, err := strconv.Atoi(end); found && err == nil {
+            config.FTP.PassivePortEnd = e
+        }
+    }
+
+    if host := os.Getenv("LUNA_FTP_PUBLIC_HOST"); host != "" {
+        config.FTP.PublicHost = host
+    }
+
+    if cert := os.Getenv("LUNA_FTP_TLS_CERT"); cert != "" {
+        config.FTP.TLSCertFile = cert
+    }
+
+    if key := os.Getenv("LUNA_FTP_TLS_KEY"); key != "" {
+        config.FTP.TLSKeyFile = key
+    }
+
+    if plain := os.Getenv("LUNA_FTP_ALLOW_PLAIN"); plain != "" {
+        config.FTP.AllowPlain = plain == "true" || plain == "1"
+    }
+
+    if enabled := os.Getenv("LUNA_S3_ENABLED"); enabled != "" {
+        config.S3.Enabled = enabled == "true" || enabled == "1"
+    }
+
+    if port := os.Getenv("LUNA_S3_PORT"); port != "" {
+        if p, err := strconv.Atoi(port); err == nil {
+            config.S3.Port = p
+        }
+    }
+
+    if region := os.Getenv("LUNA_S3_REGION"); region != "" {
+        config.S3.Region = region
+    }
+
+    if enabled := os.Getenv("LUNA_AS2_ENABLED"); enabled != "" {
+        config.AS2.Enabled = enabled == "true" || enabled == "1"
+    }
+
+    if id := os.Getenv("LUNA_AS2_ID"); id != "" {
+        config.AS2.ID = id
+    }
+
+    if cert := os.Getenv("LUNA_AS2_CERT"); cert != "" {
+        config.AS2.CertFile = cert
+    }
+
+    if key := os.Getenv("LUNA_AS2_KEY"); key != "" {
+        config.AS2.KeyFile = key
+    }
+
+    if url := os.Getenv("LUNA_AS2_PUBLIC_URL"); url != "" {
+        config.AS2.PublicURL = url
+    }
+
+    if key := os.Getenv("LUNA_RECEIPT_KEY"); key != "" {
+        config.ReceiptKeyFile = key
+    }
+
+    if secret := os.Getenv("LUNA_PGP_KEY_SECRET"); secret != "" {
+        config.PGPKeySecret = secret
+    }
+
+    if file := os.Getenv("LUNA_DATABASE_FILE"); file != "" {
+        config.DatabaseFile = file
+    }
+
+    if enabled := os.Getenv("LUNA_SCRUB_ENABLED"); enabled != "" {
+        config.Scrub.Enabled = enabled == "true" || enabled == "1"
+    }
+
+    if schedule := os.Getenv("LUNA_SCRUB_SCHEDULE"); schedule != "" {
+        config.Scrub.Schedule = schedule
+    }
+
+    if rate := os.Getenv("LUNA_SCRUB_MAX_BYTES_PER_SECOND"); rate != "" {
+        if r, err := strconv.ParseInt(rate, 10, 64); err == nil {
+            config.Scrub.MaxBytesPerSecond = r
+        }
+    }
+
+    if quarantine := os.Getenv("LUNA_SCRUB_QUARANTINE"); quarantine != "" {
+        config.Scrub.Quarantine = quarantine == "true" || quarantine == "1"
+    }
+
+    if replica := os.Getenv("LUNA_SCRUB_REPLICA_DIRECTORY"); replica != "" {
+        config.Scrub.ReplicaDirectory = replica
+    }
+
     StoragePath = getEnv("STORAGE_DIR", DefaultStoragePath)
     config.StoragePath = StoragePath
 
@@ -142,6 +479,80 @@ func LoadConfig() (*AppConfig, error) {
         return nil, fmt.Errorf("rate limit must be positive")
     }
 
+    if config.MaxExtractSize <= 0 {
+        config.MaxExtractSize = DefaultMaxExtractSize
+    }
+
+    if config.ShareSweepInterval <= 0 {
+        config.ShareSweepInterval = Duration(DefaultShareSweepInterval)
+    }
+
+    if config.SMTP.Enabled && (config.SMTP.Host == "" || config.SMTP.From == "") {
+        return nil, fmt.Errorf("smtp host and from address are required when email is enabled")
+    }
+
+    if config.SMTP.MaxAttempts <= 0 {
+        config.SMTP.MaxAttempts = DefaultSMTPMaxAttempts
+    }
+    if config.WebhookMaxAttempts <= 0 {
+        config.WebhookMaxAttempts = DefaultWebhookMaxAttempts
+    }
+    if config.WebSocketMaxConnections <= 0 {
+        config.WebSocketMaxConnections = DefaultWebSocketMaxConnections
+    }
+    if config.SFTP.Port <= 0 || config.SFTP.Port > 65535 {
+        return nil, fmt.Errorf("invalid sftp port number: %d", config.SFTP.Port)
+    }
+    if config.SFTP.HostKeyFile == "" {
+        config.SFTP.HostKeyFile = filepath.Join(config.jsonDBDirectory, DefaultSFTPHostKeyFile)
+    }
+    if config.FTP.Port <= 0 || config.FTP.Port > 65535 {
+        return nil, fmt.Errorf("invalid ftp port number: %d", config.FTP.Port)
+    }
+    if config.FTP.PassivePortStart <= 0 || config.FTP.PassivePortEnd > 65535 ||
+        config.FTP.PassivePortStart > config.FTP.PassivePortEnd {
+        return nil, fmt.Errorf("invalid ftp passive port range: %d-%d",
+            config.FTP.PassivePortStart, config.FTP.PassivePortEnd)
+    }
+    if (config.FTP.TLSCertFile == "") != (config.FTP.TLSKeyFile == "") {
+        return nil, fmt.Errorf("ftp tls_cert_file and tls_key_file must be set together")
+    }
+    if config.FTP.TLSCertFile == "" {
+        config.FTP.TLSCertFile = filepath.Join(config.jsonDBDirectory, DefaultFTPCertFile)
+        config.FTP.TLSKeyFile = filepath.Join(config.jsonDBDirectory, DefaultFTPKeyFile)
+    }
+    if config.S3.Port <= 0 || config.S3.Port > 65535 {
+        return nil, fmt.Errorf("invalid s3 port number: %d", config.S3.Port)
+    }
+    if config.S3.Region == "" {
+        config.S3.Region = DefaultS3Region
+    }
+    if config.AS2.ID == "" {
+        config.AS2.ID = DefaultAS2ID
+    }
+    if (config.AS2.CertFile == "") != (config.AS2.KeyFile == "") {
+        return nil, fmt.Errorf("as2 cert_file and key_file must be set together")
+    }
+    if config.AS2.CertFile == "" {
+        config.AS2.CertFile = filepath.Join(config.jsonDBDirectory, DefaultAS2CertFile)
+        config.AS2.KeyFile = filepath.Join(config.jsonDBDirectory, DefaultAS2KeyFile)
+    }
+    if config.AS2.PublicURL == "" {
+        config.AS2.PublicURL = fmt.Sprintf("http://localhost:%d/as2", config.Port)
+    }
+    if config.Scrub.Schedule == "" {
+        config.Scrub.Schedule = DefaultScrubSchedule
+    }
+    if config.Scrub.MaxBytesPerSecond <= 0 {
+        config.Scrub.MaxBytesPerSecond = DefaultScrubBytesPerSecond
+    }
+    if config.ReceiptKeyFile == "" {
+        config.ReceiptKeyFile = filepath.Join(config.jsonDBDirectory, DefaultReceiptKeyFile)
+    }
+    if config.DatabaseFile == "" {
+        config.DatabaseFile = filepath.Join(config.jsonDBDirectory, DefaultDatabaseFile)
+    }
+
     return config, nil
 }
 
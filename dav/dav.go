@@ -0,0 +1,227 @@
+// Package dav serves each user's virtual tree (see package vfs) over WebDAV so
+// it can be mounted as a network drive.
+package dav
+
+import (
+    "LunaTransfer/common"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "context"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+    "time"
+    "golang.org/x/net/webdav"
+)
+
+// locks is shared by all users; names come from vfs.FS.LockName so that
+// users reaching the same file through different paths see each other's locks.
+var locks = webdav.NewMemLS()
+
+// Handler serves WebDAV below prefix for the user in the request context.
+func Handler(prefix string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        username, ok := common.GetUsernameFromContext(r.Context())
+        if !ok {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+
+        fs, err := vfs.New(username, r.RemoteAddr, "WebDAV ("+r.UserAgent()+")")
+        if err != nil {
+            utils.LogError("WEBDAV_ERROR", err, username, "Failed to open user storage")
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+
+        if r.Method == http.MethodPut && !quotaAllows(fs, strings.TrimPrefix(r.URL.Path, prefix), r.ContentLength) {
+            http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+            return
+        }
+
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodPut:
+            // Transfers of large files outlast the server-wide timeouts.
+            rc := http.NewResponseController(w)
+            rc.SetReadDeadline(time.Time{})
+            rc.SetWriteDeadline(time.Time{})
+            // Without a Content-Type ServeContent sniffs the file, which
+            // would count a HEAD as a download.
+            w.Header().Set("Content-Type", contentType(r.URL.Path))
+        }
+
+        handler := &webdav.Handler{
+            Prefix:     prefix,
+            FileSystem: fileSystem{fs: fs},
+            LockSystem: lockSystem{fs: fs},
+            Logger: func(r *http.Request, err error) {
+                if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
+                    utils.LogError("WEBDAV_ERROR", err, username, r.Method+" "+r.URL.Path)
+                }
+            },
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// quotaAllows reports whether a PUT of size bytes to name fits in the
+// owner's quota. Uploads without a length are stopped by the file once they
+// reach it, which the webdav handler can only answer with a generic error.
+func quotaAllows(fs *vfs.FS, name string, size int64) bool {
+    if size <= 0 {
+        return true
+    }
+    left, err := fs.QuotaLeft(name)
+    if err != nil || left < 0 {
+        return true
+    }
+    if info, err := fs.Stat(name); err == nil && !info.IsDir() {
+        left += info.Size()
+    }
+    return size <= left
+}
+
+func contentType(name string) string {
+    if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+        return ctype
+    }
+    return "application/octet-stream"
+}
+
+// fileSystem adapts vfs.FS to webdav.FileSystem.
+type fileSystem struct {
+    fs *vfs.FS
+}
+
+func (f fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+    return f.fs.Mkdir(name)
+}
+
+func (f fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+    if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+        file, err := f.fs.Create(name, flag)
+        if err != nil {
+            return nil, err
+        }
+        return file, nil
+    }
+
+    info, err := f.fs.Stat(name)
+    if err != nil {
+        return nil, err
+    }
+    if info.IsDir() {
+        return &dir{fs: f.fs, name: name, info: info}, nil
+    }
+    file, err := f.fs.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return file, nil
+}
+
+func (f fileSystem) RemoveAll(ctx context.Context, name string) error {
+    return f.fs.RemoveAll(name)
+}
+
+// Rename never replaces; the webdav handler removes an existing destination
+// first when the client asked to overwrite it.
+func (f fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+    return f.fs.Rename(oldName, newName, false)
+}
+
+func (f fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+    info, err := f.fs.Stat(name)
+    if err != nil {
+        return nil, err
+    }
+    return fileInfo{info}, nil
+}
+
+// fileInfo answers getcontenttype from the extension so that listing a folder
+// does not open every file in it.
+type fileInfo struct {
+    os.FileInfo
+}
+
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+    return contentType(fi.Name()), nil
+}
+
+// dir is an open folder; vfs folders may be virtual, so it lists through
+// the FS instead of an os.File.
+type dir struct {
+    fs      *vfs.FS
+    name    string
+    info    os.FileInfo
+    entries []os.FileInfo
+    loaded  bool
+}
+
+func (d *dir) Close() error                                 { return nil }
+func (d *dir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *dir) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (d *dir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *dir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+    if !d.loaded {
+        entries, err := d.fs.ReadDir(d.name)
+        if err != nil {
+            return nil, err
+        }
+        d.entries, d.loaded = entries, true
+    }
+    if count <= 0 {
+        entries := d.entries
+        d.entries = nil
+        return entries, nil
+    }
+    if len(d.entries) == 0 {
+        return nil, io.EOF
+    }
+    if count > len(d.entries) {
+        count = len(d.entries)
+    }
+    entries := d.entries[:count]
+    d.entries = d.entries[count:]
+    return entries, nil
+}
+
+// lockSystem translates the user's paths to shared lock names.
+type lockSystem struct {
+    fs *vfs.FS
+}
+
+func (l lockSystem) name(p string) string {
+    if p == "" {
+        return ""
+    }
+    return l.fs.LockName(p)
+}
+
+func (l lockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+    return locks.Confirm(now, l.name(name0), l.name(name1), conditions...)
+}
+
+func (l lockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+    details.Root = l.name(details.Root)
+    return locks.Create(now, details)
+}
+
+func (l lockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+    details, err := locks.Refresh(now, token, duration)
+    if err != nil {
+        return details, err
+    }
+    details.Root = l.fs.VirtualPath(details.Root)
+    return details, nil
+}
+
+func (l lockSystem) Unlock(now time.Time, token string) error {
+    return locks.Unlock(now, token)
+}
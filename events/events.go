@@ -0,0 +1,168 @@
+package events
+
+import (
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "fmt"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Type string
+
+const (
+    FileUploaded     Type = "file.uploaded"
+    FileDownloaded   Type = "file.downloaded"
+    FileDeleted      Type = "file.deleted"
+    FileRenamed      Type = "file.renamed"
+    DirectoryCreated Type = "directory.created"
+    ShareCreated     Type = "share.created"
+    ShareRemoved     Type = "share.removed"
+    ShareExtended    Type = "share.extended"
+    ShareExpiring    Type = "share.expiring"
+    UserCreated      Type = "user.created"
+)
+
+// Event is a domain event published once by the code that performed the
+// action. Namespace is "user:<name>" or "group:<id>" and Path is relative to
+// it; SourcePath is the same location relative to the storage directory.
+// For renames PreviousSourcePath holds the old location, and for uploads of
+// files extracted from an archive ArchivePath holds the archive's.
+type Event struct {
+    ID                 string
+    Type               Type
+    Timestamp          time.Time
+    Actor              string
+    RemoteAddr         string
+    UserAgent          string
+    Namespace          string
+    Path               string
+    SourcePath         string
+    PreviousSourcePath string
+    ArchivePath        string
+    Size               int64
+    IsDir              bool
+    Elapsed            time.Duration
+    ShareID            string
+    SharedBy           string
+    TargetGroup        string
+    Permission         string
+    ExpiresAt          *time.Time
+    PreviousExpiresAt  *time.Time
+    Reason             string
+    Username           string
+}
+
+type Handler func(Event)
+
+type subscriber struct {
+    name   string
+    types  map[Type]bool
+    handle Handler
+}
+
+var (
+    subscribersMutex sync.RWMutex
+    subscribers      []subscriber
+)
+
+// Subscribe registers handle for the given event types, or for every event
+// when none are given. Handlers run synchronously in registration order, so
+// anything slow should hand off to a goroutine.
+func Subscribe(name string, handle Handler, types ...Type) {
+    sub := subscriber{name: name, handle: handle}
+    if len(types) > 0 {
+        sub.types = make(map[Type]bool, len(types))
+        for _, t := range types {
+            sub.types[t] = true
+        }
+    }
+
+    subscribersMutex.Lock()
+    subscribers = append(subscribers, sub)
+    subscribersMutex.Unlock()
+}
+
+// Publish delivers event to every interested subscriber. A panicking
+// subscriber is logged and does not stop the others.
+func Publish(event Event) {
+    if event.ID == "" {
+        event.ID = utils.GenerateUUID()
+    }
+    if event.Timestamp.IsZero() {
+        event.Timestamp = time.Now()
+    }
+    if event.Namespace == "" && event.SourcePath != "" {
+        event.Namespace, event.Path = SplitStoragePath(event.SourcePath)
+    }
+    if event.RemoteAddr == "" {
+        event.RemoteAddr = "localhost"
+    }
+
+    subscribersMutex.RLock()
+    subs := subscribers
+    subscribersMutex.RUnlock()
+
+    for _, sub := range subs {
+        if sub.types != nil && !sub.types[event.Type] {
+            continue
+        }
+        dispatch(sub, event)
+    }
+}
+
+func dispatch(sub subscriber, event Event) {
+    defer func() {
+        if r := recover(); r != nil {
+            utils.LogError("EVENT_SUBSCRIBER_PANIC", fmt.Errorf("%v", r), "system",
+                fmt.Sprintf("Subscriber %s failed on %s", sub.name, event.Type))
+        }
+    }()
+    sub.handle(event)
+}
+
+// ShareEvent describes share as an event of type t.
+func ShareEvent(t Type, actor, remoteAddr string, share models.FileShare, reason string) Event {
+    return Event{
+        Type:        t,
+        Actor:       actor,
+        RemoteAddr:  remoteAddr,
+        SourcePath:  share.SourcePath,
+        IsDir:       share.IsDir,
+        ShareID:     share.ID,
+        SharedBy:    share.SharedBy,
+        TargetGroup: share.TargetGroup,
+        Permission:  string(share.Permission),
+        ExpiresAt:   share.ExpiresAt,
+        Reason:      reason,
+    }
+}
+
+// SplitStoragePath maps a storage-relative path such as "alice/docs/a.txt" or
+// "groups/<id>/a.txt" to its namespace and the path inside it.
+func SplitStoragePath(relPath string) (string, string) {
+    relPath = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(relPath, "\\", "/")), "/")
+    parts := strings.SplitN(relPath, "/", 3)
+    if parts[0] == "groups" && len(parts) >= 2 {
+        rest := ""
+        if len(parts) == 3 {
+            rest = parts[2]
+        }
+        return "group:" + parts[1], rest
+    }
+    rest := ""
+    if i := strings.Index(relPath, "/"); i >= 0 {
+        rest = relPath[i+1:]
+    }
+    return "user:" + parts[0], rest
+}
+
+// StoragePath is the inverse of SplitStoragePath.
+func StoragePath(namespace, p string) string {
+    if id, ok := strings.CutPrefix(namespace, "group:"); ok {
+        return path.Join("groups", id, p)
+    }
+    return path.Join(strings.TrimPrefix(namespace, "user:"), p)
+}
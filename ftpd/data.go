@@ -0,0 +1,351 @@
+package ftpd
+
+import (
+    "LunaTransfer/utils"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand/v2"
+    "net"
+    "os"
+    "strings"
+    "time"
+)
+
+// handlePasv and handleEpsv open a listener in the passive port range for the
+// next transfer.
+func (s *session) handlePasv(arg string) {
+    ip := s.passiveIP()
+    if ip == nil {
+        s.reply(425, "PASV needs an IPv4 address, use EPSV")
+        return
+    }
+    port, err := s.listenPassive()
+    if err != nil {
+        s.reply(425, "Cannot open passive connection")
+        return
+    }
+    s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+        ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+func (s *session) handleEpsv(arg string) {
+    if strings.ToUpper(arg) == "ALL" {
+        s.reply(200, "EPSV ALL accepted")
+        return
+    }
+    port, err := s.listenPassive()
+    if err != nil {
+        s.reply(425, "Cannot open passive connection")
+        return
+    }
+    s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+}
+
+// passiveIP is the IPv4 address clients connect to for data: the configured
+// public host, or else the address the client reached us on.
+func (s *session) passiveIP() net.IP {
+    if host := s.cfg.PublicHost; host != "" {
+        if ip := net.ParseIP(host); ip != nil {
+            return ip.To4()
+        }
+        ips, err := net.LookupIP(host)
+        if err != nil {
+            utils.LogError("FTP_ERROR", err, "system", "Failed to resolve FTP public host "+host)
+            return nil
+        }
+        for _, ip := range ips {
+            if ip4 := ip.To4(); ip4 != nil {
+                return ip4
+            }
+        }
+        return nil
+    }
+    if addr, ok := s.raw.LocalAddr().(*net.TCPAddr); ok {
+        return addr.IP.To4()
+    }
+    return nil
+}
+
+func (s *session) listenPassive() (int, error) {
+    s.closePassive()
+
+    start, end := s.cfg.PassivePortStart, s.cfg.PassivePortEnd
+    count := end - start + 1
+    offset := rand.IntN(count)
+    for i := 0; i < count; i++ {
+        port := start + (offset+i)%count
+        listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+        if err == nil {
+            s.passive = listener
+            return port, nil
+        }
+    }
+    err := fmt.Errorf("no free port in %d-%d", start, end)
+    utils.LogError("FTP_ERROR", err, s.user, "Failed to open passive port")
+    return 0, err
+}
+
+func (s *session) closePassive() {
+    if s.passive != nil {
+        s.passive.Close()
+        s.passive = nil
+    }
+}
+
+// dataReady checks that a transfer may start before any file is touched.
+func (s *session) dataReady() bool {
+    if s.secure && !s.protected && !s.cfg.AllowPlain {
+        s.reply(521, "Data connections must be protected, use PROT P")
+        return false
+    }
+    if s.passive == nil {
+        s.reply(425, "Use PASV or EPSV first")
+        return false
+    }
+    return true
+}
+
+// openData accepts the client's data connection. Connections from any other
+// address than the control connection's are refused so that nobody else can
+// take over a transfer.
+func (s *session) openData() (net.Conn, error) {
+    listener := s.passive
+    s.passive = nil
+    defer listener.Close()
+
+    deadline := time.Now().Add(handshakeTimeout)
+    if tcpListener, ok := listener.(*net.TCPListener); ok {
+        tcpListener.SetDeadline(deadline)
+    }
+    controlIP := s.raw.RemoteAddr().(*net.TCPAddr).IP
+
+    var conn net.Conn
+    for conn == nil {
+        c, err := listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && addr.IP.Equal(controlIP) {
+            conn = c
+            continue
+        }
+        utils.LogSystem("FTP_DATA_REJECTED", s.user, c.RemoteAddr().String(),
+            fmt.Sprintf("Refused data connection for session from %s", s.remoteAddr))
+        c.Close()
+    }
+
+    if s.protected {
+        tlsConn := tls.Server(conn, s.tlsConfig)
+        tlsConn.SetDeadline(deadline)
+        if err := tlsConn.Handshake(); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        tlsConn.SetDeadline(time.Time{})
+        conn = tlsConn
+    }
+    return idleConn{conn}, nil
+}
+
+// transfer runs fn over a new data connection and reports whether it
+// completed; the caller sends the final reply.
+func (s *session) transfer(fn func(data net.Conn) error) bool {
+    s.reply(150, "Opening data connection")
+    data, err := s.openData()
+    if err != nil {
+        s.reply(425, "Cannot open data connection")
+        return false
+    }
+    err = fn(data)
+    data.Close()
+    if errors.Is(err, utils.ErrQuotaExceeded) {
+        s.reply(552, "Storage quota exceeded, transfer aborted")
+        return false
+    }
+    if err != nil {
+        s.reply(426, "Connection closed, transfer aborted")
+        return false
+    }
+    return true
+}
+
+func (s *session) handleRetr(arg string) {
+    if !s.dataReady() {
+        return
+    }
+    p := s.path(arg)
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if info.IsDir() {
+        s.reply(550, "Not a regular file")
+        return
+    }
+    file, err := s.fs.Open(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if s.restart > 0 {
+        if _, err := file.Seek(s.restart, io.SeekStart); err != nil {
+            file.Close()
+            s.replyError(err)
+            return
+        }
+    }
+
+    // Hide the embedded os.File's WriteTo so the download is counted.
+    ok := s.transfer(func(data net.Conn) error {
+        _, err := io.Copy(data, struct{ io.Reader }{file})
+        return err
+    })
+    file.Close()
+    if ok {
+        s.reply(226, "Transfer complete")
+    }
+}
+
+func (s *session) handleStor(arg string) {
+    s.store(arg, os.O_TRUNC)
+}
+
+func (s *session) handleAppe(arg string) {
+    s.store(arg, os.O_APPEND)
+}
+
+// store receives a file. After REST the file is kept and written from the
+// restart offset on.
+func (s *session) store(arg string, flag int) {
+    if !s.dataReady() {
+        return
+    }
+    if s.restart > 0 {
+        flag = 0
+    }
+    file, err := s.fs.Create(s.path(arg), flag)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if s.restart > 0 {
+        if _, err := file.Seek(s.restart, io.SeekStart); err != nil {
+            file.Close()
+            s.replyError(err)
+            return
+        }
+    }
+
+    ok := s.transfer(func(data net.Conn) error {
+        _, err := io.Copy(file, data)
+        return err
+    })
+    // Closing publishes the upload, so it happens before the client hears
+    // that the transfer is complete.
+    if err := file.Close(); err != nil && ok {
+        s.reply(451, "Failed to save file")
+        return
+    }
+    if ok {
+        s.reply(226, "Transfer complete")
+    }
+}
+
+func (s *session) handleList(arg string) {
+    s.list(arg, listLine)
+}
+
+func (s *session) handleNlst(arg string) {
+    s.list(arg, func(info os.FileInfo) string { return info.Name() })
+}
+
+func (s *session) handleMlsd(arg string) {
+    s.list(arg, factsLine)
+}
+
+// list sends one line per entry of the folder, or the file, named by arg.
+// Options such as "-la" that many clients send are ignored.
+func (s *session) list(arg string, format func(os.FileInfo) string) {
+    fields := strings.Fields(arg)
+    for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+        fields = fields[1:]
+    }
+    p := s.path(strings.Join(fields, " "))
+
+    if !s.dataReady() {
+        return
+    }
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    entries := []os.FileInfo{info}
+    if info.IsDir() {
+        if entries, err = s.fs.ReadDir(p); err != nil {
+            s.replyError(err)
+            return
+        }
+    }
+
+    var b strings.Builder
+    for _, entry := range entries {
+        b.WriteString(format(entry))
+        b.WriteString("\r\n")
+    }
+    if s.transfer(func(data net.Conn) error {
+        _, err := io.WriteString(data, b.String())
+        return err
+    }) {
+        s.reply(226, fmt.Sprintf("%d entries", len(entries)))
+    }
+}
+
+func (s *session) handleMlst(arg string) {
+    p := s.path(arg)
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    facts, _, _ := strings.Cut(factsLine(info), " ")
+    s.replyLines(250, "Listing "+p, []string{facts + " " + p}, "End")
+}
+
+// listLine formats an entry like ls -l, which is what clients parse.
+func listLine(info os.FileInfo) string {
+    layout := "Jan _2 15:04"
+    if time.Since(info.ModTime()) > 180*24*time.Hour {
+        layout = "Jan _2  2006"
+    }
+    return fmt.Sprintf("%s 1 ftp ftp %12d %s %s",
+        info.Mode().String(), info.Size(), info.ModTime().Format(layout), info.Name())
+}
+
+// factsLine formats an entry for MLSD and MLST (RFC 3659).
+func factsLine(info os.FileInfo) string {
+    kind := "file"
+    if info.IsDir() {
+        kind = "dir"
+    }
+    return fmt.Sprintf("type=%s;size=%d;modify=%s; %s",
+        kind, info.Size(), info.ModTime().UTC().Format(timeFormat), info.Name())
+}
+
+// idleConn aborts transfers that stall for longer than idleTimeout.
+type idleConn struct {
+    net.Conn
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+    c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+    return c.Conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+    c.Conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+    return c.Conn.Write(p)
+}
@@ -0,0 +1,168 @@
+// Package ftpd serves LunaTransfer storage over FTP for partners that cannot
+// use SFTP or HTTPS. Clients must secure the session with AUTH TLS (explicit
+// FTPS) unless plain FTP is allowed in the config, log in with their
+// LunaTransfer password and see the tree described in package vfs. Only
+// passive data connections are offered.
+package ftpd
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// Start listens for FTP connections until ctx is cancelled. It returns at
+// once when FTP is disabled.
+func Start(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.FTP.Enabled {
+        return
+    }
+    cfg := appConfig.FTP
+
+    tlsConfig, err := loadTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile)
+    if err != nil {
+        utils.LogError("FTP_ERROR", err, "system", "Failed to load FTP certificate")
+        log.Printf("FTP server not started: %v", err)
+        return
+    }
+
+    listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+    if err != nil {
+        utils.LogError("FTP_ERROR", err, "system", "Failed to listen for FTP")
+        log.Printf("FTP server not started: %v", err)
+        return
+    }
+    mode := "explicit FTPS required"
+    if cfg.AllowPlain {
+        mode = "plain FTP allowed"
+    }
+    utils.LogSystem("FTP_START", "system", "localhost",
+        fmt.Sprintf("FTP server listening on port %d (%s, passive ports %d-%d)",
+            cfg.Port, mode, cfg.PassivePortStart, cfg.PassivePortEnd))
+    log.Printf("LunaTransfer FTP server is running on :%d", cfg.Port)
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    sessions := make(map[*session]struct{})
+    go func() {
+        <-ctx.Done()
+        listener.Close()
+        mu.Lock()
+        for s := range sessions {
+            s.close()
+        }
+        mu.Unlock()
+    }()
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if ctx.Err() != nil {
+                break
+            }
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                time.Sleep(100 * time.Millisecond)
+                continue
+            }
+            utils.LogError("FTP_ERROR", err, "system", "Failed to accept FTP connection")
+            break
+        }
+
+        s := newSession(conn, cfg, tlsConfig)
+        mu.Lock()
+        sessions[s] = struct{}{}
+        mu.Unlock()
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            s.serve()
+            mu.Lock()
+            delete(sessions, s)
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
+}
+
+// loadTLSConfig reads the server certificate, generating a self-signed one on
+// first start when none was configured. Partners that pin certificates should
+// be given a certificate from a real CA instead.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+    if _, err := os.Stat(certFile); os.IsNotExist(err) {
+        if err := generateCertificate(certFile, keyFile); err != nil {
+            return nil, err
+        }
+        utils.LogSystem("FTP_CERT_CREATED", "system", "localhost",
+            fmt.Sprintf("Generated self-signed FTP certificate %s", certFile))
+    }
+
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+    // Data connections resume the control connection's TLS session, which
+    // many clients require; session tickets of one tls.Config allow that.
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion:   tls.VersionTLS12,
+    }, nil
+}
+
+func generateCertificate(certFile, keyFile string) error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return err
+    }
+    hostname, _ := os.Hostname()
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: hostname, Organization: []string{"LunaTransfer"}},
+        DNSNames:              []string{hostname, "localhost"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().AddDate(10, 0, 0),
+        KeyUsage:              x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+        return err
+    }
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+        return err
+    }
+    return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
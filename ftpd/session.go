@@ -0,0 +1,557 @@
+package ftpd
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "bufio"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    idleTimeout      = 5 * time.Minute
+    handshakeTimeout = 30 * time.Second
+    maxLoginFailures = 3
+    maxLineLength    = 4096
+    timeFormat       = "20060102150405"
+)
+
+// session is one control connection.
+type session struct {
+    // raw is the TCP connection; conn is the same connection wrapped in TLS
+    // after AUTH TLS.
+    raw        net.Conn
+    conn       net.Conn
+    reader     *bufio.Reader
+    cfg        config.FTPConfig
+    tlsConfig  *tls.Config
+    remoteAddr string
+
+    secure     bool
+    protected  bool
+    user       string
+    fs         *vfs.FS
+    cwd        string
+    failures   int
+    restart    int64
+    renameFrom string
+    passive    net.Listener
+    quit       bool
+}
+
+type command struct {
+    handle func(s *session, arg string)
+    // open commands are accepted before login.
+    open bool
+}
+
+var commands map[string]command
+
+func init() {
+    commands = map[string]command{
+        "AUTH": {handle: (*session).handleAuth, open: true},
+        "PBSZ": {handle: (*session).handlePbsz, open: true},
+        "PROT": {handle: (*session).handleProt, open: true},
+        "USER": {handle: (*session).handleUser, open: true},
+        "PASS": {handle: (*session).handlePass, open: true},
+        "FEAT": {handle: (*session).handleFeat, open: true},
+        "SYST": {handle: (*session).handleSyst, open: true},
+        "OPTS": {handle: (*session).handleOpts, open: true},
+        "NOOP": {handle: (*session).handleNoop, open: true},
+        "QUIT": {handle: (*session).handleQuit, open: true},
+        "HELP": {handle: (*session).handleHelp, open: true},
+        "TYPE": {handle: (*session).handleType},
+        "MODE": {handle: (*session).handleMode},
+        "STRU": {handle: (*session).handleStru},
+        "ALLO": {handle: (*session).handleAllo},
+        "ABOR": {handle: (*session).handleAbor},
+        "PWD":  {handle: (*session).handlePwd},
+        "XPWD": {handle: (*session).handlePwd},
+        "CWD":  {handle: (*session).handleCwd},
+        "XCWD": {handle: (*session).handleCwd},
+        "CDUP": {handle: (*session).handleCdup},
+        "XCUP": {handle: (*session).handleCdup},
+        "MKD":  {handle: (*session).handleMkd},
+        "XMKD": {handle: (*session).handleMkd},
+        "RMD":  {handle: (*session).handleRmd},
+        "XRMD": {handle: (*session).handleRmd},
+        "DELE": {handle: (*session).handleDele},
+        "RNFR": {handle: (*session).handleRnfr},
+        "RNTO": {handle: (*session).handleRnto},
+        "SIZE": {handle: (*session).handleSize},
+        "MDTM": {handle: (*session).handleMdtm},
+        "MFMT": {handle: (*session).handleMfmt},
+        "REST": {handle: (*session).handleRest},
+        "PASV": {handle: (*session).handlePasv},
+        "EPSV": {handle: (*session).handleEpsv},
+        "PORT": {handle: (*session).handleActive},
+        "EPRT": {handle: (*session).handleActive},
+        "RETR": {handle: (*session).handleRetr},
+        "STOR": {handle: (*session).handleStor},
+        "APPE": {handle: (*session).handleAppe},
+        "LIST": {handle: (*session).handleList},
+        "NLST": {handle: (*session).handleNlst},
+        "MLSD": {handle: (*session).handleMlsd},
+        "MLST": {handle: (*session).handleMlst},
+    }
+}
+
+func newSession(conn net.Conn, cfg config.FTPConfig, tlsConfig *tls.Config) *session {
+    return &session{
+        raw:        conn,
+        conn:       conn,
+        reader:     bufio.NewReaderSize(conn, maxLineLength),
+        cfg:        cfg,
+        tlsConfig:  tlsConfig,
+        remoteAddr: conn.RemoteAddr().String(),
+    }
+}
+
+// close ends the session from another goroutine, e.g. on shutdown.
+func (s *session) close() {
+    s.raw.Close()
+}
+
+func (s *session) serve() {
+    defer s.raw.Close()
+    defer s.closePassive()
+
+    utils.LogSystem("FTP_CONNECT", "unknown", s.remoteAddr, "FTP connection opened")
+    s.reply(220, "LunaTransfer FTP server ready")
+
+    for !s.quit {
+        s.raw.SetReadDeadline(time.Now().Add(idleTimeout))
+        line, err := s.reader.ReadSlice('\n')
+        if err != nil {
+            var netErr net.Error
+            if errors.Is(err, bufio.ErrBufferFull) {
+                s.reply(500, "Command line too long")
+            } else if errors.As(err, &netErr) && netErr.Timeout() {
+                s.reply(421, "Idle timeout, closing connection")
+            }
+            break
+        }
+
+        name, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+        name = strings.ToUpper(name)
+        cmd, ok := commands[name]
+        switch {
+        case !ok:
+            s.reply(502, "Command not implemented")
+        case !cmd.open && s.fs == nil:
+            s.reply(530, "Please log in with USER and PASS")
+        default:
+            cmd.handle(s, arg)
+        }
+
+        // REST and RNFR only apply to the command right after them.
+        if name != "REST" {
+            s.restart = 0
+        }
+        if name != "RNFR" {
+            s.renameFrom = ""
+        }
+    }
+
+    if s.fs != nil {
+        utils.LogSystem("FTP_LOGOUT", s.user, s.remoteAddr, "FTP session closed")
+    } else {
+        utils.LogSystem("FTP_DISCONNECT", "unknown", s.remoteAddr, "FTP connection closed without login")
+    }
+}
+
+func (s *session) reply(code int, message string) {
+    s.raw.SetWriteDeadline(time.Now().Add(idleTimeout))
+    fmt.Fprintf(s.conn, "%d %s\r\n", code, message)
+}
+
+// replyLines sends a multi-line reply; lines are indented by one space.
+func (s *session) replyLines(code int, first string, lines []string, last string) {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%d-%s\r\n", code, first)
+    for _, line := range lines {
+        fmt.Fprintf(&b, " %s\r\n", line)
+    }
+    fmt.Fprintf(&b, "%d %s\r\n", code, last)
+    s.raw.SetWriteDeadline(time.Now().Add(idleTimeout))
+    io.WriteString(s.conn, b.String())
+}
+
+// replyError answers a failed file operation.
+func (s *session) replyError(err error) {
+    switch {
+    case errors.Is(err, os.ErrNotExist):
+        s.reply(550, "No such file or directory")
+    case errors.Is(err, os.ErrPermission):
+        s.reply(550, "Permission denied")
+    case errors.Is(err, os.ErrExist):
+        s.reply(550, "File exists")
+    default:
+        utils.LogError("FTP_ERROR", err, s.user, "File operation failed")
+        s.reply(451, "Requested action aborted: local error")
+    }
+}
+
+// client identifies the protocol in logs and events.
+func (s *session) client() string {
+    if s.secure {
+        return "FTPS"
+    }
+    return "FTP"
+}
+
+// path turns a client argument into a virtual path relative to the working
+// directory.
+func (s *session) path(arg string) string {
+    if strings.HasPrefix(arg, "/") {
+        return vfs.Clean(arg)
+    }
+    return vfs.Clean(path.Join(s.cwd, arg))
+}
+
+func quote(p string) string {
+    return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+func (s *session) handleAuth(arg string) {
+    switch strings.ToUpper(arg) {
+    case "TLS", "TLS-C", "SSL":
+    default:
+        s.reply(504, "Unsupported security mechanism, use AUTH TLS")
+        return
+    }
+    if s.secure || s.fs != nil {
+        s.reply(503, "AUTH is only accepted once before login")
+        return
+    }
+    s.reply(234, "AUTH TLS successful")
+
+    tlsConn := tls.Server(s.raw, s.tlsConfig)
+    s.raw.SetDeadline(time.Now().Add(handshakeTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        utils.LogSystem("FTP_TLS_FAILED", "unknown", s.remoteAddr, fmt.Sprintf("TLS handshake failed: %v", err))
+        s.quit = true
+        return
+    }
+    s.raw.SetDeadline(time.Time{})
+    s.conn = tlsConn
+    s.reader = bufio.NewReaderSize(tlsConn, maxLineLength)
+    s.secure = true
+}
+
+func (s *session) handlePbsz(arg string) {
+    if !s.secure {
+        s.reply(503, "PBSZ requires AUTH TLS")
+        return
+    }
+    s.reply(200, "PBSZ=0")
+}
+
+func (s *session) handleProt(arg string) {
+    if !s.secure {
+        s.reply(503, "PROT requires AUTH TLS")
+        return
+    }
+    switch strings.ToUpper(arg) {
+    case "P":
+        s.protected = true
+        s.reply(200, "Protection level set to Private")
+    case "C":
+        if !s.cfg.AllowPlain {
+            s.reply(534, "Clear data connections are not allowed")
+            return
+        }
+        s.protected = false
+        s.reply(200, "Protection level set to Clear")
+    default:
+        s.reply(504, "Unsupported protection level")
+    }
+}
+
+func (s *session) handleUser(arg string) {
+    if !s.secure && !s.cfg.AllowPlain {
+        s.reply(530, "TLS required, use AUTH TLS first")
+        return
+    }
+    if s.fs != nil {
+        s.reply(530, "Already logged in")
+        return
+    }
+    s.user = arg
+    s.reply(331, "Password required for "+arg)
+}
+
+func (s *session) handlePass(arg string) {
+    if s.fs != nil {
+        s.reply(230, "Already logged in")
+        return
+    }
+    if s.user == "" {
+        s.reply(503, "Login with USER first")
+        return
+    }
+
+    if _, _, err := auth.AuthenticateUser(s.user, arg); err != nil {
+        utils.LogSystem("FTP_LOGIN_FAILED", s.user, s.remoteAddr, fmt.Sprintf("Failed %s password login", s.client()))
+        s.user = ""
+        s.failures++
+        // Slow down password guessing on the same connection.
+        time.Sleep(time.Second)
+        if s.failures >= maxLoginFailures {
+            s.reply(421, "Too many failed logins, closing connection")
+            s.quit = true
+            return
+        }
+        s.reply(530, "Login incorrect")
+        return
+    }
+    if err := partners.CheckAccess(s.user, partners.ProtocolFTP, s.remoteAddr); err != nil {
+        s.user = ""
+        s.reply(530, "Access denied")
+        return
+    }
+
+    fs, err := vfs.New(s.user, s.remoteAddr, s.client())
+    if err != nil {
+        utils.LogError("FTP_ERROR", err, s.user, "Failed to open user storage")
+        s.reply(421, "Service not available, closing connection")
+        s.quit = true
+        return
+    }
+    s.fs = fs
+    s.cwd = "/" + vfs.HomeDir
+    utils.LogSystem("FTP_LOGIN", s.user, s.remoteAddr, fmt.Sprintf("Logged in with password using %s", s.client()))
+    s.reply(230, "Logged in, home is "+s.cwd)
+}
+
+func (s *session) handleFeat(arg string) {
+    s.replyLines(211, "Features:", []string{
+        "AUTH TLS",
+        "PBSZ",
+        "PROT",
+        "EPSV",
+        "PASV",
+        "SIZE",
+        "MDTM",
+        "MFMT",
+        "REST STREAM",
+        "MLST type*;size*;modify*;",
+        "UTF8",
+    }, "End")
+}
+
+func (s *session) handleSyst(arg string) {
+    s.reply(215, "UNIX Type: L8")
+}
+
+func (s *session) handleOpts(arg string) {
+    if strings.HasPrefix(strings.ToUpper(arg), "UTF8") {
+        s.reply(200, "UTF8 mode is always on")
+        return
+    }
+    s.reply(501, "Option not understood")
+}
+
+func (s *session) handleNoop(arg string) {
+    s.reply(200, "OK")
+}
+
+func (s *session) handleQuit(arg string) {
+    s.reply(221, "Goodbye")
+    s.quit = true
+}
+
+func (s *session) handleHelp(arg string) {
+    s.reply(214, "See FEAT for supported extensions")
+}
+
+// handleType accepts ASCII for compatibility but always transfers files
+// unchanged, as most servers do today.
+func (s *session) handleType(arg string) {
+    switch strings.ToUpper(strings.TrimSpace(arg)) {
+    case "A", "A N", "I", "L 8":
+        s.reply(200, "Type set to "+arg)
+    default:
+        s.reply(504, "Unsupported type")
+    }
+}
+
+func (s *session) handleMode(arg string) {
+    if strings.ToUpper(arg) != "S" {
+        s.reply(504, "Only stream mode is supported")
+        return
+    }
+    s.reply(200, "Mode set to S")
+}
+
+func (s *session) handleStru(arg string) {
+    if strings.ToUpper(arg) != "F" {
+        s.reply(504, "Only file structure is supported")
+        return
+    }
+    s.reply(200, "Structure set to F")
+}
+
+func (s *session) handleAllo(arg string) {
+    s.reply(202, "No storage allocation necessary")
+}
+
+// handleAbor has nothing to abort: commands are only read between transfers.
+func (s *session) handleAbor(arg string) {
+    s.reply(226, "No transfer in progress")
+}
+
+func (s *session) handlePwd(arg string) {
+    s.reply(257, quote(s.cwd)+" is the current directory")
+}
+
+func (s *session) handleCwd(arg string) {
+    p := s.path(arg)
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if !info.IsDir() {
+        s.reply(550, "Not a directory")
+        return
+    }
+    s.cwd = p
+    s.reply(250, "Directory changed to "+p)
+}
+
+func (s *session) handleCdup(arg string) {
+    s.handleCwd("..")
+}
+
+func (s *session) handleMkd(arg string) {
+    p := s.path(arg)
+    if err := s.fs.Mkdir(p); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(257, quote(p)+" created")
+}
+
+func (s *session) handleRmd(arg string) {
+    p := s.path(arg)
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if !info.IsDir() {
+        s.reply(550, "Not a directory")
+        return
+    }
+    if err := s.fs.Remove(p); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(250, "Directory removed")
+}
+
+func (s *session) handleDele(arg string) {
+    p := s.path(arg)
+    info, err := s.fs.Stat(p)
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if info.IsDir() {
+        s.reply(550, "Is a directory, use RMD")
+        return
+    }
+    if err := s.fs.Remove(p); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(250, "File deleted")
+}
+
+func (s *session) handleRnfr(arg string) {
+    p := s.path(arg)
+    if _, err := s.fs.Stat(p); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.renameFrom = p
+    s.reply(350, "Ready for RNTO")
+}
+
+// handleRnto replaces an existing target, as FTP servers commonly do; vfs
+// still requires delete permission on it.
+func (s *session) handleRnto(arg string) {
+    if s.renameFrom == "" {
+        s.reply(503, "RNFR required first")
+        return
+    }
+    if err := s.fs.Rename(s.renameFrom, s.path(arg), true); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(250, "Rename successful")
+}
+
+func (s *session) handleSize(arg string) {
+    info, err := s.fs.Stat(s.path(arg))
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    if info.IsDir() {
+        s.reply(550, "Not a regular file")
+        return
+    }
+    s.reply(213, strconv.FormatInt(info.Size(), 10))
+}
+
+func (s *session) handleMdtm(arg string) {
+    info, err := s.fs.Stat(s.path(arg))
+    if err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(213, info.ModTime().UTC().Format(timeFormat))
+}
+
+// handleMfmt sets the modification time, e.g. "MFMT 20240102030405 file".
+func (s *session) handleMfmt(arg string) {
+    value, name, ok := strings.Cut(arg, " ")
+    mtime, err := time.ParseInLocation(timeFormat, value, time.UTC)
+    if !ok || err != nil {
+        s.reply(501, "Usage: MFMT YYYYMMDDHHMMSS path")
+        return
+    }
+    p := s.path(name)
+    if err := s.fs.Chtimes(p, mtime, mtime); err != nil {
+        s.replyError(err)
+        return
+    }
+    s.reply(213, fmt.Sprintf("Modify=%s; %s", value, p))
+}
+
+func (s *session) handleRest(arg string) {
+    offset, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil || offset < 0 {
+        s.reply(501, "Invalid restart offset")
+        return
+    }
+    s.restart = offset
+    s.reply(350, fmt.Sprintf("Restarting at %d", offset))
+}
+
+func (s *session) handleActive(arg string) {
+    s.reply(502, "Active mode is not supported, use PASV or EPSV")
+}
@@ -0,0 +1,164 @@
+package ftpd
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/partners"
+    "crypto/tls"
+    "net"
+    "net/textproto"
+    "path/filepath"
+    "testing"
+)
+
+const testPassword = "Ftp1234567"
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, []testenv.User{
+        {Username: "ftpuser", Password: testPassword, Email: "ftp@example.com", Role: auth.RoleUser},
+        {Username: "partnerlocal", Password: testPassword, Email: "local@example.com", Role: auth.RoleUser},
+        {Username: "partnerremote", Password: testPassword, Email: "remote@example.com", Role: auth.RoleUser},
+        {Username: "partnersftp", Password: testPassword, Email: "sftp@example.com", Role: auth.RoleUser},
+    }, setup)
+}
+
+func setup() error {
+    for _, p := range []partners.Partner{
+        {Name: "Local", Users: []string{"partnerlocal"}, Protocols: []string{partners.ProtocolFTP}, IPRanges: []string{"127.0.0.0/8"}},
+        {Name: "Remote", Users: []string{"partnerremote"}, IPRanges: []string{"192.0.2.0/24"}},
+        {Name: "SFTP only", Users: []string{"partnersftp"}, Protocols: []string{partners.ProtocolSFTP}},
+    } {
+        p.Normalize()
+        if err := p.Validate(); err != nil {
+            return err
+        }
+        if err := partners.CreatePartner(&p, "admin"); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// startServer serves FTP on a loopback port until the test ends and returns
+// its address.
+func startServer(t *testing.T, allowPlain bool) string {
+    t.Helper()
+    dir := t.TempDir()
+    tlsConfig, err := loadTLSConfig(filepath.Join(dir, "ftp.crt"), filepath.Join(dir, "ftp.key"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    cfg := config.FTPConfig{AllowPlain: allowPlain}
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go newSession(conn, cfg, tlsConfig).serve()
+        }
+    }()
+    return listener.Addr().String()
+}
+
+// connect opens a control connection, switching to TLS when secure is set.
+func connect(t *testing.T, addr string, secure bool) *textproto.Conn {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    text := textproto.NewConn(conn)
+    t.Cleanup(func() { text.Close() })
+    expect(t, text, "", 220)
+    if !secure {
+        return text
+    }
+
+    expect(t, text, "AUTH TLS", 234)
+    tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+    if err := tlsConn.Handshake(); err != nil {
+        t.Fatal(err)
+    }
+    text = textproto.NewConn(tlsConn)
+    t.Cleanup(func() { text.Close() })
+    return text
+}
+
+// expect sends command, unless it is empty, and checks the reply code.
+func expect(t *testing.T, text *textproto.Conn, command string, code int) string {
+    t.Helper()
+    if command != "" {
+        if err := text.PrintfLine("%s", command); err != nil {
+            t.Fatal(err)
+        }
+    }
+    got, message, err := text.ReadResponse(0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != code {
+        t.Fatalf("%q: got %d %s, want %d", command, got, message, code)
+    }
+    return message
+}
+
+func TestLoginRequiresTLS(t *testing.T) {
+    addr := startServer(t, false)
+
+    plain := connect(t, addr, false)
+    expect(t, plain, "USER ftpuser", 530)
+    expect(t, plain, "PWD", 530)
+
+    secure := connect(t, addr, true)
+    expect(t, secure, "PWD", 530)
+    expect(t, secure, "USER ftpuser", 331)
+    expect(t, secure, "PASS "+testPassword, 230)
+    expect(t, secure, "PWD", 257)
+    expect(t, secure, "PROT C", 534)
+}
+
+func TestPlainLoginWhenAllowed(t *testing.T) {
+    addr := startServer(t, true)
+
+    text := connect(t, addr, false)
+    expect(t, text, "USER ftpuser", 331)
+    expect(t, text, "PASS "+testPassword, 230)
+}
+
+func TestWrongPassword(t *testing.T) {
+    addr := startServer(t, false)
+
+    text := connect(t, addr, true)
+    expect(t, text, "PASS "+testPassword, 503)
+    expect(t, text, "USER ftpuser", 331)
+    expect(t, text, "PASS wrong-password", 530)
+    expect(t, text, "PWD", 530)
+    // A failed login forgets the user.
+    expect(t, text, "PASS "+testPassword, 503)
+}
+
+func TestPartnerAccess(t *testing.T) {
+    addr := startServer(t, false)
+
+    tests := []struct {
+        username string
+        code     int
+    }{
+        {"partnerlocal", 230},
+        {"partnerremote", 530},
+        {"partnersftp", 530},
+    }
+    for _, tt := range tests {
+        text := connect(t, addr, true)
+        expect(t, text, "USER "+tt.username, 331)
+        expect(t, text, "PASS "+testPassword, tt.code)
+    }
+}
@@ -10,4 +10,17 @@ require golang.org/x/crypto v0.36.0
 
 require golang.org/x/time v0.11.0
 
-require github.com/golang-jwt/jwt/v5 v5.2.1
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/pkg/sftp v1.13.9
+	github.com/smallstep/pkcs7 v0.2.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/net v0.37.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+)
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+    "LunaTransfer/as2"
+    "LunaTransfer/common"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path"
+    "strconv"
+)
+
+// AS2StationHandler returns what partners need to set us up: our AS2 ID,
+// endpoint and certificate.
+func AS2StationHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    station, err := as2.LoadStation()
+    if errors.Is(err, as2.ErrDisabled) {
+        http.Error(w, "AS2 is disabled", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("AS2_ERROR", err, username, "Failed to load AS2 station")
+        http.Error(w, "Failed to load AS2 station", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "as2_id":      station.ID,
+        "url":         station.URL,
+        "certificate": station.CertificatePEM(),
+        "fingerprint": station.Fingerprint(),
+        "expires_at":  station.Certificate.NotAfter,
+    })
+}
+
+func ListAS2MessagesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    limit := 100
+    if value := query.Get("limit"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 1000 {
+            limit = n
+        }
+    }
+    messages, err := as2.ListMessages(query.Get("partner_id"), query.Get("direction"), limit)
+    if err != nil {
+        utils.LogError("AS2_ERROR", err, username, "Failed to load AS2 messages")
+        http.Error(w, "Failed to load AS2 messages", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "messages": messages,
+        "total":    len(messages),
+    })
+}
+
+// SendAS2Handler sends one file from the admin's tree to a partner now. The
+// response carries the logged message; with a synchronous MDN it tells
+// whether the partner acknowledged the file.
+func SendAS2Handler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        PartnerID string `json:"partner_id"`
+        Path      string `json:"path"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PartnerID == "" || req.Path == "" {
+        http.Error(w, "partner_id and path are required", http.StatusBadRequest)
+        return
+    }
+    partner, ok := loadPartner(w, username, req.PartnerID)
+    if !ok {
+        return
+    }
+
+    fs, err := vfs.New(username, r.RemoteAddr, "AS2 send")
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    file, err := fs.Open(vfs.Clean(req.Path))
+    if os.IsNotExist(err) {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Cannot read file: "+err.Error(), http.StatusForbidden)
+        return
+    }
+    defer file.Close()
+
+    message, err := as2.Send(partner, path.Base(req.Path), file, username)
+    utils.LogAudit("AS2_SEND", username, r.RemoteAddr,
+        fmt.Sprintf("Sent %s to partner %s (%s): %s", req.Path, partner.Name, partner.ID, message.Status))
+    if errors.Is(err, as2.ErrNoAS2) {
+        http.Error(w, fmt.Sprintf("Partner %s has no AS2 URL", partner.Name), http.StatusBadRequest)
+        return
+    }
+    if err != nil && message.ID == "" {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    status := http.StatusOK
+    if err != nil {
+        status = http.StatusBadGateway
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": err == nil,
+        "message": message,
+    })
+}
@@ -3,6 +3,7 @@ package handlers
 import (
     "LunaTransfer/common"
     "LunaTransfer/auth"
+    "LunaTransfer/events"
     "LunaTransfer/utils"
     "encoding/json"
     "fmt"
@@ -112,8 +113,17 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    utils.LogSystem("USER_CREATED", "system", r.RemoteAddr, 
-    fmt.Sprintf("User %s created with role %s", user.Username, user.Role))
+    actor, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        actor = user.Username
+    }
+    events.Publish(events.Event{
+        Type:       events.UserCreated,
+        Actor:      actor,
+        RemoteAddr: r.RemoteAddr,
+        Namespace:  "user:" + user.Username,
+        Username:   user.Username,
+    })
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(map[string]interface{}{
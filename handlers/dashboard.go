@@ -44,6 +44,14 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usage, err := models.GetUsage(username)
+	if err != nil {
+		http.Error(w, "Failed to retrieve usage", http.StatusInternalServerError)
+		return
+	}
+	stats.FilesUploaded = int(usage.FilesUploaded)
+	stats.FilesDownloaded = int(usage.FilesDownloaded)
+
 	activities, err := utils.GetUserActivity(username, 10)
 	if err != nil {
 		http.Error(w, "Failed to retrieve activity log", http.StatusInternalServerError)
@@ -60,7 +68,10 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	storageLimit := int64(1024 * 1024 * 1024) // 1GB
+	storageLimit := int64(config.DefaultUserQuota)
+	if appConfig, err := config.LoadConfig(); err == nil && appConfig.UserQuota > 0 {
+		storageLimit = appConfig.UserQuota
+	}
 	storagePercent := float64(stats.TotalSize) / float64(storageLimit) * 100
 	
 	response := DashboardResponse{
@@ -103,12 +114,6 @@ func calculateUserStats(userDir string) (FileStats, error) {
 		stats.AvgFileSize = stats.TotalSize / int64(stats.TotalFiles)
 	}
 
-	// Get upload/download counts from logs
-	// This would be more accurate with a proper database
-	// For now, we'll just approximate with dummy values
-	stats.FilesUploaded = stats.TotalFiles
-	stats.FilesDownloaded = stats.TotalFiles / 2
-
 	return stats, err
 }
 
@@ -2,7 +2,10 @@ package handlers
 
 import (
     "LunaTransfer/config"
+    "LunaTransfer/events"
     "LunaTransfer/common"
+    "LunaTransfer/models"
+    "LunaTransfer/retention"
     "LunaTransfer/utils"
     "encoding/json"
     "fmt"
@@ -47,6 +50,9 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "File or directory not found", http.StatusNotFound)
         return
     }
+    if !allowedByRetention(w, r, username, filepath.ToSlash(filepath.Join(username, cleanPath))) {
+        return
+    }
     var isDir bool
     if fileInfo.IsDir() {
         isDir = true
@@ -62,12 +68,15 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if isDir {
-        utils.LogSystem("DIRECTORY_DELETED", username, r.RemoteAddr, fmt.Sprintf("Deleted directory: %s", cleanPath))
-    } else {
-        utils.LogFileTransfer("DELETE", cleanPath, username, r.RemoteAddr, 0)
-        go utils.NotifyFileDeleted(username, cleanPath)
-    }
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: filepath.ToSlash(filepath.Join(username, cleanPath)),
+        IsDir:      isDir,
+    })
+    revokeSharesOfDeletedPath(username, r.RemoteAddr, filepath.Join(username, cleanPath))
 
     w.Header().Set("Content-Type", "application/json")
     var message string
@@ -141,6 +150,9 @@ func DeleteFileJSON(w http.ResponseWriter, r *http.Request) {
         }
         return
     }
+    if !allowedByRetention(w, r, username, filepath.ToSlash(filepath.Join(username, cleanPath))) {
+        return
+    }
     
     // Determine if it's a directory
     var isDir bool
@@ -158,13 +170,16 @@ func DeleteFileJSON(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    // Log the operation
-    if isDir {
-        utils.LogSystem("DIRECTORY_DELETED", username, r.RemoteAddr, fmt.Sprintf("Deleted directory: %s", cleanPath))
-    } else {
-        utils.LogFileTransfer("DELETE", cleanPath, username, r.RemoteAddr, 0)
-        go utils.NotifyFileDeleted(username, cleanPath)
-    }
+    // Publish the operation
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: filepath.ToSlash(filepath.Join(username, cleanPath)),
+        IsDir:      isDir,
+    })
+    revokeSharesOfDeletedPath(username, r.RemoteAddr, filepath.Join(username, cleanPath))
     
     w.Header().Set("Content-Type", "application/json")
     var message string
@@ -182,3 +197,41 @@ func DeleteFileJSON(w http.ResponseWriter, r *http.Request) {
     }
     json.NewEncoder(w).Encode(response)
 }
+
+// allowedByRetention refuses to delete what a retention policy or a legal
+// hold still keeps.
+func allowedByRetention(w http.ResponseWriter, r *http.Request, username, relPath string) bool {
+    return checkRetention(w, r, username, "delete", relPath, retention.CheckDelete(relPath))
+}
+
+// allowedToOverwrite refuses to replace a file under legal hold.
+func allowedToOverwrite(w http.ResponseWriter, r *http.Request, username, relPath string) bool {
+    return checkRetention(w, r, username, "overwrite", relPath, retention.CheckOverwrite(relPath))
+}
+
+func checkRetention(w http.ResponseWriter, r *http.Request, username, action, relPath string, err error) bool {
+    if auditAction := retention.AuditAction(err); auditAction != "" {
+        utils.LogAudit(auditAction, username, r.RemoteAddr,
+            fmt.Sprintf("Refused to %s %s: %s", action, relPath, err.Error()))
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return false
+    }
+    if err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, fmt.Sprintf("Failed to check retention of %s", relPath))
+        http.Error(w, "Failed to check retention", http.StatusInternalServerError)
+        return false
+    }
+    return true
+}
+
+// revokeSharesOfDeletedPath drops shares whose source no longer exists.
+func revokeSharesOfDeletedPath(username, remoteAddr, relPath string) {
+    removed, err := models.RemoveFileSharesUnder(relPath)
+    if err != nil {
+        utils.LogError("DELETE_ERROR", err, username, fmt.Sprintf("Failed to revoke shares of %s", relPath))
+        return
+    }
+    for _, share := range removed {
+        events.Publish(events.ShareEvent(events.ShareRemoved, username, remoteAddr, share, "source deleted"))
+    }
+}
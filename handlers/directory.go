@@ -3,6 +3,7 @@ package handlers
 import (
     "LunaTransfer/common"
     "LunaTransfer/config"
+    "LunaTransfer/events"
     "LunaTransfer/utils"
     "encoding/json"
     "fmt"
@@ -55,7 +56,14 @@ func CreateDirectoryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
     
-    utils.LogSystem("DIRECTORY_CREATED", username, r.RemoteAddr, fmt.Sprintf("Created directory: %s", filepath.Join(cleanPath, cleanName)))
+    events.Publish(events.Event{
+        Type:       events.DirectoryCreated,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: filepath.ToSlash(filepath.Join(username, cleanPath, cleanName)),
+        IsDir:      true,
+    })
     
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
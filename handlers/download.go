@@ -13,6 +13,7 @@ import (
     "strings"
     "mime"
     "LunaTransfer/auth"
+    "LunaTransfer/events"
 )
 
 func DownloadFile(w http.ResponseWriter, r *http.Request) {
@@ -50,7 +51,16 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
     var filePath string
     isGroupFile := strings.HasPrefix(filename, "groups/")
 
-    if isGroupFile {
+    if strings.HasPrefix(filename, sharedPathPrefix) {
+        _, relPath, err := resolveSharedPath(username, filename, false)
+        if err != nil {
+            utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr, 
+                fmt.Sprintf("Attempted to download shared path without access: %s", filename))
+            writeSharedPathError(w, err)
+            return
+        }
+        filePath = filepath.Join(appConfig.StorageDirectory, relPath)
+    } else if isGroupFile {
         parts := strings.SplitN(filename[7:], "/", 2)
         if len(parts) < 2 {
             utils.LogError("DOWNLOAD_ERROR", fmt.Errorf("invalid group path"), username, filename)
@@ -79,6 +89,16 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
             
             hasAccess = hasPermission
         }
+
+        if !hasAccess {
+            hasSharedAccess, err := auth.HasAccessToSharedFile(username, filename, false)
+            if err != nil {
+                utils.LogError("DOWNLOAD_ERROR", err, username, "Failed to check shared access")
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+            }
+            hasAccess = hasSharedAccess
+        }
         
         if !hasAccess {
             utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr, 
@@ -89,21 +109,9 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
         
         filePath = filepath.Join(appConfig.StorageDirectory, "groups", groupID, groupFilePath)
     } else {
-        possiblePaths := []string{
-            filepath.Join(appConfig.StorageDirectory, username, filename),
-            filepath.Join(appConfig.StorageDirectory, filename),
-        }
-        
-        var fileExists bool
-        for _, path := range possiblePaths {
-            if _, err := os.Stat(path); err == nil {
-                filePath = path
-                fileExists = true
-                break
-            }
-        }
-        
-        if !fileExists {
+        filePath = filepath.Join(appConfig.StorageDirectory, username, filename)
+        if _, err := os.Stat(filePath); err != nil {
+            // Outside the user's home the file is only reachable through a share.
             hasSharedAccess, err := auth.HasAccessToSharedFile(username, filename, false)
             if err != nil || !hasSharedAccess {
                 utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr, 
@@ -139,9 +147,39 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
     }
     defer file.Close()
 
-    w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(filename))
+    // Partners get files encrypted to their key with ?encrypt_to=<key>.
+    if r.URL.Query().Get("encrypt_to") != "" {
+        relPath, err := filepath.Rel(appConfig.StorageDirectory, filePath)
+        if err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        relPath = filepath.ToSlash(relPath)
+        groupID := ""
+        namespace, _ := events.SplitStoragePath(relPath)
+        if id, ok := strings.CutPrefix(namespace, "group:"); ok {
+            groupID = id
+        }
+
+        start := time.Now()
+        if err := encryptDownload(w, r, username, groupID, file, filepath.Base(filePath)); err != nil {
+            return
+        }
+        events.Publish(events.Event{
+            Type:       events.FileDownloaded,
+            Actor:      username,
+            RemoteAddr: r.RemoteAddr,
+            UserAgent:  r.UserAgent(),
+            SourcePath: relPath,
+            Size:       info.Size(),
+            Elapsed:    time.Since(start),
+        })
+        return
+    }
+
+    w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(filePath))
     
-    contentType := mime.TypeByExtension(filepath.Ext(filename))
+    contentType := mime.TypeByExtension(filepath.Ext(filePath))
     if contentType == "" {
         contentType = "application/octet-stream"
     }
@@ -149,15 +187,18 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
     
     w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 
-    if isGroupFile {
-        parts := strings.SplitN(filename[7:], "/", 2)
-        groupID := parts[0]
-        utils.LogSystem("GROUP_FILE_DOWNLOAD", username, r.RemoteAddr, 
-            fmt.Sprintf("Downloaded group file: %s from group %s", parts[1], groupID), time.Now().Unix())
-    } else {
-        utils.LogSystem("FILE_DOWNLOAD", username, r.RemoteAddr, 
-            fmt.Sprintf("Downloaded file: %s", filename), time.Now().Unix())
-    }
+    start := time.Now()
+    http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), file)
 
-    http.ServeContent(w, r, filepath.Base(filename), info.ModTime(), file)
+    if relPath, err := filepath.Rel(appConfig.StorageDirectory, filePath); err == nil {
+        events.Publish(events.Event{
+            Type:       events.FileDownloaded,
+            Actor:      username,
+            RemoteAddr: r.RemoteAddr,
+            UserAgent:  r.UserAgent(),
+            SourcePath: filepath.ToSlash(relPath),
+            Size:       info.Size(),
+            Elapsed:    time.Since(start),
+        })
+    }
 }
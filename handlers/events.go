@@ -0,0 +1,346 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/events"
+    "LunaTransfer/integrity"
+    "LunaTransfer/mailer"
+    "LunaTransfer/models"
+    "LunaTransfer/receipts"
+    "LunaTransfer/rules"
+    "LunaTransfer/sla"
+    "LunaTransfer/utils"
+    "LunaTransfer/webhooks"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// RegisterEventSubscribers wires every side effect of a domain event. Handlers
+// only publish; new consumers belong here.
+func RegisterEventSubscribers() {
+    events.Subscribe("log", logEvent)
+    events.Subscribe("audit", auditEvent,
+        events.FileDeleted, events.FileRenamed, events.ShareCreated, events.ShareRemoved, events.ShareExtended, events.UserCreated)
+    events.Subscribe("usage", usageEvent, events.FileUploaded, events.FileDownloaded)
+    events.Subscribe("websocket", pushEvent,
+        events.FileUploaded, events.FileDeleted, events.ShareCreated, events.ShareRemoved)
+    events.Subscribe("webhooks", webhookEvent)
+    events.Subscribe("mail", mailEvent,
+        events.FileUploaded, events.ShareCreated, events.ShareRemoved, events.ShareExpiring)
+    events.Subscribe("metadata", metadataEvent, events.FileUploaded, events.FileRenamed, events.FileDeleted)
+    events.Subscribe("integrity", integrity.HandleEvent, events.FileUploaded, events.FileRenamed, events.FileDeleted)
+    events.Subscribe("receipts", receipts.HandleEvent, events.FileUploaded, events.FileDownloaded)
+    events.Subscribe("rules", rules.HandleEvent, events.FileUploaded, events.FileRenamed)
+    events.Subscribe("sla", sla.HandleEvent, events.FileUploaded)
+}
+
+// metadataEvent keeps file metadata with its file: it follows renames, goes
+// away with the file and no longer applies once the file is overwritten.
+func metadataEvent(e events.Event) {
+    var err error
+    switch e.Type {
+    case events.FileUploaded:
+        err = models.ForgetChangedFileMetadata(e.SourcePath)
+    case events.FileRenamed:
+        err = models.MoveFileMetadata(e.PreviousSourcePath, e.SourcePath)
+    case events.FileDeleted:
+        err = models.RemoveFileMetadataUnder(e.SourcePath)
+    }
+    if err != nil {
+        utils.LogError("METADATA_ERROR", err, e.Actor, fmt.Sprintf("Failed to update metadata of %s", e.SourcePath))
+    }
+}
+
+func logEvent(e events.Event) {
+    switch e.Type {
+    case events.FileUploaded:
+        utils.LogSystem("UPLOAD_SUCCESS", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Uploaded %s to %s (size: %d bytes)", e.Path, e.Namespace, e.Size))
+        logTransfer(e, utils.OpUpload)
+    case events.FileDownloaded:
+        utils.LogSystem("FILE_DOWNLOAD", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Downloaded %s from %s", e.Path, e.Namespace))
+        logTransfer(e, utils.OpDownload)
+    case events.FileDeleted:
+        if e.IsDir {
+            utils.LogSystem("DIRECTORY_DELETED", e.Actor, e.RemoteAddr,
+                fmt.Sprintf("Deleted directory %s from %s", e.Path, e.Namespace))
+        }
+        logTransfer(e, utils.OpDelete)
+    case events.FileRenamed:
+        utils.LogSystem("FILE_RENAMED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Renamed %s to %s", e.PreviousSourcePath, e.SourcePath))
+        logTransfer(e, utils.OpRename)
+    case events.DirectoryCreated:
+        utils.LogSystem("DIRECTORY_CREATED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Created directory %s in %s", e.Path, e.Namespace))
+        logTransfer(e, utils.OpMkdir)
+    case events.ShareCreated:
+        utils.LogSystem("FILE_SHARED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Shared %s from %s to group %s with %s permission",
+                e.Path, e.Namespace, e.TargetGroup, e.Permission))
+    case events.ShareRemoved:
+        utils.LogSystem("SHARE_REMOVED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Removed share %s for %s (reason: %s)", e.ShareID, e.Path, e.Reason))
+    case events.UserCreated:
+        utils.LogSystem("USER_CREATED", "system", e.RemoteAddr,
+            fmt.Sprintf("User %s created", e.Username))
+    }
+}
+
+func logTransfer(e events.Event, op utils.TransferOperation) {
+    utils.LogTransfer(utils.TransferLog{
+        Username:    e.Actor,
+        Filename:    events.StoragePath(e.Namespace, e.Path),
+        Size:        e.Size,
+        Action:      string(op),
+        Timestamp:   e.Timestamp,
+        Success:     true,
+        RemoteIP:    e.RemoteAddr,
+        UserAgent:   e.UserAgent,
+        ElapsedTime: e.Elapsed,
+    })
+}
+
+func auditEvent(e events.Event) {
+    switch e.Type {
+    case events.FileDeleted:
+        utils.LogAudit("FILE_DELETED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Deleted %s from %s (directory: %t)", e.Path, e.Namespace, e.IsDir))
+    case events.FileRenamed:
+        utils.LogAudit("FILE_RENAMED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Renamed %s to %s (directory: %t)", e.PreviousSourcePath, e.SourcePath, e.IsDir))
+    case events.ShareCreated:
+        utils.LogAudit("SHARE_CREATED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Share %s for %s to group %s with %s permission",
+                e.ShareID, e.SourcePath, e.TargetGroup, e.Permission))
+    case events.ShareRemoved:
+        utils.LogAudit("SHARE_REVOKED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Share %s for %s to group %s revoked (reason: %s)",
+                e.ShareID, e.SourcePath, e.TargetGroup, e.Reason))
+    case events.ShareExtended:
+        previous := "never"
+        if e.PreviousExpiresAt != nil {
+            previous = e.PreviousExpiresAt.Format(time.RFC3339)
+        }
+        utils.LogAudit("SHARE_EXTENDED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Share %s for %s extended from %s to %s",
+                e.ShareID, e.SourcePath, previous, e.ExpiresAt.Format(time.RFC3339)))
+    case events.UserCreated:
+        utils.LogAudit("USER_CREATED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("User %s created", e.Username))
+    }
+}
+
+func usageEvent(e events.Event) {
+    var err error
+    if e.Type == events.FileUploaded {
+        err = models.RecordUpload(e.Actor, e.Size)
+    } else {
+        err = models.RecordDownload(e.Actor, e.Size)
+    }
+    if err != nil {
+        utils.LogError("USAGE_ERROR", err, e.Actor, fmt.Sprintf("Failed to record %s", e.Type))
+    }
+}
+
+// pushView is where a recipient sees an event: their own namespace or the
+// share through which the path reaches them.
+type pushView struct {
+    namespace string
+    path      string
+}
+
+func pushEvent(e events.Event) {
+    var notification models.Notification
+    var audience map[string]pushView
+
+    switch e.Type {
+    case events.FileUploaded:
+        notification = models.Notification{
+            Type:    models.NoteFileUploaded,
+            Message: fmt.Sprintf("New file uploaded: %s", e.Path),
+        }
+        audience = pathAudience(e.Namespace, e.Path)
+    case events.FileDeleted:
+        notification = models.Notification{
+            Type:    models.NoteFileDeleted,
+            Message: fmt.Sprintf("File deleted: %s", e.Path),
+        }
+        audience = pathAudience(e.Namespace, e.Path)
+    case events.ShareCreated:
+        notification = models.Notification{
+            Type:    models.NoteShareCreated,
+            Message: fmt.Sprintf("%s shared %s with your group", e.Actor, e.Path),
+        }
+        audience = shareAudience(e)
+    case events.ShareRemoved:
+        notification = models.Notification{
+            Type:    models.NoteShareRemoved,
+            Message: fmt.Sprintf("Share of %s was removed", e.Path),
+        }
+        if e.Reason == "expired" {
+            notification.Type = models.NoteShareExpired
+            notification.Message = fmt.Sprintf("Share of %s has expired", e.Path)
+        }
+        audience = shareAudience(e)
+    }
+
+    go func() {
+        for username, view := range audience {
+            n := notification
+            n.Namespace = view.namespace
+            n.Path = view.path
+            n.Filename = e.Path[strings.LastIndex(e.Path, "/")+1:]
+            utils.NotifyUser(username, n)
+        }
+    }()
+}
+
+// pathAudience returns everyone allowed to see namespace/p: the owner or group
+// members, plus members of groups it is shared with, who see it under the
+// share.
+func pathAudience(namespace, p string) map[string]pushView {
+    audience := make(map[string]pushView)
+    for _, username := range namespaceMembers(namespace) {
+        audience[username] = pushView{namespace: namespace, path: p}
+    }
+
+    shares, err := models.LoadFileShares()
+    if err != nil {
+        utils.LogError("NOTIFY_ERROR", err, "system", "Failed to load shares")
+        return audience
+    }
+    storagePath := events.StoragePath(namespace, p)
+    now := time.Now()
+    for _, share := range shares {
+        if share.IsExpired(now) || !share.Covers(storagePath) {
+            continue
+        }
+        inner := strings.TrimPrefix(strings.TrimPrefix(storagePath, share.SourcePath), "/")
+        for _, username := range namespaceMembers("group:" + share.TargetGroup) {
+            if _, ok := audience[username]; !ok {
+                audience[username] = pushView{namespace: "share:" + share.ID, path: inner}
+            }
+        }
+    }
+    return audience
+}
+
+// shareAudience tells the target group about the share and the source side
+// about its own item.
+func shareAudience(e events.Event) map[string]pushView {
+    audience := make(map[string]pushView)
+    for _, username := range namespaceMembers("group:" + e.TargetGroup) {
+        audience[username] = pushView{namespace: "share:" + e.ShareID}
+    }
+    if e.SharedBy != "" {
+        audience[e.SharedBy] = pushView{namespace: e.Namespace, path: e.Path}
+    }
+    return audience
+}
+
+// namespaceMembers returns the owner of a user namespace or the members of a
+// group namespace.
+func namespaceMembers(namespace string) []string {
+    groupID, ok := strings.CutPrefix(namespace, "group:")
+    if !ok {
+        return []string{strings.TrimPrefix(namespace, "user:")}
+    }
+
+    members, err := auth.GetGroupMembers(groupID)
+    if err != nil {
+        utils.LogError("NOTIFY_ERROR", err, "system", fmt.Sprintf("Failed to load members of group %s", groupID))
+        return nil
+    }
+    usernames := make([]string, 0, len(members))
+    for _, member := range members {
+        usernames = append(usernames, member.Username)
+    }
+    return usernames
+}
+
+var webhookEventTypes = map[events.Type]webhooks.EventType{
+    events.FileUploaded:   webhooks.EventUploadCompleted,
+    events.FileDownloaded: webhooks.EventDownload,
+    events.FileDeleted:    webhooks.EventFileDeleted,
+    events.ShareCreated:   webhooks.EventShareCreated,
+    events.ShareRemoved:   webhooks.EventShareRemoved,
+    events.UserCreated:    webhooks.EventUserCreated,
+}
+
+func webhookEvent(e events.Event) {
+    eventType, ok := webhookEventTypes[e.Type]
+    if !ok {
+        return
+    }
+    go webhooks.Dispatch(webhooks.Event{
+        ID:          e.ID,
+        Type:        eventType,
+        Timestamp:   e.Timestamp.UTC(),
+        Actor:       e.Actor,
+        Namespace:   e.Namespace,
+        Path:        e.Path,
+        Size:        e.Size,
+        IsDir:       e.IsDir,
+        ShareID:     e.ShareID,
+        TargetGroup: e.TargetGroup,
+        Permission:  e.Permission,
+        Reason:      e.Reason,
+        Username:    e.Username,
+    })
+}
+
+func mailEvent(e events.Event) {
+    expiresAt := ""
+    if e.ExpiresAt != nil {
+        expiresAt = e.ExpiresAt.Format(time.RFC1123)
+    }
+
+    switch e.Type {
+    case events.FileUploaded:
+        if owner, ok := strings.CutPrefix(e.Namespace, "user:"); ok {
+            go checkQuotaWarning(owner)
+        }
+        if e.ShareID != "" && e.SharedBy != "" {
+            go mailer.Notify(mailer.KindFileReceived, []string{e.SharedBy}, mailer.Data{
+                Actor: e.Actor,
+                File:  e.Path[strings.LastIndex(e.Path, "/")+1:],
+                Path:  events.StoragePath(e.Namespace, e.Path),
+                Size:  utils.FormatFileSize(e.Size),
+            })
+        }
+    case events.ShareCreated:
+        go mailer.Notify(mailer.KindShareCreated, groupRecipients(e.TargetGroup, e.Actor), mailer.Data{
+            Actor:      e.Actor,
+            File:       e.Path,
+            Path:       sharedPathPrefix + e.ShareID,
+            Group:      groupName(e.TargetGroup),
+            Permission: e.Permission,
+            ExpiresAt:  expiresAt,
+        })
+    case events.ShareRemoved:
+        // Expiry already produced a warning a day ahead.
+        if e.Reason == "expired" {
+            return
+        }
+        go mailer.Notify(mailer.KindShareRemoved, groupRecipients(e.TargetGroup, e.Actor), mailer.Data{
+            Actor: e.Actor,
+            File:  e.Path,
+            Group: groupName(e.TargetGroup),
+        })
+    case events.ShareExpiring:
+        data := mailer.Data{
+            File:      e.Path,
+            Group:     groupName(e.TargetGroup),
+            ExpiresAt: expiresAt,
+        }
+        go func() {
+            owner := data
+            owner.CanExtend = true
+            mailer.Notify(mailer.KindLinkExpiring, []string{e.SharedBy}, owner)
+            mailer.Notify(mailer.KindLinkExpiring, groupRecipients(e.TargetGroup, e.SharedBy), data)
+        }()
+    }
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+    "LunaTransfer/common"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path"
+)
+
+type ExtractRequest struct {
+    Path   string `json:"path"`
+    Folder string `json:"folder"`
+}
+
+// ExtractHandler unpacks a zip archive. Paths are those of the tree served
+// over SFTP and WebDAV, such as "/home/batch.zip" or
+// "/groups/<groupId>/inbox/batch.zip"; the folder defaults to the archive's
+// path without its extension.
+func ExtractHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req ExtractRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+        http.Error(w, "path is required", http.StatusBadRequest)
+        return
+    }
+    archive := vfs.Clean(req.Path)
+    folder := req.Folder
+    if folder == "" {
+        folder = archive[:len(archive)-len(path.Ext(archive))]
+    }
+
+    fs, err := vfs.New(username, r.RemoteAddr, "HTTP ("+r.UserAgent()+")")
+    if err != nil {
+        utils.LogError("EXTRACT_ERROR", err, username, "Failed to open user storage")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    written, err := fs.Extract(archive, folder)
+    if err != nil {
+        switch {
+        case errors.Is(err, os.ErrNotExist):
+            http.Error(w, "Archive or folder not found", http.StatusNotFound)
+        case errors.Is(err, os.ErrPermission):
+            http.Error(w, "Access denied", http.StatusForbidden)
+        case errors.Is(err, os.ErrExist):
+            http.Error(w, fmt.Sprintf("Extracted %d files, then found an existing file", written), http.StatusConflict)
+        case errors.Is(err, vfs.ErrInvalidArchive):
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        case errors.Is(err, utils.ErrQuotaExceeded):
+            http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+        default:
+            utils.LogError("EXTRACT_ERROR", err, username, fmt.Sprintf("Failed to extract %s", archive))
+            http.Error(w, "Failed to extract archive", http.StatusInternalServerError)
+        }
+        return
+    }
+
+    utils.LogSystem("ARCHIVE_EXTRACTED", username, r.RemoteAddr,
+        fmt.Sprintf("Extracted %d files from %s into %s", written, archive, vfs.Clean(folder)))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "files":   written,
+        "folder":  vfs.Clean(folder),
+    })
+}
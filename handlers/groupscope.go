@@ -0,0 +1,79 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/utils"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// Webhooks, shares and similar records belong either to a group, whose
+// admins manage them, or to the whole site, which only site admins manage.
+
+// canManageGroupScoped reports whether username may manage a record of
+// groupID. createdBy is the user who keeps control of the record they
+// created, such as the sharer of a share, and empty for records that belong
+// to their group alone.
+func canManageGroupScoped(username, createdBy, groupID string) bool {
+    if auth.IsUserAdmin(username) || (createdBy != "" && createdBy == username) {
+        return true
+    }
+    if groupID == "" {
+        return false
+    }
+    canManage, err := auth.HasGroupPermission(username, groupID, "manage")
+    return err == nil && canManage
+}
+
+// checkGroupScopedOwner checks that username may put a record of kind, such
+// as "webhook", in groupID, or outside any group if it is empty, and
+// answers the request if not.
+func checkGroupScopedOwner(w http.ResponseWriter, r *http.Request, username, groupID, kind string) bool {
+    if groupID == "" {
+        if !auth.IsUserAdmin(username) {
+            http.Error(w, fmt.Sprintf("Access denied - only admins can add %ss outside a group", kind), http.StatusForbidden)
+            return false
+        }
+        return true
+    }
+    if _, err := auth.GetGroupByID(groupID); err != nil {
+        http.Error(w, "Group not found", http.StatusNotFound)
+        return false
+    }
+    canManage, err := auth.HasGroupPermission(username, groupID, "manage")
+    if err != nil {
+        utils.LogError(strings.ToUpper(kind)+"_ERROR", err, username, "Failed to check group permissions")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return false
+    }
+    if !canManage {
+        utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr,
+            fmt.Sprintf("Attempted to manage %ss of group %s without manage permission", kind, groupID))
+        http.Error(w, fmt.Sprintf("Access denied - only group admins can manage group %ss", kind), http.StatusForbidden)
+        return false
+    }
+    return true
+}
+
+// loadManaged loads the record of kind with id and checks that username may
+// manage it, answering the request if not. notFound is the error load
+// returns for unknown IDs and groupOf gives a record's group.
+func loadManaged[T any](w http.ResponseWriter, username, kind, id string, load func(string) (T, error), notFound error, groupOf func(T) string) (T, bool) {
+    record, err := load(id)
+    if errors.Is(err, notFound) {
+        http.Error(w, strings.ToUpper(kind[:1])+kind[1:]+" not found", http.StatusNotFound)
+        return record, false
+    }
+    if err != nil {
+        utils.LogError(strings.ToUpper(kind)+"_ERROR", err, username, "Failed to load "+kind)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return record, false
+    }
+    if !canManageGroupScoped(username, "", groupOf(record)) {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return record, false
+    }
+    return record, true
+}
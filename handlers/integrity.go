@@ -0,0 +1,106 @@
+package handlers
+
+import (
+    "LunaTransfer/common"
+    "LunaTransfer/config"
+    "LunaTransfer/integrity"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+)
+
+// StartScrubHandler starts a scrub now. It runs in the background; poll its
+// report for the outcome.
+func StartScrubHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    report, err := integrity.StartScrub(integrity.TriggerManual, username)
+    if errors.Is(err, integrity.ErrScrubRunning) {
+        http.Error(w, "A scrub is already running", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, username, "Failed to start scrub")
+        http.Error(w, "Failed to start scrub", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("INTEGRITY_SCRUB_REQUESTED", username, r.RemoteAddr, "Scrub "+report.ID+" started")
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "report":  report,
+    })
+}
+
+// ListScrubReportsHandler returns the latest reports newest first, with the
+// scrubber's schedule and whether a scrub is running.
+func ListScrubReportsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    limit := 20
+    if value := r.URL.Query().Get("limit"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 50 {
+            limit = n
+        }
+    }
+    reports, err := integrity.ListReports(limit)
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, username, "Failed to load scrub reports")
+        http.Error(w, "Failed to load scrub reports", http.StatusInternalServerError)
+        return
+    }
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "enabled":    appConfig.Scrub.Enabled,
+        "schedule":   appConfig.Scrub.Schedule,
+        "quarantine": appConfig.Scrub.Quarantine,
+        "repair":     appConfig.Scrub.ReplicaDirectory != "",
+        "next_run":   integrity.NextScrub(),
+        "running":    integrity.Running(),
+        "reports":    reports,
+        "total":      len(reports),
+    })
+}
+
+func GetScrubReportHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    report, err := integrity.GetReport(mux.Vars(r)["reportId"])
+    if errors.Is(err, integrity.ErrReportNotFound) {
+        http.Error(w, "Scrub report not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, username, "Failed to load scrub report")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
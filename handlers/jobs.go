@@ -0,0 +1,292 @@
+package handlers
+
+import (
+    "LunaTransfer/common"
+    "LunaTransfer/jobs"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// JobView is a job as returned by the API, without credentials.
+type JobView struct {
+    jobs.Job
+    Running bool       `json:"running"`
+    NextRun *time.Time `json:"next_run,omitempty"`
+    LastRun *jobs.Run  `json:"last_run,omitempty"`
+}
+
+func jobView(job jobs.Job) JobView {
+    view := JobView{
+        Job:     job.Redacted(),
+        Running: jobs.IsRunning(job.ID),
+        NextRun: jobs.NextRun(job),
+    }
+    if runs, err := jobs.ListRuns(job.ID); err == nil && len(runs) > 0 {
+        view.LastRun = &runs[0]
+    }
+    return view
+}
+
+// CreateJobHandler defines a scheduled transfer job. Jobs run as their
+// creator, so the creator needs write access to the folder of a pull job and
+// read access to the folder of a push job.
+func CreateJobHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job := jobs.Job{Enabled: true}
+    if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if !checkGroupScopedOwner(w, r, username, job.GroupID, "job") {
+        return
+    }
+
+    now := time.Now()
+    job.ID = utils.GenerateUUID()
+    job.CreatedBy = username
+    job.CreatedAt = now
+    job.UpdatedAt = now
+    job.Normalize()
+    if err := job.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := jobs.CreateJob(job); err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to save transfer job")
+        http.Error(w, "Failed to save job", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("JOB_CREATED", username, r.RemoteAddr,
+        fmt.Sprintf("Job %s (%s) %s %q on %q (group: %q)", job.ID, job.Name, job.Direction, job.Schedule, job.LocalPath, job.GroupID))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "job":     jobView(job),
+    })
+}
+
+func ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    all, err := jobs.ListJobs()
+    if err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to load transfer jobs")
+        http.Error(w, "Failed to load jobs", http.StatusInternalServerError)
+        return
+    }
+
+    visible := []JobView{}
+    for _, job := range all {
+        if canManageGroupScoped(username, "", job.GroupID) {
+            visible = append(visible, jobView(job))
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "jobs":  visible,
+        "total": len(visible),
+    })
+}
+
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job, ok := loadManagedJob(w, username, mux.Vars(r)["jobId"])
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "job": jobView(job),
+    })
+}
+
+// UpdateJobHandler changes the fields given in the body and keeps the others.
+// Credentials sent back redacted keep their stored value.
+func UpdateJobHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    existing, ok := loadManagedJob(w, username, mux.Vars(r)["jobId"])
+    if !ok {
+        return
+    }
+
+    job := existing
+    job.Remote.Headers = nil
+    if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if job.GroupID != existing.GroupID && !checkGroupScopedOwner(w, r, username, job.GroupID, "job") {
+        return
+    }
+
+    if job.Remote.Password == jobs.RedactedSecret {
+        job.Remote.Password = existing.Remote.Password
+    }
+    if job.Remote.PrivateKey == jobs.RedactedSecret {
+        job.Remote.PrivateKey = existing.Remote.PrivateKey
+    }
+    if job.Remote.Headers == nil {
+        job.Remote.Headers = existing.Remote.Headers
+    }
+    for name, value := range job.Remote.Headers {
+        if value == jobs.RedactedSecret {
+            job.Remote.Headers[name] = existing.Remote.Headers[name]
+        }
+    }
+    // A pinned host key belongs to the old server.
+    if (job.Remote.Host != existing.Remote.Host || job.Remote.Port != existing.Remote.Port) &&
+        job.Remote.HostKey == existing.Remote.HostKey {
+        job.Remote.HostKey = ""
+    }
+
+    job.ID = existing.ID
+    job.CreatedBy = existing.CreatedBy
+    job.CreatedAt = existing.CreatedAt
+    job.UpdatedAt = time.Now()
+    job.Normalize()
+    if err := job.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := jobs.UpdateJob(job); err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to update transfer job")
+        http.Error(w, "Failed to update job", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("JOB_UPDATED", username, r.RemoteAddr,
+        fmt.Sprintf("Job %s (%s) updated: %s %q on %q, enabled: %t", job.ID, job.Name, job.Direction, job.Schedule, job.LocalPath, job.Enabled))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "job":     jobView(job),
+    })
+}
+
+func DeleteJobHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job, ok := loadManagedJob(w, username, mux.Vars(r)["jobId"])
+    if !ok {
+        return
+    }
+
+    if err := jobs.DeleteJob(job.ID); err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to delete transfer job")
+        http.Error(w, "Failed to delete job", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("JOB_DELETED", username, r.RemoteAddr,
+        fmt.Sprintf("Job %s (%s) deleted", job.ID, job.Name))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Job deleted",
+    })
+}
+
+// RunJobHandler starts a job right away, whether or not it is enabled.
+func RunJobHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job, ok := loadManagedJob(w, username, mux.Vars(r)["jobId"])
+    if !ok {
+        return
+    }
+
+    run, err := jobs.RunNow(job, username)
+    if errors.Is(err, jobs.ErrJobRunning) {
+        http.Error(w, "Job is already running", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to start transfer job")
+        http.Error(w, "Failed to start job", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("JOB_TRIGGERED", username, r.RemoteAddr,
+        fmt.Sprintf("Job %s (%s) started manually, run %s", job.ID, job.Name, run.ID))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "run":     run,
+    })
+}
+
+func ListJobRunsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job, ok := loadManagedJob(w, username, mux.Vars(r)["jobId"])
+    if !ok {
+        return
+    }
+
+    runs, err := jobs.ListRuns(job.ID)
+    if err != nil {
+        utils.LogError("JOB_ERROR", err, username, "Failed to load job runs")
+        http.Error(w, "Failed to load runs", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "runs":  runs,
+        "total": len(runs),
+    })
+}
+
+func loadManagedJob(w http.ResponseWriter, username, id string) (jobs.Job, bool) {
+    return loadManaged(w, username, "job", id, jobs.GetJob, jobs.ErrJobNotFound,
+        func(job jobs.Job) string { return job.GroupID })
+}
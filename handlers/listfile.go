@@ -12,6 +12,7 @@ import (
     "fmt"
     "LunaTransfer/utils"
     "LunaTransfer/auth"
+    "LunaTransfer/models"
 )
 
 type FileInfo struct {
@@ -51,6 +52,41 @@ func ListFiles(w http.ResponseWriter, r *http.Request) {
     }
 
     var fileLists [][]map[string]interface{}
+    if strings.HasPrefix(queryPath, sharedPathPrefix) {
+        share, relPath, err := resolveSharedPath(username, queryPath, false)
+        if err != nil {
+            utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr, 
+                fmt.Sprintf("Attempted to list shared path without access: %s", queryPath))
+            writeSharedPathError(w, err)
+            return
+        }
+        if !share.IsDir {
+            http.Error(w, "Not a directory", http.StatusBadRequest)
+            return
+        }
+
+        sharedFiles, err := listFilesInDirectory(filepath.Join(appConfig.StorageDirectory, relPath), queryPath)
+        if err != nil && !os.IsNotExist(err) {
+            utils.LogError("LIST_ERROR", err, username, fmt.Sprintf("Failed to read shared directory: %s", queryPath))
+            http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+            return
+        }
+        for _, entry := range sharedFiles {
+            entry["permission"] = share.Permission
+        }
+        if sharedFiles == nil {
+            sharedFiles = []map[string]interface{}{}
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "files": sharedFiles,
+            "path": queryPath,
+            "shareId": share.ID,
+        })
+        return
+    }
+
     if strings.HasPrefix(queryPath, "groups/") {
         parts := strings.SplitN(queryPath[7:], "/", 2)
         groupID := parts[0]
@@ -160,16 +196,24 @@ func ListFiles(w http.ResponseWriter, r *http.Request) {
         if err == nil && len(userGroups) > 0 {
             sharedSection := []map[string]interface{}{}
             
-            allShares, err := auth.LoadSharedFiles()
+            allShares, err := models.LoadFileShares()
             if err == nil {
+                now := time.Now()
                 for _, share := range allShares {
+                    if share.IsExpired(now) {
+                        continue
+                    }
                     for _, group := range userGroups {
-                        if share.GroupID == group.ID {
+                        if share.TargetGroup == group.ID {
                             sharedInfo := map[string]interface{}{
                                 "name":       filepath.Base(share.SourcePath),
-                                "path":       share.SourcePath,
+                                "path":       sharedPathPrefix + share.ID,
+                                "sourcePath": share.SourcePath,
+                                "isDir":      share.IsDir,
+                                "shareId":    share.ID,
                                 "sharedBy":   share.SharedBy,
                                 "sharedAt":   share.SharedAt,
+                                "expiresAt":  share.ExpiresAt,
                                 "groupName":  group.Name,
                                 "permission": share.Permission,
                                 "isShared":   true,
@@ -228,6 +272,13 @@ func listFilesInDirectory(dirPath, relativePath string) ([]map[string]interface{
         return nil, err
     }
 
+    // Signature checks of decrypted files are listed with them.
+    metadata, _ := models.LoadFileMetadata()
+    storageDir := ""
+    if appConfig, err := config.LoadConfig(); err == nil {
+        storageDir = appConfig.StorageDirectory
+    }
+
     var fileList []map[string]interface{}
     for _, file := range files {
         fileInfo, err := file.Info()
@@ -246,6 +297,12 @@ func listFilesInDirectory(dirPath, relativePath string) ([]map[string]interface{
             "isDir":    file.IsDir(),
             "modified": fileInfo.ModTime(),
         }
+        if relPath, err := filepath.Rel(storageDir, filepath.Join(dirPath, file.Name())); err == nil {
+            entry, ok := metadata[filepath.ToSlash(relPath)]
+            if ok && entry.PGP != nil && entry.ModTime.Equal(fileInfo.ModTime()) {
+                fileEntry["pgp"] = entry.PGP
+            }
+        }
         fileList = append(fileList, fileEntry)
     }
     return fileList, nil
@@ -2,6 +2,7 @@ package handlers
 
 import (
     "LunaTransfer/auth"
+    "LunaTransfer/partners"
     "LunaTransfer/utils"
     "encoding/json"
     "net/http"
@@ -34,6 +35,10 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Invalid username or password", http.StatusUnauthorized)
         return
     }
+    if err := partners.CheckAccess(user.Username, partners.ProtocolHTTP, r.RemoteAddr); err != nil {
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
 
     // Generate JWT token
     token, err := utils.GenerateJWT(user.Username, user.Role)
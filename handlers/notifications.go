@@ -0,0 +1,275 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/config"
+    "LunaTransfer/mailer"
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+const (
+    quotaWarningInterval = 24 * time.Hour
+    defaultInboxPageSize = 20
+    maxInboxPageSize     = 100
+)
+
+var (
+    quotaWarningsMutex sync.Mutex
+    quotaWarnings      = make(map[string]time.Time)
+)
+
+func GetNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    prefs, err := mailer.GetPreferences(username)
+    if err != nil {
+        utils.LogError("PREFERENCES_ERROR", err, username, "Failed to load notification preferences")
+        http.Error(w, "Failed to load preferences", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "preferences": prefs,
+        "kinds":       mailer.Kinds,
+    })
+}
+
+// UpdateNotificationPreferencesHandler changes only the fields sent: a
+// missing "email" keeps the current setting, and "disabled" changes only the
+// kinds it lists.
+func UpdateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    prefs, err := mailer.GetPreferences(username)
+    if err != nil {
+        utils.LogError("PREFERENCES_ERROR", err, username, "Failed to load notification preferences")
+        http.Error(w, "Failed to load preferences", http.StatusInternalServerError)
+        return
+    }
+    if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+        utils.LogError("PREFERENCES_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    prefs, err = mailer.SavePreferences(username, prefs)
+    if err != nil {
+        utils.LogError("PREFERENCES_ERROR", err, username, "Failed to save notification preferences")
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    utils.LogSystem("PREFERENCES_UPDATED", username, r.RemoteAddr, "Updated notification preferences")
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success":     true,
+        "preferences": prefs,
+    })
+}
+
+// ListNotificationsHandler pages through the caller's inbox, newest first.
+// Query parameters: page (from 1), limit and unread=true.
+func ListNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    page, err := strconv.Atoi(query.Get("page"))
+    if err != nil || page < 1 {
+        page = 1
+    }
+    limit, err := strconv.Atoi(query.Get("limit"))
+    if err != nil || limit < 1 {
+        limit = defaultInboxPageSize
+    }
+    if limit > maxInboxPageSize {
+        limit = maxInboxPageSize
+    }
+
+    items, unread, err := models.GetInbox(username, query.Get("unread") == "true")
+    if err != nil {
+        utils.LogError("INBOX_ERROR", err, username, "Failed to load notifications")
+        http.Error(w, "Failed to load notifications", http.StatusInternalServerError)
+        return
+    }
+
+    total := len(items)
+    start := (page - 1) * limit
+    if start > total {
+        start = total
+    }
+    end := start + limit
+    if end > total {
+        end = total
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "notifications": items[start:end],
+        "total":         total,
+        "unread":        unread,
+        "page":          page,
+        "limit":         limit,
+    })
+}
+
+// MarkNotificationHandler serves both /read and /unread, for one notification
+// or, with the id "all", for the whole inbox.
+func MarkNotificationHandler(read bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        username, ok := common.GetUsernameFromContext(r.Context())
+        if !ok {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+
+        id := mux.Vars(r)["notificationId"]
+        if id == "all" {
+            id = ""
+        }
+
+        err := models.MarkInbox(username, id, read)
+        if errors.Is(err, models.ErrNotificationNotFound) {
+            http.Error(w, "Notification not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            utils.LogError("INBOX_ERROR", err, username, "Failed to update notification")
+            http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "success": true,
+            "read":    read,
+        })
+    }
+}
+
+func DeleteNotificationHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    err := models.DeleteFromInbox(username, mux.Vars(r)["notificationId"])
+    if errors.Is(err, models.ErrNotificationNotFound) {
+        http.Error(w, "Notification not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("INBOX_ERROR", err, username, "Failed to delete notification")
+        http.Error(w, "Failed to delete notification", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Notification deleted",
+    })
+}
+
+func MailQueueHandler(w http.ResponseWriter, r *http.Request) {
+    messages, err := mailer.ListQueue()
+    if err != nil {
+        utils.LogError("ADMIN_ERROR", err, "admin", "Failed to load mail queue")
+        http.Error(w, "Failed to load mail queue", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "messages": messages,
+        "total":    len(messages),
+    })
+}
+
+// groupRecipients returns the members of groupID except the acting user.
+func groupRecipients(groupID, exclude string) []string {
+    members, err := auth.GetGroupMembers(groupID)
+    if err != nil {
+        utils.LogError("NOTIFY_ERROR", err, "system", fmt.Sprintf("Failed to load members of group %s", groupID))
+        return nil
+    }
+
+    var usernames []string
+    for _, member := range members {
+        if member.Username != exclude {
+            usernames = append(usernames, member.Username)
+        }
+    }
+    return usernames
+}
+
+func groupName(groupID string) string {
+    group, err := auth.GetGroupByID(groupID)
+    if err != nil {
+        return groupID
+    }
+    return group.Name
+}
+
+// checkQuotaWarning emails username once a day while their home directory
+// is above the configured warning threshold.
+func checkQuotaWarning(username string) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return
+    }
+    used, quota, err := utils.QuotaUsage(username)
+    if err != nil {
+        utils.LogError("QUOTA_ERROR", err, username, "Failed to calculate storage usage")
+        return
+    }
+    if quota <= 0 {
+        return
+    }
+
+    percent := int(used * 100 / quota)
+    if percent < appConfig.QuotaWarningPercent {
+        return
+    }
+
+    quotaWarningsMutex.Lock()
+    if last, ok := quotaWarnings[username]; ok && time.Since(last) < quotaWarningInterval {
+        quotaWarningsMutex.Unlock()
+        return
+    }
+    quotaWarnings[username] = time.Now()
+    quotaWarningsMutex.Unlock()
+
+    utils.LogSystem("QUOTA_WARNING", username, "localhost",
+        fmt.Sprintf("Storage usage at %d%% of quota", percent))
+
+    mailer.Notify(mailer.KindQuotaWarning, []string{username}, mailer.Data{
+        Used:    utils.FormatFileSize(used),
+        Limit:   utils.FormatFileSize(quota),
+        Percent: percent,
+    })
+}
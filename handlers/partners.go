@@ -0,0 +1,438 @@
+package handlers
+
+import (
+    "LunaTransfer/as2"
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/config"
+    "LunaTransfer/jobs"
+    "LunaTransfer/models"
+    "LunaTransfer/partners"
+    "LunaTransfer/pgp"
+    "LunaTransfer/sla"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+const partnerActivityWindow = 7 * 24 * time.Hour
+
+// CreatePartnerHandler adds a partner and provisions its group, folders and
+// group memberships. Without a group_id a group named after the partner is
+// created.
+func CreatePartnerHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var partner partners.Partner
+    if err := json.NewDecoder(r.Body).Decode(&partner); err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    partner.ID = utils.GenerateUUID()
+    partner.CreatedBy = username
+    partner.CreatedAt = now
+    partner.UpdatedAt = now
+    if !checkPartner(w, &partner) {
+        return
+    }
+
+    if err := partners.CreatePartner(&partner, username); err != nil {
+        writePartnerError(w, username, err, "Failed to create partner")
+        return
+    }
+
+    utils.LogAudit("PARTNER_CREATED", username, r.RemoteAddr,
+        fmt.Sprintf("Partner %s (%s) with group %s, users %v, protocols %v, IP ranges %v",
+            partner.ID, partner.Name, partner.GroupID, partner.Users, partner.Protocols, partner.IPRanges))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "partner": partner,
+    })
+}
+
+func ListPartnersHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    all, err := partners.ListPartners()
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load partners")
+        http.Error(w, "Failed to load partners", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "partners": all,
+        "total":    len(all),
+    })
+}
+
+func GetPartnerHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    partner, ok := loadPartner(w, username, mux.Vars(r)["partnerId"])
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "partner": partner,
+    })
+}
+
+// UpdatePartnerHandler changes the fields given in the body and keeps the
+// others, then provisions the partner again. The group cannot be changed.
+func UpdatePartnerHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    existing, ok := loadPartner(w, username, mux.Vars(r)["partnerId"])
+    if !ok {
+        return
+    }
+
+    partner := existing
+    if err := json.NewDecoder(r.Body).Decode(&partner); err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if partner.GroupID != existing.GroupID {
+        http.Error(w, "The group of a partner cannot be changed", http.StatusBadRequest)
+        return
+    }
+
+    partner.ID = existing.ID
+    partner.CreatedBy = existing.CreatedBy
+    partner.CreatedAt = existing.CreatedAt
+    partner.UpdatedAt = time.Now()
+    if !checkPartner(w, &partner) {
+        return
+    }
+
+    if err := partners.UpdatePartner(&partner, username); err != nil {
+        writePartnerError(w, username, err, "Failed to update partner")
+        return
+    }
+
+    utils.LogAudit("PARTNER_UPDATED", username, r.RemoteAddr,
+        fmt.Sprintf("Partner %s (%s) updated: status %s, users %v, protocols %v, IP ranges %v",
+            partner.ID, partner.Name, partner.Status, partner.Users, partner.Protocols, partner.IPRanges))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "partner": partner,
+    })
+}
+
+// DeletePartnerHandler removes the profile only. The group, its files and its
+// members stay, and the partner's accounts are no longer restricted.
+func DeletePartnerHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    partner, ok := loadPartner(w, username, mux.Vars(r)["partnerId"])
+    if !ok {
+        return
+    }
+    if err := partners.DeletePartner(partner.ID); err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to delete partner")
+        http.Error(w, "Failed to delete partner", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("PARTNER_DELETED", username, r.RemoteAddr,
+        fmt.Sprintf("Partner %s (%s) deleted, group %s kept", partner.ID, partner.Name, partner.GroupID))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Partner deleted",
+    })
+}
+
+type partnerTotals struct {
+    Count int   `json:"count"`
+    Bytes int64 `json:"bytes"`
+}
+
+type partnerJob struct {
+    ID        string     `json:"id"`
+    Name      string     `json:"name"`
+    Direction string     `json:"direction"`
+    Schedule  string     `json:"schedule"`
+    Enabled   bool       `json:"enabled"`
+    LastRun   *jobs.Run  `json:"last_run,omitempty"`
+}
+
+type partnerSSHKey struct {
+    Username string `json:"username"`
+    auth.SSHKey
+}
+
+// PartnerOverviewHandler puts everything about one partner on one page: the
+// profile, its accounts and keys, the files waiting in its folders, its jobs
+// with their last runs, and its latest transfers with totals for the last
+// seven days. Transfers count when they touch the partner's group folder or
+// are made by one of its accounts.
+func PartnerOverviewHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    partner, ok := loadPartner(w, username, mux.Vars(r)["partnerId"])
+    if !ok {
+        return
+    }
+    limit := 50
+    if value := r.URL.Query().Get("limit"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 1000 {
+            limit = n
+        }
+    }
+
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load config")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    group, err := auth.GetGroupByID(partner.GroupID)
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, fmt.Sprintf("Group of partner %s not found", partner.Name))
+        http.Error(w, "The partner's group no longer exists", http.StatusConflict)
+        return
+    }
+    members, err := auth.GetGroupMembers(partner.GroupID)
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load group members")
+    }
+
+    prefix := "groups/" + partner.GroupID + "/"
+    isPartners := func(activity models.FileActivity) bool {
+        if strings.HasPrefix(activity.Filename+"/", prefix) {
+            return true
+        }
+        for _, user := range partner.Users {
+            if activity.Username == user {
+                return true
+            }
+        }
+        return false
+    }
+
+    // The scan stops once it has the latest transfers and has passed the
+    // window of the totals.
+    transfers := []models.FileActivity{}
+    totals := map[string]*partnerTotals{}
+    since := time.Now().Add(-partnerActivityWindow).Unix()
+    err = utils.ScanActivity(func(activity models.FileActivity) bool {
+        if activity.Timestamp < since && len(transfers) >= limit {
+            return false
+        }
+        if !isPartners(activity) {
+            return true
+        }
+        if len(transfers) < limit {
+            transfers = append(transfers, activity)
+        }
+        if activity.Timestamp >= since {
+            if totals[activity.Operation] == nil {
+                totals[activity.Operation] = &partnerTotals{}
+            }
+            totals[activity.Operation].Count++
+            totals[activity.Operation].Bytes += activity.Size
+        }
+        return true
+    })
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to read the transfer log")
+        http.Error(w, "Failed to read the transfer log", http.StatusInternalServerError)
+        return
+    }
+
+    var lastActivity *time.Time
+    if len(transfers) > 0 {
+        last := time.Unix(transfers[0].Timestamp, 0)
+        lastActivity = &last
+    }
+
+    groupDir := filepath.Join(appConfig.StorageDirectory, "groups", partner.GroupID)
+    folders := map[string]int{}
+    for _, folder := range append([]string{partner.InboundFolder, partner.OutboundFolder}, partner.Folders...) {
+        folders[folder] = countFiles(filepath.Join(groupDir, filepath.FromSlash(folder)))
+    }
+
+    pgpKeys, err := pgp.ListKeys("group:" + partner.GroupID)
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load PGP keys")
+    }
+    for i := range pgpKeys {
+        pgpKeys[i] = pgpKeys[i].Redacted()
+    }
+    sshKeys := []partnerSSHKey{}
+    for _, user := range partner.Users {
+        keys, err := auth.GetAuthorizedKeys(user)
+        if err != nil {
+            continue
+        }
+        for _, key := range keys {
+            sshKeys = append(sshKeys, partnerSSHKey{Username: user, SSHKey: key})
+        }
+    }
+
+    partnerJobs := []partnerJob{}
+    failedJobs := 0
+    allJobs, err := jobs.ListJobs()
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load transfer jobs")
+    }
+    for _, job := range allJobs {
+        if job.GroupID != partner.GroupID {
+            continue
+        }
+        entry := partnerJob{ID: job.ID, Name: job.Name, Direction: job.Direction, Schedule: job.Schedule, Enabled: job.Enabled}
+        if runs, err := jobs.ListRuns(job.ID); err == nil && len(runs) > 0 {
+            entry.LastRun = &runs[0]
+            if runs[0].Status == jobs.RunFailed {
+                failedJobs++
+            }
+        }
+        partnerJobs = append(partnerJobs, entry)
+    }
+
+    as2Messages := []as2.Message{}
+    if partner.AS2 != nil {
+        if as2Messages, err = as2.ListMessages(partner.ID, "", 10); err != nil {
+            utils.LogError("PARTNER_ERROR", err, username, "Failed to load AS2 messages")
+        }
+    }
+
+    slaHistory, err := sla.ListHistory(func(record sla.Record) bool {
+        return record.PartnerID == partner.ID
+    }, int(^uint(0)>>1))
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load SLA history")
+    }
+    slaSummary := sla.Summarize(slaHistory)
+    if len(slaHistory) > 10 {
+        slaHistory = slaHistory[:10]
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "partner": partner,
+        "group":   group,
+        "members": members,
+        "status": map[string]interface{}{
+            "state":         partner.Status,
+            "last_activity": lastActivity,
+            "last_7_days":   totals,
+            "files_waiting": folders,
+            "failed_jobs":   failedJobs,
+        },
+        "keys": map[string]interface{}{
+            "pgp": pgpKeys,
+            "ssh": sshKeys,
+        },
+        "jobs":         partnerJobs,
+        "transfers":    transfers,
+        "as2_messages": as2Messages,
+        "sla": map[string]interface{}{
+            "summary": slaSummary,
+            "recent":  slaHistory,
+        },
+    })
+}
+
+// countFiles counts the files below dir.
+func countFiles(dir string) int {
+    count := 0
+    filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+        if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+            count++
+        }
+        return nil
+    })
+    return count
+}
+
+// checkPartner normalizes and validates a partner; its accounts must exist.
+func checkPartner(w http.ResponseWriter, partner *partners.Partner) bool {
+    partner.Normalize()
+    if err := partner.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return false
+    }
+    for _, user := range partner.Users {
+        if !auth.UserExists(user) {
+            http.Error(w, fmt.Sprintf("User %s not found", user), http.StatusBadRequest)
+            return false
+        }
+    }
+    return true
+}
+
+func writePartnerError(w http.ResponseWriter, username string, err error, message string) {
+    switch {
+    case errors.Is(err, partners.ErrPartnerExists), errors.Is(err, partners.ErrUserTaken), errors.Is(err, partners.ErrGroupExists),
+        errors.Is(err, partners.ErrAS2IDTaken):
+        http.Error(w, err.Error(), http.StatusConflict)
+    case errors.Is(err, partners.ErrGroupNotFound):
+        http.Error(w, "Group not found", http.StatusBadRequest)
+    default:
+        utils.LogError("PARTNER_ERROR", err, username, message)
+        http.Error(w, message, http.StatusInternalServerError)
+    }
+}
+
+func loadPartner(w http.ResponseWriter, username, id string) (partners.Partner, bool) {
+    partner, err := partners.GetPartner(id)
+    if errors.Is(err, partners.ErrPartnerNotFound) {
+        http.Error(w, "Partner not found", http.StatusNotFound)
+        return partner, false
+    }
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load partner")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return partner, false
+    }
+    return partner, true
+}
@@ -0,0 +1,456 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/models"
+    "LunaTransfer/pgp"
+    "LunaTransfer/retention"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+type ImportPGPKeyRequest struct {
+    GroupID    string `json:"group_id"`
+    Name       string `json:"name"`
+    Key        string `json:"key"`
+    Passphrase string `json:"passphrase"`
+}
+
+type GeneratePGPKeyRequest struct {
+    GroupID string `json:"group_id"`
+    Name    string `json:"name"`
+    Email   string `json:"email"`
+}
+
+// checkKeyring resolves the keyring a request is about: the caller's own, or
+// a group's. Reading a group keyring takes read permission in the group,
+// changing it takes manage permission.
+func checkKeyring(w http.ResponseWriter, r *http.Request, username, groupID, permission string) (string, bool) {
+    if groupID == "" {
+        return "user:" + username, true
+    }
+    if _, err := auth.GetGroupByID(groupID); err != nil {
+        http.Error(w, "Group not found", http.StatusNotFound)
+        return "", false
+    }
+    if auth.IsUserAdmin(username) {
+        return "group:" + groupID, true
+    }
+    allowed, err := auth.HasGroupPermission(username, groupID, permission)
+    if err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to check group permissions")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return "", false
+    }
+    if !allowed {
+        utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr,
+            fmt.Sprintf("Attempted to %s the PGP keyring of group %s", keyringVerb(permission), groupID))
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return "", false
+    }
+    return "group:" + groupID, true
+}
+
+func keyringVerb(permission string) string {
+    if permission == "manage" {
+        return "change"
+    }
+    return "read"
+}
+
+func ListPGPKeysHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    owner, ok := checkKeyring(w, r, username, r.URL.Query().Get("group_id"), "read")
+    if !ok {
+        return
+    }
+    keys, err := pgp.ListKeys(owner)
+    if err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to load PGP keys")
+        http.Error(w, "Failed to load PGP keys", http.StatusInternalServerError)
+        return
+    }
+    for i := range keys {
+        keys[i] = keys[i].Redacted()
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "keyring": owner,
+        "keys":    keys,
+        "total":   len(keys),
+    })
+}
+
+// ImportPGPKeyHandler adds an armored public key, or a key pair with its
+// passphrase, to a keyring.
+func ImportPGPKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req ImportPGPKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    owner, ok := checkKeyring(w, r, username, req.GroupID, "manage")
+    if !ok {
+        return
+    }
+    if strings.TrimSpace(req.Key) == "" {
+        http.Error(w, "key is required", http.StatusBadRequest)
+        return
+    }
+
+    key, err := pgp.Parse(req.Key, req.Passphrase)
+    if errors.Is(err, pgp.ErrNoKeySecret) {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    addPGPKey(w, r, username, owner, req.Name, key)
+}
+
+// GeneratePGPKeyHandler creates a new key pair in a keyring. Partners get its
+// public key from the response or from GET /api/pgp/keys/{keyId}.
+func GeneratePGPKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req GeneratePGPKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    owner, ok := checkKeyring(w, r, username, req.GroupID, "manage")
+    if !ok {
+        return
+    }
+    if strings.TrimSpace(req.Name) == "" {
+        http.Error(w, "name is required", http.StatusBadRequest)
+        return
+    }
+
+    key, err := pgp.Generate(req.Name, req.Email)
+    if errors.Is(err, pgp.ErrNoKeySecret) {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to generate PGP key")
+        http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+        return
+    }
+    addPGPKey(w, r, username, owner, req.Name, key)
+}
+
+func addPGPKey(w http.ResponseWriter, r *http.Request, username, owner, name string, key pgp.Key) {
+    key.ID = utils.GenerateUUID()
+    key.Owner = owner
+    key.Name = strings.TrimSpace(name)
+    if key.Name == "" && len(key.UserIDs) > 0 {
+        key.Name = key.UserIDs[0]
+    }
+    key.CreatedBy = username
+    key.CreatedAt = time.Now()
+
+    if err := pgp.AddKey(key); errors.Is(err, pgp.ErrKeyExists) {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    } else if err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to save PGP key")
+        http.Error(w, "Failed to save key", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("PGP_KEY_ADDED", username, r.RemoteAddr,
+        fmt.Sprintf("Key %s (%s, %s) added to keyring %s (private: %t)", key.ID, key.Name, key.Fingerprint, owner, key.HasPrivate))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "key":     key.Redacted(),
+    })
+}
+
+func GetPGPKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    key, ok := loadPGPKey(w, r, username, mux.Vars(r)["keyId"], "read")
+    if !ok {
+        return
+    }
+
+    // ?format=armored returns the public key alone, ready to hand to a partner.
+    if r.URL.Query().Get("format") == "armored" {
+        w.Header().Set("Content-Type", "application/pgp-keys")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.asc", key.KeyID))
+        io.WriteString(w, key.PublicKey)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "key": key.Redacted(),
+    })
+}
+
+func DeletePGPKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    key, ok := loadPGPKey(w, r, username, mux.Vars(r)["keyId"], "manage")
+    if !ok {
+        return
+    }
+    if err := pgp.DeleteKey(key.ID); err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to delete PGP key")
+        http.Error(w, "Failed to delete key", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("PGP_KEY_DELETED", username, r.RemoteAddr,
+        fmt.Sprintf("Key %s (%s, %s) removed from keyring %s", key.ID, key.Name, key.Fingerprint, key.Owner))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Key deleted",
+    })
+}
+
+func loadPGPKey(w http.ResponseWriter, r *http.Request, username, id, permission string) (pgp.Key, bool) {
+    key, err := pgp.GetKey(id)
+    if errors.Is(err, pgp.ErrKeyNotFound) {
+        http.Error(w, "Key not found", http.StatusNotFound)
+        return key, false
+    }
+    if err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to load PGP key")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return key, false
+    }
+
+    if owner, ok := strings.CutPrefix(key.Owner, "user:"); ok {
+        if owner != username && !auth.IsUserAdmin(username) {
+            http.Error(w, "Key not found", http.StatusNotFound)
+            return key, false
+        }
+        return key, true
+    }
+    _, ok := checkKeyring(w, r, username, strings.TrimPrefix(key.Owner, "group:"), permission)
+    return key, ok
+}
+
+// decryptUpload handles the "decrypt" upload option: an uploaded .pgp, .gpg
+// or .asc file is decrypted next to itself with the keyring of owner, and
+// the encrypted file is removed unless "keep_encrypted" is set. It returns
+// the storage-relative path of the file the upload ends up as, which is
+// relPath itself when nothing was decrypted. The verification is recorded
+// with the file either way. In a home folder, quotaOwner's quota applies to
+// the plaintext as it does to uploads; a plaintext that does not fit is a
+// failed decryption.
+func decryptUpload(r *http.Request, username, owner, quotaOwner, storageDir, relPath string) (string, *models.PGPVerification) {
+    name := filepath.Base(relPath)
+    if r.FormValue("decrypt") != "true" || !pgp.IsEncryptedName(name) {
+        return relPath, nil
+    }
+
+    encryptedFile := filepath.Join(storageDir, relPath)
+    plainPath := filepath.Join(filepath.Dir(relPath), pgp.PlainName(name))
+    plainFile := filepath.Join(storageDir, plainPath)
+
+    // Legal holds and minimum retention keep the encrypted upload too.
+    removeEncrypted := r.FormValue("keep_encrypted") != "true" && retention.CheckDelete(filepath.ToSlash(relPath)) == nil
+
+    var verification models.PGPVerification
+    err := retention.CheckOverwrite(filepath.ToSlash(plainPath))
+    if auditAction := retention.AuditAction(err); auditAction != "" {
+        utils.LogAudit(auditAction, username, r.RemoteAddr, fmt.Sprintf("Refused to overwrite %s: %s", plainPath, err.Error()))
+        verification.VerifiedAt = time.Now()
+    } else if err == nil {
+        limit := int64(-1)
+        if quotaOwner != "" {
+            limit, err = uploadAllowance(quotaOwner, plainFile)
+            // The space of an encrypted upload that is removed is freed.
+            if info, statErr := os.Stat(encryptedFile); limit >= 0 && removeEncrypted && statErr == nil {
+                limit += info.Size()
+            }
+        }
+        if err == nil {
+            verification, err = decryptFile(owner, encryptedFile, plainFile, limit)
+        }
+        if errors.Is(err, utils.ErrQuotaExceeded) {
+            utils.LogSystem("QUOTA_EXCEEDED", username, r.RemoteAddr,
+                fmt.Sprintf("Decrypting %s would exceed the storage quota of %s", relPath, quotaOwner))
+        }
+    }
+    verification.SourceFile = name
+    if err != nil {
+        utils.LogError("PGP_ERROR", err, username, fmt.Sprintf("Failed to decrypt upload %s", relPath))
+        verification.Error = err.Error()
+        if err := models.SetPGPVerification(relPath, verification); err != nil {
+            utils.LogError("PGP_ERROR", err, username, "Failed to record PGP verification")
+        }
+        return relPath, &verification
+    }
+    if err := models.SetPGPVerification(plainPath, verification); err != nil {
+        utils.LogError("PGP_ERROR", err, username, "Failed to record PGP verification")
+    }
+
+    if removeEncrypted {
+        if err := os.Remove(encryptedFile); err != nil {
+            utils.LogError("PGP_ERROR", err, username, fmt.Sprintf("Failed to remove %s after decryption", relPath))
+        }
+    }
+    utils.LogSystem("PGP_DECRYPTED", username, r.RemoteAddr,
+        fmt.Sprintf("Decrypted %s with keyring %s (signature: %s)", relPath, owner, verification.Signature))
+    return plainPath, &verification
+}
+
+// decryptFile writes the plaintext of src to dst through a temporary file, so
+// a failed decryption leaves nothing behind. A plaintext of more than limit
+// bytes fails with utils.ErrQuotaExceeded; a negative limit allows any size.
+func decryptFile(owner, src, dst string, limit int64) (models.PGPVerification, error) {
+    in, err := os.Open(src)
+    if err != nil {
+        return models.PGPVerification{VerifiedAt: time.Now()}, err
+    }
+    defer in.Close()
+
+    out, err := os.CreateTemp(filepath.Dir(dst), ".decrypt-*")
+    if err != nil {
+        return models.PGPVerification{VerifiedAt: time.Now()}, err
+    }
+    defer os.Remove(out.Name())
+
+    limited := &limitedWriter{w: out, left: limit}
+    verification, err := pgp.Decrypt(owner, in, limited)
+    if limited.exceeded {
+        // Decrypt reports a write error as a corrupt message.
+        err = utils.ErrQuotaExceeded
+    }
+    if closeErr := out.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return verification, err
+    }
+    if err := os.Chmod(out.Name(), 0644); err != nil {
+        return verification, err
+    }
+    return verification, os.Rename(out.Name(), dst)
+}
+
+// limitedWriter fails with utils.ErrQuotaExceeded once more than left bytes
+// are written, unless left is negative.
+type limitedWriter struct {
+    w        io.Writer
+    left     int64
+    exceeded bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+    if l.left < 0 {
+        return l.w.Write(p)
+    }
+    if int64(len(p)) > l.left {
+        l.exceeded = true
+        return 0, utils.ErrQuotaExceeded
+    }
+    n, err := l.w.Write(p)
+    l.left -= int64(n)
+    return n, err
+}
+
+// encryptDownload serves file encrypted to the keys named in "encrypt_to",
+// looked up in the keyring of the file's group first and then in the
+// caller's own. "sign=true" signs with the caller's first key pair and
+// "armor=true" returns an ASCII armored message.
+func encryptDownload(w http.ResponseWriter, r *http.Request, username, groupID string, file io.Reader, name string) error {
+    refs := strings.Split(r.URL.Query().Get("encrypt_to"), ",")
+    recipients := []pgp.Key{}
+    for _, ref := range refs {
+        ref = strings.TrimSpace(ref)
+        if ref == "" {
+            continue
+        }
+        var found pgp.Key
+        err := pgp.ErrKeyNotFound
+        if groupID != "" {
+            found, err = pgp.FindKey("group:"+groupID, ref)
+        }
+        if err != nil {
+            found, err = pgp.FindKey("user:"+username, ref)
+        }
+        if err != nil {
+            http.Error(w, fmt.Sprintf("Recipient %q not found in your keyring or the group's", ref), http.StatusBadRequest)
+            return err
+        }
+        recipients = append(recipients, found)
+    }
+    if len(recipients) == 0 {
+        http.Error(w, "encrypt_to needs at least one key", http.StatusBadRequest)
+        return fmt.Errorf("no recipients")
+    }
+
+    var signer *pgp.Key
+    if r.URL.Query().Get("sign") == "true" {
+        key, err := pgp.SigningKey("user:" + username)
+        if err != nil {
+            http.Error(w, "You have no key pair to sign with", http.StatusBadRequest)
+            return err
+        }
+        signer = &key
+    }
+
+    armored := r.URL.Query().Get("armor") == "true"
+    ext := ".pgp"
+    contentType := "application/pgp-encrypted"
+    if armored {
+        ext = ".asc"
+        contentType = "text/plain"
+    }
+    w.Header().Set("Content-Disposition", "attachment; filename="+name+ext)
+    w.Header().Set("Content-Type", contentType)
+
+    if err := pgp.Encrypt(recipients, signer, name, armored, file, w); err != nil {
+        utils.LogError("PGP_ERROR", err, username, fmt.Sprintf("Failed to encrypt download %s", name))
+        return err
+    }
+    utils.LogSystem("PGP_ENCRYPTED", username, r.RemoteAddr,
+        fmt.Sprintf("Encrypted download %s to %d recipients (signed: %t)", name, len(recipients), signer != nil))
+    return nil
+}
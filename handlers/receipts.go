@@ -0,0 +1,129 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/receipts"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// ListReceiptsHandler returns the receipts the user may see, newest first,
+// filtered by ?type=, ?user= and ?path= (a namespace-relative path prefix).
+func ListReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    limit := 100
+    if value := query.Get("limit"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 1000 {
+            limit = n
+        }
+    }
+    visible := receiptVisibility(username)
+    receiptType, user := query.Get("type"), query.Get("user")
+    prefix := strings.Trim(query.Get("path"), "/")
+
+    list, err := receipts.ListReceipts(func(receipt receipts.Receipt) bool {
+        if receiptType != "" && receipt.Type != receiptType {
+            return false
+        }
+        if user != "" && receipt.User != user {
+            return false
+        }
+        if prefix != "" && receipt.Path != prefix && !strings.HasPrefix(receipt.Path, prefix+"/") {
+            return false
+        }
+        return visible(receipt)
+    }, limit)
+    if err != nil {
+        utils.LogError("RECEIPT_ERROR", err, username, "Failed to load receipts")
+        http.Error(w, "Failed to load receipts", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "receipts": list,
+        "total":    len(list),
+    })
+}
+
+func GetReceiptHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    receipt, err := receipts.GetReceipt(mux.Vars(r)["receiptId"])
+    if errors.Is(err, receipts.ErrReceiptNotFound) || (err == nil && !receiptVisibility(username)(receipt)) {
+        http.Error(w, "Receipt not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("RECEIPT_ERROR", err, username, "Failed to load receipt")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(receipt)
+}
+
+// ReceiptPublicKeyHandler publishes the key receipts are verified with. It
+// needs no login so partners can fetch it for offline verification; with
+// ?format=pem it returns the bare PEM.
+func ReceiptPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+    key, err := receipts.LoadKey()
+    if err != nil {
+        utils.LogError("RECEIPT_ERROR", err, "system", "Failed to load receipt key")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    publicKey, err := key.PublicKeyPEM()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if r.URL.Query().Get("format") == "pem" {
+        w.Header().Set("Content-Type", "application/x-pem-file")
+        w.Write([]byte(publicKey))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "algorithm":  receipts.Algorithm,
+        "key_id":     key.ID,
+        "public_key": publicKey,
+    })
+}
+
+// receiptVisibility decides which receipts username may see: admins see all,
+// others their own and those for files in their home or their groups, which
+// is how senders learn that recipients got their files.
+func receiptVisibility(username string) func(receipts.Receipt) bool {
+    if auth.IsUserAdmin(username) {
+        return func(receipts.Receipt) bool { return true }
+    }
+    namespaces := map[string]bool{"user:" + username: true}
+    if groups, err := auth.GetUserGroups(username); err == nil {
+        for _, group := range groups {
+            namespaces["group:"+group.ID] = true
+        }
+    }
+    return func(receipt receipts.Receipt) bool {
+        return receipt.User == username || namespaces[receipt.Namespace]
+    }
+}
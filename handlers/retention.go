@@ -0,0 +1,390 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/retention"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+func CreateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    policy := retention.Policy{Enabled: true}
+    if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    policy.ID = utils.GenerateUUID()
+    policy.CreatedBy = username
+    policy.CreatedAt = now
+    policy.UpdatedAt = now
+    if !checkRetentionPolicy(w, &policy) {
+        return
+    }
+
+    if err := retention.CreatePolicy(policy); err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to save retention policy")
+        http.Error(w, "Failed to save retention policy", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("RETENTION_POLICY_CREATED", username, r.RemoteAddr, describeRetentionPolicy(policy))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "policy":  policy,
+    })
+}
+
+func ListRetentionPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    policies, err := retention.ListPolicies()
+    if err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to load retention policies")
+        http.Error(w, "Failed to load retention policies", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "policies": policies,
+        "total":    len(policies),
+    })
+}
+
+func GetRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    policy, ok := loadRetentionPolicy(w, username, mux.Vars(r)["policyId"])
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "policy": policy,
+    })
+}
+
+// UpdateRetentionPolicyHandler changes the fields given in the body and keeps
+// the others.
+func UpdateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    existing, ok := loadRetentionPolicy(w, username, mux.Vars(r)["policyId"])
+    if !ok {
+        return
+    }
+
+    policy := existing
+    if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    policy.ID = existing.ID
+    policy.CreatedBy = existing.CreatedBy
+    policy.CreatedAt = existing.CreatedAt
+    policy.UpdatedAt = time.Now()
+    if !checkRetentionPolicy(w, &policy) {
+        return
+    }
+
+    if err := retention.UpdatePolicy(policy); err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to update retention policy")
+        http.Error(w, "Failed to update retention policy", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("RETENTION_POLICY_UPDATED", username, r.RemoteAddr,
+        fmt.Sprintf("%s, was min %d days, max %d days, enabled %t",
+            describeRetentionPolicy(policy), existing.MinDays, existing.MaxDays, existing.Enabled))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "policy":  policy,
+    })
+}
+
+func DeleteRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    policy, ok := loadRetentionPolicy(w, username, mux.Vars(r)["policyId"])
+    if !ok {
+        return
+    }
+    if err := retention.DeletePolicy(policy.ID); err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to delete retention policy")
+        http.Error(w, "Failed to delete retention policy", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("RETENTION_POLICY_DELETED", username, r.RemoteAddr, describeRetentionPolicy(policy))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Retention policy deleted",
+    })
+}
+
+// RetentionReportHandler is a dry run: it lists what the enforcer would purge
+// now without deleting anything.
+func RetentionReportHandler(w http.ResponseWriter, r *http.Request) {
+    runRetention(w, r, true)
+}
+
+// EnforceRetentionHandler purges what is due now instead of waiting for the
+// hourly run.
+func EnforceRetentionHandler(w http.ResponseWriter, r *http.Request) {
+    runRetention(w, r, false)
+}
+
+func runRetention(w http.ResponseWriter, r *http.Request, dryRun bool) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    report, err := retention.Enforce(dryRun, username)
+    if err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to enforce retention policies")
+        http.Error(w, "Failed to enforce retention policies", http.StatusInternalServerError)
+        return
+    }
+
+    action := "RETENTION_ENFORCE"
+    if dryRun {
+        action = "RETENTION_REPORT"
+    }
+    utils.LogAudit(action, username, r.RemoteAddr,
+        fmt.Sprintf("%d files (%d bytes) due for purging, %d failed, %d retained, %d held, %d checked",
+            len(report.Purged), report.Bytes, len(report.Failed), report.Retained, report.Held, report.Checked))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
+
+// checkRetentionPolicy normalizes and validates a policy; its user or group
+// must exist.
+func checkRetentionPolicy(w http.ResponseWriter, policy *retention.Policy) bool {
+    policy.Normalize()
+    if err := policy.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return false
+    }
+    return checkRetentionScope(w, policy.Scope)
+}
+
+func checkRetentionScope(w http.ResponseWriter, scope retention.Scope) bool {
+    if scope.Username != "" && !auth.UserExists(scope.Username) {
+        http.Error(w, fmt.Sprintf("User %s not found", scope.Username), http.StatusBadRequest)
+        return false
+    }
+    if scope.GroupID != "" {
+        if _, err := auth.GetGroupByID(scope.GroupID); err != nil {
+            http.Error(w, "Group not found", http.StatusBadRequest)
+            return false
+        }
+    }
+    return true
+}
+
+func describeRetentionPolicy(policy retention.Policy) string {
+    return fmt.Sprintf("Retention policy %s (%s) on %s /%s: min %d days, max %d days, enabled %t",
+        policy.ID, policy.Name, policy.Namespace(), policy.Path, policy.MinDays, policy.MaxDays, policy.Enabled)
+}
+
+func loadRetentionPolicy(w http.ResponseWriter, username, id string) (retention.Policy, bool) {
+    policy, err := retention.GetPolicy(id)
+    if errors.Is(err, retention.ErrPolicyNotFound) {
+        http.Error(w, "Retention policy not found", http.StatusNotFound)
+        return policy, false
+    }
+    if err != nil {
+        utils.LogError("RETENTION_ERROR", err, username, "Failed to load retention policy")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return policy, false
+    }
+    return policy, true
+}
+
+// PlaceLegalHoldHandler preserves a user's home, a group folder or a folder
+// inside them from now on.
+func PlaceLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var hold retention.Hold
+    if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+        utils.LogError("LEGAL_HOLD_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    hold = retention.Hold{Name: hold.Name, Reason: hold.Reason, Scope: hold.Scope}
+    hold.ID = utils.GenerateUUID()
+    hold.CreatedBy = username
+    hold.CreatedAt = time.Now()
+    hold.Normalize()
+    if err := hold.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRetentionScope(w, hold.Scope) {
+        return
+    }
+
+    if err := retention.PlaceHold(hold); err != nil {
+        utils.LogError("LEGAL_HOLD_ERROR", err, username, "Failed to save legal hold")
+        http.Error(w, "Failed to save legal hold", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("LEGAL_HOLD_PLACED", username, r.RemoteAddr,
+        fmt.Sprintf("Legal hold %s (%s) on %s /%s: %s", hold.ID, hold.Name, hold.Namespace(), hold.Path, hold.Reason))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "hold":    hold,
+    })
+}
+
+// ListLegalHoldsHandler returns all holds, or with ?active=true only those
+// not yet released.
+func ListLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    holds, err := retention.ListHolds()
+    if err != nil {
+        utils.LogError("LEGAL_HOLD_ERROR", err, username, "Failed to load legal holds")
+        http.Error(w, "Failed to load legal holds", http.StatusInternalServerError)
+        return
+    }
+    if r.URL.Query().Get("active") == "true" {
+        active := []retention.Hold{}
+        for _, hold := range holds {
+            if hold.Active() {
+                active = append(active, hold)
+            }
+        }
+        holds = active
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "holds": holds,
+        "total": len(holds),
+    })
+}
+
+func GetLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    hold, err := retention.GetHold(mux.Vars(r)["holdId"])
+    if errors.Is(err, retention.ErrHoldNotFound) {
+        http.Error(w, "Legal hold not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("LEGAL_HOLD_ERROR", err, username, "Failed to load legal hold")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "hold": hold,
+    })
+}
+
+// ReleaseLegalHoldHandler lifts a hold. The hold stays on record with who
+// released it, when and why.
+func ReleaseLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        Note string `json:"note"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+    }
+
+    hold, err := retention.ReleaseHold(mux.Vars(r)["holdId"], username, req.Note)
+    switch {
+    case errors.Is(err, retention.ErrHoldNotFound):
+        http.Error(w, "Legal hold not found", http.StatusNotFound)
+        return
+    case errors.Is(err, retention.ErrHoldReleased):
+        http.Error(w, "Legal hold was already released", http.StatusConflict)
+        return
+    case err != nil:
+        utils.LogError("LEGAL_HOLD_ERROR", err, username, "Failed to release legal hold")
+        http.Error(w, "Failed to release legal hold", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("LEGAL_HOLD_RELEASED", username, r.RemoteAddr,
+        fmt.Sprintf("Legal hold %s (%s) on %s /%s released, placed by %s on %s: %s",
+            hold.ID, hold.Name, hold.Namespace(), hold.Path, hold.CreatedBy, hold.CreatedAt.Format(time.RFC3339), req.Note))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "hold":    hold,
+    })
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/partners"
+    "LunaTransfer/pgp"
+    "LunaTransfer/rules"
+    "LunaTransfer/utils"
+    "LunaTransfer/webhooks"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+// checkRuleActions checks what actions refer to: share targets must exist,
+// group rules may only call their own group's webhooks and PGP recipients
+// must be in the keyring of the rule's namespace when it names just one.
+func checkRuleActions(w http.ResponseWriter, username string, rule rules.Rule) bool {
+    for i, action := range rule.Actions {
+        switch action.Type {
+        case rules.ActionPGPEncrypt:
+            if rule.Namespace == "" || strings.ContainsAny(rule.Namespace, "*?[") {
+                continue
+            }
+            if _, err := pgp.Recipients(rule.Namespace, action.Recipients); err != nil {
+                http.Error(w, fmt.Sprintf("Action %d: %v", i+1, err), http.StatusBadRequest)
+                return false
+            }
+        case rules.ActionAS2Send:
+            partner, err := partners.GetPartner(action.PartnerID)
+            if err != nil {
+                http.Error(w, fmt.Sprintf("Action %d: partner not found", i+1), http.StatusBadRequest)
+                return false
+            }
+            if partner.AS2 == nil || partner.AS2.URL == "" {
+                http.Error(w, fmt.Sprintf("Action %d: partner %s has no AS2 URL", i+1, partner.Name), http.StatusBadRequest)
+                return false
+            }
+            if partner.GroupID != rule.GroupID && !auth.IsUserAdmin(username) {
+                http.Error(w, fmt.Sprintf("Action %d: partner belongs to another group", i+1), http.StatusForbidden)
+                return false
+            }
+        case rules.ActionShare:
+            if _, err := auth.GetGroupByID(action.TargetGroup); err != nil {
+                http.Error(w, fmt.Sprintf("Action %d: target group not found", i+1), http.StatusBadRequest)
+                return false
+            }
+        case rules.ActionWebhook:
+            if action.WebhookID == "" {
+                continue
+            }
+            sub, err := webhooks.GetSubscription(action.WebhookID)
+            if err != nil {
+                http.Error(w, fmt.Sprintf("Action %d: webhook not found", i+1), http.StatusBadRequest)
+                return false
+            }
+            if sub.GroupID != rule.GroupID && !auth.IsUserAdmin(username) {
+                http.Error(w, fmt.Sprintf("Action %d: webhook belongs to another group", i+1), http.StatusForbidden)
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// ruleView adds the keys generated for this request to the encrypt actions:
+// like webhook secrets they are only shown once.
+func ruleView(rule rules.Rule, generated map[int]string) rules.Rule {
+    for i, key := range generated {
+        rule.Actions[i].Key = key
+    }
+    return rule
+}
+
+// saveRuleError answers a failed save, which is the client's fault when an
+// action names a key of another rule.
+func saveRuleError(w http.ResponseWriter, username string, err error) {
+    if errors.Is(err, rules.ErrKeyNotFound) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    utils.LogError("RULE_ERROR", err, username, "Failed to save rule")
+    http.Error(w, "Failed to save rule", http.StatusInternalServerError)
+}
+
+// CreateRuleHandler adds a rule. Encrypt actions without a key get a new one,
+// returned in the response only; afterwards rules show key IDs.
+func CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    rule := rules.Rule{Enabled: true}
+    if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+        utils.LogError("RULE_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if !checkGroupScopedOwner(w, r, username, rule.GroupID, "rule") {
+        return
+    }
+
+    now := time.Now()
+    rule.ID = utils.GenerateUUID()
+    rule.CreatedBy = username
+    rule.CreatedAt = now
+    rule.UpdatedAt = now
+    rule.Normalize()
+    if err := rule.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRuleActions(w, username, rule) {
+        return
+    }
+
+    rule, generated, err := rules.CreateRule(rule)
+    if err != nil {
+        saveRuleError(w, username, err)
+        return
+    }
+
+    utils.LogAudit("RULE_CREATED", username, r.RemoteAddr,
+        fmt.Sprintf("Rule %s (%s) on %q with %d actions (group: %q)", rule.ID, rule.Name, rule.Namespace, len(rule.Actions), rule.GroupID))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "rule":    ruleView(rule, generated),
+    })
+}
+
+func ListRulesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    all, err := rules.ListRules()
+    if err != nil {
+        utils.LogError("RULE_ERROR", err, username, "Failed to load rules")
+        http.Error(w, "Failed to load rules", http.StatusInternalServerError)
+        return
+    }
+
+    visible := []rules.Rule{}
+    for _, rule := range all {
+        if canManageGroupScoped(username, "", rule.GroupID) {
+            visible = append(visible, rule)
+        }
+    }
+
+    response := map[string]interface{}{
+        "rules": visible,
+        "total": len(visible),
+    }
+    if auth.IsUserAdmin(username) {
+        response["dropped_events"] = rules.DroppedEvents()
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+func GetRuleHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    rule, ok := loadManagedRule(w, username, mux.Vars(r)["ruleId"])
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "rule": rule,
+    })
+}
+
+// UpdateRuleHandler changes the fields given in the body and keeps the
+// others. A given action list replaces the old one; encrypt actions keep a
+// key by giving its key_id.
+func UpdateRuleHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    existing, ok := loadManagedRule(w, username, mux.Vars(r)["ruleId"])
+    if !ok {
+        return
+    }
+
+    rule := existing
+    rule.Actions = nil
+    if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+        utils.LogError("RULE_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if rule.GroupID != existing.GroupID && !checkGroupScopedOwner(w, r, username, rule.GroupID, "rule") {
+        return
+    }
+    if rule.Actions == nil {
+        rule.Actions = existing.Actions
+    }
+    // A former group rule is no longer confined to that group.
+    if rule.GroupID != existing.GroupID && existing.GroupID != "" && rule.Namespace == "group:"+existing.GroupID {
+        rule.Namespace = ""
+    }
+
+    rule.ID = existing.ID
+    rule.CreatedBy = existing.CreatedBy
+    rule.CreatedAt = existing.CreatedAt
+    rule.UpdatedAt = time.Now()
+    rule.Normalize()
+    if err := rule.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRuleActions(w, username, rule) {
+        return
+    }
+
+    rule, generated, err := rules.UpdateRule(rule)
+    if err != nil {
+        saveRuleError(w, username, err)
+        return
+    }
+
+    utils.LogAudit("RULE_UPDATED", username, r.RemoteAddr,
+        fmt.Sprintf("Rule %s (%s) updated: %q with %d actions, enabled: %t", rule.ID, rule.Name, rule.Namespace, len(rule.Actions), rule.Enabled))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "rule":    ruleView(rule, generated),
+    })
+}
+
+func DeleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    rule, ok := loadManagedRule(w, username, mux.Vars(r)["ruleId"])
+    if !ok {
+        return
+    }
+
+    if err := rules.DeleteRule(rule.ID); err != nil {
+        utils.LogError("RULE_ERROR", err, username, "Failed to delete rule")
+        http.Error(w, "Failed to delete rule", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("RULE_DELETED", username, r.RemoteAddr,
+        fmt.Sprintf("Rule %s (%s) deleted", rule.ID, rule.Name))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Rule deleted",
+    })
+}
+
+func loadManagedRule(w http.ResponseWriter, username, id string) (rules.Rule, bool) {
+    return loadManaged(w, username, "rule", id, rules.GetRule, rules.ErrRuleNotFound,
+        func(rule rules.Rule) string { return rule.GroupID })
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "net/http"
+)
+
+// GetS3CredentialsHandler returns the access key pair for the S3 gateway. The
+// keys are derived from the user's API key and change when it is rotated.
+func GetS3CredentialsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !appConfig.S3.Enabled {
+        http.Error(w, "The S3 gateway is not enabled", http.StatusNotFound)
+        return
+    }
+
+    accessKeyID, secretKey, err := auth.S3Credentials(username)
+    if err != nil {
+        utils.LogError("S3_CREDENTIALS_ERROR", err, username, "Failed to derive S3 credentials")
+        http.Error(w, "Failed to load S3 credentials", http.StatusInternalServerError)
+        return
+    }
+    utils.LogAudit("S3_CREDENTIALS_VIEWED", username, r.RemoteAddr, "Retrieved S3 access keys")
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "access_key_id":     accessKeyID,
+        "secret_access_key": secretKey,
+        "region":            appConfig.S3.Region,
+        "port":              appConfig.S3.Port,
+    })
+}
@@ -69,7 +69,21 @@ func SearchFilesHandler(w http.ResponseWriter, r *http.Request) {
 
     userRootDir := filepath.Join(appConfig.StorageDirectory, username)
     searchDir := userRootDir
-    if searchPath != "" {
+    resultPrefix := ""
+    if strings.HasPrefix(filepath.ToSlash(searchPath), sharedPathPrefix) {
+        // Searching inside a share: results keep the virtual shared/ path so
+        // they can be listed and downloaded through the same share.
+        _, relPath, err := resolveSharedPath(username, searchPath, false)
+        if err != nil {
+            utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr, 
+                fmt.Sprintf("Attempted to search shared path without access: %s", searchPath))
+            writeSharedPathError(w, err)
+            return
+        }
+        userRootDir = filepath.Join(appConfig.StorageDirectory, relPath)
+        searchDir = userRootDir
+        resultPrefix = searchPath
+    } else if searchPath != "" {
         if strings.Contains(searchPath, "..") {
             utils.LogError("SEARCH_ERROR", fmt.Errorf("path traversal attempt"), username)
             http.Error(w, "Invalid path", http.StatusBadRequest)
@@ -126,6 +140,10 @@ func SearchFilesHandler(w http.ResponseWriter, r *http.Request) {
             return nil
         }
 
+        if resultPrefix != "" {
+            relPath = filepath.Join(resultPrefix, relPath)
+        }
+
         results = append(results, SearchResult{
             Name:        info.Name(),
             Path:        relPath,
@@ -2,9 +2,9 @@ package handlers
 
 import (
     "LunaTransfer/auth"
+    "LunaTransfer/events"
     "encoding/json"
     "net/http"
-    "os"
     "log"
     "fmt"
 )
@@ -37,6 +37,13 @@ func SetupHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, fmt.Sprintf("Failed to create admin user: %s", err), http.StatusInternalServerError)
         return
     }
+    events.Publish(events.Event{
+        Type:       events.UserCreated,
+        Actor:      req.Username,
+        RemoteAddr: r.RemoteAddr,
+        Namespace:  "user:" + req.Username,
+        Username:   req.Username,
+    })
 
     user, token, err := auth.AuthenticateUser(req.Username, req.Password)
     if err != nil {
@@ -60,17 +67,10 @@ func SetupHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func SetupStatusHandler(w http.ResponseWriter, r *http.Request) {
-    usersFile := "users.json"
-    setupCompleted := false
-    data, err := os.ReadFile(usersFile)
-    if err == nil && len(data) > 10 {
-        setupCompleted = true
-    } else {
-        setupCompleted, err = auth.IsSetupCompleted()
-        if err != nil {
-            log.Printf("Error checking setup status: %v", err)
-            setupCompleted = false
-        }
+    setupCompleted, err := auth.IsSetupCompleted()
+    if err != nil {
+        log.Printf("Error checking setup status: %v", err)
+        setupCompleted = false
     }
     
     w.Header().Set("Content-Type", "application/json")
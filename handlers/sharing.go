@@ -1,16 +1,22 @@
 package handlers
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
     "os"
     "path/filepath"
+    "strings"
     "time"
     
+    "github.com/gorilla/mux"
+    
     "LunaTransfer/auth"
     "LunaTransfer/common"
     "LunaTransfer/config"
+    "LunaTransfer/events"
     "LunaTransfer/models"
     "LunaTransfer/utils"
 )
@@ -20,6 +26,20 @@ type ShareRequest struct {
     SourceGroup  string `json:"source_group"`
     TargetGroup  string `json:"target_group"`
     Permission   string `json:"permission"`
+    ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// sharedPathPrefix is the virtual namespace recipients use to browse shares:
+// "shared/<shareId>" is the shared item and, for folders, everything below it.
+const sharedPathPrefix = "shared/"
+
+// shareExpiryWarning is how long before expiry both sides are warned.
+const shareExpiryWarning = 24 * time.Hour
+
+var errShareAccessDenied = errors.New("access to shared path denied")
+
+type ExtendShareRequest struct {
+    ExpiresAt *time.Time `json:"expires_at"`
 }
 
 type WebSocketMessage struct {
@@ -53,11 +73,25 @@ func ShareFileHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    hasPermission, err := auth.HasGroupPermission(username, req.SourceGroup, "admin")
-    if err != nil || !hasPermission {
+    if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
         utils.LogSystem("SHARE_ERROR", username, r.RemoteAddr,
-            fmt.Sprintf("No permission to share from group %s", req.SourceGroup), time.Now().Unix())
-        http.Error(w, "You don't have permission to share files from this group", http.StatusForbidden)
+            fmt.Sprintf("Expiry date in the past: %s", req.ExpiresAt.Format(time.RFC3339)), time.Now().Unix())
+        http.Error(w, "Expiry date must be in the future", http.StatusBadRequest)
+        return
+    }
+
+    if req.SourceGroup != "" {
+        hasPermission, err := auth.HasGroupPermission(username, req.SourceGroup, "manage")
+        if err != nil || !hasPermission {
+            utils.LogSystem("SHARE_ERROR", username, r.RemoteAddr,
+                fmt.Sprintf("No permission to share from group %s", req.SourceGroup), time.Now().Unix())
+            http.Error(w, "You don't have permission to share files from this group", http.StatusForbidden)
+            return
+        }
+    }
+
+    if req.SourceGroup == req.TargetGroup {
+        http.Error(w, "Cannot share within the same group", http.StatusBadRequest)
         return
     }
 
@@ -76,24 +110,19 @@ func ShareFileHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    possiblePaths := []string{
-        filepath.Join(appConfig.StorageDirectory, "groups", req.SourceGroup, req.FilePath),
-        filepath.Join(appConfig.StorageDirectory, req.FilePath),
-    }
-    
-    var fileExists bool
-    var foundFilePath string
-    for _, path := range possiblePaths {
-        if fileInfo, err := os.Stat(path); err == nil && !fileInfo.IsDir() {
-            foundFilePath = path
-            fileExists = true
-            break
-        }
+    // Group files are shared from the group directory, everything else from
+    // the sharer's own home directory.
+    sourceRoot := filepath.Join("groups", req.SourceGroup)
+    if req.SourceGroup == "" {
+        sourceRoot = username
     }
+    sourcePath := filepath.Join(sourceRoot, filepath.Clean("/"+req.FilePath))
+    foundFilePath := filepath.Join(appConfig.StorageDirectory, sourcePath)
 
-    if !fileExists {
+    fileInfo, err := os.Stat(foundFilePath)
+    if err != nil || filepath.Clean(sourcePath) == filepath.Clean(sourceRoot) {
         utils.LogSystem("SHARE_ERROR", username, r.RemoteAddr,
-            fmt.Sprintf("File not found: %s (tried paths: %v)", req.FilePath, possiblePaths), time.Now().Unix())
+            fmt.Sprintf("File not found: %s (path: %s)", req.FilePath, foundFilePath), time.Now().Unix())
         http.Error(w, "File not found", http.StatusNotFound)
         return
     }
@@ -105,34 +134,37 @@ func ShareFileHandler(w http.ResponseWriter, r *http.Request) {
     share := models.FileShare{
         ID:          shareID,
         FilePath:    req.FilePath,
+        SourcePath:  filepath.ToSlash(sourcePath),
         SourceGroup: req.SourceGroup,
         TargetGroup: req.TargetGroup,
-        Permission:  req.Permission,
+        Permission:  models.SharePermission(req.Permission),
         SharedBy:    username,
         SharedAt:    time.Now(),
+        ExpiresAt:   req.ExpiresAt,
+        IsDir:       fileInfo.IsDir(),
     }
 
     err = models.SaveFileShare(share)
+    if err == models.ErrAlreadyShared {
+        http.Error(w, "File is already shared with this group", http.StatusConflict)
+        return
+    }
     if err != nil {
         utils.LogError("SHARE_ERROR", err, username, "Failed to save share record")
         http.Error(w, "Failed to share file", http.StatusInternalServerError)
         return
     }
 
-    utils.LogSystem("NOTIFICATION", username, r.RemoteAddr,
-        fmt.Sprintf("Would notify target group %s about new shared file", req.TargetGroup), 
-        time.Now().Unix())
-
-    utils.LogSystem("FILE_SHARED", username, r.RemoteAddr,
-        fmt.Sprintf("Shared %s from group %s to group %s with %s permission",
-            req.FilePath, req.SourceGroup, req.TargetGroup, req.Permission),
-        time.Now().Unix())
+    events.Publish(events.ShareEvent(events.ShareCreated, username, r.RemoteAddr, share, ""))
 
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(map[string]interface{}{
-        "message":   "File shared successfully",
-        "share_id":  shareID,
+        "message":    "File shared successfully",
+        "share_id":   shareID,
+        "path":       sharedPathPrefix + shareID,
+        "is_dir":     share.IsDir,
+        "expires_at": share.ExpiresAt,
     })
 }
 
@@ -193,8 +225,7 @@ func RemoveShareHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    isAdmin, err := auth.HasGroupPermission(username, share.SourceGroup, "admin")
-    if err != nil || (!isAdmin && share.SharedBy != username) {
+    if !canManageGroupScoped(username, share.SharedBy, share.SourceGroup) {
         utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr,
             fmt.Sprintf("Attempted to remove share without permission: %s", shareID),
             time.Now().Unix())
@@ -209,16 +240,164 @@ func RemoveShareHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    utils.LogSystem("NOTIFICATION", username, r.RemoteAddr,
-        fmt.Sprintf("Would notify target group %s about removed share", share.TargetGroup), 
-        time.Now().Unix())
-
-    utils.LogSystem("SHARE_REMOVED", username, r.RemoteAddr,
-        fmt.Sprintf("Removed share %s for file %s", shareID, share.FilePath),
-        time.Now().Unix())
+    events.Publish(events.ShareEvent(events.ShareRemoved, username, r.RemoteAddr, share, "manual"))
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
         "message": "Share removed successfully",
     })
-}
\ No newline at end of file
+}
+
+// ExtendShareHandler gives a share that has not expired yet a new expiry in
+// the future. The sharer and those who may remove the share can extend it.
+func ExtendShareHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    shareID := mux.Vars(r)["shareId"]
+    if shareID == "" {
+        http.Error(w, "Share ID required", http.StatusBadRequest)
+        return
+    }
+
+    var req ExtendShareRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        utils.LogError("EXTEND_SHARE_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+
+    if req.ExpiresAt == nil || !req.ExpiresAt.After(time.Now()) {
+        http.Error(w, "A future expires_at is required", http.StatusBadRequest)
+        return
+    }
+
+    share, err := models.GetFileShareByID(shareID)
+    if err != nil {
+        utils.LogError("EXTEND_SHARE_ERROR", err, username,
+            fmt.Sprintf("Failed to get share: %s", shareID))
+        http.Error(w, "Share not found", http.StatusNotFound)
+        return
+    }
+
+    if !canManageGroupScoped(username, share.SharedBy, share.SourceGroup) {
+        utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr,
+            fmt.Sprintf("Attempted to extend share without permission: %s", shareID),
+            time.Now().Unix())
+        http.Error(w, "Access denied", http.StatusForbidden)
+        return
+    }
+
+    if share.IsExpired(time.Now()) {
+        http.Error(w, "Share has already expired", http.StatusGone)
+        return
+    }
+
+    previous := share.ExpiresAt
+    share.ExpiresAt = req.ExpiresAt
+    share.ExpiryNotified = false
+
+    if err := models.UpdateFileShare(share); err != nil {
+        utils.LogError("EXTEND_SHARE_ERROR", err, username,
+            fmt.Sprintf("Failed to update share: %s", shareID))
+        http.Error(w, "Failed to extend share", http.StatusInternalServerError)
+        return
+    }
+
+    event := events.ShareEvent(events.ShareExtended, username, r.RemoteAddr, share, "")
+    event.PreviousExpiresAt = previous
+    events.Publish(event)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":    "Share extended successfully",
+        "share_id":   shareID,
+        "expires_at": share.ExpiresAt,
+    })
+}
+
+// StartShareExpirySweeper removes expired shares every interval until ctx is
+// cancelled.
+func StartShareExpirySweeper(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        SweepExpiredShares()
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func SweepExpiredShares() {
+    now := time.Now()
+    expiring, err := models.MarkExpiringFileShares(now, now.Add(shareExpiryWarning))
+    if err != nil {
+        utils.LogError("SHARE_SWEEP_ERROR", err, "system", "Failed to check expiring shares")
+    }
+    for _, share := range expiring {
+        events.Publish(events.ShareEvent(events.ShareExpiring, "system", "", share, ""))
+    }
+
+    expired, err := models.RemoveExpiredFileShares(now)
+    if err != nil {
+        utils.LogError("SHARE_SWEEP_ERROR", err, "system", "Failed to remove expired shares")
+        return
+    }
+
+    for _, share := range expired {
+        events.Publish(events.ShareEvent(events.ShareRemoved, "system", "", share, "expired"))
+    }
+}
+
+// resolveSharedPath maps a virtual "shared/<shareId>/..." path onto the
+// storage-relative path it refers to, after checking username reaches it
+// through the share.
+func resolveSharedPath(username, virtualPath string, writeAccess bool) (models.FileShare, string, error) {
+    rest := strings.TrimPrefix(filepath.ToSlash(virtualPath), sharedPathPrefix)
+    parts := strings.SplitN(rest, "/", 2)
+
+    share, err := models.GetFileShareByID(parts[0])
+    if err != nil {
+        return models.FileShare{}, "", err
+    }
+    if share.IsExpired(time.Now()) {
+        return models.FileShare{}, "", models.ErrShareNotFound
+    }
+
+    relPath := share.SourcePath
+    if len(parts) > 1 && parts[1] != "" {
+        if !share.IsDir {
+            return models.FileShare{}, "", models.ErrShareNotFound
+        }
+        relPath = filepath.ToSlash(filepath.Join(share.SourcePath, filepath.Clean("/"+parts[1])))
+    }
+
+    hasAccess, err := auth.HasAccessToSharedFile(username, relPath, writeAccess)
+    if err != nil {
+        return models.FileShare{}, "", err
+    }
+    if !hasAccess {
+        return models.FileShare{}, "", errShareAccessDenied
+    }
+
+    return share, relPath, nil
+}
+
+// writeSharedPathError translates resolveSharedPath errors into responses.
+func writeSharedPathError(w http.ResponseWriter, err error) {
+    switch err {
+    case models.ErrShareNotFound:
+        http.Error(w, "Shared item not found", http.StatusNotFound)
+    case errShareAccessDenied:
+        http.Error(w, "Access denied", http.StatusForbidden)
+    default:
+        http.Error(w, "Server error", http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/partners"
+    "LunaTransfer/sla"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+func CreateSLAHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    s := sla.SLA{Enabled: true}
+    if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    s.ID = utils.GenerateUUID()
+    s.CreatedBy = username
+    s.CreatedAt = now
+    s.UpdatedAt = now
+    if !checkSLA(w, &s) {
+        return
+    }
+
+    if err := sla.CreateSLA(s); err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to save SLA")
+        http.Error(w, "Failed to save SLA", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("SLA_CREATED", username, r.RemoteAddr, describeSLA(s))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "sla":     s,
+    })
+}
+
+func ListSLAsHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    slas, err := sla.ListSLAs()
+    if err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to load SLAs")
+        http.Error(w, "Failed to load SLAs", http.StatusInternalServerError)
+        return
+    }
+    if partnerID := r.URL.Query().Get("partner_id"); partnerID != "" {
+        filtered := []sla.SLA{}
+        for _, s := range slas {
+            if s.PartnerID == partnerID {
+                filtered = append(filtered, s)
+            }
+        }
+        slas = filtered
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "slas":  slas,
+        "total": len(slas),
+    })
+}
+
+// GetSLAHandler returns the SLA with its latest windows and their tally.
+func GetSLAHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    s, ok := loadSLA(w, username, mux.Vars(r)["slaId"])
+    if !ok {
+        return
+    }
+    history, err := sla.ListHistory(func(record sla.Record) bool {
+        return record.SLAID == s.ID
+    }, int(^uint(0)>>1))
+    if err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to load SLA history")
+        http.Error(w, "Failed to load SLA history", http.StatusInternalServerError)
+        return
+    }
+    summary := sla.Summarize(history)
+    if len(history) > 10 {
+        history = history[:10]
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "sla":     s,
+        "summary": summary,
+        "recent":  history,
+    })
+}
+
+// UpdateSLAHandler changes the fields given in the body and keeps the
+// others. Windows are tracked anew from the change.
+func UpdateSLAHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    existing, ok := loadSLA(w, username, mux.Vars(r)["slaId"])
+    if !ok {
+        return
+    }
+
+    s := existing
+    if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    s.ID = existing.ID
+    s.CreatedBy = existing.CreatedBy
+    s.CreatedAt = existing.CreatedAt
+    s.UpdatedAt = time.Now()
+    if !checkSLA(w, &s) {
+        return
+    }
+
+    if err := sla.UpdateSLA(s); err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to update SLA")
+        http.Error(w, "Failed to update SLA", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("SLA_UPDATED", username, r.RemoteAddr, describeSLA(s))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "sla":     s,
+    })
+}
+
+func DeleteSLAHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    s, ok := loadSLA(w, username, mux.Vars(r)["slaId"])
+    if !ok {
+        return
+    }
+    if err := sla.DeleteSLA(s.ID); err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to delete SLA")
+        http.Error(w, "Failed to delete SLA", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("SLA_DELETED", username, r.RemoteAddr, describeSLA(s))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "SLA deleted",
+    })
+}
+
+// SLAHistoryHandler returns delivery windows newest first, filtered by
+// ?partner_id=, ?sla_id= and ?status=, with the tally of those matched.
+func SLAHistoryHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    limit := 100
+    if value := query.Get("limit"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 1000 {
+            limit = n
+        }
+    }
+    partnerID, slaID, status := query.Get("partner_id"), query.Get("sla_id"), query.Get("status")
+
+    history, err := sla.ListHistory(func(record sla.Record) bool {
+        return (partnerID == "" || record.PartnerID == partnerID) &&
+            (slaID == "" || record.SLAID == slaID) &&
+            (status == "" || record.Status == status)
+    }, int(^uint(0)>>1))
+    if err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to load SLA history")
+        http.Error(w, "Failed to load SLA history", http.StatusInternalServerError)
+        return
+    }
+    summary := sla.Summarize(history)
+    if len(history) > limit {
+        history = history[:limit]
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "summary": summary,
+        "history": history,
+        "total":   len(history),
+    })
+}
+
+// checkSLA fills in the namespace of the partner's group, then validates the
+// SLA; its namespace and the users to notify must exist.
+func checkSLA(w http.ResponseWriter, s *sla.SLA) bool {
+    s.Normalize()
+    if s.PartnerID != "" {
+        partner, err := partners.GetPartner(s.PartnerID)
+        if err != nil {
+            http.Error(w, "Partner not found", http.StatusBadRequest)
+            return false
+        }
+        if s.Namespace == "" {
+            s.Namespace = "group:" + partner.GroupID
+        }
+    }
+    if err := s.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return false
+    }
+
+    if name, ok := strings.CutPrefix(s.Namespace, "user:"); ok && !auth.UserExists(name) {
+        http.Error(w, fmt.Sprintf("User %s not found", name), http.StatusBadRequest)
+        return false
+    }
+    if groupID, ok := strings.CutPrefix(s.Namespace, "group:"); ok {
+        if _, err := auth.GetGroupByID(groupID); err != nil {
+            http.Error(w, "Group not found", http.StatusBadRequest)
+            return false
+        }
+    }
+    for _, user := range s.Notify {
+        if !auth.UserExists(user) {
+            http.Error(w, fmt.Sprintf("User %s not found", user), http.StatusBadRequest)
+            return false
+        }
+    }
+    return true
+}
+
+func describeSLA(s sla.SLA) string {
+    return fmt.Sprintf("SLA %s (%s): %s in %s on %q due %s after opening, enabled %t",
+        s.ID, s.Name, s.Pattern, s.Namespace, s.Schedule, s.Deadline, s.Enabled)
+}
+
+func loadSLA(w http.ResponseWriter, username, id string) (sla.SLA, bool) {
+    s, err := sla.GetSLA(id)
+    if errors.Is(err, sla.ErrSLANotFound) {
+        http.Error(w, "SLA not found", http.StatusNotFound)
+        return s, false
+    }
+    if err != nil {
+        utils.LogError("SLA_ERROR", err, username, "Failed to load SLA")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return s, false
+    }
+    return s, true
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/utils"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "github.com/gorilla/mux"
+)
+
+func ListSSHKeysHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    keys, err := auth.GetAuthorizedKeys(username)
+    if err != nil {
+        utils.LogError("SSH_KEY_ERROR", err, username, "Failed to load SSH keys")
+        http.Error(w, "Failed to load SSH keys", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "keys": keys,
+    })
+}
+
+func AddSSHKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        PublicKey string `json:"public_key"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PublicKey == "" {
+        http.Error(w, "public_key is required", http.StatusBadRequest)
+        return
+    }
+
+    key, err := auth.AddAuthorizedKey(username, req.PublicKey)
+    switch err {
+    case nil:
+    case auth.ErrInvalidSSHKey:
+        http.Error(w, "Invalid SSH public key", http.StatusBadRequest)
+        return
+    case auth.ErrSSHKeyExists:
+        http.Error(w, "SSH key already added", http.StatusConflict)
+        return
+    default:
+        utils.LogError("SSH_KEY_ERROR", err, username, "Failed to add SSH key")
+        http.Error(w, "Failed to add SSH key", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("SSH_KEY_ADDED", username, r.RemoteAddr,
+        fmt.Sprintf("Added %s key %s", key.Type, key.Fingerprint))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "key":     key,
+    })
+}
+
+func DeleteSSHKeyHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    keyID := mux.Vars(r)["keyId"]
+    if err := auth.RemoveAuthorizedKey(username, keyID); err != nil {
+        if err == auth.ErrSSHKeyNotFound {
+            http.Error(w, "SSH key not found", http.StatusNotFound)
+            return
+        }
+        utils.LogError("SSH_KEY_ERROR", err, username, "Failed to remove SSH key")
+        http.Error(w, "Failed to remove SSH key", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("SSH_KEY_REMOVED", username, r.RemoteAddr, fmt.Sprintf("Removed SSH key %s", keyID))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+    })
+}
@@ -4,6 +4,8 @@ import (
     "LunaTransfer/auth"
     "LunaTransfer/common"
     "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/models"
     "LunaTransfer/utils"
     "encoding/json"
     "fmt"
@@ -69,6 +71,12 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
     }
     filename := filepath.Clean(header.Filename)
     filePath := filepath.Join(targetDir, filename)
+    if !allowedToOverwrite(w, r, username, filepath.ToSlash(filepath.Join(username, path, filename))) {
+        return
+    }
+    if !checkUploadQuota(w, r, username, username, filePath, header.Size) {
+        return
+    }
     
     dst, err := os.Create(filePath)
     if err != nil {
@@ -84,6 +92,16 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Failed to save file", http.StatusInternalServerError)
         return
     }
+    dst.Close()
+
+    relPath, verification := decryptUpload(r, username, "user:"+username, username, appConfig.StorageDirectory, filepath.Join(username, path, filename))
+    if verification != nil && verification.Error == "" {
+        filename = filepath.Base(relPath)
+        filePath = filepath.Join(targetDir, filename)
+        if info, err := os.Stat(filePath); err == nil {
+            size = info.Size()
+        }
+    }
     
     if r.FormValue("groupIds") != "" {
         var groupIds []string
@@ -103,33 +121,33 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
     }
     
     uploadTime := time.Since(start)
-    utils.LogSystem("UPLOAD_SUCCESS", username, r.RemoteAddr, 
-        fmt.Sprintf("Uploaded file %s to %s (size: %d bytes)", filename, path, size))
-    
-    utils.LogTransfer(utils.TransferLog{
-        Username:    username,
-        Filename:    filename,
-        Size:        size,
-        Action:      string(utils.OpUpload),
-        Timestamp:   time.Now(),
-        Success:     true,
-        RemoteIP:    r.RemoteAddr,
-        UserAgent:   r.UserAgent(),
-        ElapsedTime: uploadTime,
+    events.Publish(events.Event{
+        Type:       events.FileUploaded,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: filepath.ToSlash(filepath.Join(username, path, filename)),
+        Size:       size,
+        Elapsed:    uploadTime,
     })
     
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
+    response := map[string]interface{}{
         "success": true,
         "message": "File uploaded successfully",
         "filename": filename,
         "path": path,
         "size": size,
         "elapsed": uploadTime.String(),
-    })
+    }
+    if verification != nil {
+        response["pgp"] = verification
+    }
+    json.NewEncoder(w).Encode(response)
 }
 
 func UploadFileWithGroupAccess(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
     username, ok := common.GetUsernameFromContext(r.Context())
     if !ok {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -228,6 +246,9 @@ func UploadFileWithGroupAccess(w http.ResponseWriter, r *http.Request) {
         }
     }
     filePath := filepath.Join(targetDir, filepath.Base(handler.Filename))
+    if !allowedToOverwrite(w, r, username, filepath.ToSlash(filepath.Join("groups", groupID, uploadPath, filepath.Base(handler.Filename)))) {
+        return
+    }
     dst, err := os.Create(filePath)
     if err != nil {
         utils.LogError("UPLOAD_ERROR", err, username, fmt.Sprintf("Failed to create file: %s", handler.Filename))
@@ -235,30 +256,211 @@ func UploadFileWithGroupAccess(w http.ResponseWriter, r *http.Request) {
         return
     }
     defer dst.Close()
-    if _, err := io.Copy(dst, file); err != nil {
+    size, err := io.Copy(dst, file)
+    if err != nil {
         utils.LogError("UPLOAD_ERROR", err, username, fmt.Sprintf("Failed to write file: %s", handler.Filename))
         http.Error(w, "Failed to save file", http.StatusInternalServerError)
         return
     }
+    dst.Close()
     relFilePath := filepath.Join("groups", groupID)
     if uploadPath != "" {
         relFilePath = filepath.Join(relFilePath, uploadPath)
     }
-    relFilePath = filepath.Join(relFilePath, handler.Filename)
+    relFilePath = filepath.Join(relFilePath, filepath.Base(handler.Filename))
 
-    utils.LogSystem("GROUP_FILE_UPLOAD", username, r.RemoteAddr, 
-        fmt.Sprintf("Uploaded file %s to group %s", handler.Filename, group.Name))
+    relFilePath, verification := decryptUpload(r, username, "group:"+groupID, "", appConfig.StorageDirectory, relFilePath)
+    if info, err := os.Stat(filepath.Join(appConfig.StorageDirectory, relFilePath)); err == nil {
+        size = info.Size()
+    }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
+    events.Publish(events.Event{
+        Type:       events.FileUploaded,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: filepath.ToSlash(relFilePath),
+        Size:       size,
+        Elapsed:    time.Since(start),
+    })
+
+    response := map[string]interface{}{
         "success": true,
         "message": "File uploaded successfully",
         "file": map[string]interface{}{
-            "name": handler.Filename,
+            "name": filepath.Base(relFilePath),
             "path": relFilePath,
-            "size": handler.Size,
+            "size": size,
             "type": handler.Header.Get("Content-Type"),
             "group": group.Name,
         },
+    }
+    if verification != nil {
+        response["pgp"] = verification
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+// UploadToShareHandler writes into the source location of a read-write share.
+// For file shares the upload replaces the shared file; for folder shares it is
+// stored inside the shared folder at the optional "path".
+func UploadToShareHandler(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if err := r.ParseMultipartForm(32 << 20); err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, "Failed to parse multipart form")
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+    file, handler, err := r.FormFile("file")
+    if err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, "Failed to get file from request")
+        http.Error(w, "No file provided", http.StatusBadRequest)
+        return
+    }
+    defer file.Close()
+
+    shareID := r.FormValue("shareId")
+    if shareID == "" {
+        http.Error(w, "Share ID is required", http.StatusBadRequest)
+        return
+    }
+    uploadPath := r.FormValue("path")
+    if uploadPath != "" && (strings.Contains(uploadPath, "..") || strings.HasPrefix(uploadPath, "/")) {
+        utils.LogError("UPLOAD_ERROR", fmt.Errorf("path traversal attempt"), username, uploadPath)
+        http.Error(w, "Invalid path", http.StatusBadRequest)
+        return
+    }
+
+    share, err := models.GetFileShareByID(shareID)
+    if err != nil || share.IsExpired(time.Now()) {
+        http.Error(w, "Share not found", http.StatusNotFound)
+        return
+    }
+
+    relFilePath := share.SourcePath
+    if share.IsDir {
+        relFilePath = filepath.ToSlash(filepath.Join(share.SourcePath, uploadPath, filepath.Base(handler.Filename)))
+    } else if uploadPath != "" {
+        http.Error(w, "A path can only be given for folder shares", http.StatusBadRequest)
+        return
+    }
+
+    hasWriteAccess, err := auth.HasAccessToSharedFile(username, relFilePath, true)
+    if err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, "Failed to check shared access")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    if !hasWriteAccess {
+        utils.LogSystem("ACCESS_DENIED", username, r.RemoteAddr,
+            fmt.Sprintf("Attempted to write to share %s without read-write access", shareID))
+        http.Error(w, "Access denied - share is not writable for you", http.StatusForbidden)
+        return
+    }
+
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, "Failed to load config")
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    filePath := filepath.Join(appConfig.StorageDirectory, relFilePath)
+    if namespace, _ := events.SplitStoragePath(relFilePath); strings.HasPrefix(namespace, "user:") {
+        if !checkUploadQuota(w, r, username, strings.TrimPrefix(namespace, "user:"), filePath, handler.Size) {
+            return
+        }
+    }
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, fmt.Sprintf("Failed to create directory for %s", relFilePath))
+        http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+        return
+    }
+
+    if !allowedToOverwrite(w, r, username, filepath.ToSlash(relFilePath)) {
+        return
+    }
+
+    // Write next to the target and rename so readers never see a partial overwrite.
+    tempPath := filePath + ".upload-" + utils.GenerateUUID()
+    dst, err := os.Create(tempPath)
+    if err != nil {
+        utils.LogError("UPLOAD_ERROR", err, username, fmt.Sprintf("Failed to create file: %s", relFilePath))
+        http.Error(w, "Failed to save file", http.StatusInternalServerError)
+        return
+    }
+    size, err := io.Copy(dst, file)
+    dst.Close()
+    if err == nil {
+        err = os.Rename(tempPath, filePath)
+    }
+    if err != nil {
+        os.Remove(tempPath)
+        utils.LogError("UPLOAD_ERROR", err, username, fmt.Sprintf("Failed to write file: %s", relFilePath))
+        http.Error(w, "Failed to save file", http.StatusInternalServerError)
+        return
+    }
+
+    uploadTime := time.Since(start)
+    utils.LogSystem("SHARED_FILE_UPLOAD", username, r.RemoteAddr,
+        fmt.Sprintf("Wrote %s through share %s (shared by %s)", relFilePath, shareID, share.SharedBy))
+
+    events.Publish(events.Event{
+        Type:       events.FileUploaded,
+        Actor:      username,
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: relFilePath,
+        Size:       size,
+        Elapsed:    uploadTime,
+        ShareID:    shareID,
+        SharedBy:   share.SharedBy,
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success":  true,
+        "message":  "File uploaded successfully",
+        "share_id": shareID,
+        "path":     relFilePath,
+        "size":     size,
+        "elapsed":  uploadTime.String(),
     })
-}
\ No newline at end of file
+}
+
+// checkUploadQuota checks that replacing filePath, in owner's home folder,
+// with size bytes keeps owner within their quota, and answers the request
+// if not.
+func checkUploadQuota(w http.ResponseWriter, r *http.Request, username, owner, filePath string, size int64) bool {
+    left, err := uploadAllowance(owner, filePath)
+    if err != nil {
+        utils.LogError("QUOTA_ERROR", err, username, fmt.Sprintf("Failed to calculate storage usage of %s", owner))
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return false
+    }
+    if left >= 0 && size > left {
+        utils.LogSystem("QUOTA_EXCEEDED", username, r.RemoteAddr,
+            fmt.Sprintf("Upload of %s would exceed the storage quota of %s", utils.FormatFileSize(size), owner))
+        http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+        return false
+    }
+    return true
+}
+
+// uploadAllowance returns how large filePath, in owner's home folder, may
+// become without taking owner past their quota, or -1 without a quota.
+func uploadAllowance(owner, filePath string) (int64, error) {
+    left, err := utils.QuotaLeft(owner)
+    if err != nil || left < 0 {
+        return left, err
+    }
+    if info, err := os.Stat(filePath); err == nil && !info.IsDir() {
+        left += info.Size()
+    }
+    return left, nil
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"LunaTransfer/auth"
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/retention"
     "LunaTransfer/utils"
     "encoding/json"
 	"time"
@@ -42,13 +45,36 @@ func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
 func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     username := vars["username"]
-    if err := auth.DeleteUser(username); err != nil {
+    removedShares, err := auth.DeleteUser(username)
+    if retention.AuditAction(err) != "" {
+        // Deleting a user removes their home folder.
+        checkRetention(w, r, "admin", "delete", username, err)
+        return
+    }
+    if err != nil {
         utils.LogError("ADMIN_ERROR", err, "admin", "Failed to delete user")
         http.Error(w, "Failed to delete user", http.StatusInternalServerError)
         return
     }
     
     utils.LogSystem("USER_DELETED", "admin", r.RemoteAddr, "Deleted user: "+username)
+    // The home folder went with the user; checksums and the like follow it
+    // out as for any deleted folder.
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      "admin",
+        RemoteAddr: r.RemoteAddr,
+        UserAgent:  r.UserAgent(),
+        SourcePath: username,
+        IsDir:      true,
+        Reason:     "user deleted",
+    })
+    for _, share := range removedShares {
+        events.Publish(events.ShareEvent(events.ShareRemoved, "admin", r.RemoteAddr, share, "owner deleted"))
+    }
+    if err := models.DeleteInbox(username); err != nil {
+        utils.LogError("ADMIN_ERROR", err, "admin", "Failed to delete notification inbox of "+username)
+    }
     
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+    "LunaTransfer/common"
+    "LunaTransfer/utils"
+    "LunaTransfer/webhooks"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+    "github.com/gorilla/mux"
+)
+
+type WebhookRequest struct {
+    URL       string                `json:"url"`
+    Secret    string                `json:"secret"`
+    Events    []webhooks.EventType  `json:"events"`
+    GroupID   string                `json:"group_id"`
+    Namespace string                `json:"namespace"`
+    PathGlob  string                `json:"path_glob"`
+}
+
+// CreateWebhookHandler registers a webhook. Without group_id the caller must be
+// a site admin; with group_id they must be able to manage that group.
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req WebhookRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Invalid request body")
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    sub := webhooks.Subscription{
+        ID:        utils.GenerateUUID(),
+        URL:       req.URL,
+        Secret:    req.Secret,
+        Events:    req.Events,
+        GroupID:   req.GroupID,
+        Namespace: req.Namespace,
+        PathGlob:  req.PathGlob,
+        Active:    true,
+        CreatedBy: username,
+        CreatedAt: time.Now(),
+    }
+
+    if !checkGroupScopedOwner(w, r, username, req.GroupID, "webhook") {
+        return
+    }
+    if req.GroupID != "" {
+        // Group webhooks are always confined to their own group.
+        sub.Namespace = ""
+    }
+
+    if err := sub.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if sub.Secret == "" {
+        secret, err := webhooks.GenerateSecret()
+        if err != nil {
+            utils.LogError("WEBHOOK_ERROR", err, username, "Failed to generate webhook secret")
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        sub.Secret = secret
+    }
+
+    if err := webhooks.CreateSubscription(sub); err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Failed to save webhook")
+        http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("WEBHOOK_CREATED", username, r.RemoteAddr,
+        fmt.Sprintf("Webhook %s to %s (group: %q, namespace: %q)", sub.ID, sub.URL, sub.GroupID, sub.Namespace))
+
+    // The secret is only ever returned here.
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "webhook": sub,
+    })
+}
+
+func ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    subscriptions, err := webhooks.ListSubscriptions()
+    if err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Failed to load webhooks")
+        http.Error(w, "Failed to load webhooks", http.StatusInternalServerError)
+        return
+    }
+
+    visible := []webhooks.Subscription{}
+    for _, sub := range subscriptions {
+        if !canManageGroupScoped(username, "", sub.GroupID) {
+            continue
+        }
+        sub.Secret = ""
+        visible = append(visible, sub)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "webhooks":    visible,
+        "total":       len(visible),
+        "event_types": webhooks.EventTypes,
+    })
+}
+
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    sub, ok := loadManagedWebhook(w, username, mux.Vars(r)["webhookId"])
+    if !ok {
+        return
+    }
+
+    if err := webhooks.DeleteSubscription(sub.ID); err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Failed to delete webhook")
+        http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogAudit("WEBHOOK_DELETED", username, r.RemoteAddr,
+        fmt.Sprintf("Webhook %s to %s deleted", sub.ID, sub.URL))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success": true,
+        "message": "Webhook deleted",
+    })
+}
+
+func ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    sub, ok := loadManagedWebhook(w, username, mux.Vars(r)["webhookId"])
+    if !ok {
+        return
+    }
+
+    deliveries, err := webhooks.ListDeliveries(sub.ID)
+    if err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Failed to load webhook deliveries")
+        http.Error(w, "Failed to load deliveries", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "deliveries": deliveries,
+        "total":      len(deliveries),
+    })
+}
+
+func RedeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    username, ok := common.GetUsernameFromContext(r.Context())
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    vars := mux.Vars(r)
+    sub, ok := loadManagedWebhook(w, username, vars["webhookId"])
+    if !ok {
+        return
+    }
+
+    delivery, err := webhooks.Redeliver(sub.ID, vars["deliveryId"])
+    if errors.Is(err, webhooks.ErrDeliveryNotFound) {
+        http.Error(w, "Delivery not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, username, "Failed to queue redelivery")
+        http.Error(w, "Failed to queue redelivery", http.StatusInternalServerError)
+        return
+    }
+
+    utils.LogSystem("WEBHOOK_REDELIVER", username, r.RemoteAddr,
+        fmt.Sprintf("Queued redelivery of %s for webhook %s", vars["deliveryId"], sub.ID))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "success":  true,
+        "delivery": delivery,
+    })
+}
+
+func loadManagedWebhook(w http.ResponseWriter, username, id string) (webhooks.Subscription, bool) {
+    return loadManaged(w, username, "webhook", id, webhooks.GetSubscription, webhooks.ErrSubscriptionNotFound,
+        func(sub webhooks.Subscription) string { return sub.GroupID })
+}
@@ -0,0 +1,242 @@
+// Package integrity detects silent corruption of stored files. It records
+// the SHA-256 of every file as it is uploaded and follows renames and
+// deletions, and the scrubber re-hashes stored files in the background at a
+// throttled rate, reporting files whose contents no longer match and files
+// that disappeared without being deleted.
+package integrity
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+var checksumRepo = store.NewRepository[Checksum](store.Checksums)
+
+// Checksum is the recorded digest of one stored file, with the size and
+// modification time it had then. A file that changed without passing
+// through the server has a different modification time; one corrupted on
+// disk usually does not.
+type Checksum struct {
+    SHA256     string     `json:"sha256"`
+    Size       int64      `json:"size"`
+    ModTime    time.Time  `json:"mod_time"`
+    RecordedAt time.Time  `json:"recorded_at"`
+    VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// loadIndex reads every checksum, keyed by storage-relative path.
+func loadIndex() (map[string]Checksum, error) {
+    index := map[string]Checksum{}
+    err := store.View(func(tx *store.Tx) error {
+        return checksumRepo.Scan(tx, "", func(rel string, checksum Checksum) error {
+            index[rel] = checksum
+            return nil
+        })
+    })
+    return index, err
+}
+
+// checksumsUnder returns the checksums of rel and everything below it.
+func checksumsUnder(tx *store.Tx, rel string) (map[string]Checksum, error) {
+    found := map[string]Checksum{}
+    checksum, ok, err := checksumRepo.Get(tx, rel)
+    if err != nil {
+        return nil, err
+    }
+    if ok {
+        found[rel] = checksum
+    }
+    err = checksumRepo.Scan(tx, rel+"/", func(key string, checksum Checksum) error {
+        found[key] = checksum
+        return nil
+    })
+    return found, err
+}
+
+// HandleEvent keeps the index in step with uploads, renames and deletions.
+// Uploads are hashed synchronously, before anything else can touch the file;
+// receipts, issued next, take the hash from the index.
+func HandleEvent(e events.Event) {
+    var err error
+    switch e.Type {
+    case events.FileUploaded:
+        if e.IsDir {
+            return
+        }
+        var checksum Checksum
+        checksum, err = hashStored(e.SourcePath, nil)
+        if err == nil {
+            err = store.Update(func(tx *store.Tx) error {
+                return checksumRepo.Put(tx, e.SourcePath, checksum)
+            })
+        }
+    case events.FileRenamed:
+        err = store.Update(func(tx *store.Tx) error {
+            moved, err := checksumsUnder(tx, e.PreviousSourcePath)
+            if err != nil {
+                return err
+            }
+            for rel := range moved {
+                if err := checksumRepo.Delete(tx, rel); err != nil {
+                    return err
+                }
+            }
+            for rel, checksum := range moved {
+                rest, _ := under(rel, e.PreviousSourcePath)
+                if err := checksumRepo.Put(tx, e.SourcePath+rest, checksum); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+    case events.FileDeleted:
+        err = store.Update(func(tx *store.Tx) error {
+            removed, err := checksumsUnder(tx, e.SourcePath)
+            if err != nil {
+                return err
+            }
+            for rel := range removed {
+                if err := checksumRepo.Delete(tx, rel); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+    default:
+        return
+    }
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, e.Actor, fmt.Sprintf("Failed to update the checksum of %s", e.SourcePath))
+    }
+}
+
+// Current returns the checksum of the file at the storage-relative path rel:
+// the recorded one while the file has the size and modification time
+// recorded with it, and otherwise a fresh one, which is not recorded so the
+// scrubber still reports the change.
+func Current(rel string) (Checksum, error) {
+    full, err := storageFile(rel)
+    if err != nil {
+        return Checksum{}, err
+    }
+    info, err := os.Stat(full)
+    if err != nil {
+        return Checksum{}, err
+    }
+    var checksum Checksum
+    var ok bool
+    err = store.View(func(tx *store.Tx) error {
+        checksum, ok, err = checksumRepo.Get(tx, rel)
+        return err
+    })
+    if err != nil {
+        return Checksum{}, err
+    }
+    if ok && checksum.Size == info.Size() && checksum.ModTime.Equal(info.ModTime()) {
+        return checksum, nil
+    }
+    return hashStored(rel, nil)
+}
+
+// under reports whether rel is dir or below it, and returns the rest of rel.
+func under(rel, dir string) (string, bool) {
+    if rel == dir {
+        return "", true
+    }
+    if rest, ok := strings.CutPrefix(rel, dir+"/"); ok {
+        return "/" + rest, true
+    }
+    return "", false
+}
+
+// hashStored hashes the file at the storage-relative path rel, reading
+// through wrap when given.
+func hashStored(rel string, wrap func(io.Reader) io.Reader) (Checksum, error) {
+    full, err := storageFile(rel)
+    if err != nil {
+        return Checksum{}, err
+    }
+    file, err := os.Open(full)
+    if err != nil {
+        return Checksum{}, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return Checksum{}, err
+    }
+
+    var reader io.Reader = file
+    if wrap != nil {
+        reader = wrap(file)
+    }
+    hash := sha256.New()
+    if _, err := io.Copy(hash, reader); err != nil {
+        return Checksum{}, err
+    }
+    return Checksum{
+        SHA256:     hex.EncodeToString(hash.Sum(nil)),
+        Size:       info.Size(),
+        ModTime:    info.ModTime(),
+        RecordedAt: time.Now(),
+    }, nil
+}
+
+// legacyIndexFile is where checksums were kept before the database, relative
+// to the data directory.
+const legacyIndexFile = "checksums.json"
+
+// ImportLegacyChecksums moves the checksums kept in the data directory before
+// the database into it, keeping checksums it already has, and renames the
+// file with a ".migrated" suffix. It returns the number of checksums
+// imported.
+func ImportLegacyChecksums() (int, error) {
+    path, err := store.DataFile(legacyIndexFile)
+    if err != nil {
+        return 0, err
+    }
+    index := map[string]Checksum{}
+    found, err := store.ReadLegacyFile(path, &index)
+    if err != nil || !found {
+        return 0, err
+    }
+
+    imported := 0
+    err = store.Update(func(tx *store.Tx) error {
+        for rel, checksum := range index {
+            if _, exists, err := checksumRepo.Get(tx, rel); err != nil || exists {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := checksumRepo.Put(tx, rel, checksum); err != nil {
+                return err
+            }
+            imported++
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    return imported, store.ArchiveLegacyFile(path)
+}
+
+func storageFile(rel string) (string, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return "", fmt.Errorf("failed to load config: %w", err)
+    }
+    return filepath.Join(appConfig.StorageDirectory, filepath.FromSlash(rel)), nil
+}
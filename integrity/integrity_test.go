@@ -0,0 +1,260 @@
+package integrity
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/retention"
+    "LunaTransfer/store"
+    "bytes"
+    "context"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, nil, nil)
+}
+
+// modTime is when the test files were last modified.
+var modTime = time.Now().Add(-time.Hour).Truncate(time.Second)
+
+// writeFile writes data at name, last modified at modTime.
+func writeFile(t *testing.T, name, data string) {
+    t.Helper()
+    if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chtimes(name, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func stored(t *testing.T, rel string) string {
+    t.Helper()
+    full, err := storageFile(rel)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return full
+}
+
+// upload stores data at rel and records its checksum as an upload does.
+func upload(t *testing.T, rel, data string) {
+    t.Helper()
+    writeFile(t, stored(t, rel), data)
+    HandleEvent(events.Event{Type: events.FileUploaded, Actor: "test", SourcePath: rel})
+    if _, ok := recorded(t, rel); !ok {
+        t.Fatalf("no checksum recorded for %s", rel)
+    }
+}
+
+func recorded(t *testing.T, rel string) (Checksum, bool) {
+    t.Helper()
+    var checksum Checksum
+    var ok bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        checksum, ok, err = checksumRepo.Get(tx, rel)
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return checksum, ok
+}
+
+func withScrub(t *testing.T, settings config.ScrubConfig) {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := appConfig.Scrub
+    appConfig.Scrub = settings
+    t.Cleanup(func() { appConfig.Scrub = previous })
+}
+
+// runScrub scrubs the storage directory and returns the findings in
+// namespace, by path, and the report.
+func runScrub(t *testing.T, namespace string) (map[string]Finding, Report) {
+    t.Helper()
+    report := Report{ID: strings.ReplaceAll(t.Name(), "/", "-"), Trigger: TriggerManual, StartedBy: "test", Status: ReportRunning, Findings: []Finding{}}
+    scrub(context.Background(), report)
+    report, err := GetReport(report.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Status != ReportCompleted {
+        t.Fatalf("scrub %s: %s", report.Status, report.Error)
+    }
+    findings := map[string]Finding{}
+    for _, finding := range report.Findings {
+        if finding.Namespace == namespace {
+            findings[finding.Path] = finding
+        }
+    }
+    return findings, report
+}
+
+func content(t *testing.T, name string) string {
+    t.Helper()
+    data, err := os.ReadFile(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestIndexFollowsRenamesAndDeletes(t *testing.T) {
+    upload(t, "indexed/a/one.txt", "one")
+    upload(t, "indexed/a/two.txt", "two")
+    upload(t, "indexed/ab.txt", "ab")
+
+    HandleEvent(events.Event{Type: events.FileRenamed, Actor: "test", PreviousSourcePath: "indexed/a", SourcePath: "indexed/b"})
+    for rel, want := range map[string]bool{
+        "indexed/a/one.txt": false,
+        "indexed/b/one.txt": true,
+        "indexed/b/two.txt": true,
+        "indexed/ab.txt":    true,
+    } {
+        if _, ok := recorded(t, rel); ok != want {
+            t.Errorf("after the rename, %s recorded %v, want %v", rel, ok, want)
+        }
+    }
+
+    HandleEvent(events.Event{Type: events.FileDeleted, Actor: "test", SourcePath: "indexed/b"})
+    for rel, want := range map[string]bool{
+        "indexed/b/one.txt": false,
+        "indexed/b/two.txt": false,
+        "indexed/ab.txt":    true,
+    } {
+        if _, ok := recorded(t, rel); ok != want {
+            t.Errorf("after the delete, %s recorded %v, want %v", rel, ok, want)
+        }
+    }
+}
+
+func TestThrottle(t *testing.T) {
+    limiter := &throttle{ctx: context.Background(), rate: 10000, start: time.Now()}
+    data := bytes.Repeat([]byte("x"), 2500)
+    start := time.Now()
+    var hashed bytes.Buffer
+    if _, err := hashed.ReadFrom(limiter.wrap(bytes.NewReader(data))); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+        t.Errorf("read 2500 bytes at 10000 bytes per second in %v", elapsed)
+    }
+    if hashed.Len() != len(data) {
+        t.Errorf("read %d bytes, want %d", hashed.Len(), len(data))
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    limiter = &throttle{ctx: ctx, rate: 100, start: time.Now()}
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        cancel()
+    }()
+    start = time.Now()
+    _, err := hashed.ReadFrom(limiter.wrap(bytes.NewReader(data)))
+    if !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+        t.Errorf("got %v after %v, want the read cancelled", err, time.Since(start))
+    }
+}
+
+func TestRestoreFromReplica(t *testing.T) {
+    replica := t.TempDir()
+    withScrub(t, config.ScrubConfig{ReplicaDirectory: replica, Quarantine: true})
+
+    upload(t, "restore/corrupt.txt", "original contents")
+    upload(t, "restore/missing.txt", "missing contents")
+    upload(t, "restore/bad-replica.txt", "original contents")
+    writeFile(t, filepath.Join(replica, "restore", "corrupt.txt"), "original contents")
+    writeFile(t, filepath.Join(replica, "restore", "missing.txt"), "missing contents")
+    writeFile(t, filepath.Join(replica, "restore", "bad-replica.txt"), "ORIGINAL contents")
+
+    // Corruption on disk leaves the size and modification time alone.
+    writeFile(t, stored(t, "restore/corrupt.txt"), "0riginal contents")
+    writeFile(t, stored(t, "restore/bad-replica.txt"), "0riginal contents")
+    if err := os.Remove(stored(t, "restore/missing.txt")); err != nil {
+        t.Fatal(err)
+    }
+
+    findings, report := runScrub(t, "user:restore")
+    if report.Restored < 2 {
+        t.Errorf("got %d restored, want at least 2", report.Restored)
+    }
+    for rel, want := range map[string]struct{ problem, contents string }{
+        "corrupt.txt": {ProblemMismatch, "original contents"},
+        "missing.txt": {ProblemMissing, "missing contents"},
+    } {
+        finding := findings[rel]
+        if finding.Problem != want.problem || finding.Action != ActionRestored {
+            t.Errorf("%s: got %+v, want a restored %s", rel, finding, want.problem)
+        }
+        if got := content(t, stored(t, "restore/"+rel)); got != want.contents {
+            t.Errorf("%s: got %q after the restore, want %q", rel, got, want.contents)
+        }
+        if checksum, ok := recorded(t, "restore/"+rel); !ok || checksum.VerifiedAt == nil {
+            t.Errorf("%s: the restored checksum is %+v, %v", rel, checksum, ok)
+        }
+    }
+
+    // A replica that does not match the checksum either is not used.
+    finding := findings["bad-replica.txt"]
+    if finding.Action != ActionQuarantined || !strings.Contains(finding.Error, "not restored") {
+        t.Errorf("bad-replica.txt: got %+v, want it quarantined and not restored", finding)
+    }
+}
+
+func TestQuarantine(t *testing.T) {
+    withScrub(t, config.ScrubConfig{Quarantine: true})
+    upload(t, "quarantine/corrupt.txt", "original contents")
+    upload(t, "quarantine/held/corrupt.txt", "original contents")
+    upload(t, "quarantine/intact.txt", "intact contents")
+    hold := retention.Hold{ID: "scrub-hold", Name: "scrub-hold", Scope: retention.Scope{Username: "quarantine", Path: "held"}, CreatedAt: time.Now()}
+    if err := retention.PlaceHold(hold); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { retention.ReleaseHold(hold.ID, "test", "") })
+
+    writeFile(t, stored(t, "quarantine/corrupt.txt"), "0riginal contents")
+    writeFile(t, stored(t, "quarantine/held/corrupt.txt"), "0riginal contents")
+
+    findings, report := runScrub(t, "user:quarantine")
+    if len(findings) != 2 {
+        t.Fatalf("got %v, want two findings", findings)
+    }
+    finding := findings["corrupt.txt"]
+    if finding.Problem != ProblemMismatch || finding.Action != ActionQuarantined {
+        t.Fatalf("corrupt.txt: got %+v, want it quarantined", finding)
+    }
+    if _, err := os.Stat(stored(t, "quarantine/corrupt.txt")); !os.IsNotExist(err) {
+        t.Error("the corrupted file is still in storage")
+    }
+    appConfig, _ := config.LoadConfig()
+    moved := filepath.Join(appConfig.GetDataDirectory(), filepath.FromSlash(finding.QuarantinePath))
+    if !strings.HasPrefix(finding.QuarantinePath, quarantineDirectory+"/"+report.ID+"/") || content(t, moved) != "0riginal contents" {
+        t.Errorf("the file was not moved to %s", finding.QuarantinePath)
+    }
+    if _, ok := recorded(t, "quarantine/corrupt.txt"); ok {
+        t.Error("the quarantined file still has a checksum")
+    }
+
+    // A legal hold keeps the corrupted file where it is.
+    held := findings["held/corrupt.txt"]
+    if held.Action != ActionFlagged || !strings.HasPrefix(held.Error, "left in place") {
+        t.Errorf("held/corrupt.txt: got %+v, want it flagged and left in place", held)
+    }
+    if _, err := os.Stat(stored(t, "quarantine/held/corrupt.txt")); err != nil {
+        t.Errorf("the held file was moved: %v", err)
+    }
+}
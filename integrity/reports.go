@@ -0,0 +1,142 @@
+package integrity
+
+import (
+    "LunaTransfer/store"
+    "errors"
+    "sync"
+    "time"
+)
+
+const maxReports = 50
+
+const (
+    ReportRunning   = "running"
+    ReportCompleted = "completed"
+    ReportFailed    = "failed"
+
+    // A mismatch is a file whose contents changed while its modification
+    // time did not; missing files were recorded but are gone without having
+    // been deleted; unreadable files fail to read.
+    ProblemMismatch   = "mismatch"
+    ProblemMissing    = "missing"
+    ProblemUnreadable = "unreadable"
+
+    ActionFlagged     = "flagged"
+    ActionRestored    = "restored"
+    ActionQuarantined = "quarantined"
+)
+
+var (
+    ErrReportNotFound = errors.New("scrub report not found")
+
+    reportsMutex sync.Mutex
+)
+
+// Finding is a file the scrubber flagged. Restored files were copied back
+// from RestoredFrom in the replica directory; quarantined files were moved
+// to QuarantinePath, relative to the data directory.
+type Finding struct {
+    Namespace      string    `json:"namespace"`
+    Path           string    `json:"path"`
+    Problem        string    `json:"problem"`
+    Expected       string    `json:"expected_sha256,omitempty"`
+    Actual         string    `json:"actual_sha256,omitempty"`
+    Size           int64     `json:"size"`
+    RecordedAt     time.Time `json:"recorded_at"`
+    Action         string    `json:"action"`
+    RestoredFrom   string    `json:"restored_from,omitempty"`
+    QuarantinePath string    `json:"quarantine_path,omitempty"`
+    Error          string    `json:"error,omitempty"`
+}
+
+// Report sums up one scrub. Verified files matched their checksum,
+// Recorded ones had none yet and Changed ones were modified without passing
+// through the server; both get a new checksum. Restored counts the findings
+// repaired from the replica directory; without one, RepairAvailable is false
+// and findings are only flagged or quarantined.
+type Report struct {
+    ID              string     `json:"id"`
+    Trigger         string     `json:"trigger"`
+    StartedBy       string     `json:"started_by"`
+    StartedAt       time.Time  `json:"started_at"`
+    FinishedAt      *time.Time `json:"finished_at,omitempty"`
+    Status          string     `json:"status"`
+    RepairAvailable bool       `json:"repair_available"`
+    Checked         int        `json:"checked"`
+    Bytes           int64      `json:"bytes"`
+    Verified        int        `json:"verified"`
+    Recorded        int        `json:"recorded"`
+    Changed         int        `json:"changed"`
+    Restored        int        `json:"restored"`
+    Findings        []Finding  `json:"findings"`
+    Error           string     `json:"error,omitempty"`
+}
+
+const reportsFile = "scrub_reports.json"
+
+func loadReports() ([]Report, error) {
+    reports := []Report{}
+    if err := store.ReadDataFile(reportsFile, &reports); err != nil {
+        return nil, err
+    }
+    return reports, nil
+}
+
+func saveReports(reports []Report) error {
+    return store.WriteDataFile(reportsFile, reports)
+}
+
+// saveReport adds r or replaces the report with its ID, dropping the oldest
+// reports beyond maxReports.
+func saveReport(r Report) error {
+    reportsMutex.Lock()
+    defer reportsMutex.Unlock()
+
+    reports, err := loadReports()
+    if err != nil {
+        return err
+    }
+    for i := range reports {
+        if reports[i].ID == r.ID {
+            reports[i] = r
+            return saveReports(reports)
+        }
+    }
+    reports = append(reports, r)
+    if len(reports) > maxReports {
+        reports = reports[len(reports)-maxReports:]
+    }
+    return saveReports(reports)
+}
+
+// ListReports returns the latest reports, newest first.
+func ListReports(limit int) ([]Report, error) {
+    reportsMutex.Lock()
+    reports, err := loadReports()
+    reportsMutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    result := []Report{}
+    for i := len(reports) - 1; i >= 0 && len(result) < limit; i-- {
+        result = append(result, reports[i])
+    }
+    return result, nil
+}
+
+func GetReport(id string) (Report, error) {
+    reportsMutex.Lock()
+    defer reportsMutex.Unlock()
+
+    reports, err := loadReports()
+    if err != nil {
+        return Report{}, err
+    }
+    for _, r := range reports {
+        if r.ID == id {
+            return r, nil
+        }
+    }
+    return Report{}, ErrReportNotFound
+}
@@ -0,0 +1,102 @@
+package integrity
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// restoreFile copies rel back from the replica directory when the copy there
+// still has the recorded checksum, and returns the file's new checksum. A
+// restored file has the contents it was uploaded with, so legal holds and
+// retention minimums don't stand in the way. Nothing is published: to users
+// the file never changed.
+func restoreFile(replicaDir, rel string, recorded Checksum, limiter *throttle, finding *Finding) (Checksum, bool) {
+    replica := filepath.Join(replicaDir, filepath.FromSlash(rel))
+    sum, err := hashFile(replica, limiter.wrap)
+    if err != nil {
+        finding.Error = "not restored: " + err.Error()
+        return Checksum{}, false
+    }
+    if sum != recorded.SHA256 {
+        finding.Error = "not restored: the replica does not match the recorded checksum either"
+        return Checksum{}, false
+    }
+
+    full, err := storageFile(rel)
+    if err != nil {
+        finding.Error = "not restored: " + err.Error()
+        return Checksum{}, false
+    }
+    info, err := copyInto(replica, full)
+    if err != nil {
+        finding.Error = "not restored: " + err.Error()
+        return Checksum{}, false
+    }
+
+    now := time.Now()
+    finding.Action = ActionRestored
+    finding.RestoredFrom = replica
+    return Checksum{
+        SHA256:     recorded.SHA256,
+        Size:       info.Size(),
+        ModTime:    info.ModTime(),
+        RecordedAt: recorded.RecordedAt,
+        VerifiedAt: &now,
+    }, true
+}
+
+func hashFile(name string, wrap func(io.Reader) io.Reader) (string, error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, wrap(file)); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyInto replaces target with a copy of source. The copy is written next
+// to target and renamed over it, so target is never half written.
+func copyInto(source, target string) (os.FileInfo, error) {
+    src, err := os.Open(source)
+    if err != nil {
+        return nil, err
+    }
+    defer src.Close()
+
+    if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        return nil, err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(target), ".restore-*")
+    if err != nil {
+        return nil, err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := io.Copy(tmp, src); err != nil {
+        tmp.Close()
+        return nil, err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return nil, err
+    }
+    if err := tmp.Close(); err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(tmp.Name(), 0644); err != nil {
+        return nil, err
+    }
+    if err := os.Rename(tmp.Name(), target); err != nil {
+        return nil, fmt.Errorf("failed to replace the file: %w", err)
+    }
+    return os.Stat(target)
+}
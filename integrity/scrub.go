@@ -0,0 +1,437 @@
+package integrity
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/jobs"
+    "LunaTransfer/models"
+    "LunaTransfer/retention"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    TriggerSchedule = "schedule"
+    TriggerManual   = "manual"
+
+    // quarantineDirectory, in the data directory, holds quarantined files
+    // under the ID of the report that moved them.
+    quarantineDirectory = "quarantine"
+)
+
+var (
+    ErrScrubRunning = errors.New("a scrub is already running")
+
+    stateMutex sync.Mutex
+    scrubbing  bool
+    runCtx     = context.Background()
+)
+
+// Start scrubs on the configured schedule until ctx is done; a scrub in
+// progress is cancelled with it. Scrubs started by admins run even when the
+// schedule is disabled.
+func Start(ctx context.Context) {
+    if err := failInterruptedScrubs(); err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, "system", "Failed to load scrub reports")
+    }
+    stateMutex.Lock()
+    runCtx = ctx
+    stateMutex.Unlock()
+
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.Scrub.Enabled {
+        return
+    }
+    schedule, err := jobs.ParseSchedule(appConfig.Scrub.Schedule)
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, "system", fmt.Sprintf("Invalid scrub schedule %q", appConfig.Scrub.Schedule))
+        return
+    }
+
+    for {
+        next := schedule.Next(time.Now())
+        if next.IsZero() {
+            return
+        }
+        timer := time.NewTimer(time.Until(next))
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+        if _, err := StartScrub(TriggerSchedule, "system"); err != nil && !errors.Is(err, ErrScrubRunning) {
+            utils.LogError("INTEGRITY_ERROR", err, "system", "Failed to start the scheduled scrub")
+        }
+    }
+}
+
+// NextScrub is when the scheduled scrub runs next, or nil if it does not.
+func NextScrub() *time.Time {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.Scrub.Enabled {
+        return nil
+    }
+    schedule, err := jobs.ParseSchedule(appConfig.Scrub.Schedule)
+    if err != nil {
+        return nil
+    }
+    next := schedule.Next(time.Now())
+    if next.IsZero() {
+        return nil
+    }
+    return &next
+}
+
+// Running reports whether a scrub is in progress.
+func Running() bool {
+    stateMutex.Lock()
+    defer stateMutex.Unlock()
+
+    return scrubbing
+}
+
+// StartScrub begins a scrub in the background and returns its report as it
+// starts. Only one scrub runs at a time.
+func StartScrub(trigger, startedBy string) (Report, error) {
+    stateMutex.Lock()
+    if scrubbing {
+        stateMutex.Unlock()
+        return Report{}, ErrScrubRunning
+    }
+    scrubbing = true
+    ctx := runCtx
+    stateMutex.Unlock()
+
+    report := Report{
+        ID:        utils.GenerateUUID(),
+        Trigger:   trigger,
+        StartedBy: startedBy,
+        StartedAt: time.Now(),
+        Status:    ReportRunning,
+        Findings:  []Finding{},
+    }
+    if appConfig, err := config.LoadConfig(); err == nil {
+        report.RepairAvailable = appConfig.Scrub.ReplicaDirectory != ""
+    }
+    if err := saveReport(report); err != nil {
+        stateMutex.Lock()
+        scrubbing = false
+        stateMutex.Unlock()
+        return Report{}, err
+    }
+
+    go func() {
+        defer func() {
+            stateMutex.Lock()
+            scrubbing = false
+            stateMutex.Unlock()
+        }()
+        scrub(ctx, report)
+    }()
+    return report, nil
+}
+
+// failInterruptedScrubs closes reports left running by a shutdown.
+func failInterruptedScrubs() error {
+    reports, err := ListReports(maxReports)
+    if err != nil {
+        return err
+    }
+    for _, r := range reports {
+        if r.Status != ReportRunning {
+            continue
+        }
+        now := time.Now()
+        r.Status = ReportFailed
+        r.Error = "interrupted by a shutdown"
+        r.FinishedAt = &now
+        if err := saveReport(r); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// scrub hashes every stored file at the configured rate and compares it with
+// its checksum. The checksums are updated at the end, except where an upload,
+// rename or deletion changed them in the meantime.
+func scrub(ctx context.Context, report Report) {
+    utils.LogSystem("INTEGRITY_SCRUB_STARTED", report.StartedBy, "localhost",
+        fmt.Sprintf("Scrub %s started (%s)", report.ID, report.Trigger))
+
+    err := func() error {
+        appConfig, err := config.LoadConfig()
+        if err != nil {
+            return err
+        }
+        index, err := loadIndex()
+        if err != nil {
+            return err
+        }
+
+        limiter := &throttle{ctx: ctx, rate: appConfig.Scrub.MaxBytesPerSecond, start: time.Now()}
+        updates := map[string]Checksum{}
+        seen := map[string]bool{}
+        storageDir := appConfig.StorageDirectory
+        walkErr := filepath.Walk(storageDir, func(full string, info os.FileInfo, err error) error {
+            if ctxErr := ctx.Err(); ctxErr != nil {
+                return ctxErr
+            }
+            if err != nil || !info.Mode().IsRegular() {
+                return nil
+            }
+            rel, err := filepath.Rel(storageDir, full)
+            if err != nil {
+                return nil
+            }
+            rel = filepath.ToSlash(rel)
+            seen[rel] = true
+            checkFile(&report, index, updates, rel, limiter, appConfig.Scrub)
+            return nil
+        })
+        if walkErr != nil {
+            return walkErr
+        }
+
+        for rel, recorded := range index {
+            if seen[rel] {
+                continue
+            }
+            if _, err := os.Stat(filepath.Join(storageDir, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+                continue
+            }
+            finding := Finding{Problem: ProblemMissing, Expected: recorded.SHA256, Size: recorded.Size, RecordedAt: recorded.RecordedAt}
+            if appConfig.Scrub.ReplicaDirectory != "" {
+                if restored, ok := restoreFile(appConfig.Scrub.ReplicaDirectory, rel, recorded, limiter, &finding); ok {
+                    report.Restored++
+                    updates[rel] = restored
+                }
+            }
+            flag(&report, rel, finding)
+        }
+        return applyUpdates(index, updates, report.Findings)
+    }()
+
+    now := time.Now()
+    report.FinishedAt = &now
+    report.Status = ReportCompleted
+    if err != nil {
+        report.Status = ReportFailed
+        report.Error = err.Error()
+        utils.LogError("INTEGRITY_ERROR", err, report.StartedBy, fmt.Sprintf("Scrub %s failed", report.ID))
+    }
+    if err := saveReport(report); err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, report.StartedBy, fmt.Sprintf("Failed to save scrub report %s", report.ID))
+    }
+    utils.LogSystem("INTEGRITY_SCRUBBED", report.StartedBy, "localhost",
+        fmt.Sprintf("Scrub %s %s: %d files (%d bytes) checked, %d verified, %d recorded, %d changed, %d flagged, %d restored",
+            report.ID, report.Status, report.Checked, report.Bytes, report.Verified, report.Recorded, report.Changed, len(report.Findings), report.Restored))
+}
+
+// checkFile compares one file with its checksum and notes the outcome in
+// report and updates. A mismatched file is restored from the replica
+// directory if it can be, and quarantined otherwise when so configured.
+func checkFile(report *Report, index, updates map[string]Checksum, rel string, limiter *throttle, settings config.ScrubConfig) {
+    actual, err := hashStored(rel, limiter.wrap)
+    if os.IsNotExist(err) || errors.Is(err, context.Canceled) {
+        return
+    }
+    recorded, known := index[rel]
+    if err != nil {
+        flag(report, rel, Finding{Problem: ProblemUnreadable, Expected: recorded.SHA256, RecordedAt: recorded.RecordedAt, Error: err.Error()})
+        return
+    }
+    report.Checked++
+    report.Bytes += actual.Size
+
+    switch {
+    case !known:
+        report.Recorded++
+        updates[rel] = actual
+    case !actual.ModTime.Equal(recorded.ModTime):
+        if actual.SHA256 != recorded.SHA256 {
+            report.Changed++
+        } else {
+            report.Verified++
+            actual.VerifiedAt = &actual.RecordedAt
+        }
+        updates[rel] = actual
+    case actual.SHA256 == recorded.SHA256:
+        report.Verified++
+        recorded.VerifiedAt = &actual.RecordedAt
+        updates[rel] = recorded
+    default:
+        finding := Finding{
+            Problem:    ProblemMismatch,
+            Expected:   recorded.SHA256,
+            Actual:     actual.SHA256,
+            Size:       actual.Size,
+            RecordedAt: recorded.RecordedAt,
+        }
+        restored := false
+        if settings.ReplicaDirectory != "" {
+            var checksum Checksum
+            if checksum, restored = restoreFile(settings.ReplicaDirectory, rel, recorded, limiter, &finding); restored {
+                report.Restored++
+                updates[rel] = checksum
+            }
+        }
+        if !restored && settings.Quarantine {
+            quarantineFile(report.ID, rel, &finding)
+        }
+        flag(report, rel, finding)
+    }
+}
+
+func flag(report *Report, rel string, finding Finding) {
+    finding.Namespace, finding.Path = events.SplitStoragePath(rel)
+    if finding.Action == "" {
+        finding.Action = ActionFlagged
+    }
+    report.Findings = append(report.Findings, finding)
+
+    details := fmt.Sprintf("Scrub %s: %s in %s is %s", report.ID, finding.Path, finding.Namespace, finding.Problem)
+    if finding.Problem == ProblemMismatch {
+        details += fmt.Sprintf(" (recorded %s, now %s)", finding.Expected, finding.Actual)
+    }
+    switch finding.Action {
+    case ActionRestored:
+        details += ", restored from " + finding.RestoredFrom
+    case ActionQuarantined:
+        details += ", quarantined to " + finding.QuarantinePath
+    }
+    utils.LogAudit("INTEGRITY_"+strings.ToUpper(finding.Problem), "system", "localhost", details)
+}
+
+// quarantineFile moves a corrupted file out of storage so nobody downloads
+// it, unless a legal hold or minimum retention says to leave it in place.
+// Its removal is published like a deletion.
+func quarantineFile(reportID, rel string, finding *Finding) {
+    if err := retention.CheckDelete(rel); err != nil {
+        finding.Error = "left in place: " + err.Error()
+        return
+    }
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        finding.Error = err.Error()
+        return
+    }
+    target := filepath.Join(quarantineDirectory, reportID, filepath.FromSlash(rel))
+    full := filepath.Join(appConfig.GetDataDirectory(), target)
+    if err := os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+        finding.Error = err.Error()
+        return
+    }
+    if err := os.Rename(filepath.Join(appConfig.StorageDirectory, filepath.FromSlash(rel)), full); err != nil {
+        finding.Error = err.Error()
+        return
+    }
+    finding.Action = ActionQuarantined
+    finding.QuarantinePath = filepath.ToSlash(target)
+
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      "system",
+        RemoteAddr: "localhost",
+        UserAgent:  "Integrity scrubber",
+        SourcePath: rel,
+        Size:       finding.Size,
+        Reason:     "quarantined by the integrity scrubber",
+    })
+    removed, err := models.RemoveFileSharesUnder(rel)
+    if err != nil {
+        utils.LogError("INTEGRITY_ERROR", err, "system", fmt.Sprintf("Failed to revoke shares of %s", rel))
+        return
+    }
+    for _, share := range removed {
+        events.Publish(events.ShareEvent(events.ShareRemoved, "system", "localhost", share, "source quarantined"))
+    }
+}
+
+// applyUpdates saves the new checksums and forgets missing files that were
+// not restored and quarantined ones, skipping entries changed since the scrub
+// read the index.
+func applyUpdates(snapshot, updates map[string]Checksum, findings []Finding) error {
+    return store.Update(func(tx *store.Tx) error {
+        unchanged := func(rel string) (bool, error) {
+            current, ok, err := checksumRepo.Get(tx, rel)
+            if err != nil {
+                return false, err
+            }
+            before, known := snapshot[rel]
+            return ok == known && (!ok || current.RecordedAt.Equal(before.RecordedAt)), nil
+        }
+        for rel, checksum := range updates {
+            if ok, err := unchanged(rel); err != nil || !ok {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := checksumRepo.Put(tx, rel, checksum); err != nil {
+                return err
+            }
+        }
+        for _, finding := range findings {
+            rel := events.StoragePath(finding.Namespace, finding.Path)
+            if finding.Action == ActionRestored || (finding.Problem != ProblemMissing && finding.Action != ActionQuarantined) {
+                continue
+            }
+            if ok, err := unchanged(rel); err != nil || !ok {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := checksumRepo.Delete(tx, rel); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// throttle keeps the reads of one scrub under rate bytes per second and
+// stops them when ctx is done.
+type throttle struct {
+    ctx   context.Context
+    rate  int64
+    start time.Time
+    read  int64
+}
+
+func (t *throttle) wrap(r io.Reader) io.Reader {
+    return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+    r io.Reader
+    t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+    if err := tr.t.ctx.Err(); err != nil {
+        return 0, err
+    }
+    n, err := tr.r.Read(p)
+    tr.t.read += int64(n)
+    due := tr.t.start.Add(time.Duration(float64(tr.t.read) / float64(tr.t.rate) * float64(time.Second)))
+    if wait := time.Until(due); wait > 0 {
+        select {
+        case <-tr.t.ctx.Done():
+            return n, tr.t.ctx.Err()
+        case <-time.After(wait):
+        }
+    }
+    return n, err
+}
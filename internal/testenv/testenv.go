@@ -0,0 +1,78 @@
+// Package testenv gives package tests a scratch server environment: a
+// temporary working directory, where the default configuration keeps
+// storage, data and logs, with the loggers running, the database open and
+// test users created.
+package testenv
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// User is an account Main creates before the tests run.
+type User struct {
+    Username string
+    Password string
+    Email    string
+    Role     string
+}
+
+// Main runs m in a scratch environment with users created and exits with
+// its result. setup, if not nil, runs after that and before the tests; an
+// error from it fails the package without running them. Environment
+// variables the configuration should see must be set before calling Main.
+func Main(m *testing.M, users []User, setup func() error) {
+    os.Exit(run(m, users, setup))
+}
+
+func run(m *testing.M, users []User, setup func() error) int {
+    dir, err := os.MkdirTemp("", "lunatransfer-test-")
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer os.RemoveAll(dir)
+    if err := os.Chdir(dir); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+
+    if _, err := config.LoadConfig(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := utils.InitLoggers(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer utils.CloseLoggers()
+    if err := config.EnsureStorageExists(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := store.Open(filepath.Join(dir, "test.db")); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer store.Close()
+    for _, user := range users {
+        if _, _, err := auth.CreateUser(user.Username, user.Password, user.Email, user.Role); err != nil {
+            fmt.Println(err)
+            return 1
+        }
+    }
+
+    if setup != nil {
+        if err := setup(); err != nil {
+            fmt.Println(err)
+            return 1
+        }
+    }
+    return m.Run()
+}
@@ -0,0 +1,169 @@
+package jobs
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schedule is a parsed five-field cron expression (minute, hour, day of
+// month, month, day of week) evaluated in the server's local time.
+type Schedule struct {
+    minute, hour, dom, month, dow uint64
+    // Like cron, a job whose day of month and day of week are both
+    // restricted runs when either matches.
+    domStar, dowStar bool
+}
+
+var scheduleMacros = map[string]string{
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly":  "0 0 1 * *",
+    "@weekly":   "0 0 * * 0",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+    "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+    "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+    "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseSchedule accepts "*", lists, ranges, steps and month or day names,
+// e.g. "*/15 6-18 * * mon-fri", as well as @hourly, @daily and the like.
+func ParseSchedule(expr string) (*Schedule, error) {
+    expr = strings.TrimSpace(expr)
+    if macro, ok := scheduleMacros[strings.ToLower(expr)]; ok {
+        expr = macro
+    }
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("schedule must have 5 fields (minute hour day month weekday), got %d", len(fields))
+    }
+
+    var s Schedule
+    var err error
+    if s.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+        return nil, fmt.Errorf("minute: %w", err)
+    }
+    if s.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+        return nil, fmt.Errorf("hour: %w", err)
+    }
+    if s.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+        return nil, fmt.Errorf("day of month: %w", err)
+    }
+    if s.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+        return nil, fmt.Errorf("month: %w", err)
+    }
+    if s.dow, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+        return nil, fmt.Errorf("day of week: %w", err)
+    }
+    // 7 is another name for Sunday.
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domStar = fields[2] == "*" || fields[2] == "?"
+    s.dowStar = fields[4] == "*" || fields[4] == "?"
+    return &s, nil
+}
+
+func parseField(field string, min, max int, names map[string]int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rangePart, stepPart, hasStep := strings.Cut(part, "/")
+        step := 1
+        if hasStep {
+            n, err := strconv.Atoi(stepPart)
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step %q", stepPart)
+            }
+            step = n
+        }
+
+        var lo, hi int
+        switch {
+        case rangePart == "*" || rangePart == "?":
+            lo, hi = min, max
+        case strings.Contains(rangePart, "-"):
+            from, to, _ := strings.Cut(rangePart, "-")
+            var err error
+            if lo, err = parseValue(from, names); err != nil {
+                return 0, err
+            }
+            if hi, err = parseValue(to, names); err != nil {
+                return 0, err
+            }
+        default:
+            n, err := parseValue(rangePart, names)
+            if err != nil {
+                return 0, err
+            }
+            lo, hi = n, n
+            // "5/10" means every 10 starting at 5.
+            if hasStep {
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func parseValue(s string, names map[string]int) (int, error) {
+    if n, ok := names[strings.ToLower(s)]; ok {
+        return n, nil
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid value %q", s)
+    }
+    return n, nil
+}
+
+// Next returns the first time after t the schedule fires, or the zero time if
+// it never does (e.g. "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    // Every combination repeats within a few years.
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        if s.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !s.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    if s.domStar || s.dowStar {
+        return dom && dow
+    }
+    return dom || dow
+}
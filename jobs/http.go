@@ -0,0 +1,202 @@
+package jobs
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "path"
+    "regexp"
+    "strings"
+    "time"
+)
+
+const (
+    maxIndexBytes = 4 << 20
+    maxErrorBytes = 512
+)
+
+var (
+    httpClient = &http.Client{
+        Transport: &http.Transport{
+            Proxy:                 http.ProxyFromEnvironment,
+            ResponseHeaderTimeout: time.Minute,
+            TLSHandshakeTimeout:   dialTimeout,
+            IdleConnTimeout:       time.Minute,
+        },
+    }
+    hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'#?]+)["']`)
+)
+
+// httpRemote reads folders from the index pages web servers generate (Apache,
+// nginx autoindex and the like) and remembers files by their ETag or
+// Last-Modified validator.
+type httpRemote struct {
+    base     *url.URL
+    folder   bool
+    username string
+    password string
+    headers  map[string]string
+}
+
+func newHTTPRemote(job Job) *httpRemote {
+    base, _ := url.Parse(job.Remote.URL)
+    return &httpRemote{
+        base:     base,
+        folder:   strings.HasSuffix(base.Path, "/"),
+        username: job.Remote.Username,
+        password: job.Remote.Password,
+        headers:  job.Remote.Headers,
+    }
+}
+
+func (h *httpRemote) fileURL(name string) string {
+    if !h.folder {
+        return h.base.String()
+    }
+    return h.base.ResolveReference(&url.URL{Path: name}).String()
+}
+
+func (h *httpRemote) do(ctx context.Context, method, target string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, method, target, body)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        req.ContentLength = size
+    }
+    req.Header.Set("User-Agent", "LunaTransfer-Jobs/1.0")
+    for name, value := range h.headers {
+        req.Header.Set(name, value)
+    }
+    for name, values := range header {
+        req.Header[name] = values
+    }
+    if h.username != "" {
+        req.SetBasicAuth(h.username, h.password)
+    }
+    return httpClient.Do(req)
+}
+
+func statusError(resp *http.Response) error {
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBytes))
+    if text := strings.TrimSpace(string(body)); text != "" {
+        return fmt.Errorf("server returned %s: %s", resp.Status, text)
+    }
+    return fmt.Errorf("server returned %s", resp.Status)
+}
+
+func (h *httpRemote) list(ctx context.Context) ([]remoteFile, error) {
+    if !h.folder {
+        return []remoteFile{{name: path.Base(h.base.Path), size: -1}}, nil
+    }
+
+    resp, err := h.do(ctx, http.MethodGet, h.base.String(), nil, 0, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, statusError(resp)
+    }
+    page, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexBytes))
+    if err != nil {
+        return nil, err
+    }
+
+    // Only links to files directly in the folder count; sorting links,
+    // parent and sub folders are skipped.
+    seen := map[string]bool{}
+    var files []remoteFile
+    for _, match := range hrefPattern.FindAllStringSubmatch(string(page), -1) {
+        link, err := url.Parse(match[1])
+        if err != nil {
+            continue
+        }
+        target := h.base.ResolveReference(link)
+        if target.Host != h.base.Host || path.Dir(target.Path) != path.Clean(h.base.Path) {
+            continue
+        }
+        name := path.Base(target.Path)
+        if strings.HasSuffix(target.Path, "/") || !isRemoteFileName(name) || seen[name] {
+            continue
+        }
+        seen[name] = true
+        files = append(files, remoteFile{name: name, size: -1})
+    }
+    return files, nil
+}
+
+func (h *httpRemote) fetch(ctx context.Context, file remoteFile, seen string) (io.ReadCloser, string, error) {
+    header := http.Header{}
+    if validator, value, ok := strings.Cut(seen, ":"); ok {
+        switch validator {
+        case "etag":
+            header.Set("If-None-Match", value)
+        case "modified":
+            header.Set("If-Modified-Since", value)
+        }
+    }
+
+    resp, err := h.do(ctx, http.MethodGet, h.fileURL(file.name), nil, 0, header)
+    if err != nil {
+        return nil, "", err
+    }
+    switch resp.StatusCode {
+    case http.StatusOK:
+    case http.StatusNotModified:
+        resp.Body.Close()
+        return nil, "", errUnchanged
+    default:
+        defer resp.Body.Close()
+        return nil, "", statusError(resp)
+    }
+
+    version := ""
+    if etag := resp.Header.Get("ETag"); etag != "" {
+        version = "etag:" + etag
+    } else if modified := resp.Header.Get("Last-Modified"); modified != "" {
+        version = "modified:" + modified
+    }
+    // Servers without validators cannot tell whether a file changed, so it
+    // is fetched again on every run unless the job deletes it.
+    if version != "" && version == seen {
+        resp.Body.Close()
+        return nil, "", errUnchanged
+    }
+    return resp.Body, version, nil
+}
+
+func (h *httpRemote) put(ctx context.Context, name string, r io.Reader, size int64) error {
+    header := http.Header{"Content-Type": {"application/octet-stream"}}
+    resp, err := h.do(ctx, http.MethodPut, h.fileURL(name), r, size, header)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return statusError(resp)
+    }
+    return nil
+}
+
+func (h *httpRemote) remove(ctx context.Context, name string) error {
+    resp, err := h.do(ctx, http.MethodDelete, h.fileURL(name), nil, 0, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if (resp.StatusCode < 200 || resp.StatusCode > 299) && resp.StatusCode != http.StatusNotFound {
+        return statusError(resp)
+    }
+    return nil
+}
+
+func (h *httpRemote) move(ctx context.Context, name, folder string) error {
+    return fmt.Errorf("HTTP remotes do not support moving files")
+}
+
+func (h *httpRemote) Close() error {
+    return nil
+}
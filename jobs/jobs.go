@@ -0,0 +1,323 @@
+// Package jobs runs scheduled transfers between LunaTransfer and remote SFTP
+// or HTTP servers. A pull job fetches new remote files into a folder of the
+// owner's home or of a group; a push job sends new files from such a folder
+// out. Local files are read and written through package vfs as the job's
+// creator, so group roles, the transfer log, notifications and webhooks apply
+// exactly as for a user transfer.
+package jobs
+
+import (
+    "LunaTransfer/store"
+    "errors"
+    "fmt"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DirectionPull = "pull"
+    DirectionPush = "push"
+
+    RemoteSFTP = "sftp"
+    RemoteHTTP = "http"
+
+    PostActionNone   = ""
+    PostActionDelete = "delete"
+    PostActionMove   = "move"
+
+    defaultMaxAttempts = 3
+    defaultRetryDelay  = 60
+    maxAttemptsLimit   = 10
+
+    // RedactedSecret replaces credentials in API responses.
+    RedactedSecret = "********"
+)
+
+var (
+    ErrJobNotFound = errors.New("transfer job not found")
+
+    jobsMutex sync.RWMutex
+)
+
+// Remote is the other end of a job. SFTP remotes use Host, Port, Username,
+// Password or PrivateKey and the folder Path; HostKey pins the server's key
+// fingerprint. It may only be left empty with TrustOnFirstUse, in which case
+// the key seen on the first connection is pinned. HTTP remotes
+// use URL: a URL ending in "/" is a folder whose index page lists the files
+// (pull) or below which files are PUT (push), any other URL is a single file.
+type Remote struct {
+    Type            string            `json:"type"`
+    Host            string            `json:"host,omitempty"`
+    Port            int               `json:"port,omitempty"`
+    Username        string            `json:"username,omitempty"`
+    Password        string            `json:"password,omitempty"`
+    PrivateKey      string            `json:"private_key,omitempty"`
+    HostKey         string            `json:"host_key,omitempty"`
+    TrustOnFirstUse bool              `json:"trust_on_first_use,omitempty"`
+    Path            string            `json:"path,omitempty"`
+    URL             string            `json:"url,omitempty"`
+    Headers         map[string]string `json:"headers,omitempty"`
+}
+
+// Job is a scheduled transfer. Without GroupID LocalPath is below the
+// creator's home folder, otherwise below the group folder. PostAction applies
+// to the source once a file was transferred: the remote file on pull, the
+// local file on push. MoveTo is a folder on the same side.
+type Job struct {
+    ID          string    `json:"id"`
+    Name        string    `json:"name"`
+    Direction   string    `json:"direction"`
+    Schedule    string    `json:"schedule"`
+    Enabled     bool      `json:"enabled"`
+    GroupID     string    `json:"group_id,omitempty"`
+    LocalPath   string    `json:"local_path"`
+    Pattern     string    `json:"pattern,omitempty"`
+    Remote      Remote    `json:"remote"`
+    PostAction  string    `json:"post_action,omitempty"`
+    MoveTo      string    `json:"move_to,omitempty"`
+    MaxAttempts int       `json:"max_attempts"`
+    RetryDelay  int       `json:"retry_delay_seconds"`
+    CreatedBy   string    `json:"created_by"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Redacted hides the credentials before a job is returned by the API.
+func (j Job) Redacted() Job {
+    if j.Remote.Password != "" {
+        j.Remote.Password = RedactedSecret
+    }
+    if j.Remote.PrivateKey != "" {
+        j.Remote.PrivateKey = RedactedSecret
+    }
+    if len(j.Remote.Headers) > 0 {
+        headers := make(map[string]string, len(j.Remote.Headers))
+        for name := range j.Remote.Headers {
+            headers[name] = RedactedSecret
+        }
+        j.Remote.Headers = headers
+    }
+    return j
+}
+
+// Normalize fills in defaults and cleans paths before Validate.
+func (j *Job) Normalize() {
+    j.Direction = strings.ToLower(strings.TrimSpace(j.Direction))
+    j.Remote.Type = strings.ToLower(strings.TrimSpace(j.Remote.Type))
+    j.PostAction = strings.ToLower(strings.TrimSpace(j.PostAction))
+    if j.Pattern == "" {
+        j.Pattern = "*"
+    }
+    j.LocalPath = cleanLocal(j.LocalPath)
+    if j.PostAction == PostActionMove && j.Direction == DirectionPush {
+        j.MoveTo = cleanLocal(j.MoveTo)
+    }
+    if j.MaxAttempts == 0 {
+        j.MaxAttempts = defaultMaxAttempts
+    }
+    if j.RetryDelay == 0 {
+        j.RetryDelay = defaultRetryDelay
+    }
+    if j.Remote.Type == RemoteSFTP {
+        if j.Remote.Port == 0 {
+            j.Remote.Port = 22
+        }
+        if j.Remote.Path == "" {
+            j.Remote.Path = "."
+        }
+    }
+}
+
+func cleanLocal(p string) string {
+    return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// Validate checks a job as supplied by its creator.
+func (j Job) Validate() error {
+    if strings.TrimSpace(j.Name) == "" {
+        return fmt.Errorf("name is required")
+    }
+    if j.Direction != DirectionPull && j.Direction != DirectionPush {
+        return fmt.Errorf("direction must be %q or %q", DirectionPull, DirectionPush)
+    }
+    if _, err := ParseSchedule(j.Schedule); err != nil {
+        return fmt.Errorf("invalid schedule: %w", err)
+    }
+    if strings.Contains(j.Pattern, "/") {
+        return fmt.Errorf("pattern matches file names and may not contain '/'")
+    }
+    if _, err := path.Match(j.Pattern, ""); err != nil {
+        return fmt.Errorf("invalid pattern: %w", err)
+    }
+    if j.MaxAttempts < 1 || j.MaxAttempts > maxAttemptsLimit {
+        return fmt.Errorf("max_attempts must be between 1 and %d", maxAttemptsLimit)
+    }
+    if j.RetryDelay < 1 {
+        return fmt.Errorf("retry_delay_seconds must be positive")
+    }
+
+    switch j.PostAction {
+    case PostActionNone, PostActionDelete:
+    case PostActionMove:
+        if strings.TrimSpace(j.MoveTo) == "" {
+            return fmt.Errorf("move_to is required for the move post action")
+        }
+        if j.Direction == DirectionPull && j.Remote.Type == RemoteHTTP {
+            return fmt.Errorf("HTTP remotes do not support the move post action")
+        }
+    default:
+        return fmt.Errorf("post_action must be %q or %q", PostActionDelete, PostActionMove)
+    }
+
+    switch j.Remote.Type {
+    case RemoteSFTP:
+        if j.Remote.Host == "" || j.Remote.Username == "" {
+            return fmt.Errorf("SFTP remotes need a host and username")
+        }
+        if j.Remote.Port < 1 || j.Remote.Port > 65535 {
+            return fmt.Errorf("invalid SFTP port %d", j.Remote.Port)
+        }
+        if j.Remote.Password == "" && j.Remote.PrivateKey == "" {
+            return fmt.Errorf("SFTP remotes need a password or private key")
+        }
+        if j.Remote.PrivateKey != "" {
+            if _, err := parsePrivateKey(j.Remote.PrivateKey); err != nil {
+                return fmt.Errorf("invalid private key: %w", err)
+            }
+        }
+        if j.Remote.HostKey == "" && !j.Remote.TrustOnFirstUse {
+            return fmt.Errorf("SFTP remotes need the server's host_key fingerprint, or trust_on_first_use to pin the key seen on the first connection")
+        }
+        if j.Remote.HostKey != "" && !strings.HasPrefix(j.Remote.HostKey, "SHA256:") {
+            return fmt.Errorf("host_key must be a SHA256 fingerprint (SHA256:...)")
+        }
+    case RemoteHTTP:
+        u, err := url.Parse(j.Remote.URL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("url must be an absolute http or https URL")
+        }
+        if j.Direction == DirectionPush && !strings.HasSuffix(u.Path, "/") {
+            return fmt.Errorf("push URLs must end in '/'; files are uploaded below them")
+        }
+    default:
+        return fmt.Errorf("remote type must be %q or %q", RemoteSFTP, RemoteHTTP)
+    }
+    return nil
+}
+
+const jobsFile = "jobs.json"
+
+func loadJobs() ([]Job, error) {
+    jobs := []Job{}
+    if err := store.ReadDataFile(jobsFile, &jobs); err != nil {
+        return nil, err
+    }
+    return jobs, nil
+}
+
+func saveJobs(jobs []Job) error {
+    if jobs == nil {
+        jobs = []Job{}
+    }
+    return store.WriteDataFile(jobsFile, jobs)
+}
+
+func ListJobs() ([]Job, error) {
+    jobsMutex.RLock()
+    defer jobsMutex.RUnlock()
+
+    return loadJobs()
+}
+
+func GetJob(id string) (Job, error) {
+    jobs, err := ListJobs()
+    if err != nil {
+        return Job{}, err
+    }
+    for _, job := range jobs {
+        if job.ID == id {
+            return job, nil
+        }
+    }
+    return Job{}, ErrJobNotFound
+}
+
+func CreateJob(job Job) error {
+    jobsMutex.Lock()
+    defer jobsMutex.Unlock()
+
+    jobs, err := loadJobs()
+    if err != nil {
+        return err
+    }
+    if err := saveJobs(append(jobs, job)); err != nil {
+        return err
+    }
+    wakeScheduler()
+    return nil
+}
+
+// UpdateJob replaces the stored job with the same ID.
+func UpdateJob(job Job) error {
+    jobsMutex.Lock()
+    defer jobsMutex.Unlock()
+
+    jobs, err := loadJobs()
+    if err != nil {
+        return err
+    }
+    for i := range jobs {
+        if jobs[i].ID == job.ID {
+            jobs[i] = job
+            if err := saveJobs(jobs); err != nil {
+                return err
+            }
+            wakeScheduler()
+            return nil
+        }
+    }
+    return ErrJobNotFound
+}
+
+func DeleteJob(id string) error {
+    jobsMutex.Lock()
+    defer jobsMutex.Unlock()
+
+    jobs, err := loadJobs()
+    if err != nil {
+        return err
+    }
+    for i, job := range jobs {
+        if job.ID == id {
+            if err := saveJobs(append(jobs[:i], jobs[i+1:]...)); err != nil {
+                return err
+            }
+            forgetFiles(id)
+            forgetRuns(id)
+            wakeScheduler()
+            return nil
+        }
+    }
+    return ErrJobNotFound
+}
+
+// pinHostKey records the fingerprint seen on a job's first SFTP connection.
+func pinHostKey(id, fingerprint string) error {
+    jobsMutex.Lock()
+    defer jobsMutex.Unlock()
+
+    jobs, err := loadJobs()
+    if err != nil {
+        return err
+    }
+    for i := range jobs {
+        if jobs[i].ID == id && jobs[i].Remote.HostKey == "" {
+            jobs[i].Remote.HostKey = fingerprint
+            return saveJobs(jobs)
+        }
+    }
+    return nil
+}
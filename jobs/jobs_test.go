@@ -0,0 +1,567 @@
+package jobs
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/utils"
+    "crypto/ed25519"
+    "crypto/rand"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+const (
+    testOwner    = "jobowner"
+    testPassword = "secret"
+)
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, []testenv.User{
+        {Username: testOwner, Password: "Owner12345", Email: "owner@example.com", Role: auth.RoleUser},
+    }, func() error {
+        appConfig, err := config.LoadConfig()
+        if err != nil {
+            return err
+        }
+        stagingDir = filepath.Join(appConfig.GetDataDirectory(), "job_staging")
+        return os.MkdirAll(stagingDir, 0700)
+    })
+}
+
+// newJob returns a valid job owned by testOwner with a unique ID.
+func newJob(t *testing.T, direction, localPath string, remote Remote) Job {
+    t.Helper()
+    job := Job{
+        ID:          utils.GenerateUUID(),
+        Name:        t.Name(),
+        Direction:   direction,
+        Schedule:    "@daily",
+        LocalPath:   localPath,
+        Remote:      remote,
+        MaxAttempts: 1,
+        RetryDelay:  1,
+        CreatedBy:   testOwner,
+        CreatedAt:   time.Now(),
+    }
+    job.Normalize()
+    if err := job.Validate(); err != nil {
+        t.Fatalf("invalid job: %v", err)
+    }
+    return job
+}
+
+// runJob runs job to completion and returns the run from the history.
+func runJob(t *testing.T, job Job, attempt int) Run {
+    t.Helper()
+    run, err := startRun(job, TriggerManual, testOwner, attempt)
+    if err != nil {
+        t.Fatalf("startRun: %v", err)
+    }
+    deadline := time.Now().Add(10 * time.Second)
+    for IsRunning(job.ID) {
+        if time.Now().After(deadline) {
+            t.Fatalf("run %s did not finish", run.ID)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    runs, err := ListRuns(job.ID)
+    if err != nil {
+        t.Fatalf("ListRuns: %v", err)
+    }
+    for _, r := range runs {
+        if r.ID == run.ID {
+            return r
+        }
+    }
+    t.Fatalf("run %s missing from history", run.ID)
+    return Run{}
+}
+
+func ownerFile(p string) string {
+    return filepath.Join("storage", testOwner, filepath.FromSlash(p))
+}
+
+func writeFile(t *testing.T, name, content string) {
+    t.Helper()
+    if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func readFile(t *testing.T, name string) string {
+    t.Helper()
+    data, err := os.ReadFile(name)
+    if err != nil {
+        t.Fatalf("reading %s: %v", name, err)
+    }
+    return string(data)
+}
+
+func runFileNames(run Run) []string {
+    names := []string{}
+    for _, file := range run.Files {
+        names = append(names, file.Name)
+    }
+    return names
+}
+
+// sftpServer is an SFTP server on loopback serving dir to testOwner with
+// testPassword.
+type sftpServer struct {
+    dir         string
+    port        int
+    fingerprint string
+}
+
+func startSFTPServer(t *testing.T) *sftpServer {
+    t.Helper()
+    _, key, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    serverConfig := &ssh.ServerConfig{
+        PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+            if conn.User() == testOwner && string(password) == testPassword {
+                return nil, nil
+            }
+            return nil, fmt.Errorf("access denied")
+        },
+    }
+    serverConfig.AddHostKey(signer)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := &sftpServer{
+        dir:         t.TempDir(),
+        port:        listener.Addr().(*net.TCPAddr).Port,
+        fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+    }
+    var wg sync.WaitGroup
+    t.Cleanup(func() {
+        listener.Close()
+        wg.Wait()
+    })
+
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                server.serve(conn, serverConfig)
+            }()
+        }
+    }()
+    return server
+}
+
+func (s *sftpServer) serve(conn net.Conn, serverConfig *ssh.ServerConfig) {
+    defer conn.Close()
+    _, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+    if err != nil {
+        return
+    }
+    go ssh.DiscardRequests(reqs)
+    for newChannel := range chans {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            return
+        }
+        go func() {
+            for req := range requests {
+                req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+            }
+        }()
+        server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.dir))
+        if err != nil {
+            channel.Close()
+            return
+        }
+        server.Serve()
+        server.Close()
+    }
+}
+
+func (s *sftpServer) remote(hostKey string) Remote {
+    return Remote{
+        Type:     RemoteSFTP,
+        Host:     "127.0.0.1",
+        Port:     s.port,
+        Username: testOwner,
+        Password: testPassword,
+        HostKey:  hostKey,
+        Path:     ".",
+    }
+}
+
+func TestSFTPPull(t *testing.T) {
+    server := startSFTPServer(t)
+    writeFile(t, filepath.Join(server.dir, "orders.csv"), "order,1\n")
+    writeFile(t, filepath.Join(server.dir, "notes.txt"), "skip me\n")
+
+    job := newJob(t, DirectionPull, "incoming", server.remote(server.fingerprint))
+    job.Pattern = "*.csv"
+    job.PostAction = PostActionMove
+    job.MoveTo = "done"
+
+    run := runJob(t, job, 1)
+    if run.Status != RunSucceeded {
+        t.Fatalf("run status %s: %s", run.Status, run.Error)
+    }
+    if names := runFileNames(run); len(names) != 1 || names[0] != "orders.csv" {
+        t.Fatalf("transferred %v, want [orders.csv]", names)
+    }
+    if got := readFile(t, ownerFile("incoming/orders.csv")); got != "order,1\n" {
+        t.Errorf("local content %q", got)
+    }
+    if _, err := os.Stat(filepath.Join(server.dir, "done", "orders.csv")); err != nil {
+        t.Errorf("remote file not moved: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(server.dir, "notes.txt")); err != nil {
+        t.Errorf("unmatched remote file touched: %v", err)
+    }
+}
+
+func TestSFTPPullSkipsTransferredFiles(t *testing.T) {
+    server := startSFTPServer(t)
+    writeFile(t, filepath.Join(server.dir, "daily.csv"), "v1\n")
+    job := newJob(t, DirectionPull, "daily", server.remote(server.fingerprint))
+
+    if run := runJob(t, job, 1); len(run.Files) != 1 {
+        t.Fatalf("first run transferred %v", runFileNames(run))
+    }
+    if run := runJob(t, job, 1); len(run.Files) != 0 || run.Status != RunSucceeded {
+        t.Fatalf("second run transferred %v (%s)", runFileNames(run), run.Status)
+    }
+
+    // A changed file is fetched again.
+    writeFile(t, filepath.Join(server.dir, "daily.csv"), "version 2\n")
+    if run := runJob(t, job, 1); len(run.Files) != 1 {
+        t.Fatalf("run after change transferred %v", runFileNames(run))
+    }
+    if got := readFile(t, ownerFile("daily/daily.csv")); got != "version 2\n" {
+        t.Errorf("local content %q", got)
+    }
+}
+
+func TestSFTPPush(t *testing.T) {
+    server := startSFTPServer(t)
+    writeFile(t, ownerFile("outgoing/invoice.csv"), "invoice,42\n")
+    writeFile(t, ownerFile("outgoing/readme.txt"), "not sent\n")
+
+    job := newJob(t, DirectionPush, "outgoing", server.remote(server.fingerprint))
+    job.Pattern = "*.csv"
+    job.PostAction = PostActionMove
+    job.MoveTo = "sent"
+    job.Normalize()
+
+    run := runJob(t, job, 1)
+    if run.Status != RunSucceeded {
+        t.Fatalf("run status %s: %s", run.Status, run.Error)
+    }
+    if got := readFile(t, filepath.Join(server.dir, "invoice.csv")); got != "invoice,42\n" {
+        t.Errorf("remote content %q", got)
+    }
+    if _, err := os.Stat(filepath.Join(server.dir, "invoice.csv.partial")); !os.IsNotExist(err) {
+        t.Errorf("partial upload left behind: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(server.dir, "readme.txt")); !os.IsNotExist(err) {
+        t.Errorf("unmatched file pushed: %v", err)
+    }
+    if got := readFile(t, ownerFile("sent/invoice.csv")); got != "invoice,42\n" {
+        t.Errorf("local file not moved: %q", got)
+    }
+}
+
+func TestSFTPHostKey(t *testing.T) {
+    server := startSFTPServer(t)
+    writeFile(t, filepath.Join(server.dir, "a.csv"), "a\n")
+
+    remote := server.remote("")
+    job := Job{Name: "no key", Direction: DirectionPull, Schedule: "@daily", Remote: remote}
+    job.Normalize()
+    if err := job.Validate(); err == nil || !strings.Contains(err.Error(), "host_key") {
+        t.Fatalf("job without host key validated: %v", err)
+    }
+
+    t.Run("mismatch", func(t *testing.T) {
+        job := newJob(t, DirectionPull, "hostkey", server.remote("SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"))
+        run := runJob(t, job, 1)
+        if run.Status != RunFailed || !strings.Contains(run.Error, "host key mismatch") {
+            t.Fatalf("run with wrong host key: %s %q", run.Status, run.Error)
+        }
+    })
+
+    t.Run("missing", func(t *testing.T) {
+        // Jobs stored before host keys were required fail to connect.
+        job := newJob(t, DirectionPull, "hostkey", server.remote(server.fingerprint))
+        job.Remote.HostKey = ""
+        run := runJob(t, job, 1)
+        if run.Status != RunFailed || !strings.Contains(run.Error, "no host key configured") {
+            t.Fatalf("run without host key: %s %q", run.Status, run.Error)
+        }
+    })
+
+    t.Run("trust on first use", func(t *testing.T) {
+        remote := server.remote("")
+        remote.TrustOnFirstUse = true
+        job := newJob(t, DirectionPull, "hostkey", remote)
+        if err := CreateJob(job); err != nil {
+            t.Fatal(err)
+        }
+        defer DeleteJob(job.ID)
+
+        if run := runJob(t, job, 1); run.Status != RunSucceeded {
+            t.Fatalf("run status %s: %s", run.Status, run.Error)
+        }
+        stored, err := GetJob(job.ID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if stored.Remote.HostKey != server.fingerprint {
+            t.Errorf("pinned %q, want %q", stored.Remote.HostKey, server.fingerprint)
+        }
+    })
+}
+
+// httpFolder serves files from an index page with ETags and records PUTs.
+type httpFolder struct {
+    mu    sync.Mutex
+    files map[string]string
+    puts  []string
+    // failures makes the next requests fail with 503.
+    failures int
+}
+
+func (f *httpFolder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.failures > 0 {
+        f.failures--
+        http.Error(w, "try later", http.StatusServiceUnavailable)
+        return
+    }
+    name := strings.TrimPrefix(r.URL.Path, "/files/")
+    switch {
+    case r.Method == http.MethodGet && name == "":
+        fmt.Fprint(w, `<html><body><a href="?C=N;O=D">Name</a> <a href="../">Parent</a> <a href="sub/">sub/</a>`)
+        for file := range f.files {
+            fmt.Fprintf(w, `<a href="%s">%s</a>`, file, file)
+        }
+        fmt.Fprint(w, `</body></html>`)
+    case r.Method == http.MethodGet:
+        content, ok := f.files[name]
+        if !ok {
+            http.NotFound(w, r)
+            return
+        }
+        etag := fmt.Sprintf(`"%d-%x"`, len(content), content)
+        if r.Header.Get("If-None-Match") == etag {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        w.Header().Set("ETag", etag)
+        io.WriteString(w, content)
+    case r.Method == http.MethodPut:
+        data, _ := io.ReadAll(r.Body)
+        f.files[name] = string(data)
+        f.puts = append(f.puts, name)
+        w.WriteHeader(http.StatusCreated)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func startHTTPFolder(t *testing.T, files map[string]string) (*httpFolder, string) {
+    t.Helper()
+    folder := &httpFolder{files: files}
+    server := httptest.NewServer(folder)
+    t.Cleanup(server.Close)
+    return folder, server.URL + "/files/"
+}
+
+func TestHTTPPull(t *testing.T) {
+    _, url := startHTTPFolder(t, map[string]string{"rates.csv": "eur,1.1\n", "usd.csv": "usd,1\n"})
+    job := newJob(t, DirectionPull, "rates", Remote{Type: RemoteHTTP, URL: url})
+
+    run := runJob(t, job, 1)
+    if run.Status != RunSucceeded {
+        t.Fatalf("run status %s: %s", run.Status, run.Error)
+    }
+    if names := runFileNames(run); len(names) != 2 || names[0] != "rates.csv" || names[1] != "usd.csv" {
+        t.Fatalf("transferred %v", names)
+    }
+    if got := readFile(t, ownerFile("rates/rates.csv")); got != "eur,1.1\n" {
+        t.Errorf("local content %q", got)
+    }
+
+    // Unchanged files answer 304 and are not recorded.
+    if run := runJob(t, job, 1); len(run.Files) != 0 {
+        t.Fatalf("second run transferred %v", runFileNames(run))
+    }
+}
+
+func TestHTTPPush(t *testing.T) {
+    folder, url := startHTTPFolder(t, map[string]string{})
+    writeFile(t, ownerFile("reports/q1.pdf"), "report")
+    job := newJob(t, DirectionPush, "reports", Remote{Type: RemoteHTTP, URL: url})
+    job.PostAction = PostActionDelete
+
+    run := runJob(t, job, 1)
+    if run.Status != RunSucceeded {
+        t.Fatalf("run status %s: %s", run.Status, run.Error)
+    }
+    folder.mu.Lock()
+    defer folder.mu.Unlock()
+    if len(folder.puts) != 1 || folder.files["q1.pdf"] != "report" {
+        t.Fatalf("puts %v, files %v", folder.puts, folder.files)
+    }
+    if _, err := os.Stat(ownerFile("reports/q1.pdf")); !os.IsNotExist(err) {
+        t.Errorf("local file not deleted: %v", err)
+    }
+}
+
+func TestRetries(t *testing.T) {
+    folder, url := startHTTPFolder(t, map[string]string{"batch.csv": "1\n"})
+    folder.failures = 2
+    job := newJob(t, DirectionPull, "retries", Remote{Type: RemoteHTTP, URL: url})
+    job.MaxAttempts = 3
+    job.RetryDelay = 10
+
+    before := time.Now()
+    if run := runJob(t, job, 1); run.Status != RunFailed || !strings.Contains(run.Error, "503") {
+        t.Fatalf("first attempt: %s %q", run.Status, run.Error)
+    }
+    stateMutex.Lock()
+    retry, ok := retries[job.ID]
+    stateMutex.Unlock()
+    if !ok || retry.attempt != 2 {
+        t.Fatalf("no second attempt scheduled: %+v", retry)
+    }
+    if wait := retry.at.Sub(before); wait < 10*time.Second || wait > 11*time.Second {
+        t.Errorf("second attempt in %s, want 10s", wait)
+    }
+    if _, ok := takeRetry(job.ID, time.Now()); ok {
+        t.Fatal("retry taken before it was due")
+    }
+
+    // The delay doubles with every attempt.
+    retry, ok = takeRetry(job.ID, retry.at)
+    if !ok {
+        t.Fatal("due retry not taken")
+    }
+    before = time.Now()
+    if run := runJob(t, job, retry.attempt); run.Status != RunFailed || run.Attempt != 2 {
+        t.Fatalf("second attempt: %s attempt %d", run.Status, run.Attempt)
+    }
+    stateMutex.Lock()
+    retry = retries[job.ID]
+    stateMutex.Unlock()
+    if wait := retry.at.Sub(before); retry.attempt != 3 || wait < 20*time.Second || wait > 21*time.Second {
+        t.Fatalf("third attempt %d in %s, want 3 in 20s", retry.attempt, wait)
+    }
+
+    dropRetry(job.ID)
+    if run := runJob(t, job, 3); run.Status != RunSucceeded || len(run.Files) != 1 {
+        t.Fatalf("third attempt: %s %v %q", run.Status, runFileNames(run), run.Error)
+    }
+    stateMutex.Lock()
+    _, ok = retries[job.ID]
+    stateMutex.Unlock()
+    if ok {
+        t.Error("retry scheduled after success")
+    }
+
+    // The last attempt is not retried.
+    folder.mu.Lock()
+    folder.failures = 1
+    folder.mu.Unlock()
+    if run := runJob(t, job, 3); run.Status != RunFailed {
+        t.Fatalf("last attempt: %s", run.Status)
+    }
+    stateMutex.Lock()
+    _, ok = retries[job.ID]
+    stateMutex.Unlock()
+    if ok {
+        t.Error("retry scheduled after the last attempt")
+    }
+}
+
+func TestRunHistory(t *testing.T) {
+    jobID := utils.GenerateUUID()
+    other := utils.GenerateUUID()
+    start := time.Now().Add(-time.Hour)
+    if err := saveRun(Run{ID: utils.GenerateUUID(), JobID: other, Status: RunSucceeded, StartedAt: start}); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < maxRunsPerJob+5; i++ {
+        run := Run{ID: fmt.Sprintf("run-%03d", i), JobID: jobID, Status: RunSucceeded, StartedAt: start.Add(time.Duration(i) * time.Second)}
+        if err := saveRun(run); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    runs, err := ListRuns(jobID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(runs) != maxRunsPerJob {
+        t.Fatalf("kept %d runs, want %d", len(runs), maxRunsPerJob)
+    }
+    if runs[0].ID != fmt.Sprintf("run-%03d", maxRunsPerJob+4) || runs[len(runs)-1].ID != "run-005" {
+        t.Errorf("kept runs %s..%s, want the newest first", runs[0].ID, runs[len(runs)-1].ID)
+    }
+    if runs, _ := ListRuns(other); len(runs) != 1 {
+        t.Errorf("other job has %d runs, want 1", len(runs))
+    }
+
+    // Runs left running by a stopped server are closed as failed.
+    interrupted := Run{ID: utils.GenerateUUID(), JobID: jobID, Status: RunRunning, StartedAt: time.Now()}
+    if err := saveRun(interrupted); err != nil {
+        t.Fatal(err)
+    }
+    if err := failInterruptedRuns(); err != nil {
+        t.Fatal(err)
+    }
+    runs, _ = ListRuns(jobID)
+    if runs[0].ID != interrupted.ID || runs[0].Status != RunFailed || runs[0].FinishedAt == nil {
+        t.Errorf("interrupted run: %+v", runs[0])
+    }
+
+    forgetRuns(jobID)
+    if runs, _ := ListRuns(jobID); len(runs) != 0 {
+        t.Errorf("%d runs left after forgetRuns", len(runs))
+    }
+}
@@ -0,0 +1,217 @@
+package jobs
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+const dialTimeout = 30 * time.Second
+
+// errUnchanged is returned by fetch when the remote file still has the
+// version that was transferred before.
+var errUnchanged = errors.New("remote file unchanged")
+
+// remoteFile is a file found on a remote. version identifies its content as
+// far as the remote can tell; it may be empty until the file is fetched.
+type remoteFile struct {
+    name    string
+    size    int64
+    version string
+}
+
+// remote is a connection to the other end of a job. Names are file names
+// within the configured remote folder.
+type remote interface {
+    list(ctx context.Context) ([]remoteFile, error)
+    // fetch opens a file unless its version still equals seen.
+    fetch(ctx context.Context, file remoteFile, seen string) (io.ReadCloser, string, error)
+    put(ctx context.Context, name string, r io.Reader, size int64) error
+    remove(ctx context.Context, name string) error
+    move(ctx context.Context, name, folder string) error
+    Close() error
+}
+
+func connect(ctx context.Context, job Job) (remote, error) {
+    switch job.Remote.Type {
+    case RemoteSFTP:
+        return dialSFTP(ctx, job)
+    case RemoteHTTP:
+        return newHTTPRemote(job), nil
+    }
+    return nil, fmt.Errorf("unknown remote type %q", job.Remote.Type)
+}
+
+func parsePrivateKey(key string) (ssh.Signer, error) {
+    return ssh.ParsePrivateKey([]byte(key))
+}
+
+type sftpRemote struct {
+    conn   *ssh.Client
+    client *sftp.Client
+    dir    string
+}
+
+func dialSFTP(ctx context.Context, job Job) (*sftpRemote, error) {
+    var methods []ssh.AuthMethod
+    if job.Remote.PrivateKey != "" {
+        signer, err := parsePrivateKey(job.Remote.PrivateKey)
+        if err != nil {
+            return nil, fmt.Errorf("invalid private key: %w", err)
+        }
+        methods = append(methods, ssh.PublicKeys(signer))
+    }
+    if job.Remote.Password != "" {
+        methods = append(methods, ssh.Password(job.Remote.Password))
+    }
+
+    // Without a pinned key the first key seen is trusted and pinned, but
+    // only if the job asks for that.
+    hostKey := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+        fingerprint := ssh.FingerprintSHA256(key)
+        if job.Remote.HostKey == "" {
+            if !job.Remote.TrustOnFirstUse {
+                return fmt.Errorf("no host key configured: server offered %s", fingerprint)
+            }
+            return pinHostKey(job.ID, fingerprint)
+        }
+        if fingerprint != job.Remote.HostKey {
+            return fmt.Errorf("host key mismatch: server offered %s, expected %s", fingerprint, job.Remote.HostKey)
+        }
+        return nil
+    }
+
+    addr := net.JoinHostPort(job.Remote.Host, strconv.Itoa(job.Remote.Port))
+    dialer := net.Dialer{Timeout: dialTimeout}
+    rawConn, err := dialer.DialContext(ctx, "tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    rawConn.SetDeadline(time.Now().Add(dialTimeout))
+    sshConn, chans, reqs, err := ssh.NewClientConn(rawConn, addr, &ssh.ClientConfig{
+        User:            job.Remote.Username,
+        Auth:            methods,
+        HostKeyCallback: hostKey,
+        ClientVersion:   "SSH-2.0-LunaTransfer",
+        Timeout:         dialTimeout,
+    })
+    if err != nil {
+        rawConn.Close()
+        return nil, err
+    }
+    rawConn.SetDeadline(time.Time{})
+    conn := ssh.NewClient(sshConn, chans, reqs)
+
+    client, err := sftp.NewClient(conn)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    // Closing the connection aborts a transfer in progress on cancellation.
+    go func() {
+        <-ctx.Done()
+        conn.Close()
+    }()
+    return &sftpRemote{conn: conn, client: client, dir: job.Remote.Path}, nil
+}
+
+func (s *sftpRemote) path(name string) string {
+    return path.Join(s.dir, name)
+}
+
+func (s *sftpRemote) list(ctx context.Context) ([]remoteFile, error) {
+    infos, err := s.client.ReadDir(s.dir)
+    if err != nil {
+        return nil, err
+    }
+    files := make([]remoteFile, 0, len(infos))
+    for _, info := range infos {
+        if !info.Mode().IsRegular() || !isRemoteFileName(info.Name()) {
+            continue
+        }
+        files = append(files, remoteFile{
+            name:    info.Name(),
+            size:    info.Size(),
+            version: fmt.Sprintf("%d:%d", info.Size(), info.ModTime().Unix()),
+        })
+    }
+    return files, nil
+}
+
+func (s *sftpRemote) fetch(ctx context.Context, file remoteFile, seen string) (io.ReadCloser, string, error) {
+    if seen != "" && seen == file.version {
+        return nil, "", errUnchanged
+    }
+    f, err := s.client.Open(s.path(file.name))
+    if err != nil {
+        return nil, "", err
+    }
+    return f, file.version, nil
+}
+
+// put uploads under a temporary name and renames the file when complete, so
+// partners polling the folder never pick up a partial file.
+func (s *sftpRemote) put(ctx context.Context, name string, r io.Reader, size int64) error {
+    target := s.path(name)
+    partial := target + ".partial"
+    f, err := s.client.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(f, r); err != nil {
+        f.Close()
+        s.client.Remove(partial)
+        return err
+    }
+    if err := f.Close(); err != nil {
+        s.client.Remove(partial)
+        return err
+    }
+    if err := s.client.PosixRename(partial, target); err != nil {
+        // Servers without the posix-rename extension refuse to replace.
+        s.client.Remove(target)
+        if err := s.client.Rename(partial, target); err != nil {
+            s.client.Remove(partial)
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *sftpRemote) remove(ctx context.Context, name string) error {
+    return s.client.Remove(s.path(name))
+}
+
+func (s *sftpRemote) move(ctx context.Context, name, folder string) error {
+    target := path.Join(folder, name)
+    if !path.IsAbs(folder) {
+        target = path.Join(s.dir, folder, name)
+    }
+    if err := s.client.MkdirAll(path.Dir(target)); err != nil {
+        return err
+    }
+    if err := s.client.PosixRename(s.path(name), target); err != nil {
+        return s.client.Rename(s.path(name), target)
+    }
+    return nil
+}
+
+func (s *sftpRemote) Close() error {
+    s.client.Close()
+    return s.conn.Close()
+}
+
+// isRemoteFileName rejects names a listing should never produce.
+func isRemoteFileName(name string) bool {
+    return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
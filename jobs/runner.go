@@ -0,0 +1,458 @@
+package jobs
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    pollInterval = 15 * time.Second
+    // A single run may take long for big files, but never forever.
+    runTimeout = 6 * time.Hour
+)
+
+var (
+    ErrJobRunning = errors.New("transfer job is already running")
+
+    wake = make(chan struct{}, 1)
+
+    stateMutex sync.Mutex
+    running    = map[string]bool{}
+    retries    = map[string]pendingRetry{}
+    runCtx     = context.Background()
+    stagingDir string
+)
+
+type pendingRetry struct {
+    attempt int
+    at      time.Time
+}
+
+func wakeScheduler() {
+    select {
+    case wake <- struct{}{}:
+    default:
+    }
+}
+
+// Start runs jobs on their schedules until ctx is cancelled; runs in progress
+// are cancelled with it.
+func Start(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return
+    }
+    stagingDir = filepath.Join(appConfig.GetDataDirectory(), "job_staging")
+    os.RemoveAll(stagingDir)
+    if err := os.MkdirAll(stagingDir, 0700); err != nil {
+        utils.LogError("JOB_ERROR", err, "system", "Failed to create job staging directory")
+        return
+    }
+    if err := failInterruptedRuns(); err != nil {
+        utils.LogError("JOB_ERROR", err, "system", "Failed to load job run history")
+    }
+
+    stateMutex.Lock()
+    runCtx = ctx
+    stateMutex.Unlock()
+
+    ticker := time.NewTicker(pollInterval)
+    defer ticker.Stop()
+    next := map[string]time.Time{}
+    schedules := map[string]string{}
+    for {
+        jobs, err := ListJobs()
+        if err != nil {
+            utils.LogError("JOB_ERROR", err, "system", "Failed to load transfer jobs")
+        }
+
+        now := time.Now()
+        known := map[string]bool{}
+        for _, job := range jobs {
+            known[job.ID] = true
+            if !job.Enabled {
+                delete(next, job.ID)
+                continue
+            }
+            schedule, err := ParseSchedule(job.Schedule)
+            if err != nil {
+                continue
+            }
+            // New or rescheduled jobs first run at their next slot.
+            if _, ok := next[job.ID]; !ok || schedules[job.ID] != job.Schedule {
+                next[job.ID] = schedule.Next(now)
+                schedules[job.ID] = job.Schedule
+            }
+
+            if retry, ok := takeRetry(job.ID, now); ok {
+                startRun(job, TriggerRetry, "", retry.attempt)
+            }
+            if due := next[job.ID]; !due.IsZero() && !due.After(now) {
+                next[job.ID] = schedule.Next(now)
+                if _, err := startRun(job, TriggerSchedule, "", 1); errors.Is(err, ErrJobRunning) {
+                    utils.LogSystem("JOB_SKIPPED", job.CreatedBy, "localhost",
+                        fmt.Sprintf("Job %s (%s) skipped its scheduled run: the previous run is still going", job.Name, job.ID))
+                }
+            }
+        }
+        for id := range next {
+            if !known[id] {
+                delete(next, id)
+                delete(schedules, id)
+                dropRetry(id)
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        case <-wake:
+        }
+    }
+}
+
+// NextRun is when an enabled job is next due on its schedule.
+func NextRun(job Job) *time.Time {
+    if !job.Enabled {
+        return nil
+    }
+    schedule, err := ParseSchedule(job.Schedule)
+    if err != nil {
+        return nil
+    }
+    next := schedule.Next(time.Now())
+    if next.IsZero() {
+        return nil
+    }
+    return &next
+}
+
+func IsRunning(id string) bool {
+    stateMutex.Lock()
+    defer stateMutex.Unlock()
+    return running[id]
+}
+
+// RunNow starts a run of job right away on behalf of username.
+func RunNow(job Job, username string) (Run, error) {
+    dropRetry(job.ID)
+    return startRun(job, TriggerManual, username, 1)
+}
+
+func takeRetry(id string, now time.Time) (pendingRetry, bool) {
+    stateMutex.Lock()
+    defer stateMutex.Unlock()
+    retry, ok := retries[id]
+    if !ok || retry.at.After(now) || running[id] {
+        return pendingRetry{}, false
+    }
+    delete(retries, id)
+    return retry, true
+}
+
+func dropRetry(id string) {
+    stateMutex.Lock()
+    delete(retries, id)
+    stateMutex.Unlock()
+}
+
+// startRun records a new run and executes it in the background.
+func startRun(job Job, trigger, triggeredBy string, attempt int) (Run, error) {
+    stateMutex.Lock()
+    if running[job.ID] {
+        stateMutex.Unlock()
+        return Run{}, ErrJobRunning
+    }
+    running[job.ID] = true
+    ctx := runCtx
+    stateMutex.Unlock()
+
+    run := Run{
+        ID:          utils.GenerateUUID(),
+        JobID:       job.ID,
+        Trigger:     trigger,
+        TriggeredBy: triggeredBy,
+        Attempt:     attempt,
+        Status:      RunRunning,
+        Files:       []RunFile{},
+        StartedAt:   time.Now(),
+    }
+    if err := saveRun(run); err != nil {
+        utils.LogError("JOB_ERROR", err, job.CreatedBy, "Failed to record job run")
+    }
+
+    go func() {
+        defer func() {
+            stateMutex.Lock()
+            delete(running, job.ID)
+            stateMutex.Unlock()
+        }()
+        execute(ctx, job, run)
+    }()
+    return run, nil
+}
+
+func execute(parent context.Context, job Job, run Run) {
+    ctx, cancel := context.WithTimeout(parent, runTimeout)
+    defer cancel()
+
+    err := transfer(ctx, job, &run)
+    failed := 0
+    for _, file := range run.Files {
+        if file.Error != "" {
+            failed++
+        }
+    }
+    if err == nil && failed > 0 {
+        err = fmt.Errorf("%d of %d files failed", failed, len(run.Files))
+    }
+
+    finished := time.Now()
+    run.FinishedAt = &finished
+    run.Status = RunSucceeded
+    if err != nil {
+        run.Status = RunFailed
+        run.Error = err.Error()
+    }
+    if saveErr := saveRun(run); saveErr != nil {
+        utils.LogError("JOB_ERROR", saveErr, job.CreatedBy, "Failed to record job run")
+    }
+
+    summary := fmt.Sprintf("Job %s (%s, %s %s) attempt %d: %d files transferred",
+        job.Name, job.ID, job.Direction, remoteName(job), run.Attempt, len(run.Files)-failed)
+    if err == nil {
+        utils.LogSystem("JOB_RUN", job.CreatedBy, "localhost", summary)
+        return
+    }
+    utils.LogError("JOB_FAILED", err, job.CreatedBy, summary)
+
+    if run.Attempt < job.MaxAttempts && parent.Err() == nil {
+        delay := time.Duration(job.RetryDelay) * time.Second << (run.Attempt - 1)
+        stateMutex.Lock()
+        retries[job.ID] = pendingRetry{attempt: run.Attempt + 1, at: time.Now().Add(delay)}
+        stateMutex.Unlock()
+    }
+}
+
+// remoteName identifies the remote in logs without credentials.
+func remoteName(job Job) string {
+    if job.Remote.Type == RemoteSFTP {
+        return fmt.Sprintf("sftp://%s@%s:%d/%s", job.Remote.Username, job.Remote.Host, job.Remote.Port,
+            strings.TrimPrefix(job.Remote.Path, "/"))
+    }
+    if u, err := url.Parse(job.Remote.URL); err == nil {
+        u.User = nil
+        u.RawQuery = ""
+        return u.String()
+    }
+    return job.Remote.Type
+}
+
+func remoteHost(job Job) string {
+    if job.Remote.Type == RemoteSFTP {
+        return job.Remote.Host
+    }
+    if u, err := url.Parse(job.Remote.URL); err == nil {
+        return u.Hostname()
+    }
+    return "localhost"
+}
+
+// localRoot is the job's folder in the creator's virtual tree.
+func localRoot(job Job) string {
+    root := "/" + vfs.HomeDir
+    if job.GroupID != "" {
+        root = "/" + path.Join(vfs.GroupsDir, job.GroupID)
+    }
+    return path.Join(root, job.LocalPath)
+}
+
+func matching(pattern, name string) bool {
+    ok, _ := path.Match(pattern, name)
+    return ok
+}
+
+func transfer(ctx context.Context, job Job, run *Run) error {
+    fs, err := vfs.New(job.CreatedBy, remoteHost(job), "Job "+job.Name)
+    if err != nil {
+        return fmt.Errorf("job owner %s is not available: %w", job.CreatedBy, err)
+    }
+    folder := localRoot(job)
+    action := vfs.ActionRead
+    if job.Direction == DirectionPull {
+        action = vfs.ActionWrite
+    }
+    if err := fs.Check(folder, action); err != nil {
+        return fmt.Errorf("%s may not %s %s: %w", job.CreatedBy, action, folder, err)
+    }
+
+    seen, err := transferredFiles(job.ID)
+    if err != nil {
+        return err
+    }
+    r, err := connect(ctx, job)
+    if err != nil {
+        return fmt.Errorf("connecting to %s: %w", remoteName(job), err)
+    }
+    defer r.Close()
+
+    if job.Direction == DirectionPull {
+        return pull(ctx, job, run, fs, r, folder, seen)
+    }
+    return push(ctx, job, run, fs, r, folder, seen)
+}
+
+func pull(ctx context.Context, job Job, run *Run, fs *vfs.FS, r remote, folder string, seen map[string]string) error {
+    files, err := r.list(ctx)
+    if err != nil {
+        return fmt.Errorf("listing %s: %w", remoteName(job), err)
+    }
+    sort.Slice(files, func(i, k int) bool { return files[i].name < files[k].name })
+
+    for _, file := range files {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if !matching(job.Pattern, file.name) {
+            continue
+        }
+        result, err := pullFile(ctx, job, fs, r, folder, file, seen[file.name])
+        if errors.Is(err, errUnchanged) {
+            continue
+        }
+        if err != nil {
+            result.Error = err.Error()
+        }
+        run.Files = append(run.Files, result)
+    }
+    return nil
+}
+
+func pullFile(ctx context.Context, job Job, fs *vfs.FS, r remote, folder string, file remoteFile, seen string) (RunFile, error) {
+    result := RunFile{Name: file.name}
+    body, version, err := r.fetch(ctx, file, seen)
+    if err != nil {
+        return result, err
+    }
+
+    // The remote file is staged first so that only complete files appear
+    // in LunaTransfer.
+    staged, err := os.CreateTemp(stagingDir, "pull-*")
+    if err != nil {
+        body.Close()
+        return result, err
+    }
+    defer os.Remove(staged.Name())
+    defer staged.Close()
+    result.Size, err = io.Copy(staged, body)
+    body.Close()
+    if err != nil {
+        return result, err
+    }
+    if _, err := staged.Seek(0, io.SeekStart); err != nil {
+        return result, err
+    }
+
+    if err := fs.MkdirAll(folder); err != nil {
+        return result, err
+    }
+    local, err := fs.Create(path.Join(folder, file.name), os.O_TRUNC)
+    if err != nil {
+        return result, err
+    }
+    _, err = io.Copy(struct{ io.Writer }{local}, staged)
+    if closeErr := local.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return result, err
+    }
+    if version != "" {
+        if err := markTransferred(job.ID, file.name, version); err != nil {
+            utils.LogError("JOB_ERROR", err, job.CreatedBy, "Failed to record transferred file")
+        }
+    }
+
+    switch job.PostAction {
+    case PostActionDelete:
+        err = r.remove(ctx, file.name)
+    case PostActionMove:
+        err = r.move(ctx, file.name, job.MoveTo)
+    }
+    if err != nil {
+        return result, fmt.Errorf("transferred, but %s on the remote failed: %w", job.PostAction, err)
+    }
+    return result, nil
+}
+
+func push(ctx context.Context, job Job, run *Run, fs *vfs.FS, r remote, folder string, seen map[string]string) error {
+    infos, err := fs.ReadDir(folder)
+    if err != nil {
+        return fmt.Errorf("listing %s: %w", folder, err)
+    }
+    sort.Slice(infos, func(i, k int) bool { return infos[i].Name() < infos[k].Name() })
+
+    for _, info := range infos {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if !info.Mode().IsRegular() || !matching(job.Pattern, info.Name()) {
+            continue
+        }
+        version := fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+        if seen[info.Name()] == version {
+            continue
+        }
+        result := RunFile{Name: info.Name(), Size: info.Size()}
+        if err := pushFile(ctx, job, fs, r, folder, info.Name(), info.Size(), version); err != nil {
+            result.Error = err.Error()
+        }
+        run.Files = append(run.Files, result)
+    }
+    return nil
+}
+
+func pushFile(ctx context.Context, job Job, fs *vfs.FS, r remote, folder, name string, size int64, version string) error {
+    p := path.Join(folder, name)
+    local, err := fs.Open(p)
+    if err != nil {
+        return err
+    }
+    // Hide WriteTo so that the read is counted as a download.
+    err = r.put(ctx, name, struct{ io.Reader }{local}, size)
+    local.Close()
+    if err != nil {
+        return err
+    }
+    if err := markTransferred(job.ID, name, version); err != nil {
+        utils.LogError("JOB_ERROR", err, job.CreatedBy, "Failed to record transferred file")
+    }
+
+    switch job.PostAction {
+    case PostActionDelete:
+        err = fs.Remove(p)
+    case PostActionMove:
+        target := localRoot(Job{GroupID: job.GroupID, LocalPath: job.MoveTo})
+        if err = fs.MkdirAll(target); err == nil {
+            err = fs.Rename(p, path.Join(target, name), true)
+        }
+    }
+    if err != nil {
+        return fmt.Errorf("transferred, but %s of the local file failed: %w", job.PostAction, err)
+    }
+    return nil
+}
@@ -0,0 +1,213 @@
+package jobs
+
+import (
+    "LunaTransfer/store"
+    "sort"
+    "sync"
+    "time"
+)
+
+const maxRunsPerJob = 100
+
+type RunStatus string
+
+const (
+    RunRunning   RunStatus = "running"
+    RunSucceeded RunStatus = "succeeded"
+    RunFailed    RunStatus = "failed"
+)
+
+const (
+    TriggerSchedule = "schedule"
+    TriggerManual   = "manual"
+    TriggerRetry    = "retry"
+)
+
+var (
+    runsMutex  sync.Mutex
+    filesMutex sync.Mutex
+)
+
+// RunFile is one file a run transferred or failed to transfer.
+type RunFile struct {
+    Name  string `json:"name"`
+    Size  int64  `json:"size"`
+    Error string `json:"error,omitempty"`
+}
+
+// Run is one attempt of a job. A failed attempt is retried until the job's
+// MaxAttempts; files that were already transferred are not sent again.
+type Run struct {
+    ID          string     `json:"id"`
+    JobID       string     `json:"job_id"`
+    Trigger     string     `json:"trigger"`
+    TriggeredBy string     `json:"triggered_by,omitempty"`
+    Attempt     int        `json:"attempt"`
+    Status      RunStatus  `json:"status"`
+    Files       []RunFile  `json:"files"`
+    Error       string     `json:"error,omitempty"`
+    StartedAt   time.Time  `json:"started_at"`
+    FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func loadRuns() ([]Run, error) {
+    runs := []Run{}
+    err := store.ReadDataFile("job_runs.json", &runs)
+    return runs, err
+}
+
+// saveRun adds or replaces run in the history, keeping the latest
+// maxRunsPerJob runs of each job so that a frequent job cannot push the
+// history of the others out.
+func saveRun(run Run) error {
+    runsMutex.Lock()
+    defer runsMutex.Unlock()
+
+    runs, err := loadRuns()
+    if err != nil {
+        return err
+    }
+    found := false
+    for i := range runs {
+        if runs[i].ID == run.ID {
+            runs[i] = run
+            found = true
+            break
+        }
+    }
+    if !found {
+        runs = append(runs, run)
+    }
+    count := 0
+    for _, r := range runs {
+        if r.JobID == run.JobID {
+            count++
+        }
+    }
+    if count > maxRunsPerJob {
+        kept := runs[:0]
+        for _, r := range runs {
+            if r.JobID == run.JobID && count > maxRunsPerJob && r.Status != RunRunning {
+                count--
+                continue
+            }
+            kept = append(kept, r)
+        }
+        runs = kept
+    }
+    return store.WriteDataFile("job_runs.json", runs)
+}
+
+// ListRuns returns the history of a job, newest first.
+func ListRuns(jobID string) ([]Run, error) {
+    runsMutex.Lock()
+    runs, err := loadRuns()
+    runsMutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    result := []Run{}
+    for _, run := range runs {
+        if run.JobID == jobID {
+            result = append(result, run)
+        }
+    }
+    sort.SliceStable(result, func(i, k int) bool {
+        return result[i].StartedAt.After(result[k].StartedAt)
+    })
+    return result, nil
+}
+
+func forgetRuns(jobID string) {
+    runsMutex.Lock()
+    defer runsMutex.Unlock()
+
+    runs, err := loadRuns()
+    if err != nil {
+        return
+    }
+    kept := runs[:0]
+    for _, run := range runs {
+        if run.JobID != jobID {
+            kept = append(kept, run)
+        }
+    }
+    store.WriteDataFile("job_runs.json", kept)
+}
+
+// failInterruptedRuns closes runs that were still running when the server
+// stopped.
+func failInterruptedRuns() error {
+    runsMutex.Lock()
+    defer runsMutex.Unlock()
+
+    runs, err := loadRuns()
+    if err != nil {
+        return err
+    }
+    changed := false
+    now := time.Now()
+    for i := range runs {
+        if runs[i].Status == RunRunning {
+            runs[i].Status = RunFailed
+            runs[i].Error = "interrupted by server shutdown"
+            runs[i].FinishedAt = &now
+            changed = true
+        }
+    }
+    if !changed {
+        return nil
+    }
+    return store.WriteDataFile("job_runs.json", runs)
+}
+
+// The files a job already transferred are remembered by name together with a
+// version (size and modification time, or the HTTP validator) so that later
+// runs only pick up new or changed files.
+func loadFiles() (map[string]map[string]string, error) {
+    files := map[string]map[string]string{}
+    err := store.ReadDataFile("job_files.json", &files)
+    return files, err
+}
+
+func transferredFiles(jobID string) (map[string]string, error) {
+    filesMutex.Lock()
+    defer filesMutex.Unlock()
+
+    files, err := loadFiles()
+    if err != nil {
+        return nil, err
+    }
+    if files[jobID] == nil {
+        return map[string]string{}, nil
+    }
+    return files[jobID], nil
+}
+
+func markTransferred(jobID, name, version string) error {
+    filesMutex.Lock()
+    defer filesMutex.Unlock()
+
+    files, err := loadFiles()
+    if err != nil {
+        return err
+    }
+    if files[jobID] == nil {
+        files[jobID] = map[string]string{}
+    }
+    files[jobID][name] = version
+    return store.WriteDataFile("job_files.json", files)
+}
+
+func forgetFiles(jobID string) {
+    filesMutex.Lock()
+    defer filesMutex.Unlock()
+
+    files, err := loadFiles()
+    if err != nil || files[jobID] == nil {
+        return
+    }
+    delete(files, jobID)
+    store.WriteDataFile("job_files.json", files)
+}
@@ -0,0 +1,161 @@
+package mailer
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "bytes"
+    "fmt"
+    "strings"
+    "text/template"
+    "time"
+)
+
+type Kind string
+
+const (
+    KindShareCreated Kind = "share_created"
+    KindShareRemoved Kind = "share_removed"
+    KindFileReceived Kind = "file_received"
+    KindQuotaWarning Kind = "quota_warning"
+    KindLinkExpiring Kind = "link_expiring"
+)
+
+// Kinds lists every notification a user can opt in or out of.
+var Kinds = []Kind{KindShareCreated, KindShareRemoved, KindFileReceived, KindQuotaWarning, KindLinkExpiring}
+
+type messageTemplate struct {
+    subject *template.Template
+    body    *template.Template
+}
+
+func newTemplate(name, subject, body string) messageTemplate {
+    return messageTemplate{
+        subject: template.Must(template.New(name + "_subject").Parse(subject)),
+        body:    template.Must(template.New(name + "_body").Parse(body)),
+    }
+}
+
+var templates = map[Kind]messageTemplate{
+    KindShareCreated: newTemplate(string(KindShareCreated),
+        `{{.Actor}} shared "{{.File}}" with {{.Group}}`,
+        `Hello {{.Recipient}},
+
+{{.Actor}} shared "{{.File}}" with the group {{.Group}} ({{.Permission}} access).
+{{if .ExpiresAt}}The share expires on {{.ExpiresAt}}.
+{{end}}
+You can find it under {{.Path}} in LunaTransfer.
+`),
+    KindShareRemoved: newTemplate(string(KindShareRemoved),
+        `"{{.File}}" is no longer shared with {{.Group}}`,
+        `Hello {{.Recipient}},
+
+{{.Actor}} removed the share of "{{.File}}" with the group {{.Group}}.
+The file is no longer available to group members.
+`),
+    KindFileReceived: newTemplate(string(KindFileReceived),
+        `New file received: {{.File}}`,
+        `Hello {{.Recipient}},
+
+{{.Actor}} uploaded "{{.File}}" ({{.Size}}) to {{.Path}}.
+`),
+    KindQuotaWarning: newTemplate(string(KindQuotaWarning),
+        `Your LunaTransfer storage is {{.Percent}}% full`,
+        `Hello {{.Recipient}},
+
+You are using {{.Used}} of your {{.Limit}} storage quota ({{.Percent}}%).
+Please remove files you no longer need to avoid failed uploads.
+`),
+    KindLinkExpiring: newTemplate(string(KindLinkExpiring),
+        `Share of "{{.File}}" expires soon`,
+        `Hello {{.Recipient}},
+
+The share of "{{.File}}" with the group {{.Group}} expires on {{.ExpiresAt}}.
+{{if .CanExtend}}You can extend it from the sharing settings before then.
+{{end}}`),
+}
+
+// Data carries the values substituted into a notification template.
+type Data struct {
+    Recipient  string
+    Actor      string
+    File       string
+    Path       string
+    Group      string
+    Permission string
+    ExpiresAt  string
+    Size       string
+    Used       string
+    Limit      string
+    Percent    int
+    CanExtend  bool
+}
+
+// Notify renders the template for kind and queues one email per recipient who
+// has an address on file and has not opted out of this kind. It is a no-op when
+// SMTP is not configured.
+func Notify(kind Kind, usernames []string, data Data) {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.SMTP.Enabled {
+        return
+    }
+
+    tmpl, ok := templates[kind]
+    if !ok {
+        utils.LogError("MAIL_ERROR", fmt.Errorf("unknown notification kind %q", kind), "system")
+        return
+    }
+
+    seen := make(map[string]bool)
+    for _, username := range usernames {
+        if username == "" || seen[username] {
+            continue
+        }
+        seen[username] = true
+
+        user, err := auth.GetUserByUsername(username)
+        if err != nil || user.Email == "" {
+            continue
+        }
+
+        prefs, err := GetPreferences(username)
+        if err != nil {
+            utils.LogError("MAIL_ERROR", err, username, "Failed to load notification preferences")
+            continue
+        }
+        if !prefs.Wants(kind) {
+            continue
+        }
+
+        data.Recipient = username
+        subject, body, err := render(tmpl, data)
+        if err != nil {
+            utils.LogError("MAIL_ERROR", err, username, fmt.Sprintf("Failed to render %s email", kind))
+            continue
+        }
+
+        if err := enqueue(Message{
+            ID:        utils.GenerateUUID(),
+            Kind:      kind,
+            To:        user.Email,
+            Username:  username,
+            Subject:   subject,
+            Body:      body,
+            CreatedAt: time.Now(),
+        }); err != nil {
+            utils.LogError("MAIL_ERROR", err, username, fmt.Sprintf("Failed to queue %s email", kind))
+        }
+    }
+}
+
+func render(tmpl messageTemplate, data Data) (string, string, error) {
+    var subject, body bytes.Buffer
+    if err := tmpl.subject.Execute(&subject, data); err != nil {
+        return "", "", err
+    }
+    if err := tmpl.body.Execute(&body, data); err != nil {
+        return "", "", err
+    }
+    // Subjects end up in a header, so they must stay on one line.
+    return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
@@ -0,0 +1,402 @@
+package mailer
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "math/big"
+    "net"
+    "net/textproto"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const (
+    testUser     = "mailuser"
+    testAddress  = "mailuser@example.com"
+    smtpUsername = "relay"
+    smtpPassword = "relay-secret"
+)
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, []testenv.User{
+        {Username: testUser, Password: "Mail123456", Email: testAddress, Role: auth.RoleUser},
+    }, nil)
+}
+
+// received is one message the fake server accepted.
+type received struct {
+    from, to string
+    data     string
+}
+
+// smtpServer is a fake SMTP server on loopback. It offers STARTTLS unless
+// noTLS is set, accepts AUTH PLAIN with smtpUsername and smtpPassword, and
+// answers MAIL FROM with a temporary failure while failures is positive.
+type smtpServer struct {
+    addr     *net.TCPAddr
+    tls      *tls.Config
+    noTLS    bool
+    mu       sync.Mutex
+    failures int
+    sessions int
+    // auth records for every AUTH whether it came over TLS.
+    auth     []bool
+    messages []received
+}
+
+func startSMTPServer(t *testing.T, noTLS bool) *smtpServer {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &smtpServer{addr: listener.Addr().(*net.TCPAddr), tls: testTLSConfig(t), noTLS: noTLS}
+    var wg sync.WaitGroup
+    t.Cleanup(func() {
+        listener.Close()
+        wg.Wait()
+    })
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                s.serve(conn)
+            }()
+        }
+    }()
+    return s
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "127.0.0.1"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+    defer func() { conn.Close() }()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    s.mu.Lock()
+    s.sessions++
+    s.mu.Unlock()
+
+    text := textproto.NewConn(conn)
+    secure := false
+    var mail received
+    text.PrintfLine("220 fake ESMTP")
+    for {
+        line, err := text.ReadLine()
+        if err != nil {
+            return
+        }
+        verb, arg, _ := strings.Cut(line, " ")
+        switch strings.ToUpper(verb) {
+        case "EHLO", "HELO":
+            if !s.noTLS && !secure {
+                text.PrintfLine("250-fake")
+                text.PrintfLine("250-STARTTLS")
+            } else {
+                text.PrintfLine("250-fake")
+            }
+            text.PrintfLine("250 AUTH PLAIN")
+        case "STARTTLS":
+            if s.noTLS || secure {
+                text.PrintfLine("502 not supported")
+                continue
+            }
+            text.PrintfLine("220 ready")
+            tlsConn := tls.Server(conn, s.tls)
+            if err := tlsConn.Handshake(); err != nil {
+                return
+            }
+            conn, secure = tlsConn, true
+            text = textproto.NewConn(tlsConn)
+        case "AUTH":
+            mechanism, response, _ := strings.Cut(arg, " ")
+            decoded, err := base64.StdEncoding.DecodeString(response)
+            s.mu.Lock()
+            s.auth = append(s.auth, secure)
+            s.mu.Unlock()
+            if !strings.EqualFold(mechanism, "PLAIN") || err != nil || string(decoded) != "\x00"+smtpUsername+"\x00"+smtpPassword {
+                text.PrintfLine("535 authentication failed")
+                continue
+            }
+            text.PrintfLine("235 authenticated")
+        case "MAIL":
+            s.mu.Lock()
+            fail := s.failures > 0
+            if fail {
+                s.failures--
+            }
+            s.mu.Unlock()
+            if fail {
+                text.PrintfLine("451 try again later")
+                continue
+            }
+            mail = received{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+            text.PrintfLine("250 ok")
+        case "RCPT":
+            mail.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+            text.PrintfLine("250 ok")
+        case "DATA":
+            text.PrintfLine("354 go ahead")
+            data, err := text.ReadDotBytes()
+            if err != nil {
+                return
+            }
+            mail.data = string(data)
+            s.mu.Lock()
+            s.messages = append(s.messages, mail)
+            s.mu.Unlock()
+            text.PrintfLine("250 queued")
+        case "RSET", "NOOP":
+            text.PrintfLine("250 ok")
+        case "QUIT":
+            text.PrintfLine("221 bye")
+            return
+        default:
+            text.PrintfLine("502 unknown command")
+        }
+    }
+}
+
+func (s *smtpServer) fail(n int) {
+    s.mu.Lock()
+    s.failures = n
+    s.mu.Unlock()
+}
+
+func (s *smtpServer) snapshot() (int, []bool, []received) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.sessions, append([]bool(nil), s.auth...), append([]received(nil), s.messages...)
+}
+
+// useServer points the SMTP configuration at s for the rest of the test and
+// starts with an empty queue.
+func useServer(t *testing.T, s *smtpServer) *config.SMTPConfig {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := appConfig.SMTP
+    appConfig.SMTP = config.SMTPConfig{
+        Enabled:            true,
+        Host:               "127.0.0.1",
+        Port:               s.addr.Port,
+        Username:           smtpUsername,
+        Password:           smtpPassword,
+        From:               "LunaTransfer <noreply@example.com>",
+        InsecureSkipVerify: true,
+        MaxAttempts:        3,
+    }
+    t.Cleanup(func() { appConfig.SMTP = saved })
+    if err := saveQueue(nil); err != nil {
+        t.Fatal(err)
+    }
+    return &appConfig.SMTP
+}
+
+func queued(t *testing.T) []Message {
+    t.Helper()
+    messages, err := ListQueue()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return messages
+}
+
+func notifyFileReceived() {
+    Notify(KindFileReceived, []string{testUser, testUser, "nobody"}, Data{
+        Actor: "bob",
+        File:  "report.pdf",
+        Path:  "groups/finance/report.pdf",
+        Size:  "2 KB",
+    })
+}
+
+func TestDelivery(t *testing.T) {
+    server := startSMTPServer(t, false)
+    useServer(t, server)
+
+    notifyFileReceived()
+    if messages := queued(t); len(messages) != 1 || messages[0].To != testAddress {
+        t.Fatalf("queued %+v, want one message to %s", messages, testAddress)
+    }
+    processQueue()
+
+    _, auth, messages := server.snapshot()
+    if len(messages) != 1 {
+        t.Fatalf("server received %d messages", len(messages))
+    }
+    msg := messages[0]
+    if msg.to != testAddress || msg.from != "noreply@example.com" || !strings.Contains(msg.data, "From: LunaTransfer <noreply@example.com>") {
+        t.Errorf("envelope from %q to %q", msg.from, msg.to)
+    }
+    for _, want := range []string{"Subject: New file received: report.pdf", "To: " + testAddress, `bob uploaded "report.pdf" (2 KB) to groups/finance/report.pdf.`} {
+        if !strings.Contains(msg.data, want) {
+            t.Errorf("message lacks %q:\n%s", want, msg.data)
+        }
+    }
+    if len(auth) != 1 || !auth[0] {
+        t.Errorf("AUTH over TLS: %v, want one AUTH after STARTTLS", auth)
+    }
+    if messages := queued(t); len(messages) != 0 {
+        t.Errorf("%d messages left in the queue", len(messages))
+    }
+}
+
+func TestPreferencesFilterMail(t *testing.T) {
+    server := startSMTPServer(t, false)
+    useServer(t, server)
+    defer SavePreferences(testUser, defaultPreferences())
+
+    if _, err := SavePreferences(testUser, Preferences{Email: true, Disabled: map[Kind]bool{KindFileReceived: true}}); err != nil {
+        t.Fatal(err)
+    }
+    notifyFileReceived()
+    if messages := queued(t); len(messages) != 0 {
+        t.Fatalf("queued %d messages of a disabled kind", len(messages))
+    }
+
+    if _, err := SavePreferences(testUser, Preferences{Email: false}); err != nil {
+        t.Fatal(err)
+    }
+    notifyFileReceived()
+    if messages := queued(t); len(messages) != 0 {
+        t.Fatalf("queued %d messages with email off", len(messages))
+    }
+}
+
+func TestRequireStartTLS(t *testing.T) {
+    server := startSMTPServer(t, true)
+    cfg := useServer(t, server)
+    cfg.RequireStartTLS = true
+
+    notifyFileReceived()
+    processQueue()
+
+    _, auth, messages := server.snapshot()
+    if len(messages) != 0 || len(auth) != 0 {
+        t.Fatalf("sent %d messages and %d AUTHs without TLS", len(messages), len(auth))
+    }
+    queue := queued(t)
+    if len(queue) != 1 || queue[0].Attempts != 1 || !strings.Contains(queue[0].LastError, "STARTTLS") {
+        t.Fatalf("queue %+v", queue)
+    }
+}
+
+func TestRetryScheduling(t *testing.T) {
+    server := startSMTPServer(t, false)
+    useServer(t, server)
+    server.fail(1)
+
+    notifyFileReceived()
+    before := time.Now()
+    processQueue()
+
+    queue := queued(t)
+    if len(queue) != 1 || queue[0].Attempts != 1 || queue[0].Failed || !strings.Contains(queue[0].LastError, "451") {
+        t.Fatalf("after a temporary failure: %+v", queue)
+    }
+    if wait := queue[0].NextAttempt.Sub(before); wait < retryBaseDelay || wait > retryBaseDelay+5*time.Second {
+        t.Errorf("next attempt in %s, want %s", wait, retryBaseDelay)
+    }
+
+    // Nothing is sent before the next attempt is due.
+    processQueue()
+    if sessions, _, _ := server.snapshot(); sessions != 1 {
+        t.Fatalf("%d sessions before the retry was due", sessions)
+    }
+
+    makeDue(t)
+    processQueue()
+    if _, _, messages := server.snapshot(); len(messages) != 1 {
+        t.Fatalf("retry delivered %d messages", len(messages))
+    }
+    if queue := queued(t); len(queue) != 0 {
+        t.Errorf("%d messages left after delivery", len(queue))
+    }
+}
+
+func TestGiveUpAfterMaxAttempts(t *testing.T) {
+    server := startSMTPServer(t, false)
+    useServer(t, server)
+    server.fail(100)
+
+    notifyFileReceived()
+    for attempt := 1; attempt <= 3; attempt++ {
+        processQueue()
+        makeDue(t)
+    }
+    queue := queued(t)
+    if len(queue) != 1 || queue[0].Attempts != 3 || !queue[0].Failed {
+        t.Fatalf("after 3 failures: %+v", queue)
+    }
+    processQueue()
+    if sessions, _, _ := server.snapshot(); sessions != 3 {
+        t.Errorf("%d sessions, want no attempt after giving up", sessions)
+    }
+}
+
+func TestRetryDelay(t *testing.T) {
+    for attempts, want := range map[int]time.Duration{
+        1:  retryBaseDelay,
+        2:  2 * retryBaseDelay,
+        3:  4 * retryBaseDelay,
+        20: retryMaxDelay,
+    } {
+        if got := retryDelay(attempts); got != want {
+            t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+        }
+    }
+}
+
+// makeDue moves every queued retry to now.
+func makeDue(t *testing.T) {
+    t.Helper()
+    queueMutex.Lock()
+    defer queueMutex.Unlock()
+    messages, err := loadQueue()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := range messages {
+        messages[i].NextAttempt = time.Now()
+    }
+    if err := saveQueue(messages); err != nil {
+        t.Fatal(err)
+    }
+}
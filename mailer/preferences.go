@@ -0,0 +1,84 @@
+package mailer
+
+import (
+    "LunaTransfer/store"
+    "fmt"
+    "sync"
+)
+
+var prefsMutex sync.RWMutex
+
+// Preferences controls which emails a user receives. Kinds missing from
+// Disabled are delivered, so new notification kinds default to on.
+type Preferences struct {
+    Email    bool          `json:"email"`
+    Disabled map[Kind]bool `json:"disabled,omitempty"`
+}
+
+func (p Preferences) Wants(kind Kind) bool {
+    return p.Email && !p.Disabled[kind]
+}
+
+func defaultPreferences() Preferences {
+    return Preferences{Email: true, Disabled: map[Kind]bool{}}
+}
+
+const preferencesFile = "notification_preferences.json"
+
+func loadAllPreferences() (map[string]Preferences, error) {
+    all := make(map[string]Preferences)
+    if err := store.ReadDataFile(preferencesFile, &all); err != nil {
+        return nil, err
+    }
+    return all, nil
+}
+
+func GetPreferences(username string) (Preferences, error) {
+    prefsMutex.RLock()
+    defer prefsMutex.RUnlock()
+
+    all, err := loadAllPreferences()
+    if err != nil {
+        return Preferences{}, err
+    }
+
+    prefs, ok := all[username]
+    if !ok {
+        return defaultPreferences(), nil
+    }
+    if prefs.Disabled == nil {
+        prefs.Disabled = map[Kind]bool{}
+    }
+    return prefs, nil
+}
+
+// SavePreferences stores prefs for username and returns them as stored.
+func SavePreferences(username string, prefs Preferences) (Preferences, error) {
+    for kind := range prefs.Disabled {
+        if _, ok := templates[kind]; !ok {
+            return Preferences{}, fmt.Errorf("unknown notification kind %q", kind)
+        }
+    }
+
+    // Re-enabled kinds are dropped rather than kept as false.
+    disabled := map[Kind]bool{}
+    for kind, off := range prefs.Disabled {
+        if off {
+            disabled[kind] = true
+        }
+    }
+    prefs.Disabled = disabled
+
+    prefsMutex.Lock()
+    defer prefsMutex.Unlock()
+
+    all, err := loadAllPreferences()
+    if err != nil {
+        return Preferences{}, err
+    }
+    all[username] = prefs
+    if err := store.WriteDataFile(preferencesFile, all); err != nil {
+        return Preferences{}, err
+    }
+    return prefs, nil
+}
@@ -0,0 +1,175 @@
+package mailer
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "context"
+    "fmt"
+    "sync"
+    "time"
+)
+
+const (
+    queuePollInterval = 30 * time.Second
+    retryBaseDelay    = 30 * time.Second
+    retryMaxDelay     = time.Hour
+)
+
+var (
+    queueMutex sync.Mutex
+    wake       = make(chan struct{}, 1)
+)
+
+// Message is a rendered email waiting in the delivery queue. Messages that
+// exhaust their attempts stay in the queue marked Failed for inspection.
+type Message struct {
+    ID          string    `json:"id"`
+    Kind        Kind      `json:"kind"`
+    To          string    `json:"to"`
+    Username    string    `json:"username"`
+    Subject     string    `json:"subject"`
+    Body        string    `json:"body"`
+    CreatedAt   time.Time `json:"created_at"`
+    Attempts    int       `json:"attempts"`
+    NextAttempt time.Time `json:"next_attempt"`
+    LastError   string    `json:"last_error,omitempty"`
+    Failed      bool      `json:"failed,omitempty"`
+}
+
+const queueFile = "mail_queue.json"
+
+func loadQueue() ([]Message, error) {
+    messages := []Message{}
+    if err := store.ReadDataFile(queueFile, &messages); err != nil {
+        return nil, err
+    }
+    return messages, nil
+}
+
+func saveQueue(messages []Message) error {
+    if messages == nil {
+        messages = []Message{}
+    }
+    return store.WriteDataFile(queueFile, messages)
+}
+
+func enqueue(msg Message) error {
+    queueMutex.Lock()
+    defer queueMutex.Unlock()
+
+    messages, err := loadQueue()
+    if err != nil {
+        return err
+    }
+    msg.NextAttempt = time.Now()
+    if err := saveQueue(append(messages, msg)); err != nil {
+        return err
+    }
+
+    select {
+    case wake <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+// ListQueue returns every queued message, including permanently failed ones.
+func ListQueue() ([]Message, error) {
+    queueMutex.Lock()
+    defer queueMutex.Unlock()
+
+    return loadQueue()
+}
+
+// Start delivers queued mail until ctx is cancelled. New messages are sent
+// right away; failures are retried with exponential backoff.
+func Start(ctx context.Context) {
+    ticker := time.NewTicker(queuePollInterval)
+    defer ticker.Stop()
+
+    for {
+        processQueue()
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        case <-wake:
+        }
+    }
+}
+
+func processQueue() {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.SMTP.Enabled {
+        return
+    }
+
+    queueMutex.Lock()
+    messages, err := loadQueue()
+    queueMutex.Unlock()
+    if err != nil {
+        utils.LogError("MAIL_QUEUE_ERROR", err, "system", "Failed to load mail queue")
+        return
+    }
+
+    now := time.Now()
+    for _, msg := range messages {
+        if msg.Failed || msg.NextAttempt.After(now) {
+            continue
+        }
+        sendErr := send(appConfig.SMTP, msg)
+        if err := recordAttempt(msg.ID, sendErr, appConfig.SMTP.MaxAttempts); err != nil {
+            utils.LogError("MAIL_QUEUE_ERROR", err, "system", "Failed to update mail queue")
+            return
+        }
+    }
+}
+
+// recordAttempt removes a delivered message or schedules the next retry.
+func recordAttempt(id string, sendErr error, maxAttempts int) error {
+    queueMutex.Lock()
+    defer queueMutex.Unlock()
+
+    messages, err := loadQueue()
+    if err != nil {
+        return err
+    }
+
+    for i, msg := range messages {
+        if msg.ID != id {
+            continue
+        }
+        if sendErr == nil {
+            utils.LogSystem("MAIL_SENT", msg.Username, "localhost",
+                fmt.Sprintf("Sent %s email to %s", msg.Kind, msg.To))
+            return saveQueue(append(messages[:i], messages[i+1:]...))
+        }
+
+        msg.Attempts++
+        msg.LastError = sendErr.Error()
+        if msg.Attempts >= maxAttempts {
+            msg.Failed = true
+            utils.LogError("MAIL_UNDELIVERABLE", sendErr, msg.Username,
+                fmt.Sprintf("Giving up on %s email to %s after %d attempts", msg.Kind, msg.To, msg.Attempts))
+        } else {
+            msg.NextAttempt = time.Now().Add(retryDelay(msg.Attempts))
+            utils.LogError("MAIL_RETRY", sendErr, msg.Username,
+                fmt.Sprintf("Will retry %s email to %s at %s", msg.Kind, msg.To, msg.NextAttempt.Format(time.RFC3339)))
+        }
+        messages[i] = msg
+        return saveQueue(messages)
+    }
+    return nil
+}
+
+func retryDelay(attempts int) time.Duration {
+    delay := retryBaseDelay
+    for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+        delay *= 2
+    }
+    if delay > retryMaxDelay {
+        delay = retryMaxDelay
+    }
+    return delay
+}
@@ -0,0 +1,100 @@
+package mailer
+
+import (
+    "LunaTransfer/config"
+    "crypto/tls"
+    "fmt"
+    "mime"
+    "net"
+    "net/mail"
+    "net/smtp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const dialTimeout = 15 * time.Second
+
+// send delivers msg over SMTP. STARTTLS is used whenever the server offers it
+// and is mandatory when RequireStartTLS is set; credentials are only sent over
+// an encrypted connection.
+func send(cfg config.SMTPConfig, msg Message) error {
+    addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+    conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+    if err != nil {
+        return fmt.Errorf("failed to connect to %s: %w", addr, err)
+    }
+
+    client, err := smtp.NewClient(conn, cfg.Host)
+    if err != nil {
+        conn.Close()
+        return fmt.Errorf("failed to start smtp session: %w", err)
+    }
+    defer client.Close()
+
+    if err := client.Hello("localhost"); err != nil {
+        return fmt.Errorf("smtp HELO failed: %w", err)
+    }
+
+    if ok, _ := client.Extension("STARTTLS"); ok {
+        tlsConfig := &tls.Config{
+            ServerName:         cfg.Host,
+            InsecureSkipVerify: cfg.InsecureSkipVerify,
+        }
+        if err := client.StartTLS(tlsConfig); err != nil {
+            return fmt.Errorf("smtp STARTTLS failed: %w", err)
+        }
+    } else if cfg.RequireStartTLS {
+        return fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+    }
+
+    if cfg.Username != "" {
+        if ok, _ := client.Extension("AUTH"); !ok {
+            return fmt.Errorf("smtp server %s does not support AUTH", addr)
+        }
+        if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+            return fmt.Errorf("smtp AUTH failed: %w", err)
+        }
+    }
+
+    // From may carry a display name; the envelope takes the bare address.
+    sender := cfg.From
+    if addr, err := mail.ParseAddress(cfg.From); err == nil {
+        sender = addr.Address
+    }
+    if err := client.Mail(sender); err != nil {
+        return fmt.Errorf("smtp MAIL FROM rejected: %w", err)
+    }
+    if err := client.Rcpt(msg.To); err != nil {
+        return fmt.Errorf("smtp RCPT TO rejected: %w", err)
+    }
+
+    w, err := client.Data()
+    if err != nil {
+        return fmt.Errorf("smtp DATA rejected: %w", err)
+    }
+    if _, err := w.Write(buildMessage(cfg.From, msg)); err != nil {
+        w.Close()
+        return fmt.Errorf("failed to write message: %w", err)
+    }
+    if err := w.Close(); err != nil {
+        return fmt.Errorf("smtp server rejected message: %w", err)
+    }
+
+    return client.Quit()
+}
+
+func buildMessage(from string, msg Message) []byte {
+    var b strings.Builder
+    b.WriteString("From: " + from + "\r\n")
+    b.WriteString("To: " + msg.To + "\r\n")
+    b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+    b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+    b.WriteString("Message-ID: <" + msg.ID + "@lunatransfer>\r\n")
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+    b.WriteString("\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return []byte(b.String())
+}
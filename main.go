@@ -1,13 +1,30 @@
 package main
 
 import (
+    "LunaTransfer/as2"
     "LunaTransfer/auth"
     "LunaTransfer/config"
+    "LunaTransfer/dav"
+    "LunaTransfer/ftpd"
     "LunaTransfer/handlers"
+    "LunaTransfer/integrity"
+    "LunaTransfer/jobs"
+    "LunaTransfer/mailer"
     "LunaTransfer/middleware"
+    "LunaTransfer/models"
+    "LunaTransfer/pgp"
+    "LunaTransfer/receipts"
+    "LunaTransfer/retention"
+    "LunaTransfer/rules"
+    "LunaTransfer/s3api"
+    "LunaTransfer/sftpd"
+    "LunaTransfer/sla"
+    "LunaTransfer/store"
     "LunaTransfer/utils"
+    "LunaTransfer/webhooks"
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "net/http"
@@ -36,6 +53,43 @@ func main() {
         fmt.Sprintf("Server starting on port %d", appConfig.Port))
     fmt.Println("Loggers initialized successfully")
         utils.InitJWT(appConfig)
+
+    if err := store.Open(appConfig.DatabaseFile); err != nil {
+        logger.Fatalf("Failed to open database: %v", err)
+    }
+    defer store.Close()
+
+    imported, err := auth.ImportLegacyJSON()
+    if err != nil {
+        logger.Fatalf("Failed to import JSON stores: %v", err)
+    }
+    if _, err := auth.IndexS3AccessKeys(); err != nil {
+        logger.Fatalf("Failed to index S3 access keys: %v", err)
+    }
+    if sealed, err := pgp.SealKeys(); errors.Is(err, pgp.ErrNoKeySecret) {
+        logger.Printf("Warning: PGP private keys are stored with their passphrases until pgp_key_secret is set")
+    } else if err != nil {
+        logger.Fatalf("Failed to protect PGP private keys: %v", err)
+    } else if sealed > 0 {
+        logger.Printf("Protected %d PGP private keys with pgp_key_secret", sealed)
+    }
+    importedMetadata, err := models.ImportLegacyFileMetadata()
+    if err != nil {
+        logger.Fatalf("Failed to import file metadata: %v", err)
+    }
+    importedReceipts, err := receipts.ImportLegacyReceipts()
+    if err != nil {
+        logger.Fatalf("Failed to import receipts: %v", err)
+    }
+    importedChecksums, err := integrity.ImportLegacyChecksums()
+    if err != nil {
+        logger.Fatalf("Failed to import checksums: %v", err)
+    }
+    if imported += importedMetadata + importedReceipts + importedChecksums; imported > 0 {
+        logger.Printf("Imported %d records from JSON stores into the database", imported)
+        utils.LogSystem("DATABASE_IMPORTED", "system", "localhost",
+            fmt.Sprintf("Imported %d records from JSON stores into %s", imported, appConfig.DatabaseFile))
+    }
     
     users, err := auth.LoadUsers()
     if err != nil {
@@ -47,6 +101,18 @@ func main() {
         logger.Fatalf("Failed to create storage directory: %v", err)
     }
 
+    migrated, err := models.MigrateLegacyShares()
+    if err != nil {
+        logger.Fatalf("Failed to migrate legacy shares: %v", err)
+    }
+    if migrated > 0 {
+        logger.Printf("Migrated %d legacy share records", migrated)
+        utils.LogSystem("SHARES_MIGRATED", "system", "localhost",
+            fmt.Sprintf("Imported %d share records from legacy stores", migrated))
+    }
+
+    handlers.RegisterEventSubscribers()
+
     r := mux.NewRouter()    
 
     // Non-authenticated routes with validation
@@ -58,42 +124,8 @@ func main() {
     r.HandleFunc("/api/system/setup-status", setupStatusHandler).Methods("GET")
 
     r.HandleFunc("/debug/setup", func(w http.ResponseWriter, r *http.Request) {
-        usersFile := "users.json"
-        fileExists := false
-        userCount := 0
-        
-        data, err := os.ReadFile(usersFile)
-        if err == nil {
-            fileExists = true
-            
-            var users []auth.User
-            if err := json.Unmarshal(data, &users); err == nil {
-                userCount = len(users)
-            }
-        }
-        
-        setupStatus, err := auth.IsSetupCompleted()
-        errMsg := ""
-        if err != nil {
-            errMsg = err.Error()
-        }
-        
-        absPath, absErr := filepath.Abs(usersFile)
-        if absErr != nil {
-            absPath = usersFile
-        }
-        
-        result := map[string]interface{}{
-            "fileExists": fileExists,
-            "fileSize": len(data),
-            "userCount": userCount,
-            "setupStatus": setupStatus,
-            "error": errMsg,
-            "filePath": absPath,
-        }
-        
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(result)
+        json.NewEncoder(w).Encode(auth.DebugSetupStatus())
     })
 
     api := r.PathPrefix("/api").Subrouter()
@@ -142,6 +174,16 @@ func main() {
         ),
     ).Methods("POST")
 
+    api.Handle("/upload/shared", 
+        middleware.PermissionMiddleware("write", "files")(
+            middleware.MaxBodySizeMiddleware(maxUploadSize)(
+                middleware.ParamValidationMiddleware(middleware.ValidateUploadRequest)(
+                    http.HandlerFunc(handlers.UploadToShareHandler),
+                ),
+            ),
+        ),
+    ).Methods("POST")
+
     api.Handle("/delete/{filename:.*}", 
         middleware.PermissionMiddleware("delete", "files")(
             middleware.ParamValidationMiddleware(middleware.ValidateFilenameParam)(
@@ -158,6 +200,12 @@ func main() {
         ),
     ).Methods("POST")
 
+    api.Handle("/extract",
+        middleware.PermissionMiddleware("write", "files")(
+            http.HandlerFunc(handlers.ExtractHandler),
+        ),
+    ).Methods("POST")
+
     api.Handle("/search", 
         middleware.PermissionMiddleware("read", "files")(
             middleware.ParamValidationMiddleware(middleware.ValidateSearchRequest)(
@@ -178,24 +226,116 @@ func main() {
         ),
     ).Methods("DELETE")
 
+    api.Handle("/share/{shareId}/extend", 
+        middleware.AuthMiddleware(
+            http.HandlerFunc(handlers.ExtendShareHandler),
+        ),
+    ).Methods("POST")
+
     api.Handle("/shared", 
         middleware.AuthMiddleware(
             http.HandlerFunc(handlers.ListSharedFilesHandler),
         ),
     ).Methods("GET")
 
+    api.HandleFunc("/notifications/preferences", handlers.GetNotificationPreferencesHandler).Methods("GET")
+    api.HandleFunc("/notifications/preferences", handlers.UpdateNotificationPreferencesHandler).Methods("PUT")
+    api.HandleFunc("/notifications", handlers.ListNotificationsHandler).Methods("GET")
+    api.HandleFunc("/notifications/{notificationId}/read", handlers.MarkNotificationHandler(true)).Methods("POST")
+    api.HandleFunc("/notifications/{notificationId}/unread", handlers.MarkNotificationHandler(false)).Methods("POST")
+    api.HandleFunc("/notifications/{notificationId}", handlers.DeleteNotificationHandler).Methods("DELETE")
+    api.HandleFunc("/events", utils.HandleSSE).Methods("GET")
+
+    api.HandleFunc("/ssh-keys", handlers.ListSSHKeysHandler).Methods("GET")
+    api.HandleFunc("/ssh-keys", handlers.AddSSHKeyHandler).Methods("POST")
+    api.HandleFunc("/ssh-keys/{keyId}", handlers.DeleteSSHKeyHandler).Methods("DELETE")
+    api.HandleFunc("/s3/credentials", handlers.GetS3CredentialsHandler).Methods("GET")
+
+    api.HandleFunc("/webhooks", handlers.CreateWebhookHandler).Methods("POST")
+    api.HandleFunc("/webhooks", handlers.ListWebhooksHandler).Methods("GET")
+    api.HandleFunc("/webhooks/{webhookId}", handlers.DeleteWebhookHandler).Methods("DELETE")
+    api.HandleFunc("/webhooks/{webhookId}/deliveries", handlers.ListWebhookDeliveriesHandler).Methods("GET")
+    api.HandleFunc("/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", handlers.RedeliverWebhookHandler).Methods("POST")
+
+    api.HandleFunc("/jobs", handlers.CreateJobHandler).Methods("POST")
+    api.HandleFunc("/jobs", handlers.ListJobsHandler).Methods("GET")
+    api.HandleFunc("/jobs/{jobId}", handlers.GetJobHandler).Methods("GET")
+    api.HandleFunc("/jobs/{jobId}", handlers.UpdateJobHandler).Methods("PUT")
+    api.HandleFunc("/jobs/{jobId}", handlers.DeleteJobHandler).Methods("DELETE")
+    api.HandleFunc("/jobs/{jobId}/run", handlers.RunJobHandler).Methods("POST")
+    api.HandleFunc("/jobs/{jobId}/runs", handlers.ListJobRunsHandler).Methods("GET")
+
+    api.HandleFunc("/rules", handlers.CreateRuleHandler).Methods("POST")
+    api.HandleFunc("/rules", handlers.ListRulesHandler).Methods("GET")
+    api.HandleFunc("/rules/{ruleId}", handlers.GetRuleHandler).Methods("GET")
+    api.HandleFunc("/rules/{ruleId}", handlers.UpdateRuleHandler).Methods("PUT")
+    api.HandleFunc("/rules/{ruleId}", handlers.DeleteRuleHandler).Methods("DELETE")
+
+    api.HandleFunc("/pgp/keys", handlers.ImportPGPKeyHandler).Methods("POST")
+    api.HandleFunc("/pgp/keys", handlers.ListPGPKeysHandler).Methods("GET")
+    api.HandleFunc("/pgp/keys/generate", handlers.GeneratePGPKeyHandler).Methods("POST")
+    api.HandleFunc("/pgp/keys/{keyId}", handlers.GetPGPKeyHandler).Methods("GET")
+    api.HandleFunc("/pgp/keys/{keyId}", handlers.DeletePGPKeyHandler).Methods("DELETE")
+
+    api.HandleFunc("/receipts", handlers.ListReceiptsHandler).Methods("GET")
+    api.HandleFunc("/receipts/{receiptId}", handlers.GetReceiptHandler).Methods("GET")
+
     r.Handle("/ws", middleware.AuthMiddleware(http.HandlerFunc(utils.HandleWebSocket))).Methods("GET")
 
+    davHandler := middleware.BasicAuthMiddleware("LunaTransfer")(
+        middleware.MaxBodySizeMiddleware(maxUploadSize)(dav.Handler("/dav")),
+    )
+    r.Handle("/dav", davHandler)
+    r.PathPrefix("/dav/").Handler(davHandler)
+
+    // Partners verify delivery receipts offline with this key.
+    r.HandleFunc("/receipts/public-key", handlers.ReceiptPublicKeyHandler).Methods("GET")
+
+    // AS2 partners authenticate by certificate, not by login.
+    if appConfig.AS2.Enabled {
+        r.Handle("/as2", middleware.MaxBodySizeMiddleware(maxUploadSize)(as2.Handler())).Methods("POST")
+    }
+
     admin := api.PathPrefix("/admin").Subrouter()
     admin.Use(middleware.RoleMiddleware(auth.RoleAdmin))
     admin.HandleFunc("/users", handlers.ListUsersHandler).Methods("GET")
     admin.HandleFunc("/users/{username}", handlers.DeleteUserHandler).Methods("DELETE")
     admin.HandleFunc("/system/stats", handlers.SystemStatsHandler).Methods("GET")
+    admin.HandleFunc("/mail/queue", handlers.MailQueueHandler).Methods("GET")
     admin.HandleFunc("/groups", handlers.CreateGroupHandler).Methods("POST")
     admin.HandleFunc("/groups", handlers.ListGroupsHandler).Methods("GET")
     admin.HandleFunc("/groups/{groupId}/members", handlers.AddUserToGroupHandler).Methods("POST")
     admin.HandleFunc("/groups/{groupId}/members", handlers.GetGroupMembersHandler).Methods("GET")
     admin.HandleFunc("/groups/{groupId}/members/{username}", handlers.RemoveUserFromGroupHandler).Methods("DELETE")
+    admin.HandleFunc("/partners", handlers.CreatePartnerHandler).Methods("POST")
+    admin.HandleFunc("/partners", handlers.ListPartnersHandler).Methods("GET")
+    admin.HandleFunc("/partners/{partnerId}", handlers.GetPartnerHandler).Methods("GET")
+    admin.HandleFunc("/partners/{partnerId}", handlers.UpdatePartnerHandler).Methods("PUT")
+    admin.HandleFunc("/partners/{partnerId}", handlers.DeletePartnerHandler).Methods("DELETE")
+    admin.HandleFunc("/partners/{partnerId}/overview", handlers.PartnerOverviewHandler).Methods("GET")
+    admin.HandleFunc("/as2/station", handlers.AS2StationHandler).Methods("GET")
+    admin.HandleFunc("/as2/messages", handlers.ListAS2MessagesHandler).Methods("GET")
+    admin.HandleFunc("/as2/send", handlers.SendAS2Handler).Methods("POST")
+    admin.HandleFunc("/retention/policies", handlers.CreateRetentionPolicyHandler).Methods("POST")
+    admin.HandleFunc("/retention/policies", handlers.ListRetentionPoliciesHandler).Methods("GET")
+    admin.HandleFunc("/retention/policies/{policyId}", handlers.GetRetentionPolicyHandler).Methods("GET")
+    admin.HandleFunc("/retention/policies/{policyId}", handlers.UpdateRetentionPolicyHandler).Methods("PUT")
+    admin.HandleFunc("/retention/policies/{policyId}", handlers.DeleteRetentionPolicyHandler).Methods("DELETE")
+    admin.HandleFunc("/retention/report", handlers.RetentionReportHandler).Methods("GET")
+    admin.HandleFunc("/retention/enforce", handlers.EnforceRetentionHandler).Methods("POST")
+    admin.HandleFunc("/legal-holds", handlers.PlaceLegalHoldHandler).Methods("POST")
+    admin.HandleFunc("/legal-holds", handlers.ListLegalHoldsHandler).Methods("GET")
+    admin.HandleFunc("/legal-holds/{holdId}", handlers.GetLegalHoldHandler).Methods("GET")
+    admin.HandleFunc("/legal-holds/{holdId}/release", handlers.ReleaseLegalHoldHandler).Methods("POST")
+    admin.HandleFunc("/slas", handlers.CreateSLAHandler).Methods("POST")
+    admin.HandleFunc("/slas", handlers.ListSLAsHandler).Methods("GET")
+    admin.HandleFunc("/slas/history", handlers.SLAHistoryHandler).Methods("GET")
+    admin.HandleFunc("/slas/{slaId}", handlers.GetSLAHandler).Methods("GET")
+    admin.HandleFunc("/slas/{slaId}", handlers.UpdateSLAHandler).Methods("PUT")
+    admin.HandleFunc("/slas/{slaId}", handlers.DeleteSLAHandler).Methods("DELETE")
+    admin.HandleFunc("/integrity/scrub", handlers.StartScrubHandler).Methods("POST")
+    admin.HandleFunc("/integrity/reports", handlers.ListScrubReportsHandler).Methods("GET")
+    admin.HandleFunc("/integrity/reports/{reportId}", handlers.GetScrubReportHandler).Methods("GET")
 
     srv := &http.Server{
         Addr:         fmt.Sprintf(":%d", appConfig.Port),
@@ -204,6 +344,20 @@ func main() {
         IdleTimeout:  60 * time.Second,
         Handler:      r,
     }
+    bgCtx, stopBackground := context.WithCancel(context.Background())
+    defer stopBackground()
+    go handlers.StartShareExpirySweeper(bgCtx, time.Duration(appConfig.ShareSweepInterval))
+    go mailer.Start(bgCtx)
+    go webhooks.Start(bgCtx)
+    go sftpd.Start(bgCtx)
+    go ftpd.Start(bgCtx)
+    go s3api.Start(bgCtx)
+    go jobs.Start(bgCtx)
+    go rules.Start(bgCtx)
+    go retention.Start(bgCtx)
+    go sla.Start(bgCtx)
+    go integrity.Start(bgCtx)
+
     logger.Printf("Starting LunaTransfer Server on port %d", appConfig.Port)
     go func() {
         logger.Printf("LunaTransfer Server is running on :%d", appConfig.Port)
@@ -218,6 +372,7 @@ func main() {
     ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
     defer cancel()
     logger.Println("Shutting down server...")
+    stopBackground()
     if err := srv.Shutdown(ctx); err != nil {
         logger.Fatalf("Server forced to shutdown: %v", err)
     }
@@ -225,14 +380,9 @@ func main() {
 }
 
 func setupStatusHandler(w http.ResponseWriter, r *http.Request) {
-    userFilePath := "users.json"
-    setupCompleted := false
-    data, err := os.ReadFile(userFilePath)
-    if err == nil {
-        var usersList []interface{}
-        if json.Unmarshal(data, &usersList) == nil {
-            setupCompleted = len(usersList) > 0
-        }
+    setupCompleted, err := auth.IsSetupCompleted()
+    if err != nil {
+        log.Printf("Error checking setup status: %v", err)
     }
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{
@@ -2,6 +2,7 @@ package middleware
 
 import (
     "LunaTransfer/common"
+    "LunaTransfer/partners"
     "LunaTransfer/utils"
     "context"
     "net/http"
@@ -32,6 +33,12 @@ func AuthMiddleware(next http.Handler) http.Handler {
             }
             return
         }
+        // Partner accounts stay within their partner's addresses, also
+        // with tokens obtained elsewhere.
+        if err := partners.CheckAccess(claims.Username, partners.ProtocolHTTP, r.RemoteAddr); err != nil {
+            http.Error(w, "Access denied", http.StatusForbidden)
+            return
+        }
 
         ctx := r.Context()
         ctx = context.WithValue(ctx, common.UsernameContextKey, claims.Username)
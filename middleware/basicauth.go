@@ -0,0 +1,178 @@
+package middleware
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/common"
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "golang.org/x/time/rate"
+)
+
+// basicAuthCacheTTL keeps mounted drives, which send credentials with every
+// request, from paying for a bcrypt comparison each time.
+const basicAuthCacheTTL = 5 * time.Minute
+
+// Failed Basic logins are limited per client address and per username:
+// after basicAuthFailureBurst failures further attempts are refused, and one
+// more is allowed every basicAuthFailureInterval.
+const (
+    basicAuthFailureBurst    = 10
+    basicAuthFailureInterval = time.Minute
+)
+
+type cachedLogin struct {
+    digest  [32]byte
+    expires time.Time
+}
+
+var (
+    basicAuthMutex sync.Mutex
+    basicAuthCache = make(map[string]cachedLogin)
+
+    basicAuthFailures = make(map[string]*rate.Limiter)
+)
+
+// BasicAuthMiddleware authenticates clients that cannot obtain a JWT, such as
+// WebDAV drives. It accepts HTTP Basic credentials with either the account
+// password or the user's API key as password, as well as a Bearer token.
+func BasicAuthMiddleware(realm string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            var username, role string
+
+            if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(strings.ToLower(authHeader), "bearer ") {
+                claims, err := utils.ValidateJWT(authHeader[7:])
+                if err != nil {
+                    http.Error(w, "Invalid token", http.StatusUnauthorized)
+                    return
+                }
+                username, role = claims.Username, claims.Role
+            } else {
+                user, password, ok := r.BasicAuth()
+                failureKeys := basicAuthFailureKeys(r, user)
+                if ok && basicAuthBlocked(failureKeys) {
+                    w.Header().Set("Retry-After", "60")
+                    http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+                    return
+                }
+                account, valid := checkBasicCredentials(user, password)
+                if !ok || !valid {
+                    if ok {
+                        utils.LogSystem("LOGIN_FAIL", user, r.RemoteAddr, "Invalid basic auth credentials")
+                        if recordBasicAuthFailure(failureKeys) {
+                            utils.LogSystem("LOGIN_BLOCKED", user, r.RemoteAddr, "Too many failed basic auth logins")
+                        }
+                    }
+                    w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+                    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                    return
+                }
+                username, role = account.Username, account.Role
+            }
+            if err := partners.CheckAccess(username, partners.ProtocolWebDAV, r.RemoteAddr); err != nil {
+                http.Error(w, "Access denied", http.StatusForbidden)
+                return
+            }
+
+            ctx := context.WithValue(r.Context(), common.UsernameContextKey, username)
+            ctx = context.WithValue(ctx, common.RoleContextKey, role)
+            next.ServeHTTP(w, r.WithContext(ctx))
+        })
+    }
+}
+
+// checkBasicCredentials returns username's account if password is its
+// password or API key. Cached logins are keyed by the stored password hash
+// too, so changing the password or deleting the user ends them at once.
+func checkBasicCredentials(username, password string) (*auth.User, bool) {
+    if password == "" {
+        return nil, false
+    }
+    account, err := auth.GetUserByUsername(username)
+    if err != nil {
+        return nil, false
+    }
+    if owner, ok := auth.GetUserByAPIKey(password); ok {
+        return account, owner == username
+    }
+
+    digest := sha256.Sum256([]byte(username + "\x00" + account.PasswordHash + "\x00" + password))
+    basicAuthMutex.Lock()
+    cached, ok := basicAuthCache[username]
+    basicAuthMutex.Unlock()
+    if ok && time.Now().Before(cached.expires) && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+        return account, true
+    }
+
+    if _, _, err := auth.AuthenticateUser(username, password); err != nil {
+        return nil, false
+    }
+    basicAuthMutex.Lock()
+    basicAuthCache[username] = cachedLogin{digest: digest, expires: time.Now().Add(basicAuthCacheTTL)}
+    basicAuthMutex.Unlock()
+    return account, true
+}
+
+// basicAuthFailureKeys returns the keys failed logins from r as username are
+// counted under: the client address and the username.
+func basicAuthFailureKeys(r *http.Request, username string) []string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return []string{"addr:" + host, "user:" + username}
+}
+
+// basicAuthBlocked reports whether any of keys has used up its failed logins.
+func basicAuthBlocked(keys []string) bool {
+    basicAuthMutex.Lock()
+    defer basicAuthMutex.Unlock()
+    for _, key := range keys {
+        if limiter, ok := basicAuthFailures[key]; ok && limiter.Tokens() < 1 {
+            return true
+        }
+    }
+    return false
+}
+
+// recordBasicAuthFailure counts a failed login against each of keys and
+// reports whether that used up the failed logins of any of them.
+func recordBasicAuthFailure(keys []string) bool {
+    basicAuthMutex.Lock()
+    defer basicAuthMutex.Unlock()
+    pruneBasicAuthFailures()
+    blocked := false
+    for _, key := range keys {
+        limiter, ok := basicAuthFailures[key]
+        if !ok {
+            limiter = rate.NewLimiter(rate.Every(basicAuthFailureInterval), basicAuthFailureBurst)
+            basicAuthFailures[key] = limiter
+        }
+        limiter.Allow()
+        if limiter.Tokens() < 1 {
+            blocked = true
+        }
+    }
+    return blocked
+}
+
+// pruneBasicAuthFailures forgets keys whose failures have all expired, once
+// there are enough of them to matter. basicAuthMutex must be held.
+func pruneBasicAuthFailures() {
+    if len(basicAuthFailures) < 10000 {
+        return
+    }
+    for key, limiter := range basicAuthFailures {
+        if limiter.Tokens() >= basicAuthFailureBurst {
+            delete(basicAuthFailures, key)
+        }
+    }
+}
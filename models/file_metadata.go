@@ -0,0 +1,227 @@
+package models
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+)
+
+type SignatureStatus string
+
+const (
+    SignatureValid         SignatureStatus = "valid"
+    SignatureInvalid       SignatureStatus = "invalid"
+    SignatureUnsigned      SignatureStatus = "unsigned"
+    SignatureUnknownSigner SignatureStatus = "unknown_signer"
+)
+
+// PGPVerification records how a file was decrypted and whether its signature
+// checked out against the keyring it was decrypted with.
+type PGPVerification struct {
+    SourceFile        string          `json:"source_file"`
+    DecryptedWith     string          `json:"decrypted_with,omitempty"`
+    Signature         SignatureStatus `json:"signature"`
+    SignerKeyID       string          `json:"signer_key_id,omitempty"`
+    SignerFingerprint string          `json:"signer_fingerprint,omitempty"`
+    SignerName        string          `json:"signer_name,omitempty"`
+    SignedAt          *time.Time      `json:"signed_at,omitempty"`
+    Error             string          `json:"error,omitempty"`
+    VerifiedAt        time.Time       `json:"verified_at"`
+}
+
+// FileMetadata is what LunaTransfer knows about a stored file beyond the file
+// system. It is keyed by the path relative to the storage directory and
+// follows the file when it is moved. ModTime is the file's modification time
+// when the metadata was recorded; once the file is overwritten it no longer
+// applies.
+type FileMetadata struct {
+    ModTime time.Time        `json:"mod_time"`
+    PGP     *PGPVerification `json:"pgp,omitempty"`
+}
+
+var fileMetadataRepo = store.NewRepository[FileMetadata](store.FileMetadata)
+
+// legacyFileMetadataFile, in the data directory, held file metadata before
+// the database.
+const legacyFileMetadataFile = "file_metadata.json"
+
+func storedModTime(path string) (time.Time, error) {
+    cfg, err := config.LoadConfig()
+    if err != nil {
+        return time.Time{}, err
+    }
+    info, err := os.Stat(filepath.Join(cfg.StorageDirectory, filepath.FromSlash(path)))
+    if err != nil {
+        return time.Time{}, err
+    }
+    return info.ModTime(), nil
+}
+
+// LoadFileMetadata returns the metadata of every file that has any.
+func LoadFileMetadata() (map[string]FileMetadata, error) {
+    metadata := map[string]FileMetadata{}
+    err := store.View(func(tx *store.Tx) error {
+        return fileMetadataRepo.Scan(tx, "", func(path string, entry FileMetadata) error {
+            metadata[path] = entry
+            return nil
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return metadata, nil
+}
+
+func GetFileMetadata(path string) (FileMetadata, bool) {
+    var entry FileMetadata
+    var ok bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        entry, ok, err = fileMetadataRepo.Get(tx, filepath.ToSlash(filepath.Clean(path)))
+        return err
+    })
+    if err != nil {
+        return FileMetadata{}, false
+    }
+    return entry, ok
+}
+
+// fileMetadataUnder returns the paths with metadata that are path or below it.
+func fileMetadataUnder(tx *store.Tx, path string) (map[string]FileMetadata, error) {
+    under := map[string]FileMetadata{}
+    err := fileMetadataRepo.Scan(tx, path, func(p string, entry FileMetadata) error {
+        if p == path || strings.HasPrefix(p, path+"/") {
+            under[p] = entry
+        }
+        return nil
+    })
+    return under, err
+}
+
+// SetPGPVerification stores the verification result of the file at path.
+func SetPGPVerification(path string, verification PGPVerification) error {
+    path = filepath.ToSlash(filepath.Clean(path))
+    modTime, err := storedModTime(path)
+    if err != nil {
+        return err
+    }
+    return store.Update(func(tx *store.Tx) error {
+        entry, _, err := fileMetadataRepo.Get(tx, path)
+        if err != nil {
+            return err
+        }
+        if !entry.ModTime.Equal(modTime) {
+            entry = FileMetadata{}
+        }
+        entry.ModTime = modTime
+        entry.PGP = &verification
+        return fileMetadataRepo.Put(tx, path, entry)
+    })
+}
+
+// ForgetChangedFileMetadata drops the metadata of path if the file was
+// written since it was recorded.
+func ForgetChangedFileMetadata(path string) error {
+    path = filepath.ToSlash(filepath.Clean(path))
+    modTime, err := storedModTime(path)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return store.Update(func(tx *store.Tx) error {
+        entry, ok, err := fileMetadataRepo.Get(tx, path)
+        if err != nil || !ok || entry.ModTime.Equal(modTime) {
+            return err
+        }
+        return fileMetadataRepo.Delete(tx, path)
+    })
+}
+
+// MoveFileMetadata carries the metadata of from, or of everything below it,
+// over to to.
+func MoveFileMetadata(from, to string) error {
+    from = filepath.ToSlash(filepath.Clean(from))
+    to = filepath.ToSlash(filepath.Clean(to))
+    return store.Update(func(tx *store.Tx) error {
+        moved, err := fileMetadataUnder(tx, from)
+        if err != nil {
+            return err
+        }
+        for path := range moved {
+            if err := fileMetadataRepo.Delete(tx, path); err != nil {
+                return err
+            }
+        }
+        for path, entry := range moved {
+            if err := fileMetadataRepo.Put(tx, to+strings.TrimPrefix(path, from), entry); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// RemoveFileMetadataUnder forgets path and everything below it.
+func RemoveFileMetadataUnder(path string) error {
+    return store.Update(func(tx *store.Tx) error {
+        return RemoveFileMetadataUnderTx(tx, path)
+    })
+}
+
+// RemoveFileMetadataUnderTx is RemoveFileMetadataUnder in tx, for callers
+// that remove other records with it.
+func RemoveFileMetadataUnderTx(tx *store.Tx, path string) error {
+    removed, err := fileMetadataUnder(tx, filepath.ToSlash(filepath.Clean(path)))
+    if err != nil {
+        return err
+    }
+    for p := range removed {
+        if err := fileMetadataRepo.Delete(tx, p); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ImportLegacyFileMetadata moves the metadata kept in the data directory
+// before the database into it, keeping records it already has, and renames
+// the file with a ".migrated" suffix. It returns the number of records
+// imported.
+func ImportLegacyFileMetadata() (int, error) {
+    cfg, err := config.LoadConfig()
+    if err != nil {
+        return 0, err
+    }
+    path := filepath.Join(cfg.GetDataDirectory(), legacyFileMetadataFile)
+
+    metadata := map[string]FileMetadata{}
+    found, err := store.ReadLegacyFile(path, &metadata)
+    if err != nil || !found {
+        return 0, err
+    }
+
+    imported := 0
+    err = store.Update(func(tx *store.Tx) error {
+        for p, entry := range metadata {
+            if _, exists, err := fileMetadataRepo.Get(tx, p); err != nil || exists {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := fileMetadataRepo.Put(tx, p, entry); err != nil {
+                return err
+            }
+            imported++
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    return imported, store.ArchiveLegacyFile(path)
+}
@@ -1,136 +1,432 @@
 package models
 
 import (
-    "encoding/json"
-    "fmt"
+    "errors"
+    "log"
     "os"
     "path/filepath"
-    "sync"
+    "sort"
+    "strings"
     "time"
-    
+
     "LunaTransfer/config"
+    "LunaTransfer/store"
+)
+
+type SharePermission string
+
+const (
+    SharePermissionRead      SharePermission = "read"
+    SharePermissionReadWrite SharePermission = "write"
+)
+
+var (
+    ErrShareNotFound = errors.New("share not found")
+    ErrAlreadyShared = errors.New("file is already shared with this group")
 )
 
 type FileShare struct {
     ID          string    `json:"id"`
     FilePath    string    `json:"file_path"`
+    SourcePath  string    `json:"source_path"` // Path relative to the storage directory
     SourceGroup string    `json:"source_group"`
     TargetGroup string    `json:"target_group"`
-    Permission  string    `json:"permission"`
+    Permission  SharePermission `json:"permission"`
     SharedBy    string    `json:"shared_by"`
     SharedAt    time.Time `json:"shared_at"`
+    ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+    IsDir       bool      `json:"is_dir,omitempty"`
+    ExpiryNotified bool   `json:"expiry_notified,omitempty"`
+}
+
+// IsExpired reports whether the share has an expiry date that has passed.
+func (s FileShare) IsExpired(now time.Time) bool {
+    return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// Covers reports whether path (relative to the storage directory) is the
+// shared item itself or, for folder shares, anything inside it.
+func (s FileShare) Covers(path string) bool {
+    path = filepath.ToSlash(filepath.Clean(path))
+    if path == s.SourcePath {
+        return true
+    }
+    return s.IsDir && strings.HasPrefix(path, s.SourcePath+"/")
 }
 
 var (
-    fileSharesMutex sync.RWMutex
-    fileSharesFile  = "file_shares.json"
+    shareRepo    = store.NewRepository[FileShare](store.FileShares)
+    shareKeyRepo = store.NewRepository[string](store.FileShareKeys)
+
+    // Locations used before shares moved into the database: the JSON store
+    // in the data directory, and the two it consolidated before that.
+    legacyFileSharesFile    = "file_shares.json"  // relative to the data directory
+    legacyStorageSharesFile = "file_shares.json"  // relative to the storage directory
+    legacyGroupSharesFile   = "shared_files.json" // relative to the data directory
 )
 
-func GetFileSharePath() (string, error) {
-    cfg, err := config.LoadConfig()
-    if err != nil {
-        return "", err
+// shareKey indexes the newest share of a source path with a target group,
+// so a duplicate share is found without reading the others.
+func shareKey(share FileShare) string {
+    return share.TargetGroup + "/" + share.SourcePath
+}
+
+// putShare stores share and makes it the indexed share of its source path
+// and target group.
+func putShare(tx *store.Tx, share FileShare) error {
+    if err := shareRepo.Put(tx, share.ID, share); err != nil {
+        return err
     }
-    return filepath.Join(cfg.StorageDirectory, fileSharesFile), nil
+    return shareKeyRepo.Put(tx, shareKey(share), share.ID)
 }
 
-func LoadFileShares() ([]FileShare, error) {
-    fileSharesMutex.RLock()
-    defer fileSharesMutex.RUnlock()
+// deleteShare removes share and its index entry, if the entry is still its.
+func deleteShare(tx *store.Tx, share FileShare) error {
+    if err := shareRepo.Delete(tx, share.ID); err != nil {
+        return err
+    }
+    id, ok, err := shareKeyRepo.Get(tx, shareKey(share))
+    if err != nil || !ok || id != share.ID {
+        return err
+    }
+    return shareKeyRepo.Delete(tx, shareKey(share))
+}
 
-    path, err := GetFileSharePath()
+// matchingShares returns the shares match accepts.
+func matchingShares(tx *store.Tx, match func(FileShare) bool) ([]FileShare, error) {
+    var matched []FileShare
+    err := shareRepo.Scan(tx, "", func(id string, share FileShare) error {
+        if match(share) {
+            matched = append(matched, share)
+        }
+        return nil
+    })
+    return matched, err
+}
+
+// LoadFileShares returns every share, oldest first.
+func LoadFileShares() ([]FileShare, error) {
+    var shares []FileShare
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        shares, err = store.List(tx, shareRepo, "")
+        return err
+    })
     if err != nil {
         return nil, err
     }
-
-    if _, err := os.Stat(path); os.IsNotExist(err) {
-        return []FileShare{}, nil
+    if shares == nil {
+        shares = []FileShare{}
     }
 
-    data, err := os.ReadFile(path)
+    sort.SliceStable(shares, func(i, j int) bool {
+        return shares[i].SharedAt.Before(shares[j].SharedAt)
+    })
+    return shares, nil
+}
+
+// SaveFileShare stores a new share, refusing a second active share of the
+// same source path with the same target group.
+func SaveFileShare(share FileShare) error {
+    now := time.Now()
+    return store.Update(func(tx *store.Tx) error {
+        id, ok, err := shareKeyRepo.Get(tx, shareKey(share))
+        if err != nil {
+            return err
+        }
+        if ok {
+            existing, exists, err := shareRepo.Get(tx, id)
+            if err != nil {
+                return err
+            }
+            if exists && !existing.IsExpired(now) {
+                return ErrAlreadyShared
+            }
+        }
+        return putShare(tx, share)
+    })
+}
+
+func GetFileSharesForGroup(groupID string) ([]FileShare, error) {
+    shares, err := LoadFileShares()
     if err != nil {
         return nil, err
     }
 
-    var shares []FileShare
-    err = json.Unmarshal(data, &shares)
+    now := time.Now()
+    var groupShares []FileShare
+    for _, share := range shares {
+        if share.TargetGroup == groupID && !share.IsExpired(now) {
+            groupShares = append(groupShares, share)
+        }
+    }
+
+    return groupShares, nil
+}
+
+func GetFileShareByID(shareID string) (FileShare, error) {
+    var share FileShare
+    var exists bool
+    err := store.View(func(tx *store.Tx) error {
+        var err error
+        share, exists, err = shareRepo.Get(tx, shareID)
+        return err
+    })
     if err != nil {
-        return nil, err
+        return FileShare{}, err
+    }
+    if !exists {
+        return FileShare{}, ErrShareNotFound
     }
 
-    return shares, nil
+    return share, nil
 }
 
-func SaveFileShares(shares []FileShare) error {
-    fileSharesMutex.Lock()
-    defer fileSharesMutex.Unlock()
+func DeleteFileShare(shareID string) error {
+    return store.Update(func(tx *store.Tx) error {
+        share, exists, err := shareRepo.Get(tx, shareID)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            return ErrShareNotFound
+        }
+        return deleteShare(tx, share)
+    })
+}
 
-    path, err := GetFileSharePath()
+func UpdateFileShare(updated FileShare) error {
+    return store.Update(func(tx *store.Tx) error {
+        share, exists, err := shareRepo.Get(tx, updated.ID)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            return ErrShareNotFound
+        }
+        if shareKey(share) != shareKey(updated) {
+            if err := deleteShare(tx, share); err != nil {
+                return err
+            }
+        }
+        return putShare(tx, updated)
+    })
+}
+
+// RemoveExpiredFileShares deletes every share whose expiry has passed and
+// returns the removed records so callers can notify and audit them.
+func RemoveExpiredFileShares(now time.Time) ([]FileShare, error) {
+    var expired []FileShare
+    err := store.Update(func(tx *store.Tx) error {
+        var err error
+        expired, err = matchingShares(tx, func(share FileShare) bool {
+            return share.IsExpired(now)
+        })
+        if err != nil {
+            return err
+        }
+        for _, share := range expired {
+            if err := deleteShare(tx, share); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
     if err != nil {
-        return err
+        return nil, err
     }
 
-    data, err := json.MarshalIndent(shares, "", "  ")
+    return expired, nil
+}
+
+// MarkExpiringFileShares flags active shares that expire before deadline and
+// returns those that had not been flagged yet, so each gets one warning.
+func MarkExpiringFileShares(now, deadline time.Time) ([]FileShare, error) {
+    var expiring []FileShare
+    err := store.Update(func(tx *store.Tx) error {
+        var err error
+        expiring, err = matchingShares(tx, func(share FileShare) bool {
+            return share.ExpiresAt != nil && !share.ExpiryNotified && !share.IsExpired(now) && !share.ExpiresAt.After(deadline)
+        })
+        if err != nil {
+            return err
+        }
+        for i := range expiring {
+            expiring[i].ExpiryNotified = true
+            if err := shareRepo.Put(tx, expiring[i].ID, expiring[i]); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
     if err != nil {
-        return err
+        return nil, err
     }
 
-    return os.WriteFile(path, data, 0644)
+    return expiring, nil
 }
 
-func SaveFileShare(share FileShare) error {
-    shares, err := LoadFileShares()
-    if err != nil {
+// RemoveFileSharesUnder deletes the shares of path and of anything below it,
+// for use after the shared item itself was deleted. Changes inside a shared
+// folder do not affect its share.
+func RemoveFileSharesUnder(path string) ([]FileShare, error) {
+    var removed []FileShare
+    err := store.Update(func(tx *store.Tx) error {
+        var err error
+        removed, err = RemoveFileSharesUnderTx(tx, path)
         return err
+    })
+    if err != nil {
+        return nil, err
     }
 
-    shares = append(shares, share)
-    return SaveFileShares(shares)
+    return removed, nil
 }
 
-func GetFileSharesForGroup(groupID string) ([]FileShare, error) {
-    shares, err := LoadFileShares()
+// RemoveFileSharesUnderTx is RemoveFileSharesUnder in tx, for callers that
+// remove other records with it.
+func RemoveFileSharesUnderTx(tx *store.Tx, path string) ([]FileShare, error) {
+    path = filepath.ToSlash(filepath.Clean(path))
+    removed, err := matchingShares(tx, func(share FileShare) bool {
+        return share.SourcePath == path || strings.HasPrefix(share.SourcePath, path+"/")
+    })
     if err != nil {
         return nil, err
     }
-
-    var groupShares []FileShare
-    for _, share := range shares {
-        if share.TargetGroup == groupID {
-            groupShares = append(groupShares, share)
+    for _, share := range removed {
+        if err := deleteShare(tx, share); err != nil {
+            return nil, err
         }
     }
+    return removed, nil
+}
 
-    return groupShares, nil
+type legacyGroupShare struct {
+    ID          string    `json:"id"`
+    SourcePath  string    `json:"source_path"`
+    GroupID     string    `json:"group_id"`
+    SourceGroup string    `json:"source_group"`
+    SharedBy    string    `json:"shared_by"`
+    SharedAt    time.Time `json:"shared_at"`
+    Permission  string    `json:"permission"`
 }
 
-func GetFileShareByID(shareID string) (FileShare, error) {
-    shares, err := LoadFileShares()
+// MigrateLegacyShares merges the records of the JSON share store and of the
+// two stores it consolidated into the database. Records are matched by ID so
+// the migration can safely run on every startup; records without an ID, or
+// whose ID another record took, are imported under a new one. Migrated files
+// are renamed with a ".migrated" suffix. It returns the number of records
+// imported.
+func MigrateLegacyShares() (int, error) {
+    cfg, err := config.LoadConfig()
     if err != nil {
-        return FileShare{}, err
+        return 0, err
     }
 
-    for _, share := range shares {
-        if share.ID == shareID {
-            return share, nil
-        }
+    dataFile := filepath.Join(cfg.GetDataDirectory(), legacyFileSharesFile)
+    storageFile := filepath.Join(cfg.StorageDirectory, legacyStorageSharesFile)
+    groupFile := filepath.Join(cfg.GetDataDirectory(), legacyGroupSharesFile)
+
+    var fromData []FileShare
+    dataFound, err := store.ReadLegacyFile(dataFile, &fromData)
+    if err != nil {
+        return 0, err
     }
 
-    return FileShare{}, fmt.Errorf("share not found")
-}
+    var fromStorage []FileShare
+    storageFound, err := store.ReadLegacyFile(storageFile, &fromStorage)
+    if err != nil {
+        return 0, err
+    }
 
-func DeleteFileShare(shareID string) error {
-    shares, err := LoadFileShares()
+    var fromGroups []legacyGroupShare
+    groupFound, err := store.ReadLegacyFile(groupFile, &fromGroups)
     if err != nil {
-        return err
+        return 0, err
     }
 
-    var newShares []FileShare
-    for _, share := range shares {
-        if share.ID != shareID {
-            newShares = append(newShares, share)
+    if !dataFound && !storageFound && !groupFound {
+        return 0, nil
+    }
+
+    incoming := fromData
+    for _, share := range fromStorage {
+        if share.SourcePath == "" {
+            share.SourcePath = resolveLegacySourcePath(cfg.StorageDirectory, share.SourceGroup, share.FilePath)
+        }
+        share.Permission = normalizeSharePermission(string(share.Permission))
+        incoming = append(incoming, share)
+    }
+    for _, legacy := range fromGroups {
+        incoming = append(incoming, FileShare{
+            ID:          legacy.ID,
+            FilePath:    legacy.SourcePath,
+            SourcePath:  filepath.ToSlash(filepath.Clean(legacy.SourcePath)),
+            SourceGroup: legacy.SourceGroup,
+            TargetGroup: legacy.GroupID,
+            Permission:  normalizeSharePermission(legacy.Permission),
+            SharedBy:    legacy.SharedBy,
+            SharedAt:    legacy.SharedAt,
+        })
+    }
+
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        added, s, err := store.ImportRecords(tx, shareRepo, incoming, func(share FileShare) string {
+            return share.ID
+        }, func(share FileShare, id string) FileShare {
+            share.ID = id
+            return share
+        })
+        stats = s
+        if err != nil {
+            return err
+        }
+        // Index the imported shares that no share in the database covers yet.
+        for _, share := range added {
+            if _, indexed, err := shareKeyRepo.Get(tx, shareKey(share)); err != nil || indexed {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := shareKeyRepo.Put(tx, shareKey(share), share.ID); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    log.Printf("Imported legacy shares: %s", stats)
+
+    for path, found := range map[string]bool{dataFile: dataFound, storageFile: storageFound, groupFile: groupFound} {
+        if found {
+            if err := store.ArchiveLegacyFile(path); err != nil {
+                return stats.Imported, err
+            }
         }
     }
 
-    return SaveFileShares(newShares)
-}
\ No newline at end of file
+    return stats.Imported, nil
+}
+
+func resolveLegacySourcePath(storageDir, sourceGroup, filePath string) string {
+    if sourceGroup != "" {
+        groupPath := filepath.Join("groups", sourceGroup, filePath)
+        if _, err := os.Stat(filepath.Join(storageDir, groupPath)); err == nil {
+            return filepath.ToSlash(groupPath)
+        }
+    }
+    return filepath.ToSlash(filepath.Clean(filePath))
+}
+
+func normalizeSharePermission(permission string) SharePermission {
+    switch permission {
+    case "write", "read_write":
+        return SharePermissionReadWrite
+    default:
+        return SharePermissionRead
+    }
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "LunaTransfer/store"
+)
+
+// MaxInboxSize bounds each user's inbox; the oldest read items go first.
+const MaxInboxSize = 500
+
+var (
+    ErrNotificationNotFound = errors.New("notification not found")
+
+    inboxMutex sync.Mutex
+    inboxDir   = "inbox"
+)
+
+// InboxItem is a stored notification with its read state.
+type InboxItem struct {
+    Notification
+    Read   bool       `json:"read"`
+    ReadAt *time.Time `json:"read_at,omitempty"`
+}
+
+// inboxFile is username's inbox in the data directory.
+func inboxFile(username string) string {
+    return filepath.Join(inboxDir, filepath.Base(username)+".json")
+}
+
+func loadInbox(username string) ([]InboxItem, error) {
+    items := []InboxItem{}
+    if err := store.ReadDataFile(inboxFile(username), &items); err != nil {
+        return nil, err
+    }
+    return items, nil
+}
+
+func saveInbox(username string, items []InboxItem) error {
+    if items == nil {
+        items = []InboxItem{}
+    }
+    return store.WriteDataFile(inboxFile(username), items)
+}
+
+// AddToInbox stores n as unread for username. Items are kept oldest first.
+func AddToInbox(username string, n Notification) error {
+    inboxMutex.Lock()
+    defer inboxMutex.Unlock()
+
+    items, err := loadInbox(username)
+    if err != nil {
+        return err
+    }
+    items = append(items, InboxItem{Notification: n})
+
+    for len(items) > MaxInboxSize {
+        drop := 0
+        for i, item := range items {
+            if item.Read {
+                drop = i
+                break
+            }
+        }
+        items = append(items[:drop], items[drop+1:]...)
+    }
+    return saveInbox(username, items)
+}
+
+// GetInbox returns username's notifications newest first, optionally only
+// unread ones, along with the total and unread counts.
+func GetInbox(username string, unreadOnly bool) ([]InboxItem, int, error) {
+    inboxMutex.Lock()
+    items, err := loadInbox(username)
+    inboxMutex.Unlock()
+    if err != nil {
+        return nil, 0, err
+    }
+
+    unread := 0
+    result := make([]InboxItem, 0, len(items))
+    for _, item := range items {
+        if !item.Read {
+            unread++
+        } else if unreadOnly {
+            continue
+        }
+        result = append(result, item)
+    }
+    sort.SliceStable(result, func(i, j int) bool {
+        return result[i].Timestamp.After(result[j].Timestamp)
+    })
+    return result, unread, nil
+}
+
+// GetUnread returns username's unread notifications oldest first, for replay.
+func GetUnread(username string) ([]InboxItem, error) {
+    items, _, err := GetInbox(username, true)
+    if err != nil {
+        return nil, err
+    }
+    for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+        items[i], items[j] = items[j], items[i]
+    }
+    return items, nil
+}
+
+// MarkInbox sets the read state of one notification, or of all of them when
+// id is empty.
+func MarkInbox(username, id string, read bool) error {
+    inboxMutex.Lock()
+    defer inboxMutex.Unlock()
+
+    items, err := loadInbox(username)
+    if err != nil {
+        return err
+    }
+
+    found := id == ""
+    now := time.Now()
+    for i := range items {
+        if id != "" && items[i].ID != id {
+            continue
+        }
+        found = true
+        items[i].Read = read
+        items[i].ReadAt = nil
+        if read {
+            items[i].ReadAt = &now
+        }
+    }
+    if !found {
+        return ErrNotificationNotFound
+    }
+    return saveInbox(username, items)
+}
+
+func DeleteFromInbox(username, id string) error {
+    inboxMutex.Lock()
+    defer inboxMutex.Unlock()
+
+    items, err := loadInbox(username)
+    if err != nil {
+        return err
+    }
+    for i, item := range items {
+        if item.ID == id {
+            return saveInbox(username, append(items[:i], items[i+1:]...))
+        }
+    }
+    return ErrNotificationNotFound
+}
+
+// DeleteInbox removes username's inbox entirely.
+func DeleteInbox(username string) error {
+    inboxMutex.Lock()
+    defer inboxMutex.Unlock()
+
+    path, err := store.DataFile(inboxFile(username))
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
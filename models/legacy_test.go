@@ -0,0 +1,159 @@
+package models
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// fixtures holds JSON files as servers kept them before the database. It is
+// made absolute before the tests move to a scratch directory.
+var fixtures = filepath.Join("testdata", "legacy")
+
+// TestMain sets up what testenv.Main would, without the loggers: testenv
+// and utils both need this package.
+func TestMain(m *testing.M) {
+    os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+    var err error
+    if fixtures, err = filepath.Abs(fixtures); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    dir, err := os.MkdirTemp("", "lunatransfer-test-")
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer os.RemoveAll(dir)
+    if err := os.Chdir(dir); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if _, err := config.LoadConfig(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := config.EnsureStorageExists(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := store.Open(filepath.Join(dir, "test.db")); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer store.Close()
+    return m.Run()
+}
+
+// copyFixture copies the fixture name to target.
+func copyFixture(t *testing.T, name, target string) {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join(fixtures, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(target, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestImportLegacyFileMetadata(t *testing.T) {
+    cfg, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    file := filepath.Join(cfg.GetDataDirectory(), legacyFileMetadataFile)
+    copyFixture(t, "file_metadata.json", file)
+
+    imported, err := ImportLegacyFileMetadata()
+    if err != nil || imported != 3 {
+        t.Fatalf("got %d imported, %v; want 3", imported, err)
+    }
+    if _, err := os.Stat(file + ".migrated"); err != nil {
+        t.Errorf("the legacy file was not archived: %v", err)
+    }
+    entry, ok := GetFileMetadata("alice/invoices/march.csv")
+    if !ok || entry.PGP == nil || entry.PGP.Signature != SignatureValid || entry.PGP.DecryptedWith != "key-alice" {
+        t.Errorf("got %+v", entry)
+    }
+    if metadata, err := LoadFileMetadata(); err != nil || len(metadata) != 3 {
+        t.Errorf("got %d entries, %v; want 3", len(metadata), err)
+    }
+    if imported, err := ImportLegacyFileMetadata(); err != nil || imported != 0 {
+        t.Errorf("second import: got %d, %v", imported, err)
+    }
+}
+
+func TestMigrateLegacyShares(t *testing.T) {
+    cfg, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := map[string]string{
+        "file_shares.json":         filepath.Join(cfg.GetDataDirectory(), legacyFileSharesFile),
+        "storage_file_shares.json": filepath.Join(cfg.StorageDirectory, legacyStorageSharesFile),
+        "shared_files.json":        filepath.Join(cfg.GetDataDirectory(), legacyGroupSharesFile),
+    }
+    for fixture, file := range files {
+        copyFixture(t, fixture, file)
+    }
+
+    // Two shares from the share store, one of them without an ID; one from
+    // the storage directory whose ID the first took; one group share.
+    migrated, err := MigrateLegacyShares()
+    if err != nil || migrated != 4 {
+        t.Fatalf("got %d migrated, %v; want 4", migrated, err)
+    }
+    for _, file := range files {
+        if _, err := os.Stat(file + ".migrated"); err != nil {
+            t.Errorf("%s was not archived: %v", file, err)
+        }
+    }
+
+    shares, err := LoadFileShares()
+    if err != nil {
+        t.Fatal(err)
+    }
+    bySource := map[string]FileShare{}
+    for _, share := range shares {
+        if share.ID == "" {
+            t.Errorf("%s was imported without an ID", share.SourcePath)
+        }
+        bySource[share.SourcePath] = share
+    }
+    if len(shares) != 4 || len(bySource) != 4 {
+        t.Fatalf("got %v, want 4 shares of different files", shares)
+    }
+    if share, err := GetFileShareByID("s1"); err != nil || share.SourcePath != "alice/a.pdf" {
+        t.Errorf("s1: got %+v, %v; want the share store's", share, err)
+    }
+    if share := bySource["alice/c.pdf"]; share.ID == "s1" || share.Permission != SharePermissionReadWrite {
+        t.Errorf("the storage share: got %+v, want it under a new ID with write permission", share)
+    }
+    if share := bySource["groups/finance/ledger.csv"]; share.ID != "g1" || share.TargetGroup != "partners" || share.Permission != SharePermissionReadWrite {
+        t.Errorf("the group share: got %+v", share)
+    }
+    if finance, err := GetFileSharesForGroup("finance"); err != nil || len(finance) != 2 {
+        t.Errorf("got %d shares with finance, %v; want 2", len(finance), err)
+    }
+
+    // The imported shares are indexed, so sharing one again is refused.
+    again := bySource["alice/b.pdf"]
+    again.ID = "again"
+    if err := SaveFileShare(again); err != ErrAlreadyShared {
+        t.Errorf("sharing an imported share again: got %v, want ErrAlreadyShared", err)
+    }
+
+    if migrated, err := MigrateLegacyShares(); err != nil || migrated != 0 {
+        t.Errorf("second migration: got %d, %v", migrated, err)
+    }
+}
@@ -24,11 +24,20 @@ const (
     NoteFileUploaded NotificationType = "FILE_UPLOADED"
     NoteFileDeleted  NotificationType = "FILE_DELETED"
     NoteFileAccessed NotificationType = "FILE_ACCESSED"
+    NoteShareCreated NotificationType = "SHARE_CREATED"
+    NoteShareRemoved NotificationType = "SHARE_REMOVED"
+    NoteShareExpired NotificationType = "SHARE_EXPIRED"
+    NoteRuleTriggered NotificationType = "RULE_TRIGGERED"
+    NoteSLALate       NotificationType = "SLA_LATE"
+    NoteSLAMissed     NotificationType = "SLA_MISSED"
 )
 
 type Notification struct {
+    ID        string           `json:"id,omitempty"`
     Type      NotificationType `json:"type"`
     Timestamp time.Time        `json:"timestamp"`
     Filename  string           `json:"filename,omitempty"`
+    Namespace string           `json:"namespace,omitempty"`
+    Path      string           `json:"path,omitempty"`
     Message   string           `json:"message"`
 }
\ No newline at end of file
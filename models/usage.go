@@ -0,0 +1,79 @@
+package models
+
+import (
+    "sync"
+    "time"
+
+    "LunaTransfer/store"
+)
+
+// Usage holds per-user transfer counters maintained from upload and download
+// events.
+type Usage struct {
+    Username        string    `json:"username"`
+    FilesUploaded   int64     `json:"files_uploaded"`
+    BytesUploaded   int64     `json:"bytes_uploaded"`
+    FilesDownloaded int64     `json:"files_downloaded"`
+    BytesDownloaded int64     `json:"bytes_downloaded"`
+    LastActivity    time.Time `json:"last_activity"`
+}
+
+var (
+    usageMutex sync.Mutex
+    usageFile  = "usage.json"
+)
+
+func loadUsage() (map[string]Usage, error) {
+    usage := make(map[string]Usage)
+    if err := store.ReadDataFile(usageFile, &usage); err != nil {
+        return nil, err
+    }
+    return usage, nil
+}
+
+func saveUsage(usage map[string]Usage) error {
+    return store.WriteDataFile(usageFile, usage)
+}
+
+func recordUsage(username string, fn func(*Usage)) error {
+    usageMutex.Lock()
+    defer usageMutex.Unlock()
+
+    usage, err := loadUsage()
+    if err != nil {
+        return err
+    }
+    u := usage[username]
+    u.Username = username
+    fn(&u)
+    u.LastActivity = time.Now()
+    usage[username] = u
+    return saveUsage(usage)
+}
+
+func RecordUpload(username string, size int64) error {
+    return recordUsage(username, func(u *Usage) {
+        u.FilesUploaded++
+        u.BytesUploaded += size
+    })
+}
+
+func RecordDownload(username string, size int64) error {
+    return recordUsage(username, func(u *Usage) {
+        u.FilesDownloaded++
+        u.BytesDownloaded += size
+    })
+}
+
+func GetUsage(username string) (Usage, error) {
+    usageMutex.Lock()
+    defer usageMutex.Unlock()
+
+    usage, err := loadUsage()
+    if err != nil {
+        return Usage{}, err
+    }
+    u := usage[username]
+    u.Username = username
+    return u, nil
+}
@@ -0,0 +1,108 @@
+package partners
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+)
+
+// CheckAccess decides whether username may sign in over protocol from
+// remoteAddr. Accounts that belong to no partner are not restricted; partner
+// accounts are refused while the partner is suspended, and outside its
+// protocols and IP ranges. Refusals are logged, so callers only need to
+// reject the login.
+func CheckAccess(username, protocol, remoteAddr string) error {
+    partner, ok, err := PartnerOfUser(username)
+    if err != nil {
+        utils.LogError("PARTNER_ERROR", err, username, "Failed to load partners")
+        return err
+    }
+    if !ok {
+        return nil
+    }
+
+    if err := partner.refusal(protocol, remoteAddr); err != nil {
+        utils.LogSystem("PARTNER_ACCESS_DENIED", username, remoteAddr, err.Error())
+        return err
+    }
+    return nil
+}
+
+// CheckPartnerAccess is CheckAccess for protocols such as AS2 where the
+// partner itself rather than one of its accounts connects.
+func CheckPartnerAccess(p Partner, protocol, remoteAddr string) error {
+    if err := p.refusal(protocol, remoteAddr); err != nil {
+        utils.LogSystem("PARTNER_ACCESS_DENIED", "partner:"+p.ID, remoteAddr, err.Error())
+        return err
+    }
+    return nil
+}
+
+func (p Partner) refusal(protocol, remoteAddr string) error {
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        host = remoteAddr
+    }
+    switch {
+    case p.Status == StatusSuspended:
+        return fmt.Errorf("partner %s is suspended", p.Name)
+    case !p.AllowsProtocol(protocol):
+        return fmt.Errorf("partner %s may not use %s", p.Name, protocol)
+    case !p.AllowsAddress(net.ParseIP(host)):
+        return fmt.Errorf("partner %s may not connect from %s", p.Name, host)
+    }
+    return nil
+}
+
+// Provision creates what the partner's profile describes: its group, unless
+// GroupID names an existing one, the folders inside it, and the group
+// memberships of its accounts. Accounts in previousUsers that are no longer
+// listed leave the group. Provisioning is idempotent.
+func Provision(p *Partner, actor string, previousUsers []string) error {
+    if p.GroupID == "" {
+        group, err := auth.CreateGroup(p.Name, "Trading partner "+p.Name, actor)
+        if errors.Is(err, auth.ErrGroupExists) {
+            return ErrGroupExists
+        }
+        if err != nil {
+            return fmt.Errorf("failed to create group: %w", err)
+        }
+        p.GroupID = group.ID
+    } else if _, err := auth.GetGroupByID(p.GroupID); err != nil {
+        return ErrGroupNotFound
+    }
+
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    groupDir := filepath.Join(appConfig.StorageDirectory, "groups", p.GroupID)
+    folders := append([]string{p.InboundFolder, p.OutboundFolder}, p.Folders...)
+    for _, folder := range folders {
+        if err := os.MkdirAll(filepath.Join(groupDir, filepath.FromSlash(folder)), 0755); err != nil {
+            return fmt.Errorf("failed to create folder %s: %w", folder, err)
+        }
+    }
+
+    for _, username := range p.Users {
+        err := auth.AddUserToGroup(p.GroupID, username, p.UserRole, actor)
+        if err != nil && !errors.Is(err, auth.ErrUserAlreadyInGroup) {
+            return fmt.Errorf("failed to add %s to the partner's group: %w", username, err)
+        }
+    }
+    for _, username := range previousUsers {
+        if contains(p.Users, username) {
+            continue
+        }
+        err := auth.RemoveUserFromGroup(p.GroupID, username, actor)
+        if err != nil && !errors.Is(err, auth.ErrUserNotInGroup) {
+            return fmt.Errorf("failed to remove %s from the partner's group: %w", username, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,489 @@
+// Package partners keeps trading-partner profiles. A partner is an external
+// organization that exchanges files with us: its contacts, the accounts it
+// signs in with, the protocols and addresses those accounts may use, and the
+// group whose folder holds its inbound and outbound files. The group's PGP
+// keyring holds the partner's keys, its members' SSH keys and S3 credentials
+// are the partner's logins, and jobs and rules of the group move its files,
+// so a partner ties together settings that otherwise live apart.
+package partners
+
+import (
+    "LunaTransfer/store"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "mime"
+    "net"
+    "net/mail"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    StatusActive    = "active"
+    StatusSuspended = "suspended"
+
+    ProtocolHTTP   = "http"
+    ProtocolSFTP   = "sftp"
+    ProtocolFTP    = "ftp"
+    ProtocolWebDAV = "webdav"
+    ProtocolS3     = "s3"
+    ProtocolAS2    = "as2"
+
+    MDNSync  = "sync"
+    MDNAsync = "async"
+    MDNNone  = "none"
+
+    DefaultInboundFolder  = "inbound"
+    DefaultOutboundFolder = "outbound"
+)
+
+// Protocols lists every protocol a partner can be allowed.
+var Protocols = []string{ProtocolHTTP, ProtocolSFTP, ProtocolFTP, ProtocolWebDAV, ProtocolS3, ProtocolAS2}
+
+// EncryptionAlgorithms lists the content encryption a partner can be sent.
+var EncryptionAlgorithms = []string{"aes128-cbc", "aes256-cbc", "aes128-gcm", "aes256-gcm"}
+
+var (
+    ErrPartnerNotFound = errors.New("partner not found")
+    ErrPartnerExists   = errors.New("a partner with that name already exists")
+    ErrUserTaken       = errors.New("user already belongs to another partner")
+    ErrGroupNotFound   = errors.New("group not found")
+    ErrGroupExists     = errors.New("a group with the partner's name already exists; pass its group_id to use it")
+    ErrAS2IDTaken      = errors.New("another partner already uses that AS2 ID")
+
+    partnersMutex sync.RWMutex
+)
+
+type Contact struct {
+    Name  string `json:"name"`
+    Email string `json:"email,omitempty"`
+    Phone string `json:"phone,omitempty"`
+    Role  string `json:"role,omitempty"`
+}
+
+// AS2Settings describe how a partner speaks AS2. ID is its AS2 name and
+// Certificate its PEM certificate, which verifies what it signs and is what
+// we encrypt to. URL is its receiving endpoint, needed only to send to it.
+// Asynchronous MDNs it asks for are posted only to MDNURL or to the host of
+// URL or MDNURL.
+// Sign, Encrypt, EncryptionAlgorithm, MDN and SignedMDN shape what we send;
+// RequireSigned and RequireEncrypted refuse weaker messages from it.
+type AS2Settings struct {
+    ID                  string `json:"id"`
+    URL                 string `json:"url,omitempty"`
+    MDNURL              string `json:"mdn_url,omitempty"`
+    Certificate         string `json:"certificate"`
+    Sign                bool   `json:"sign"`
+    Encrypt             bool   `json:"encrypt"`
+    EncryptionAlgorithm string `json:"encryption_algorithm"`
+    MDN                 string `json:"mdn"`
+    SignedMDN           bool   `json:"signed_mdn"`
+    RequireSigned       bool   `json:"require_signed"`
+    RequireEncrypted    bool   `json:"require_encrypted"`
+    ContentType         string `json:"content_type"`
+}
+
+func isHTTPURL(s string) bool {
+    u, err := url.Parse(s)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// AllowsMDNURL reports whether an asynchronous MDN may be posted to target.
+func (a AS2Settings) AllowsMDNURL(target string) bool {
+    u, err := url.Parse(target)
+    if err != nil || !isHTTPURL(target) || u.User != nil {
+        return false
+    }
+    if a.MDNURL != "" && target == a.MDNURL {
+        return true
+    }
+    for _, known := range []string{a.URL, a.MDNURL} {
+        if k, err := url.Parse(known); known != "" && err == nil && strings.EqualFold(k.Hostname(), u.Hostname()) {
+            return true
+        }
+    }
+    return false
+}
+
+// ParseCertificate returns the partner's AS2 certificate.
+func (a AS2Settings) ParseCertificate() (*x509.Certificate, error) {
+    block, _ := pem.Decode([]byte(a.Certificate))
+    if block == nil || block.Type != "CERTIFICATE" {
+        return nil, fmt.Errorf("certificate must be a PEM encoded X.509 certificate")
+    }
+    return x509.ParseCertificate(block.Bytes)
+}
+
+func (a *AS2Settings) normalize() {
+    a.ID = strings.TrimSpace(a.ID)
+    a.URL = strings.TrimSpace(a.URL)
+    a.MDNURL = strings.TrimSpace(a.MDNURL)
+    a.EncryptionAlgorithm = strings.ToLower(strings.TrimSpace(a.EncryptionAlgorithm))
+    if a.EncryptionAlgorithm == "" {
+        a.EncryptionAlgorithm = "aes256-cbc"
+    }
+    a.MDN = strings.ToLower(strings.TrimSpace(a.MDN))
+    if a.MDN == "" {
+        a.MDN = MDNSync
+    }
+    if a.ContentType == "" {
+        a.ContentType = "application/octet-stream"
+    }
+}
+
+func (a AS2Settings) validate() error {
+    // RFC 4130 limits AS2 names to 128 printable ASCII characters.
+    if a.ID == "" || len(a.ID) > 128 {
+        return fmt.Errorf("as2 id must be 1 to 128 characters")
+    }
+    for _, c := range a.ID {
+        if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+            return fmt.Errorf("as2 id may only contain printable ASCII without quotes or backslashes")
+        }
+    }
+    cert, err := a.ParseCertificate()
+    if err != nil {
+        return fmt.Errorf("as2 certificate: %w", err)
+    }
+    if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok && a.Encrypt {
+        return fmt.Errorf("as2 encryption needs an RSA certificate")
+    }
+    if a.URL != "" && !isHTTPURL(a.URL) {
+        return fmt.Errorf("as2 url must be an http or https URL")
+    }
+    if a.MDNURL != "" && !isHTTPURL(a.MDNURL) {
+        return fmt.Errorf("as2 mdn_url must be an http or https URL")
+    }
+    if !contains(EncryptionAlgorithms, a.EncryptionAlgorithm) {
+        return fmt.Errorf("as2 encryption_algorithm must be one of %s", strings.Join(EncryptionAlgorithms, ", "))
+    }
+    if a.MDN != MDNSync && a.MDN != MDNAsync && a.MDN != MDNNone {
+        return fmt.Errorf("as2 mdn must be %q, %q or %q", MDNSync, MDNAsync, MDNNone)
+    }
+    if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+        return fmt.Errorf("as2 content_type is not a MIME type")
+    }
+    return nil
+}
+
+// Partner is one trading partner. Users are the partner's accounts; they
+// are members of GroupID with UserRole and may only sign in over Protocols
+// from IPRanges, where empty lists allow everything. InboundFolder receives
+// what the partner sends, OutboundFolder holds what we send, and Folders
+// lists any further folders to provision, all inside the group folder. AS2
+// messages from the partner land in InboundFolder.
+type Partner struct {
+    ID             string    `json:"id"`
+    Name           string    `json:"name"`
+    Description    string    `json:"description,omitempty"`
+    Status         string    `json:"status"`
+    GroupID        string    `json:"group_id"`
+    Contacts       []Contact `json:"contacts"`
+    Users          []string  `json:"users"`
+    UserRole       string    `json:"user_role"`
+    Protocols      []string  `json:"protocols"`
+    IPRanges       []string  `json:"ip_ranges"`
+    InboundFolder  string    `json:"inbound_folder"`
+    OutboundFolder string    `json:"outbound_folder"`
+    Folders        []string  `json:"folders,omitempty"`
+    AS2            *AS2Settings `json:"as2,omitempty"`
+    CreatedBy      string    `json:"created_by"`
+    CreatedAt      time.Time `json:"created_at"`
+    UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Normalize fills in defaults and cleans names before Validate. Single
+// addresses in IPRanges become /32 or /128 ranges.
+func (p *Partner) Normalize() {
+    p.Name = strings.TrimSpace(p.Name)
+    if p.Status == "" {
+        p.Status = StatusActive
+    }
+    if p.UserRole == "" {
+        p.UserRole = "contributor"
+    }
+    if p.InboundFolder == "" {
+        p.InboundFolder = DefaultInboundFolder
+    }
+    if p.OutboundFolder == "" {
+        p.OutboundFolder = DefaultOutboundFolder
+    }
+    p.InboundFolder = cleanFolder(p.InboundFolder)
+    p.OutboundFolder = cleanFolder(p.OutboundFolder)
+    for i := range p.Folders {
+        p.Folders[i] = cleanFolder(p.Folders[i])
+    }
+    for i := range p.Protocols {
+        p.Protocols[i] = strings.ToLower(strings.TrimSpace(p.Protocols[i]))
+    }
+    for i := range p.Users {
+        p.Users[i] = strings.TrimSpace(p.Users[i])
+    }
+    for i, r := range p.IPRanges {
+        r = strings.TrimSpace(r)
+        if ip := net.ParseIP(r); ip != nil {
+            if ip.To4() != nil {
+                r += "/32"
+            } else {
+                r += "/128"
+            }
+        }
+        p.IPRanges[i] = r
+    }
+    if p.AS2 != nil {
+        p.AS2.normalize()
+    }
+    if p.Contacts == nil {
+        p.Contacts = []Contact{}
+    }
+    if p.Users == nil {
+        p.Users = []string{}
+    }
+    if p.Protocols == nil {
+        p.Protocols = []string{}
+    }
+    if p.IPRanges == nil {
+        p.IPRanges = []string{}
+    }
+}
+
+func cleanFolder(p string) string {
+    return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// Validate checks a partner as supplied by an admin.
+func (p Partner) Validate() error {
+    if p.Name == "" {
+        return fmt.Errorf("name is required")
+    }
+    if p.Status != StatusActive && p.Status != StatusSuspended {
+        return fmt.Errorf("status must be %q or %q", StatusActive, StatusSuspended)
+    }
+    if p.UserRole != "contributor" && p.UserRole != "reader" {
+        return fmt.Errorf("user_role must be 'contributor' or 'reader'")
+    }
+    for i, contact := range p.Contacts {
+        if strings.TrimSpace(contact.Name) == "" && contact.Email == "" {
+            return fmt.Errorf("contact %d needs a name or an email", i+1)
+        }
+        if contact.Email != "" {
+            if _, err := mail.ParseAddress(contact.Email); err != nil {
+                return fmt.Errorf("contact %d: invalid email %q", i+1, contact.Email)
+            }
+        }
+    }
+    for _, protocol := range p.Protocols {
+        if !contains(Protocols, protocol) {
+            return fmt.Errorf("protocols may only contain %s", strings.Join(Protocols, ", "))
+        }
+    }
+    for _, r := range p.IPRanges {
+        if _, _, err := net.ParseCIDR(r); err != nil {
+            return fmt.Errorf("invalid IP range %q", r)
+        }
+    }
+    if p.InboundFolder == "" || p.OutboundFolder == "" {
+        return fmt.Errorf("inbound and outbound folders may not be the group folder itself")
+    }
+    if p.InboundFolder == p.OutboundFolder {
+        return fmt.Errorf("inbound and outbound folders must differ")
+    }
+    for _, folder := range p.Folders {
+        if folder == "" {
+            return fmt.Errorf("folders may not be the group folder itself")
+        }
+    }
+    if p.AS2 != nil {
+        if err := p.AS2.validate(); err != nil {
+            return err
+        }
+    }
+    seen := map[string]bool{}
+    for _, username := range p.Users {
+        if username == "" || seen[username] {
+            return fmt.Errorf("users must be distinct usernames")
+        }
+        seen[username] = true
+    }
+    return nil
+}
+
+// AllowsProtocol reports whether the partner's accounts may use protocol.
+func (p Partner) AllowsProtocol(protocol string) bool {
+    return len(p.Protocols) == 0 || contains(p.Protocols, protocol)
+}
+
+// AllowsAddress reports whether the partner's accounts may connect from ip.
+func (p Partner) AllowsAddress(ip net.IP) bool {
+    if len(p.IPRanges) == 0 {
+        return true
+    }
+    for _, r := range p.IPRanges {
+        if _, network, err := net.ParseCIDR(r); err == nil && ip != nil && network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+const partnersFile = "partners.json"
+
+func loadPartners() ([]Partner, error) {
+    partners := []Partner{}
+    if err := store.ReadDataFile(partnersFile, &partners); err != nil {
+        return nil, err
+    }
+    return partners, nil
+}
+
+func savePartners(partners []Partner) error {
+    if partners == nil {
+        partners = []Partner{}
+    }
+
+    return store.WriteDataFile(partnersFile, partners)
+}
+
+func ListPartners() ([]Partner, error) {
+    partnersMutex.RLock()
+    defer partnersMutex.RUnlock()
+
+    return loadPartners()
+}
+
+func GetPartner(id string) (Partner, error) {
+    partners, err := ListPartners()
+    if err != nil {
+        return Partner{}, err
+    }
+    for _, partner := range partners {
+        if partner.ID == id {
+            return partner, nil
+        }
+    }
+    return Partner{}, ErrPartnerNotFound
+}
+
+// PartnerByAS2ID returns the partner whose AS2 name is id.
+func PartnerByAS2ID(id string) (Partner, error) {
+    partners, err := ListPartners()
+    if err != nil {
+        return Partner{}, err
+    }
+    for _, partner := range partners {
+        if partner.AS2 != nil && partner.AS2.ID == id {
+            return partner, nil
+        }
+    }
+    return Partner{}, ErrPartnerNotFound
+}
+
+// PartnerOfUser returns the partner whose account username is.
+func PartnerOfUser(username string) (Partner, bool, error) {
+    partners, err := ListPartners()
+    if err != nil {
+        return Partner{}, false, err
+    }
+    for _, partner := range partners {
+        if contains(partner.Users, username) {
+            return partner, true, nil
+        }
+    }
+    return Partner{}, false, nil
+}
+
+// checkConflicts keeps names unique and every account with one partner.
+func checkConflicts(partners []Partner, p Partner) error {
+    for _, other := range partners {
+        if other.ID == p.ID {
+            continue
+        }
+        if strings.EqualFold(other.Name, p.Name) {
+            return ErrPartnerExists
+        }
+        if p.AS2 != nil && other.AS2 != nil && other.AS2.ID == p.AS2.ID {
+            return ErrAS2IDTaken
+        }
+        for _, username := range p.Users {
+            if contains(other.Users, username) {
+                return fmt.Errorf("%w: %s belongs to %s", ErrUserTaken, username, other.Name)
+            }
+        }
+    }
+    return nil
+}
+
+// CreatePartner provisions p, filling in GroupID when a group is created
+// for it, and stores it.
+func CreatePartner(p *Partner, actor string) error {
+    partnersMutex.Lock()
+    defer partnersMutex.Unlock()
+
+    partners, err := loadPartners()
+    if err != nil {
+        return err
+    }
+    if err := checkConflicts(partners, *p); err != nil {
+        return err
+    }
+    if err := Provision(p, actor, nil); err != nil {
+        return err
+    }
+    return savePartners(append(partners, *p))
+}
+
+// UpdatePartner provisions p again and replaces the stored partner with the
+// same ID. Accounts no longer listed leave the partner's group.
+func UpdatePartner(p *Partner, actor string) error {
+    partnersMutex.Lock()
+    defer partnersMutex.Unlock()
+
+    partners, err := loadPartners()
+    if err != nil {
+        return err
+    }
+    if err := checkConflicts(partners, *p); err != nil {
+        return err
+    }
+    for i := range partners {
+        if partners[i].ID == p.ID {
+            if err := Provision(p, actor, partners[i].Users); err != nil {
+                return err
+            }
+            partners[i] = *p
+            return savePartners(partners)
+        }
+    }
+    return ErrPartnerNotFound
+}
+
+func DeletePartner(id string) error {
+    partnersMutex.Lock()
+    defer partnersMutex.Unlock()
+
+    partners, err := loadPartners()
+    if err != nil {
+        return err
+    }
+    for i, partner := range partners {
+        if partner.ID == id {
+            return savePartners(append(partners[:i], partners[i+1:]...))
+        }
+    }
+    return ErrPartnerNotFound
+}
@@ -0,0 +1,216 @@
+package pgp
+
+import (
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "path"
+    "strings"
+    "time"
+
+    "github.com/ProtonMail/go-crypto/openpgp"
+    "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+var ErrNoSigningKey = errors.New("no key pair in this keyring to sign with")
+
+// IsEncryptedName reports whether name has one of the extensions partners
+// use for OpenPGP messages.
+func IsEncryptedName(name string) bool {
+    switch strings.ToLower(path.Ext(name)) {
+    case ".pgp", ".gpg", ".asc":
+        return true
+    }
+    return false
+}
+
+// PlainName strips the OpenPGP extension: "orders.csv.pgp" becomes
+// "orders.csv".
+func PlainName(name string) string {
+    if !IsEncryptedName(name) {
+        return name
+    }
+    plain := strings.TrimSuffix(name, path.Ext(name))
+    if plain == "" {
+        return name
+    }
+    return plain
+}
+
+// keyring loads every usable key of owner. Keys that can no longer be read
+// are logged and left out rather than failing the whole keyring.
+func keyring(owner string) (openpgp.EntityList, map[string]Key, error) {
+    keys, err := ListKeys(owner)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    entities := openpgp.EntityList{}
+    byFingerprint := map[string]Key{}
+    for _, key := range keys {
+        entity, err := key.entity()
+        if err != nil {
+            utils.LogError("PGP_ERROR", err, owner, fmt.Sprintf("Skipping key %s", key.ID))
+            continue
+        }
+        entities = append(entities, entity)
+        byFingerprint[key.Fingerprint] = key
+    }
+    return entities, byFingerprint, nil
+}
+
+// Decrypt reads an armored or binary OpenPGP message with the keyring of
+// owner and writes the plaintext to w. Signatures are checked against the
+// same keyring. An error means w must be discarded; a bad signature is not
+// an error but is reported in the returned verification.
+func Decrypt(owner string, r io.Reader, w io.Writer) (models.PGPVerification, error) {
+    verification := models.PGPVerification{VerifiedAt: time.Now()}
+
+    entities, keys, err := keyring(owner)
+    if err != nil {
+        return verification, err
+    }
+
+    in := bufio.NewReader(r)
+    var body io.Reader = in
+    if head, _ := in.Peek(64); bytes.Contains(head, []byte("-----BEGIN PGP")) {
+        block, err := armor.Decode(in)
+        if err != nil {
+            return verification, fmt.Errorf("invalid armored message: %w", err)
+        }
+        body = block.Body
+    }
+
+    md, err := openpgp.ReadMessage(body, entities, nil, nil)
+    if err != nil {
+        return verification, fmt.Errorf("failed to decrypt: %w", err)
+    }
+    if md.IsEncrypted && md.DecryptedWith.Entity != nil {
+        fingerprint := fmt.Sprintf("%X", md.DecryptedWith.Entity.PrimaryKey.Fingerprint)
+        if key, ok := keys[fingerprint]; ok {
+            verification.DecryptedWith = key.ID
+        }
+    }
+
+    // The signature and the integrity check are only known at the end.
+    if _, err := io.Copy(w, md.UnverifiedBody); err != nil {
+        return verification, fmt.Errorf("message is corrupt or was tampered with: %w", err)
+    }
+
+    switch {
+    case !md.IsSigned:
+        verification.Signature = models.SignatureUnsigned
+    case md.SignedBy == nil:
+        verification.Signature = models.SignatureUnknownSigner
+        verification.SignerKeyID = fmt.Sprintf("%016X", md.SignedByKeyId)
+    default:
+        signer := md.SignedBy.Entity
+        verification.SignerKeyID = signer.PrimaryKey.KeyIdString()
+        verification.SignerFingerprint = fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+        if key, ok := keys[verification.SignerFingerprint]; ok {
+            verification.SignerName = key.Name
+        }
+        if md.Signature != nil {
+            signedAt := md.Signature.CreationTime
+            verification.SignedAt = &signedAt
+        }
+        if md.SignatureError != nil {
+            verification.Signature = models.SignatureInvalid
+            verification.Error = md.SignatureError.Error()
+        } else {
+            verification.Signature = models.SignatureValid
+        }
+    }
+    return verification, nil
+}
+
+// Recipients resolves key references (IDs, fingerprints or key IDs) in the
+// keyring of owner.
+func Recipients(owner string, refs []string) ([]Key, error) {
+    recipients := []Key{}
+    for _, ref := range refs {
+        key, err := FindKey(owner, ref)
+        if err != nil {
+            return nil, fmt.Errorf("recipient %q: %w", ref, err)
+        }
+        recipients = append(recipients, key)
+    }
+    return recipients, nil
+}
+
+// SigningKey returns the first key pair of owner's keyring.
+func SigningKey(owner string) (Key, error) {
+    keys, err := ListKeys(owner)
+    if err != nil {
+        return Key{}, err
+    }
+    for _, key := range keys {
+        if key.HasPrivate {
+            return key, nil
+        }
+    }
+    return Key{}, ErrNoSigningKey
+}
+
+// Encrypt encrypts r to the recipients, signed by signer if given, and
+// writes the message to w, ASCII armored if asked to. name is stored in the
+// message as the original file name.
+func Encrypt(recipients []Key, signer *Key, name string, armored bool, r io.Reader, w io.Writer) error {
+    if len(recipients) == 0 {
+        return fmt.Errorf("no recipients")
+    }
+
+    to := []*openpgp.Entity{}
+    for _, key := range recipients {
+        entity, err := key.Redacted().entity()
+        if err != nil {
+            return err
+        }
+        if _, ok := entity.EncryptionKey(time.Now()); !ok {
+            return fmt.Errorf("key %s (%s) cannot encrypt: it is expired, revoked or signing only", key.KeyID, key.Name)
+        }
+        to = append(to, entity)
+    }
+
+    var signedBy *openpgp.Entity
+    if signer != nil {
+        entity, err := signer.entity()
+        if err != nil {
+            return err
+        }
+        if entity.PrivateKey == nil {
+            return ErrNoSigningKey
+        }
+        signedBy = entity
+    }
+
+    out := w
+    var armorWriter io.WriteCloser
+    if armored {
+        var err error
+        armorWriter, err = armor.Encode(w, "PGP MESSAGE", nil)
+        if err != nil {
+            return err
+        }
+        out = armorWriter
+    }
+
+    plaintext, err := openpgp.Encrypt(out, to, signedBy, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+    if err != nil {
+        return fmt.Errorf("failed to encrypt: %w", err)
+    }
+    if _, err := io.Copy(plaintext, r); err != nil {
+        return err
+    }
+    if err := plaintext.Close(); err != nil {
+        return err
+    }
+    if armorWriter != nil {
+        return armorWriter.Close()
+    }
+    return nil
+}
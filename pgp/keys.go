@@ -0,0 +1,339 @@
+// Package pgp keeps OpenPGP keyrings and decrypts, verifies and encrypts
+// files with them. Every home folder and every group has its own keyring,
+// named like event namespaces ("user:<name>", "group:<id>"). A keyring holds
+// the owner's key pairs, which decrypt what partners send and sign what goes
+// out, and the partners' public keys, which verify their signatures and
+// encrypt for them. A group set up for a trading partner therefore holds that
+// partner's keys.
+package pgp
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "bytes"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ProtonMail/go-crypto/openpgp"
+    "github.com/ProtonMail/go-crypto/openpgp/armor"
+    "github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+var (
+    ErrKeyNotFound = errors.New("PGP key not found")
+    ErrKeyExists   = errors.New("PGP key is already in this keyring")
+    ErrNoKeySecret = errors.New("pgp_key_secret is not configured, so private keys cannot be stored")
+
+    keysMutex sync.RWMutex
+)
+
+// Key is one key of a keyring. PrivateKey is only set for the owner's own
+// key pairs and never leaves the server. It is protected with the server's
+// pgp_key_secret rather than the passphrase it was imported with, so the data
+// directory alone does not unlock it. Passphrase is only set on keys stored
+// before that, until SealKeys protects them.
+type Key struct {
+    ID          string     `json:"id"`
+    Owner       string     `json:"owner"`
+    Name        string     `json:"name"`
+    Fingerprint string     `json:"fingerprint"`
+    KeyID       string     `json:"key_id"`
+    UserIDs     []string   `json:"user_ids"`
+    PublicKey   string     `json:"public_key"`
+    PrivateKey  string     `json:"private_key,omitempty"`
+    Passphrase  string     `json:"passphrase,omitempty"`
+    HasPrivate  bool       `json:"has_private"`
+    ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+    CreatedBy   string     `json:"created_by"`
+    CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Redacted drops the private key material before a key is returned by the
+// API.
+func (k Key) Redacted() Key {
+    k.PrivateKey = ""
+    k.Passphrase = ""
+    return k
+}
+
+// Parse reads one armored public key or key pair. An encrypted private key
+// needs its passphrase; the key is stored protected with pgp_key_secret
+// instead, so files can be decrypted unattended.
+func Parse(armored, passphrase string) (Key, error) {
+    entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+    if err != nil {
+        return Key{}, fmt.Errorf("not an armored OpenPGP key: %w", err)
+    }
+    if len(entities) != 1 {
+        return Key{}, fmt.Errorf("expected exactly one key, got %d", len(entities))
+    }
+    entity := entities[0]
+
+    key := Key{}
+    if entity.PrivateKey != nil {
+        if entity.PrivateKey.Encrypted {
+            if passphrase == "" {
+                return Key{}, fmt.Errorf("the private key is protected; a passphrase is required")
+            }
+            if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+                return Key{}, fmt.Errorf("wrong passphrase for the private key")
+            }
+        }
+        if key.PrivateKey, err = protect(entity); err != nil {
+            return Key{}, err
+        }
+        key.HasPrivate = true
+    }
+    return describe(entity, key)
+}
+
+// Generate creates a new Curve25519 key pair for the owner of a keyring.
+func Generate(name, email string) (Key, error) {
+    entity, err := openpgp.NewEntity(name, "", email, &packet.Config{
+        Algorithm: packet.PubKeyAlgoEdDSA,
+        Curve:     packet.Curve25519,
+    })
+    if err != nil {
+        return Key{}, fmt.Errorf("failed to generate key: %w", err)
+    }
+
+    private, err := protect(entity)
+    if err != nil {
+        return Key{}, err
+    }
+    return describe(entity, Key{PrivateKey: private, HasPrivate: true})
+}
+
+func keySecret() ([]byte, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return nil, err
+    }
+    if appConfig.PGPKeySecret == "" {
+        return nil, ErrNoKeySecret
+    }
+    return []byte(appConfig.PGPKeySecret), nil
+}
+
+// protect encrypts the unlocked private keys of entity with pgp_key_secret
+// and returns them armored.
+func protect(entity *openpgp.Entity) (string, error) {
+    secret, err := keySecret()
+    if err != nil {
+        return "", err
+    }
+    if err := entity.EncryptPrivateKeys(secret, nil); err != nil {
+        return "", fmt.Errorf("failed to protect the private key: %w", err)
+    }
+
+    var private bytes.Buffer
+    w, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+    if err != nil {
+        return "", err
+    }
+    if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+        return "", fmt.Errorf("failed to serialize key: %w", err)
+    }
+    w.Close()
+    return private.String(), nil
+}
+
+func describe(entity *openpgp.Entity, key Key) (Key, error) {
+    var public bytes.Buffer
+    w, err := armor.Encode(&public, openpgp.PublicKeyType, nil)
+    if err != nil {
+        return Key{}, err
+    }
+    if err := entity.Serialize(w); err != nil {
+        return Key{}, fmt.Errorf("failed to serialize public key: %w", err)
+    }
+    w.Close()
+
+    key.PublicKey = public.String()
+    key.Fingerprint = fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+    key.KeyID = entity.PrimaryKey.KeyIdString()
+    key.UserIDs = []string{}
+    for name := range entity.Identities {
+        key.UserIDs = append(key.UserIDs, name)
+    }
+    sort.Strings(key.UserIDs)
+    if sig, _ := entity.PrimarySelfSignature(); sig != nil && sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs > 0 {
+        expiresAt := entity.PrimaryKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+        key.ExpiresAt = &expiresAt
+    }
+    return key, nil
+}
+
+// entity reads a stored key back, with its private key unlocked.
+func (k Key) entity() (*openpgp.Entity, error) {
+    armored := k.PublicKey
+    if k.PrivateKey != "" {
+        armored = k.PrivateKey
+    }
+    entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+    if err != nil || len(entities) == 0 {
+        return nil, fmt.Errorf("stored key %s is unreadable: %v", k.KeyID, err)
+    }
+    entity := entities[0]
+    if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+        passphrase := []byte(k.Passphrase)
+        if k.Passphrase == "" {
+            if passphrase, err = keySecret(); err != nil {
+                return nil, err
+            }
+        }
+        if err := entity.DecryptPrivateKeys(passphrase); err != nil {
+            return nil, fmt.Errorf("failed to unlock key %s: %w", k.KeyID, err)
+        }
+    }
+    return entity, nil
+}
+
+// sealed reports whether k's private key, if any, is protected with
+// pgp_key_secret.
+func (k Key) sealed() bool {
+    if k.PrivateKey == "" {
+        return true
+    }
+    if k.Passphrase != "" {
+        return false
+    }
+    entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(k.PrivateKey))
+    return err != nil || len(entities) == 0 || entities[0].PrivateKey == nil || entities[0].PrivateKey.Encrypted
+}
+
+// SealKeys protects private keys stored before pgp_key_secret with it and
+// drops their passphrases. It returns the number of keys sealed; without a
+// secret, keys that need sealing are an ErrNoKeySecret error.
+func SealKeys() (int, error) {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return 0, err
+    }
+    sealed := 0
+    for i := range keys {
+        if keys[i].sealed() {
+            continue
+        }
+        entity, err := keys[i].entity()
+        if err != nil {
+            return 0, err
+        }
+        if keys[i].PrivateKey, err = protect(entity); err != nil {
+            return 0, err
+        }
+        keys[i].Passphrase = ""
+        sealed++
+    }
+    if sealed == 0 {
+        return 0, nil
+    }
+    return sealed, saveKeys(keys)
+}
+
+const keysFile = "pgp_keys.json"
+
+func loadKeys() ([]Key, error) {
+    keys := []Key{}
+    if err := store.ReadDataFile(keysFile, &keys); err != nil {
+        return nil, err
+    }
+    return keys, nil
+}
+
+func saveKeys(keys []Key) error {
+    if keys == nil {
+        keys = []Key{}
+    }
+
+    return store.WriteDataFile(keysFile, keys)
+}
+
+// ListKeys returns the keyring of owner.
+func ListKeys(owner string) ([]Key, error) {
+    keysMutex.RLock()
+    defer keysMutex.RUnlock()
+
+    all, err := loadKeys()
+    if err != nil {
+        return nil, err
+    }
+    keys := []Key{}
+    for _, key := range all {
+        if key.Owner == owner {
+            keys = append(keys, key)
+        }
+    }
+    return keys, nil
+}
+
+func GetKey(id string) (Key, error) {
+    keysMutex.RLock()
+    defer keysMutex.RUnlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return Key{}, err
+    }
+    for _, key := range keys {
+        if key.ID == id {
+            return key, nil
+        }
+    }
+    return Key{}, ErrKeyNotFound
+}
+
+// FindKey looks a key of owner's keyring up by ID, fingerprint or key ID.
+func FindKey(owner, ref string) (Key, error) {
+    ref = strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(ref, "0x"), " ", ""))
+    keys, err := ListKeys(owner)
+    if err != nil {
+        return Key{}, err
+    }
+    for _, key := range keys {
+        if strings.EqualFold(key.ID, ref) || key.Fingerprint == ref || key.KeyID == ref {
+            return key, nil
+        }
+    }
+    return Key{}, ErrKeyNotFound
+}
+
+// AddKey stores key in its owner's keyring; a keyring holds each key once.
+func AddKey(key Key) error {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return err
+    }
+    for _, existing := range keys {
+        if existing.Owner == key.Owner && existing.Fingerprint == key.Fingerprint {
+            return ErrKeyExists
+        }
+    }
+    return saveKeys(append(keys, key))
+}
+
+func DeleteKey(id string) error {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return err
+    }
+    for i, key := range keys {
+        if key.ID == id {
+            return saveKeys(append(keys[:i], keys[i+1:]...))
+        }
+    }
+    return ErrKeyNotFound
+}
@@ -0,0 +1,133 @@
+package pgp
+
+import (
+    "LunaTransfer/internal/testenv"
+    "bytes"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/ProtonMail/go-crypto/openpgp"
+    "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func TestMain(m *testing.M) {
+    os.Setenv("LUNA_PGP_KEY_SECRET", "test-key-secret")
+    testenv.Main(m, nil, nil)
+}
+
+// armoredKeyPair returns a new key pair protected with passphrase, or not
+// protected at all when passphrase is empty.
+func armoredKeyPair(t *testing.T, passphrase string) string {
+    t.Helper()
+    entity, err := openpgp.NewEntity("Partner", "", "partner@example.com", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if passphrase != "" {
+        if err := entity.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var private bytes.Buffer
+    w, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+        t.Fatal(err)
+    }
+    w.Close()
+    return private.String()
+}
+
+func encryptDecrypt(t *testing.T, key Key) {
+    t.Helper()
+    key.ID = "key-" + key.KeyID
+    key.Owner = "user:" + key.KeyID
+    if err := AddKey(key); err != nil {
+        t.Fatal(err)
+    }
+    var encrypted bytes.Buffer
+    if err := Encrypt([]Key{key}, &key, "orders.csv", false, strings.NewReader("orders"), &encrypted); err != nil {
+        t.Fatal(err)
+    }
+    var plain bytes.Buffer
+    if _, err := Decrypt(key.Owner, &encrypted, &plain); err != nil {
+        t.Fatalf("decrypt with the stored key: %v", err)
+    }
+    if plain.String() != "orders" {
+        t.Errorf("got %q", plain.String())
+    }
+}
+
+func TestStoredKeysAreProtectedWithTheSecret(t *testing.T) {
+    armored := armoredKeyPair(t, "partner passphrase")
+    if _, err := Parse(armored, ""); err == nil {
+        t.Error("a protected key was accepted without its passphrase")
+    }
+    key, err := Parse(armored, "partner passphrase")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if key.Passphrase != "" || strings.Contains(key.PrivateKey, "partner passphrase") {
+        t.Error("the passphrase is stored with the key")
+    }
+
+    entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.PrivateKey))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !entities[0].PrivateKey.Encrypted {
+        t.Fatal("the stored private key is not protected")
+    }
+    if entities[0].DecryptPrivateKeys([]byte("partner passphrase")) == nil {
+        t.Error("the stored private key still opens with the import passphrase")
+    }
+    encryptDecrypt(t, key)
+
+    generated, err := Generate("Own key", "own@example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !generated.sealed() {
+        t.Error("a generated key is not protected")
+    }
+    encryptDecrypt(t, generated)
+}
+
+func TestSealKeys(t *testing.T) {
+    legacy := []Key{
+        {ID: "legacy-protected", Owner: "user:legacy", PrivateKey: armoredKeyPair(t, "old passphrase"), Passphrase: "old passphrase", HasPrivate: true},
+        {ID: "legacy-plain", Owner: "user:legacy", PrivateKey: armoredKeyPair(t, ""), HasPrivate: true},
+    }
+    keysMutex.Lock()
+    keys, err := loadKeys()
+    if err == nil {
+        err = saveKeys(append(keys, legacy...))
+    }
+    keysMutex.Unlock()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    sealed, err := SealKeys()
+    if err != nil || sealed != 2 {
+        t.Fatalf("got %d keys sealed, %v", sealed, err)
+    }
+    for _, ref := range legacy {
+        key, err := GetKey(ref.ID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if key.Passphrase != "" || !key.sealed() {
+            t.Errorf("%s was not sealed", key.ID)
+        }
+        if _, err := key.entity(); err != nil {
+            t.Errorf("%s: %v", key.ID, err)
+        }
+    }
+    if sealed, err := SealKeys(); err != nil || sealed != 0 {
+        t.Errorf("second run: got %d keys sealed, %v", sealed, err)
+    }
+}
@@ -0,0 +1,87 @@
+package receipts
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/integrity"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "fmt"
+    "net"
+)
+
+// HandleEvent issues a receipt for every completed upload and for the first
+// download of each file by each recipient. It runs synchronously, after the
+// integrity index has recorded an upload, so the receipt carries the hash of
+// the file as it was transferred, before rules move or change it; files the
+// index knows unchanged are not hashed again.
+func HandleEvent(e events.Event) {
+    if e.IsDir || e.SourcePath == "" {
+        return
+    }
+    var receiptType string
+    switch e.Type {
+    case events.FileUploaded:
+        receiptType = TypeUpload
+    case events.FileDownloaded:
+        receiptType = TypeDownload
+    default:
+        return
+    }
+
+    checksum, err := integrity.Current(e.SourcePath)
+    if err != nil {
+        utils.LogError("RECEIPT_ERROR", err, e.Actor, fmt.Sprintf("Failed to hash %s for a receipt", e.SourcePath))
+        return
+    }
+    ip := e.RemoteAddr
+    if host, _, err := net.SplitHostPort(ip); err == nil {
+        ip = host
+    }
+    statement := Statement{
+        ID:        utils.GenerateUUID(),
+        Type:      receiptType,
+        Namespace: e.Namespace,
+        Path:      e.Path,
+        SHA256:    checksum.SHA256,
+        Size:      checksum.Size,
+        User:      e.Actor,
+        IP:        ip,
+        Timestamp: e.Timestamp.UTC(),
+    }
+
+    issued, err := issue(statement)
+    if err != nil {
+        utils.LogError("RECEIPT_ERROR", err, e.Actor, fmt.Sprintf("Failed to issue %s receipt for %s", receiptType, e.SourcePath))
+        return
+    }
+    if issued {
+        utils.LogSystem("RECEIPT_ISSUED", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Issued %s receipt %s for %s in %s (sha256 %s)", receiptType, statement.ID, e.Path, e.Namespace, checksum.SHA256))
+    }
+}
+
+// issue signs and stores statement unless it is a download the user's last
+// receipt for the file already covers: a file counts as the same while its
+// hash is.
+func issue(statement Statement) (bool, error) {
+    receipt, err := sign(statement)
+    if err != nil {
+        return false, err
+    }
+    issued := false
+    err = store.Update(func(tx *store.Tx) error {
+        if statement.Type == TypeDownload {
+            key := downloadKey(statement.User, statement.Namespace, statement.Path)
+            last, found, err := lastDownloadRepo.Get(tx, key)
+            if err != nil || (found && last.SHA256 == statement.SHA256) {
+                return err
+            }
+            if err := lastDownloadRepo.Put(tx, key, lastDownload{ReceiptID: statement.ID, SHA256: statement.SHA256}); err != nil {
+                return err
+            }
+        }
+        issued = true
+        return putReceipt(tx, receipt)
+    })
+    return issued, err
+}
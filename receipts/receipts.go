@@ -0,0 +1,295 @@
+// Package receipts issues signed delivery receipts: proof that a file with a
+// given SHA-256 was uploaded, or first downloaded by a recipient, by whom,
+// from where and when. Receipts are signed with the server's Ed25519 key, so
+// anyone holding the public key can verify them without asking the server.
+package receipts
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    TypeUpload   = "upload"
+    TypeDownload = "download"
+
+    Algorithm = "Ed25519"
+)
+
+var (
+    ErrReceiptNotFound = errors.New("receipt not found")
+
+    // errListFull stops ListReceipts' scan once it has enough receipts.
+    errListFull = errors.New("receipt list is full")
+
+    keyMutex sync.Mutex
+    key      *Key
+)
+
+// Statement is what a receipt attests. It is signed as the exact bytes of
+// its JSON encoding, which the receipt carries as Payload.
+type Statement struct {
+    ID        string    `json:"id"`
+    Type      string    `json:"type"`
+    Namespace string    `json:"namespace"`
+    Path      string    `json:"path"`
+    SHA256    string    `json:"sha256"`
+    Size      int64     `json:"size"`
+    User      string    `json:"user"`
+    IP        string    `json:"ip"`
+    Timestamp time.Time `json:"timestamp"`
+    KeyID     string    `json:"key_id"`
+}
+
+// Receipt is a signed statement. Payload and Signature are base64; the
+// statement fields are repeated for reading and are only trustworthy as far
+// as they match the verified payload.
+type Receipt struct {
+    Statement
+    Payload   string `json:"payload"`
+    Signature string `json:"signature"`
+}
+
+// Key is the server's receipt signing key. ID is the first 16 hex digits of
+// the SHA-256 of the public key, so receipts name the key that signed them.
+type Key struct {
+    ID      string
+    Private ed25519.PrivateKey
+    Public  ed25519.PublicKey
+}
+
+// PublicKeyPEM is the public key as a PKIX PEM block, which OpenSSL and most
+// crypto libraries read.
+func (k *Key) PublicKeyPEM() (string, error) {
+    der, err := x509.MarshalPKIXPublicKey(k.Public)
+    if err != nil {
+        return "", err
+    }
+    return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// LoadKey returns the signing key, reading it once and generating one on
+// first use.
+func LoadKey() (*Key, error) {
+    keyMutex.Lock()
+    defer keyMutex.Unlock()
+
+    if key != nil {
+        return key, nil
+    }
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return nil, err
+    }
+    path := appConfig.ReceiptKeyFile
+
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        data, err = generateKey(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to generate receipt key: %w", err)
+        }
+        utils.LogSystem("RECEIPT_KEY_CREATED", "system", "localhost",
+            fmt.Sprintf("Generated receipt signing key %s", path))
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read receipt key: %w", err)
+    }
+
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("receipt key %s is not PEM", path)
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse receipt key: %w", err)
+    }
+    private, ok := parsed.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("the receipt key must be an Ed25519 key")
+    }
+    public := private.Public().(ed25519.PublicKey)
+    sum := sha256.Sum256(public)
+    key = &Key{ID: hex.EncodeToString(sum[:8]), Private: private, Public: public}
+    return key, nil
+}
+
+func generateKey(path string) ([]byte, error) {
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(private)
+    if err != nil {
+        return nil, err
+    }
+    data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return nil, err
+    }
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// sign completes statement with the key ID and signs it.
+func sign(statement Statement) (Receipt, error) {
+    k, err := LoadKey()
+    if err != nil {
+        return Receipt{}, err
+    }
+    statement.KeyID = k.ID
+    payload, err := json.Marshal(statement)
+    if err != nil {
+        return Receipt{}, err
+    }
+    return Receipt{
+        Statement: statement,
+        Payload:   base64.StdEncoding.EncodeToString(payload),
+        Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(k.Private, payload)),
+    }, nil
+}
+
+var (
+    receiptRepo      = store.NewRepository[Receipt](store.Receipts)
+    receiptIDRepo    = store.NewRepository[string](store.ReceiptIDs)
+    lastDownloadRepo = store.NewRepository[lastDownload](store.ReceiptDownloads)
+)
+
+// lastDownload is the last receipt a user was issued for downloading a file.
+type lastDownload struct {
+    ReceiptID string `json:"receipt_id"`
+    SHA256    string `json:"sha256"`
+}
+
+// keyTimeFormat has a fixed width, so receipt keys sort by time.
+const keyTimeFormat = "20060102T150405.000000000Z"
+
+func receiptKey(receipt Receipt) string {
+    return receipt.Timestamp.UTC().Format(keyTimeFormat) + "/" + receipt.ID
+}
+
+func downloadKey(user, namespace, path string) string {
+    return user + "/" + namespace + "/" + path
+}
+
+func putReceipt(tx *store.Tx, receipt Receipt) error {
+    key := receiptKey(receipt)
+    if err := receiptRepo.Put(tx, key, receipt); err != nil {
+        return err
+    }
+    return receiptIDRepo.Put(tx, receipt.ID, key)
+}
+
+// ListReceipts returns the receipts match accepts, newest first. Receipts
+// are proof, so unlike other logs they are never trimmed.
+func ListReceipts(match func(Receipt) bool, limit int) ([]Receipt, error) {
+    result := []Receipt{}
+    err := store.View(func(tx *store.Tx) error {
+        return receiptRepo.ScanReverse(tx, "", func(key string, receipt Receipt) error {
+            if match(receipt) {
+                result = append(result, receipt)
+            }
+            if len(result) >= limit {
+                return errListFull
+            }
+            return nil
+        })
+    })
+    if err != nil && err != errListFull {
+        return nil, err
+    }
+    return result, nil
+}
+
+func GetReceipt(id string) (Receipt, error) {
+    var receipt Receipt
+    err := store.View(func(tx *store.Tx) error {
+        key, found, err := receiptIDRepo.Get(tx, id)
+        if err != nil || !found {
+            if err == nil {
+                err = ErrReceiptNotFound
+            }
+            return err
+        }
+        receipt, found, err = receiptRepo.Get(tx, key)
+        if err == nil && !found {
+            err = ErrReceiptNotFound
+        }
+        return err
+    })
+    return receipt, err
+}
+
+// legacyReceiptsFile is where receipts were kept before the database,
+// relative to the data directory.
+const legacyReceiptsFile = "receipts.json"
+
+// ImportLegacyReceipts moves the receipts kept in the data directory before
+// the database into it, keeping receipts it already has, and renames the file
+// with a ".migrated" suffix. It returns the number of receipts imported.
+func ImportLegacyReceipts() (int, error) {
+    path, err := store.DataFile(legacyReceiptsFile)
+    if err != nil {
+        return 0, err
+    }
+    var receipts []Receipt
+    found, err := store.ReadLegacyFile(path, &receipts)
+    if err != nil || !found {
+        return 0, err
+    }
+
+    // Receipts are signed with their IDs, so one without an ID can't be
+    // given one and is skipped.
+    var stats store.ImportStats
+    err = store.Update(func(tx *store.Tx) error {
+        added, s, err := store.ImportRecords(tx, receiptRepo, receipts, func(receipt Receipt) string {
+            if receipt.ID == "" {
+                return ""
+            }
+            return receiptKey(receipt)
+        }, nil)
+        if err != nil {
+            return err
+        }
+        stats = s
+        for _, receipt := range added {
+            if err := receiptIDRepo.Put(tx, receipt.ID, receiptKey(receipt)); err != nil {
+                return err
+            }
+            if receipt.Type != TypeDownload {
+                continue
+            }
+            // Receipts are imported oldest first, so the last one wins.
+            key := downloadKey(receipt.User, receipt.Namespace, receipt.Path)
+            if err := lastDownloadRepo.Put(tx, key, lastDownload{ReceiptID: receipt.ID, SHA256: receipt.SHA256}); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    if stats.Skipped > 0 {
+        utils.LogSystem("RECEIPTS_SKIPPED", "system", "localhost",
+            fmt.Sprintf("Skipped %d receipts without an ID in %s", stats.Skipped, path))
+    }
+    return stats.Imported, store.ArchiveLegacyFile(path)
+}
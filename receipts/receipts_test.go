@@ -0,0 +1,163 @@
+package receipts
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/integrity"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/store"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, nil, nil)
+}
+
+// writeStored writes data at the storage-relative path rel, last modified at
+// modTime.
+func writeStored(t *testing.T, rel, data string, modTime time.Time) {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    full := filepath.Join(appConfig.StorageDirectory, filepath.FromSlash(rel))
+    if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chtimes(full, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// transfer sends the event the server publishes for a transfer of rel by
+// user to the subscribers in the order the server registers them.
+func transfer(eventType events.Type, user, rel string) {
+    e := events.Event{Type: eventType, Actor: user, SourcePath: rel, RemoteAddr: "192.0.2.1:5000", Timestamp: time.Now()}
+    e.Namespace, e.Path = events.SplitStoragePath(rel)
+    integrity.HandleEvent(e)
+    HandleEvent(e)
+}
+
+func receiptsOf(t *testing.T, user string) []Receipt {
+    t.Helper()
+    list, err := ListReceipts(func(r Receipt) bool { return r.User == user }, 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return list
+}
+
+func TestReceiptsUseTheRecordedChecksum(t *testing.T) {
+    modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+    writeStored(t, "alice/report.pdf", "quarterly report", modTime)
+    transfer(events.FileUploaded, "alice", "alice/report.pdf")
+
+    recorded, err := integrity.Current("alice/report.pdf")
+    if err != nil {
+        t.Fatal(err)
+    }
+    list := receiptsOf(t, "alice")
+    if len(list) != 1 || list[0].Type != TypeUpload || list[0].SHA256 != recorded.SHA256 || list[0].IP != "192.0.2.1" {
+        t.Fatalf("got %+v, want one upload receipt for %s", list, recorded.SHA256)
+    }
+
+    // The same size and modification time: the recorded checksum is used
+    // without reading the file.
+    writeStored(t, "alice/report.pdf", "QUARTERLY REPORT", modTime)
+    transfer(events.FileDownloaded, "bob", "alice/report.pdf")
+    transfer(events.FileDownloaded, "bob", "alice/report.pdf")
+    list = receiptsOf(t, "bob")
+    if len(list) != 1 || list[0].Type != TypeDownload || list[0].SHA256 != recorded.SHA256 {
+        t.Fatalf("got %+v, want one download receipt for %s", list, recorded.SHA256)
+    }
+
+    // A changed file is hashed and downloading it again is receipted.
+    writeStored(t, "alice/report.pdf", "revised report", time.Now())
+    transfer(events.FileDownloaded, "bob", "alice/report.pdf")
+    list = receiptsOf(t, "bob")
+    if len(list) != 2 || list[0].SHA256 == recorded.SHA256 || list[0].Size != int64(len("revised report")) {
+        t.Fatalf("got %+v, want a second download receipt for the revised file", list)
+    }
+}
+
+func TestListAndGetReceipts(t *testing.T) {
+    start := time.Now().Add(-time.Hour)
+    var ids []string
+    for i := 0; i < 3; i++ {
+        statement := Statement{
+            ID:        "list-" + string(rune('a'+i)),
+            Type:      TypeUpload,
+            Namespace: "user:carol",
+            Path:      "file.txt",
+            User:      "carol",
+            Timestamp: start.Add(time.Duration(i) * time.Minute),
+        }
+        if issued, err := issue(statement); err != nil || !issued {
+            t.Fatalf("issue %s: %v, %v", statement.ID, issued, err)
+        }
+        ids = append(ids, statement.ID)
+    }
+
+    list, err := ListReceipts(func(r Receipt) bool { return r.User == "carol" }, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 2 || list[0].ID != ids[2] || list[1].ID != ids[1] {
+        t.Errorf("got %v, want the two newest receipts, newest first", list)
+    }
+
+    receipt, err := GetReceipt(ids[0])
+    if err != nil || receipt.ID != ids[0] || receipt.Signature == "" {
+        t.Errorf("got %+v, %v", receipt, err)
+    }
+    if _, err := GetReceipt("missing"); !errors.Is(err, ErrReceiptNotFound) {
+        t.Errorf("got %v, want ErrReceiptNotFound", err)
+    }
+}
+
+func TestImportLegacyReceipts(t *testing.T) {
+    var legacy []Receipt
+    for _, statement := range []Statement{
+        {ID: "legacy-upload", Type: TypeUpload, Namespace: "user:dave", Path: "in.csv", SHA256: "aa", User: "dave"},
+        {ID: "legacy-download", Type: TypeDownload, Namespace: "user:dave", Path: "in.csv", SHA256: "aa", User: "erin"},
+        {Type: TypeDownload, Namespace: "user:dave", Path: "in.csv", SHA256: "aa", User: "frank"},
+    } {
+        statement.Timestamp = time.Now().Add(-time.Hour)
+        receipt, err := sign(statement)
+        if err != nil {
+            t.Fatal(err)
+        }
+        legacy = append(legacy, receipt)
+    }
+    if err := store.WriteDataFile(legacyReceiptsFile, legacy); err != nil {
+        t.Fatal(err)
+    }
+
+    imported, err := ImportLegacyReceipts()
+    if err != nil || imported != 2 {
+        t.Fatalf("got %d imported, %v; want 2", imported, err)
+    }
+    path, _ := store.DataFile(legacyReceiptsFile)
+    if _, err := os.Stat(path + ".migrated"); err != nil {
+        t.Errorf("the legacy file was not archived: %v", err)
+    }
+    for _, id := range []string{"legacy-upload", "legacy-download"} {
+        if _, err := GetReceipt(id); err != nil {
+            t.Errorf("%s: %v", id, err)
+        }
+    }
+
+    // The imported download counts as erin's first.
+    again := Statement{ID: "again", Type: TypeDownload, Namespace: "user:dave", Path: "in.csv", SHA256: "aa", User: "erin", Timestamp: time.Now()}
+    if issued, err := issue(again); err != nil || issued {
+        t.Errorf("a repeated download was receipted: %v, %v", issued, err)
+    }
+}
@@ -0,0 +1,177 @@
+package retention
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const sweepInterval = time.Hour
+
+// enforceMutex keeps the hourly sweep and runs started by admins apart.
+var enforceMutex sync.Mutex
+
+// Item is a file in an enforcement report.
+type Item struct {
+    Namespace  string    `json:"namespace"`
+    Path       string    `json:"path"`
+    Size       int64     `json:"size"`
+    ModifiedAt time.Time `json:"modified_at"`
+    PurgeAt    time.Time `json:"purge_at"`
+    PolicyID   string    `json:"policy_id"`
+    Policy     string    `json:"policy"`
+    Error      string    `json:"error,omitempty"`
+}
+
+// Report sums up one enforcement run. Checked counts the files covered by
+// any policy, Retained those a minimum retention keeps right now and Held
+// those a legal hold kept from being purged. In a dry run, Purged lists what
+// would have been deleted.
+type Report struct {
+    DryRun    bool      `json:"dry_run"`
+    StartedAt time.Time `json:"started_at"`
+    Checked   int       `json:"checked"`
+    Retained  int       `json:"retained"`
+    Held      int       `json:"held"`
+    Purged    []Item    `json:"purged"`
+    Bytes     int64     `json:"bytes"`
+    Failed    []Item    `json:"failed"`
+}
+
+// Start enforces the policies now and every hour until ctx is done.
+func Start(ctx context.Context) {
+    ticker := time.NewTicker(sweepInterval)
+    defer ticker.Stop()
+
+    for {
+        if _, err := Enforce(false, "system"); err != nil {
+            utils.LogError("RETENTION_ERROR", err, "system", "Failed to enforce retention policies")
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// Enforce purges the files past their maximum retention, or only reports
+// them when dryRun is set. Every purged file is audited and published as a
+// deletion by actor.
+func Enforce(dryRun bool, actor string) (Report, error) {
+    enforceMutex.Lock()
+    defer enforceMutex.Unlock()
+
+    report := Report{DryRun: dryRun, StartedAt: time.Now(), Purged: []Item{}, Failed: []Item{}}
+    policies, err := enabledPolicies()
+    if err != nil {
+        return report, err
+    }
+    holds, err := activeHolds()
+    if err != nil {
+        return report, err
+    }
+    storageDir, err := storageDirectory()
+    if err != nil {
+        return report, err
+    }
+
+    // Overlapping policies walk the same files; each is judged once.
+    seen := map[string]bool{}
+    for _, policy := range policies {
+        root := filepath.Join(storageDir, filepath.FromSlash(events.StoragePath(policy.Namespace(), policy.Path)))
+        filepath.Walk(root, func(full string, info os.FileInfo, err error) error {
+            if err != nil || info.IsDir() {
+                return nil
+            }
+            fileRel, err := filepath.Rel(storageDir, full)
+            if err != nil {
+                return nil
+            }
+            fileRel = filepath.ToSlash(fileRel)
+            if seen[fileRel] {
+                return nil
+            }
+            seen[fileRel] = true
+            enforceFile(&report, policies, holds, full, fileRel, info, actor)
+            return nil
+        })
+    }
+
+    if !dryRun && (len(report.Purged) > 0 || len(report.Failed) > 0) {
+        utils.LogSystem("RETENTION_ENFORCED", actor, "localhost",
+            fmt.Sprintf("Purged %d files (%d bytes), %d failed, %d held, %d checked",
+                len(report.Purged), report.Bytes, len(report.Failed), report.Held, report.Checked))
+    }
+    return report, nil
+}
+
+func enforceFile(report *Report, policies []Policy, holds []Hold, full, fileRel string, info os.FileInfo, actor string) {
+    namespace, p := events.SplitStoragePath(fileRel)
+    l := limitsFor(policies, namespace, p)
+    report.Checked++
+    now := time.Now()
+    if l.min > 0 && l.keptUntil(info.ModTime()).After(now) {
+        report.Retained++
+    }
+    purgeAt := l.purgeAt(info.ModTime())
+    if purgeAt.IsZero() || purgeAt.After(now) {
+        return
+    }
+    for _, hold := range holds {
+        if hold.Covers(namespace, p) {
+            report.Held++
+            return
+        }
+    }
+
+    item := Item{
+        Namespace:  namespace,
+        Path:       p,
+        Size:       info.Size(),
+        ModifiedAt: info.ModTime(),
+        PurgeAt:    purgeAt,
+        PolicyID:   l.maxPolicy.ID,
+        Policy:     l.maxPolicy.Name,
+    }
+    if report.DryRun {
+        report.Purged = append(report.Purged, item)
+        report.Bytes += item.Size
+        return
+    }
+
+    if err := os.Remove(full); err != nil {
+        item.Error = err.Error()
+        report.Failed = append(report.Failed, item)
+        utils.LogError("RETENTION_ERROR", err, actor, fmt.Sprintf("Failed to purge %s in %s", p, namespace))
+        return
+    }
+    report.Purged = append(report.Purged, item)
+    report.Bytes += item.Size
+
+    utils.LogAudit("RETENTION_PURGED", actor, "localhost",
+        fmt.Sprintf("Purged %s in %s (%d bytes, modified %s) under retention policy %s (%s)",
+            p, namespace, item.Size, item.ModifiedAt.Format(time.RFC3339), l.maxPolicy.Name, l.maxPolicy.ID))
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      actor,
+        RemoteAddr: "localhost",
+        UserAgent:  "Retention policies",
+        SourcePath: fileRel,
+        Size:       item.Size,
+    })
+    removed, err := models.RemoveFileSharesUnder(fileRel)
+    if err != nil {
+        utils.LogError("RETENTION_ERROR", err, actor, fmt.Sprintf("Failed to revoke shares of %s", fileRel))
+        return
+    }
+    for _, share := range removed {
+        events.Publish(events.ShareEvent(events.ShareRemoved, actor, "localhost", share, "source purged"))
+    }
+}
@@ -0,0 +1,144 @@
+package retention
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// RetainedError refuses to let go of a file a minimum retention still keeps.
+// It counts as a permission error, so protocols report it as one.
+type RetainedError struct {
+    // Path is storage-relative, like event paths.
+    Path   string
+    Policy string
+    Until  time.Time
+}
+
+func (e *RetainedError) Error() string {
+    _, rel := events.SplitStoragePath(e.Path)
+    return fmt.Sprintf("%s is kept until %s by retention policy %s", rel, e.Until.Format("2006-01-02"), e.Policy)
+}
+
+func (e *RetainedError) Is(target error) bool {
+    return target == os.ErrPermission
+}
+
+// CheckDelete returns a *HeldError if a legal hold covers the file or folder
+// at the storage-relative path rel or anything below it, and a
+// *RetainedError if a minimum retention still keeps a file there.
+func CheckDelete(rel string) error {
+    if err := checkHolds(rel, true, nil); err != nil {
+        return err
+    }
+    return check(rel, func(string, limits, []Policy) bool {
+        return false
+    })
+}
+
+// CheckMove refuses to move from to to if that takes anything out of a legal
+// hold or takes a retained file where it is kept for a shorter time. Moves
+// within the reach of the same holds and policies are allowed.
+func CheckMove(from, to string) error {
+    namespace, p := events.SplitStoragePath(to)
+    err := checkHolds(from, true, func(hold Hold) bool {
+        return hold.Covers(namespace, p)
+    })
+    if err != nil {
+        return err
+    }
+    return check(from, func(fileRel string, l limits, policies []Policy) bool {
+        namespace, p := events.SplitStoragePath(path.Join(to, strings.TrimPrefix(fileRel, from)))
+        return limitsFor(policies, namespace, p).min >= l.min
+    })
+}
+
+// CheckOverwrite returns a *HeldError if a file exists at the
+// storage-relative path rel and is under legal hold.
+func CheckOverwrite(rel string) error {
+    storageDir, err := storageDirectory()
+    if err != nil {
+        return err
+    }
+    if _, err := os.Stat(filepath.Join(storageDir, filepath.FromSlash(rel))); err != nil {
+        return nil
+    }
+    return checkHolds(rel, false, nil)
+}
+
+// AuditAction names the audit entry for a change refused with err, or is
+// empty if err is no such refusal.
+func AuditAction(err error) string {
+    var held *HeldError
+    var retained *RetainedError
+    switch {
+    case errors.As(err, &held):
+        return "LEGAL_HOLD_BLOCKED"
+    case errors.As(err, &retained):
+        return "RETENTION_BLOCKED"
+    }
+    return ""
+}
+
+// check walks the files at or below rel that a minimum retention keeps and
+// refuses the first one allowed does not let go.
+func check(rel string, allowed func(fileRel string, l limits, policies []Policy) bool) error {
+    policies, err := enabledPolicies()
+    if err != nil {
+        return err
+    }
+    namespace, p := events.SplitStoragePath(rel)
+    relevant := false
+    for _, policy := range policies {
+        if policy.MinDays > 0 && policy.reaches(namespace, p) {
+            relevant = true
+            break
+        }
+    }
+    if !relevant {
+        return nil
+    }
+
+    storageDir, err := storageDirectory()
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    return filepath.Walk(filepath.Join(storageDir, filepath.FromSlash(rel)), func(full string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() {
+            return nil
+        }
+        fileRel, err := filepath.Rel(storageDir, full)
+        if err != nil {
+            return err
+        }
+        fileRel = filepath.ToSlash(fileRel)
+        namespace, p := events.SplitStoragePath(fileRel)
+        l := limitsFor(policies, namespace, p)
+        until := l.keptUntil(info.ModTime())
+        if l.min == 0 || !until.After(now) || allowed(fileRel, l, policies) {
+            return nil
+        }
+        return &RetainedError{Path: fileRel, Policy: l.minPolicy.Name, Until: until}
+    })
+}
+
+func storageDirectory() (string, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return "", fmt.Errorf("failed to load config: %w", err)
+    }
+    return appConfig.StorageDirectory, nil
+}
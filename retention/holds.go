@@ -0,0 +1,183 @@
+package retention
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/store"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    ErrHoldNotFound = errors.New("legal hold not found")
+    ErrHoldReleased = errors.New("legal hold already released")
+
+    holdsMutex sync.RWMutex
+)
+
+// Hold preserves everything in its scope until it is released: nothing there
+// may be deleted, overwritten, moved out or purged, whatever the retention
+// policies say. A hold on a user without a path also keeps the account from
+// being deleted. Released holds stay on record.
+type Hold struct {
+    ID     string `json:"id"`
+    Name   string `json:"name"`
+    Reason string `json:"reason,omitempty"`
+    Scope
+    CreatedBy   string     `json:"created_by"`
+    CreatedAt   time.Time  `json:"created_at"`
+    ReleasedBy  string     `json:"released_by,omitempty"`
+    ReleasedAt  *time.Time `json:"released_at,omitempty"`
+    ReleaseNote string     `json:"release_note,omitempty"`
+}
+
+func (h Hold) Active() bool {
+    return h.ReleasedAt == nil
+}
+
+func (h *Hold) Normalize() {
+    h.Name = strings.TrimSpace(h.Name)
+    h.Reason = strings.TrimSpace(h.Reason)
+    h.Scope.normalize()
+}
+
+func (h Hold) Validate() error {
+    if h.Name == "" {
+        return fmt.Errorf("name is required")
+    }
+    return h.Scope.validate()
+}
+
+// HeldError refuses a change to something under legal hold. Like
+// RetainedError it counts as a permission error.
+type HeldError struct {
+    // Path is storage-relative, like event paths.
+    Path   string
+    HoldID string
+    Hold   string
+}
+
+func (e *HeldError) Error() string {
+    _, rel := events.SplitStoragePath(e.Path)
+    if rel == "" {
+        rel = "/"
+    }
+    return fmt.Sprintf("%s is under legal hold %s", rel, e.Hold)
+}
+
+func (e *HeldError) Is(target error) bool {
+    return target == os.ErrPermission
+}
+
+const holdsFile = "legal_holds.json"
+
+func loadHolds() ([]Hold, error) {
+    holds := []Hold{}
+    if err := store.ReadDataFile(holdsFile, &holds); err != nil {
+        return nil, err
+    }
+    return holds, nil
+}
+
+func saveHolds(holds []Hold) error {
+    return store.WriteDataFile(holdsFile, holds)
+}
+
+// ListHolds returns all holds, released ones included.
+func ListHolds() ([]Hold, error) {
+    holdsMutex.RLock()
+    defer holdsMutex.RUnlock()
+
+    return loadHolds()
+}
+
+func GetHold(id string) (Hold, error) {
+    holds, err := ListHolds()
+    if err != nil {
+        return Hold{}, err
+    }
+    for _, hold := range holds {
+        if hold.ID == id {
+            return hold, nil
+        }
+    }
+    return Hold{}, ErrHoldNotFound
+}
+
+func PlaceHold(hold Hold) error {
+    holdsMutex.Lock()
+    defer holdsMutex.Unlock()
+
+    holds, err := loadHolds()
+    if err != nil {
+        return err
+    }
+    return saveHolds(append(holds, hold))
+}
+
+// ReleaseHold lifts the hold id. Holds are never deleted, so the record of
+// what was preserved, by whom and until when stays.
+func ReleaseHold(id, releasedBy, note string) (Hold, error) {
+    holdsMutex.Lock()
+    defer holdsMutex.Unlock()
+
+    holds, err := loadHolds()
+    if err != nil {
+        return Hold{}, err
+    }
+    for i := range holds {
+        hold := &holds[i]
+        if hold.ID != id {
+            continue
+        }
+        if !hold.Active() {
+            return *hold, ErrHoldReleased
+        }
+        now := time.Now()
+        hold.ReleasedBy = releasedBy
+        hold.ReleasedAt = &now
+        hold.ReleaseNote = note
+        return *hold, saveHolds(holds)
+    }
+    return Hold{}, ErrHoldNotFound
+}
+
+func activeHolds() ([]Hold, error) {
+    holds, err := ListHolds()
+    if err != nil {
+        return nil, err
+    }
+    active := holds[:0]
+    for _, hold := range holds {
+        if hold.Active() {
+            active = append(active, hold)
+        }
+    }
+    return active, nil
+}
+
+// checkHolds refuses a change to the storage-relative path rel if a hold
+// covers it or, with below set, anything below it. allowed may let a covering
+// hold pass.
+func checkHolds(rel string, below bool, allowed func(Hold) bool) error {
+    holds, err := activeHolds()
+    if err != nil {
+        return err
+    }
+    namespace, p := events.SplitStoragePath(rel)
+    for _, hold := range holds {
+        switch {
+        case hold.Covers(namespace, p):
+            if allowed != nil && allowed(hold) {
+                continue
+            }
+            return &HeldError{Path: rel, HoldID: hold.ID, Hold: hold.Name}
+        case below && hold.reaches(namespace, p):
+            return &HeldError{Path: events.StoragePath(hold.Namespace(), hold.Path), HoldID: hold.ID, Hold: hold.Name}
+        }
+    }
+    return nil
+}
@@ -0,0 +1,168 @@
+package retention
+
+import (
+    "errors"
+    "os"
+    "testing"
+    "time"
+)
+
+// withHold places hold for the test and returns its ID.
+func withHold(t *testing.T, hold Hold) string {
+    t.Helper()
+    hold.ID = hold.Name
+    hold.CreatedAt = time.Now()
+    if err := PlaceHold(hold); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { saveHolds([]Hold{}) })
+    return hold.ID
+}
+
+func held(t *testing.T, err error, hold string) bool {
+    t.Helper()
+    var heldErr *HeldError
+    if !errors.As(err, &heldErr) {
+        if err != nil {
+            t.Errorf("got %v, want a HeldError or nothing", err)
+        }
+        return false
+    }
+    if heldErr.HoldID != hold {
+        t.Errorf("held by %s, want %s", heldErr.HoldID, hold)
+    }
+    if !errors.Is(err, os.ErrPermission) || AuditAction(err) != "LEGAL_HOLD_BLOCKED" {
+        t.Errorf("%v is not reported as a legal hold", err)
+    }
+    return true
+}
+
+func TestUserHold(t *testing.T) {
+    id := withHold(t, Hold{Name: "litigation", Scope: Scope{Username: "alice"}})
+    writeStored(t, "alice/report.pdf", time.Hour)
+    writeStored(t, "bob/report.pdf", time.Hour)
+
+    tests := []struct {
+        name string
+        err  error
+        held bool
+    }{
+        {"delete a file", CheckDelete("alice/report.pdf"), true},
+        {"delete the home folder", CheckDelete("alice"), true},
+        {"overwrite a file", CheckOverwrite("alice/report.pdf"), true},
+        {"write a new file", CheckOverwrite("alice/new.pdf"), false},
+        {"move within the home folder", CheckMove("alice/report.pdf", "alice/2024/report.pdf"), false},
+        {"move out", CheckMove("alice/report.pdf", "bob/report.pdf"), true},
+        {"delete another user's file", CheckDelete("bob/report.pdf"), false},
+        {"overwrite another user's file", CheckOverwrite("bob/report.pdf"), false},
+    }
+    for _, tt := range tests {
+        if got := held(t, tt.err, id); got != tt.held {
+            t.Errorf("%s: held %v, want %v", tt.name, got, tt.held)
+        }
+    }
+}
+
+func TestGroupHold(t *testing.T) {
+    id := withHold(t, Hold{Name: "audit", Scope: Scope{GroupID: "g2"}})
+    writeStored(t, "groups/g2/inbox/order.csv", time.Hour)
+    writeStored(t, "groups/g3/inbox/order.csv", time.Hour)
+
+    tests := []struct {
+        name string
+        err  error
+        held bool
+    }{
+        {"delete a file", CheckDelete("groups/g2/inbox/order.csv"), true},
+        {"delete a folder", CheckDelete("groups/g2/inbox"), true},
+        {"overwrite a file", CheckOverwrite("groups/g2/inbox/order.csv"), true},
+        {"move within the group", CheckMove("groups/g2/inbox/order.csv", "groups/g2/done/order.csv"), false},
+        {"move to another group", CheckMove("groups/g2/inbox/order.csv", "groups/g3/inbox/order2.csv"), true},
+        {"delete in another group", CheckDelete("groups/g3/inbox/order.csv"), false},
+    }
+    for _, tt := range tests {
+        if got := held(t, tt.err, id); got != tt.held {
+            t.Errorf("%s: held %v, want %v", tt.name, got, tt.held)
+        }
+    }
+}
+
+func TestFolderHold(t *testing.T) {
+    id := withHold(t, Hold{Name: "contracts", Scope: Scope{Username: "erin", Path: "contracts"}})
+    writeStored(t, "erin/contracts/2024/signed.pdf", time.Hour)
+    writeStored(t, "erin/contractsold/signed.pdf", time.Hour)
+    writeStored(t, "erin/notes.txt", time.Hour)
+
+    tests := []struct {
+        name string
+        err  error
+        held bool
+    }{
+        {"delete a file in the folder", CheckDelete("erin/contracts/2024/signed.pdf"), true},
+        {"delete the folder", CheckDelete("erin/contracts"), true},
+        {"delete the home folder around it", CheckDelete("erin"), true},
+        {"delete a folder with the same prefix", CheckDelete("erin/contractsold/signed.pdf"), false},
+        {"delete a file outside", CheckDelete("erin/notes.txt"), false},
+        {"move within the folder", CheckMove("erin/contracts/2024/signed.pdf", "erin/contracts/signed.pdf"), false},
+        {"move out of the folder", CheckMove("erin/contracts/2024/signed.pdf", "erin/signed.pdf"), true},
+        {"move the folder", CheckMove("erin/contracts", "erin/archive"), true},
+        {"overwrite a file in the folder", CheckOverwrite("erin/contracts/2024/signed.pdf"), true},
+        {"overwrite a file outside", CheckOverwrite("erin/notes.txt"), false},
+    }
+    for _, tt := range tests {
+        if got := held(t, tt.err, id); got != tt.held {
+            t.Errorf("%s: held %v, want %v", tt.name, got, tt.held)
+        }
+    }
+}
+
+func TestHoldOverridesRetention(t *testing.T) {
+    withPolicies(t, Policy{Name: "short", Scope: Scope{Username: "frank"}, MaxDays: 1})
+    withHold(t, Hold{Name: "investigation", Scope: Scope{Username: "frank", Path: "kept"}})
+    writeStored(t, "frank/kept/old.csv", 48*time.Hour)
+    writeStored(t, "frank/old.csv", 48*time.Hour)
+
+    report, err := Enforce(false, "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Held != 1 || len(report.Purged) != 1 || report.Purged[0].Path != "old.csv" {
+        t.Errorf("got %d held and %v purged, want 1 held and old.csv purged", report.Held, report.Purged)
+    }
+    if !exists(t, "frank/kept/old.csv") {
+        t.Error("a held file was purged")
+    }
+}
+
+func TestReleaseHold(t *testing.T) {
+    id := withHold(t, Hold{Name: "released", Scope: Scope{Username: "grace"}})
+    writeStored(t, "grace/report.pdf", time.Hour)
+    if !held(t, CheckDelete("grace/report.pdf"), id) {
+        t.Fatal("the hold does not apply")
+    }
+
+    hold, err := ReleaseHold(id, "admin", "case closed")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hold.Active() || hold.ReleasedBy != "admin" || hold.ReleaseNote != "case closed" {
+        t.Errorf("got %+v", hold)
+    }
+    if err := CheckDelete("grace/report.pdf"); err != nil {
+        t.Errorf("delete after release: %v", err)
+    }
+    if err := CheckOverwrite("grace/report.pdf"); err != nil {
+        t.Errorf("overwrite after release: %v", err)
+    }
+
+    // The released hold stays on record.
+    if stored, err := GetHold(id); err != nil || stored.Active() {
+        t.Errorf("released hold: got %+v, %v", stored, err)
+    }
+    if _, err := ReleaseHold(id, "admin", ""); !errors.Is(err, ErrHoldReleased) {
+        t.Errorf("second release: got %v, want ErrHoldReleased", err)
+    }
+    if _, err := ReleaseHold("missing", "admin", ""); !errors.Is(err, ErrHoldNotFound) {
+        t.Errorf("release of an unknown hold: got %v, want ErrHoldNotFound", err)
+    }
+}
@@ -0,0 +1,242 @@
+// Package retention keeps stored files as long as compliance requires and no
+// longer. A policy covers a user's home folder or a group folder, or one
+// folder inside them, and may set a minimum retention, during which files
+// cannot be deleted or moved out of its reach, and a maximum retention,
+// after which the enforcer purges them. A file's age counts from its last
+// modification. Where policies overlap, the longest retention wins. Legal
+// holds override all of it: what they cover is kept unchanged until they are
+// released.
+package retention
+
+import (
+    "LunaTransfer/store"
+    "errors"
+    "fmt"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+// maxDays caps retention periods at a century.
+const maxDays = 36500
+
+var (
+    ErrPolicyNotFound = errors.New("retention policy not found")
+
+    policiesMutex sync.RWMutex
+)
+
+// Scope is the home of Username or the folder of GroupID, below Path when
+// set.
+type Scope struct {
+    Username string `json:"username,omitempty"`
+    GroupID  string `json:"group_id,omitempty"`
+    Path     string `json:"path,omitempty"`
+}
+
+// Namespace is the namespace of the scope, as in events.
+func (s Scope) Namespace() string {
+    if s.GroupID != "" {
+        return "group:" + s.GroupID
+    }
+    return "user:" + s.Username
+}
+
+// Covers reports whether the namespace-relative path rel of namespace falls
+// within the scope.
+func (s Scope) Covers(namespace, rel string) bool {
+    if namespace != s.Namespace() {
+        return false
+    }
+    return s.Path == "" || rel == s.Path || strings.HasPrefix(rel, s.Path+"/")
+}
+
+// reaches reports whether the scope covers anything at or below rel.
+func (s Scope) reaches(namespace, rel string) bool {
+    return s.Covers(namespace, rel) || (namespace == s.Namespace() && (rel == "" || strings.HasPrefix(s.Path, rel+"/")))
+}
+
+func (s *Scope) normalize() {
+    s.Username = strings.TrimSpace(s.Username)
+    s.GroupID = strings.TrimSpace(s.GroupID)
+    s.Path = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(s.Path, "\\", "/")), "/")
+}
+
+func (s Scope) validate() error {
+    if (s.Username == "") == (s.GroupID == "") {
+        return fmt.Errorf("exactly one of username and group_id is required")
+    }
+    return nil
+}
+
+// Policy sets how long files in its scope are kept. MinDays and MaxDays of
+// zero mean no minimum and no maximum.
+type Policy struct {
+    ID      string `json:"id"`
+    Name    string `json:"name"`
+    Enabled bool   `json:"enabled"`
+    Scope
+    MinDays   int       `json:"min_days,omitempty"`
+    MaxDays   int       `json:"max_days,omitempty"`
+    CreatedBy string    `json:"created_by"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *Policy) Normalize() {
+    p.Name = strings.TrimSpace(p.Name)
+    p.Scope.normalize()
+}
+
+func (p Policy) Validate() error {
+    if p.Name == "" {
+        return fmt.Errorf("name is required")
+    }
+    if err := p.Scope.validate(); err != nil {
+        return err
+    }
+    if p.MinDays < 0 || p.MaxDays < 0 || p.MinDays > maxDays || p.MaxDays > maxDays {
+        return fmt.Errorf("min_days and max_days must be between 0 and %d", maxDays)
+    }
+    if p.MinDays == 0 && p.MaxDays == 0 {
+        return fmt.Errorf("min_days or max_days is required")
+    }
+    if p.MaxDays > 0 && p.MaxDays < p.MinDays {
+        return fmt.Errorf("max_days may not be shorter than min_days")
+    }
+    return nil
+}
+
+func days(n int) time.Duration {
+    return time.Duration(n) * 24 * time.Hour
+}
+
+const policiesFile = "retention_policies.json"
+
+func loadPolicies() ([]Policy, error) {
+    policies := []Policy{}
+    if err := store.ReadDataFile(policiesFile, &policies); err != nil {
+        return nil, err
+    }
+    return policies, nil
+}
+
+func savePolicies(policies []Policy) error {
+    return store.WriteDataFile(policiesFile, policies)
+}
+
+func ListPolicies() ([]Policy, error) {
+    policiesMutex.RLock()
+    defer policiesMutex.RUnlock()
+
+    return loadPolicies()
+}
+
+func GetPolicy(id string) (Policy, error) {
+    policies, err := ListPolicies()
+    if err != nil {
+        return Policy{}, err
+    }
+    for _, policy := range policies {
+        if policy.ID == id {
+            return policy, nil
+        }
+    }
+    return Policy{}, ErrPolicyNotFound
+}
+
+func CreatePolicy(policy Policy) error {
+    policiesMutex.Lock()
+    defer policiesMutex.Unlock()
+
+    policies, err := loadPolicies()
+    if err != nil {
+        return err
+    }
+    return savePolicies(append(policies, policy))
+}
+
+func UpdatePolicy(policy Policy) error {
+    policiesMutex.Lock()
+    defer policiesMutex.Unlock()
+
+    policies, err := loadPolicies()
+    if err != nil {
+        return err
+    }
+    for i := range policies {
+        if policies[i].ID == policy.ID {
+            policies[i] = policy
+            return savePolicies(policies)
+        }
+    }
+    return ErrPolicyNotFound
+}
+
+func DeletePolicy(id string) error {
+    policiesMutex.Lock()
+    defer policiesMutex.Unlock()
+
+    policies, err := loadPolicies()
+    if err != nil {
+        return err
+    }
+    for i, policy := range policies {
+        if policy.ID == id {
+            return savePolicies(append(policies[:i], policies[i+1:]...))
+        }
+    }
+    return ErrPolicyNotFound
+}
+
+func enabledPolicies() ([]Policy, error) {
+    policies, err := ListPolicies()
+    if err != nil {
+        return nil, err
+    }
+    enabled := policies[:0]
+    for _, policy := range policies {
+        if policy.Enabled {
+            enabled = append(enabled, policy)
+        }
+    }
+    return enabled, nil
+}
+
+// limits is the retention that applies to one file: the longest minimum
+// and the longest maximum among the policies covering it.
+type limits struct {
+    min, max             int
+    minPolicy, maxPolicy Policy
+}
+
+func limitsFor(policies []Policy, namespace, rel string) limits {
+    var l limits
+    for _, policy := range policies {
+        if !policy.Covers(namespace, rel) {
+            continue
+        }
+        if policy.MinDays > l.min {
+            l.min, l.minPolicy = policy.MinDays, policy
+        }
+        if policy.MaxDays > l.max {
+            l.max, l.maxPolicy = policy.MaxDays, policy
+        }
+    }
+    return l
+}
+
+// keptUntil is when a file modified at modTime may be deleted.
+func (l limits) keptUntil(modTime time.Time) time.Time {
+    return modTime.Add(days(l.min))
+}
+
+// purgeAt is when a file modified at modTime is purged, or the zero time if
+// no maximum applies. A longer minimum of another policy defers it.
+func (l limits) purgeAt(modTime time.Time) time.Time {
+    if l.max == 0 {
+        return time.Time{}
+    }
+    return modTime.Add(days(max(l.max, l.min)))
+}
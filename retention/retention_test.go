@@ -0,0 +1,208 @@
+package retention
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// TestMain sets up what testenv.Main would; testenv needs auth, which needs
+// this package.
+func TestMain(m *testing.M) {
+    os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+    dir, err := os.MkdirTemp("", "lunatransfer-test-")
+    if err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer os.RemoveAll(dir)
+    if err := os.Chdir(dir); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if _, err := config.LoadConfig(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := utils.InitLoggers(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer utils.CloseLoggers()
+    if err := config.EnsureStorageExists(); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    if err := store.Open(filepath.Join(dir, "test.db")); err != nil {
+        fmt.Println(err)
+        return 1
+    }
+    defer store.Close()
+    return m.Run()
+}
+
+// writeStored writes a file at the storage-relative path rel, last modified
+// age ago.
+func writeStored(t *testing.T, rel string, age time.Duration) {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    full := filepath.Join(appConfig.StorageDirectory, filepath.FromSlash(rel))
+    if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(full, []byte(rel), 0644); err != nil {
+        t.Fatal(err)
+    }
+    modTime := time.Now().Add(-age)
+    if err := os.Chtimes(full, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func exists(t *testing.T, rel string) bool {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = os.Stat(filepath.Join(appConfig.StorageDirectory, filepath.FromSlash(rel)))
+    return err == nil
+}
+
+// withPolicies stores policies, enabled, for the test.
+func withPolicies(t *testing.T, policies ...Policy) {
+    t.Helper()
+    for i := range policies {
+        policies[i].ID = policies[i].Name
+        policies[i].Enabled = true
+    }
+    if err := savePolicies(policies); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { savePolicies([]Policy{}) })
+}
+
+func TestMinimumRetention(t *testing.T) {
+    withPolicies(t,
+        Policy{Name: "ledger", Scope: Scope{Username: "carol"}, MinDays: 30},
+        Policy{Name: "audit", Scope: Scope{Username: "carol", Path: "audit"}, MinDays: 90},
+    )
+    day := 24 * time.Hour
+    writeStored(t, "carol/young.csv", 30*day-time.Minute)
+    writeStored(t, "carol/old.csv", 30*day+time.Minute)
+    writeStored(t, "carol/audit/q1.csv", 60*day)
+    writeStored(t, "dave/free.csv", time.Hour)
+
+    tests := []struct {
+        rel    string
+        policy string
+    }{
+        {"carol/young.csv", "ledger"},
+        {"carol/old.csv", ""},
+        {"carol/audit/q1.csv", "audit"},
+        {"carol/audit", "audit"},
+        {"carol", "audit"},
+        {"carol/missing.csv", ""},
+        {"dave/free.csv", ""},
+    }
+    for _, tt := range tests {
+        err := CheckDelete(tt.rel)
+        var retained *RetainedError
+        switch {
+        case tt.policy == "" && err != nil:
+            t.Errorf("delete %s: %v", tt.rel, err)
+        case tt.policy != "" && !errors.As(err, &retained):
+            t.Errorf("delete %s: got %v, want a RetainedError", tt.rel, err)
+        case tt.policy != "" && retained.Policy != tt.policy:
+            t.Errorf("delete %s: kept by %s, want %s", tt.rel, retained.Policy, tt.policy)
+        case tt.policy != "" && (!errors.Is(err, os.ErrPermission) || AuditAction(err) != "RETENTION_BLOCKED"):
+            t.Errorf("delete %s: %v is not reported as a retention refusal", tt.rel, err)
+        }
+    }
+}
+
+func TestMinimumRetentionMoves(t *testing.T) {
+    withPolicies(t,
+        Policy{Name: "ledger", Scope: Scope{Username: "carol"}, MinDays: 30},
+        Policy{Name: "audit", Scope: Scope{Username: "carol", Path: "audit"}, MinDays: 90},
+    )
+    writeStored(t, "carol/young.csv", time.Hour)
+    writeStored(t, "carol/audit/q1.csv", time.Hour)
+
+    tests := []struct {
+        from, to string
+        allowed  bool
+    }{
+        {"carol/young.csv", "carol/moved/young.csv", true},
+        {"carol/young.csv", "carol/audit/young.csv", true},
+        {"carol/young.csv", "dave/young.csv", false},
+        {"carol/audit/q1.csv", "carol/audit/2024/q1.csv", true},
+        {"carol/audit/q1.csv", "carol/q1.csv", false},
+        {"carol/audit", "carol/archive", false},
+    }
+    for _, tt := range tests {
+        err := CheckMove(tt.from, tt.to)
+        if allowed := err == nil; allowed != tt.allowed {
+            t.Errorf("move %s to %s: got %v, want allowed %v", tt.from, tt.to, err, tt.allowed)
+        }
+    }
+}
+
+func TestMaximumRetention(t *testing.T) {
+    withPolicies(t,
+        Policy{Name: "inbox", Scope: Scope{GroupID: "g1", Path: "inbox"}, MaxDays: 10},
+        Policy{Name: "contracts", Scope: Scope{GroupID: "g1", Path: "inbox/contracts"}, MinDays: 20},
+    )
+    day := 24 * time.Hour
+    writeStored(t, "groups/g1/inbox/fresh.csv", 10*day-time.Minute)
+    writeStored(t, "groups/g1/inbox/stale.csv", 10*day+time.Minute)
+    writeStored(t, "groups/g1/inbox/contracts/signed.pdf", 15*day)
+    writeStored(t, "groups/g1/inbox/contracts/expired.pdf", 20*day+time.Minute)
+    writeStored(t, "groups/g1/outbox/stale.csv", 100*day)
+
+    report, err := Enforce(true, "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    purged := map[string]bool{}
+    for _, item := range report.Purged {
+        purged[item.Path] = true
+    }
+    want := []string{"inbox/stale.csv", "inbox/contracts/expired.pdf"}
+    if len(report.Purged) != len(want) || !purged[want[0]] || !purged[want[1]] {
+        t.Fatalf("dry run: got %v, want %v", report.Purged, want)
+    }
+    if report.Checked != 4 || report.Retained != 1 {
+        t.Errorf("dry run: checked %d and retained %d, want 4 and 1", report.Checked, report.Retained)
+    }
+    if !exists(t, "groups/g1/inbox/stale.csv") {
+        t.Fatal("a dry run purged a file")
+    }
+
+    if _, err := Enforce(false, "test"); err != nil {
+        t.Fatal(err)
+    }
+    for rel, kept := range map[string]bool{
+        "groups/g1/inbox/fresh.csv":             true,
+        "groups/g1/inbox/stale.csv":             false,
+        "groups/g1/inbox/contracts/signed.pdf":  true,
+        "groups/g1/inbox/contracts/expired.pdf": false,
+        "groups/g1/outbox/stale.csv":            true,
+    } {
+        if exists(t, rel) != kept {
+            t.Errorf("%s: kept %v, want %v", rel, !kept, kept)
+        }
+    }
+}
@@ -0,0 +1,580 @@
+package rules
+
+import (
+    "LunaTransfer/as2"
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "LunaTransfer/webhooks"
+    "context"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Client names the rules engine in logs and events. Files written by rules
+// do not trigger rules again, so rules cannot loop.
+const Client = "Automation rules"
+
+const (
+    queueSize     = 256
+    sweepInterval = time.Hour
+)
+
+var (
+    queue      = make(chan events.Event, queueSize)
+    dropped    atomic.Int64
+    storageDir string
+    stagingDir string
+)
+
+// HandleEvent queues an upload, move or extraction for evaluation. It never blocks the
+// publisher; rules run on the worker started by Start. When the worker has
+// fallen queueSize events behind, the event is dropped, counted and logged.
+func HandleEvent(e events.Event) {
+    if e.IsDir || strings.HasPrefix(e.UserAgent, Client) {
+        return
+    }
+    if e.Type != events.FileUploaded && e.Type != events.FileRenamed {
+        return
+    }
+    select {
+    case queue <- e:
+    default:
+        total := dropped.Add(1)
+        utils.LogSystem("RULES_QUEUE_FULL", e.Actor, e.RemoteAddr,
+            fmt.Sprintf("Rules were not applied to %s in %s: %d events are waiting, %d dropped since start",
+                e.Path, e.Namespace, queueSize, total))
+    }
+}
+
+// DroppedEvents returns how many events were not evaluated since start
+// because the queue was full.
+func DroppedEvents() int64 {
+    return dropped.Load()
+}
+
+// Start evaluates queued events and deletes files whose delete_after period
+// has passed until ctx is cancelled.
+func Start(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return
+    }
+    storageDir = appConfig.StorageDirectory
+    stagingDir = filepath.Join(appConfig.GetDataDirectory(), "rule_staging")
+    os.RemoveAll(stagingDir)
+    if err := os.MkdirAll(stagingDir, 0700); err != nil {
+        utils.LogError("RULE_ERROR", err, "system", "Failed to create rule staging directory")
+        return
+    }
+
+    ticker := time.NewTicker(sweepInterval)
+    defer ticker.Stop()
+    sweepExpirations()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case e := <-queue:
+            evaluate(e)
+        case <-ticker.C:
+            sweepExpirations()
+        }
+    }
+}
+
+// evaluate applies the matching rules to the file of e in order. A rule that
+// moves or renames the file hands its new path to the rules after it.
+func evaluate(e events.Event) {
+    rules, err := ListRules()
+    if err != nil {
+        utils.LogError("RULE_ERROR", err, "system", "Failed to load rules")
+        return
+    }
+    trigger := TriggerUpload
+    if e.Type == events.FileRenamed {
+        trigger = TriggerMove
+    } else if e.ArchivePath != "" {
+        trigger = TriggerExtract
+    }
+
+    current := e.Path
+    for _, rule := range rules {
+        if !rule.Enabled || !rule.wants(trigger, e.Namespace) {
+            continue
+        }
+        info, err := os.Stat(storageFile(e.Namespace, current))
+        if err != nil || info.IsDir() {
+            return
+        }
+        if !rule.matches(e.Namespace, current, info) {
+            continue
+        }
+
+        run, err := newExecution(rule, e, current)
+        if err != nil {
+            utils.LogError("RULE_ERROR", err, rule.CreatedBy,
+                fmt.Sprintf("Rule %s (%s) could not act on %s in %s", rule.Name, rule.ID, current, e.Namespace))
+            continue
+        }
+        run.apply()
+        current = run.path
+        if rule.Stop {
+            return
+        }
+    }
+}
+
+func (r Rule) wants(trigger, namespace string) bool {
+    if len(r.Events) > 0 {
+        wanted := false
+        for _, event := range r.Events {
+            if event == trigger {
+                wanted = true
+                break
+            }
+        }
+        if !wanted {
+            return false
+        }
+    }
+    if r.Namespace == "" {
+        return true
+    }
+    ok, _ := path.Match(r.Namespace, namespace)
+    return ok
+}
+
+func (r Rule) matches(namespace, p string, info os.FileInfo) bool {
+    if r.PathGlob != "" {
+        target := p
+        if !strings.Contains(r.PathGlob, "/") {
+            target = path.Base(p)
+        }
+        if ok, _ := path.Match(r.PathGlob, target); !ok {
+            return false
+        }
+    }
+    if r.PathRegex != "" && (r.pathRegex == nil || !r.pathRegex.MatchString(p)) {
+        return false
+    }
+    if info.Size() < r.MinSize || (r.MaxSize > 0 && info.Size() > r.MaxSize) {
+        return false
+    }
+    if len(r.ContentTypes) == 0 {
+        return true
+    }
+
+    ext := strings.ToLower(path.Ext(p))
+    detected := contentType(storageFile(namespace, p), ext)
+    for _, wanted := range r.ContentTypes {
+        switch {
+        case strings.HasPrefix(wanted, "."):
+            if wanted == ext {
+                return true
+            }
+        case strings.HasSuffix(wanted, "/*"):
+            if strings.HasPrefix(detected, strings.TrimSuffix(wanted, "*")) {
+                return true
+            }
+        case wanted == detected:
+            return true
+        }
+    }
+    return false
+}
+
+// contentType goes by the extension and sniffs the content of files without
+// a known one.
+func contentType(file, ext string) string {
+    detected := mime.TypeByExtension(ext)
+    if detected == "" {
+        f, err := os.Open(file)
+        if err != nil {
+            return ""
+        }
+        defer f.Close()
+        head := make([]byte, 512)
+        n, _ := io.ReadFull(f, head)
+        detected = http.DetectContentType(head[:n])
+    }
+    if mediaType, _, err := mime.ParseMediaType(detected); err == nil {
+        return mediaType
+    }
+    return detected
+}
+
+func storageFile(namespace, p string) string {
+    return filepath.Join(storageDir, filepath.FromSlash(events.StoragePath(namespace, p)))
+}
+
+// execution is one rule applied to one file. path is where the file is now,
+// relative to its namespace.
+type execution struct {
+    rule      Rule
+    event     events.Event
+    fs        *vfs.FS
+    namespace string
+    root      string
+    path      string
+}
+
+// newExecution acts as the owner of a home folder or as the rule's creator
+// in a group folder.
+func newExecution(rule Rule, e events.Event, p string) (*execution, error) {
+    actor := rule.CreatedBy
+    root := ""
+    if owner, ok := strings.CutPrefix(e.Namespace, "user:"); ok {
+        actor = owner
+        root = "/" + vfs.HomeDir
+    } else if groupID, ok := strings.CutPrefix(e.Namespace, "group:"); ok {
+        root = path.Join("/", vfs.GroupsDir, groupID)
+    } else {
+        return nil, fmt.Errorf("unknown namespace %q", e.Namespace)
+    }
+
+    fs, err := vfs.New(actor, "localhost", fmt.Sprintf("%s (%s)", Client, rule.Name))
+    if err != nil {
+        return nil, err
+    }
+    return &execution{rule: rule, event: e, fs: fs, namespace: e.Namespace, root: root, path: p}, nil
+}
+
+func (x *execution) virtual(p string) string {
+    return path.Join(x.root, p)
+}
+
+func (x *execution) apply() {
+    original := x.path
+    applied := make([]string, 0, len(x.rule.Actions))
+    for i, action := range x.rule.Actions {
+        if err := x.run(action); err != nil {
+            utils.LogError("RULE_ERROR", err, x.fs.Username,
+                fmt.Sprintf("Rule %s (%s) failed at action %d (%s) on %s in %s",
+                    x.rule.Name, x.rule.ID, i+1, action.Type, x.path, x.namespace))
+            return
+        }
+        applied = append(applied, action.Type)
+    }
+    utils.LogSystem("RULE_APPLIED", x.fs.Username, "localhost",
+        fmt.Sprintf("Rule %s (%s) applied to %s in %s: %s",
+            x.rule.Name, x.rule.ID, original, x.namespace, strings.Join(applied, ", ")))
+}
+
+func (x *execution) run(action Action) error {
+    switch action.Type {
+    case ActionMove:
+        return x.move(action.Folder, path.Base(x.path))
+    case ActionCopy:
+        target, err := x.freeName(action.Folder, path.Base(x.path))
+        if err != nil {
+            return err
+        }
+        return x.copyFile(x.path, target)
+    case ActionRename:
+        name := expandTemplate(action.Template, x.templateData())
+        if name == path.Base(x.path) {
+            return nil
+        }
+        return x.move(path.Dir(x.path), name)
+    case ActionEncrypt:
+        return x.encrypt(action)
+    case ActionShare:
+        return x.share(action)
+    case ActionNotify:
+        return x.notify(action)
+    case ActionWebhook:
+        return x.webhook(action)
+    case ActionDeleteAfter:
+        return x.scheduleDelete(action)
+    case ActionPGPDecrypt:
+        return x.pgpDecrypt(action)
+    case ActionPGPEncrypt:
+        return x.pgpEncrypt(action)
+    case ActionAS2Send:
+        return x.as2Send(action)
+    }
+    return fmt.Errorf("unknown action %q", action.Type)
+}
+
+// freeName picks name in folder, or name-1, name-2 and so on when taken.
+func (x *execution) freeName(folder, name string) (string, error) {
+    if err := x.fs.MkdirAll(x.virtual(folder)); err != nil {
+        return "", err
+    }
+    ext := path.Ext(name)
+    base := strings.TrimSuffix(name, ext)
+    for i := 0; i < 1000; i++ {
+        candidate := name
+        if i > 0 {
+            candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+        }
+        target := path.Join(folder, candidate)
+        if _, err := x.fs.Stat(x.virtual(target)); os.IsNotExist(err) {
+            return target, nil
+        } else if err != nil {
+            return "", err
+        }
+    }
+    return "", fmt.Errorf("no free name for %s in %s", name, folder)
+}
+
+func (x *execution) move(folder, name string) error {
+    target, err := x.freeName(folder, name)
+    if err != nil {
+        return err
+    }
+    if err := x.fs.Rename(x.virtual(x.path), x.virtual(target), false); err != nil {
+        return err
+    }
+    x.path = target
+    return nil
+}
+
+func (x *execution) copyFile(from, to string) error {
+    src, err := x.fs.Open(x.virtual(from))
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    return x.store(struct{ io.Reader }{src}, to)
+}
+
+// store writes r to the new file p.
+func (x *execution) store(r io.Reader, p string) error {
+    dst, err := x.fs.Create(x.virtual(p), os.O_EXCL)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(struct{ io.Writer }{dst}, r); err != nil {
+        dst.Close()
+        x.fs.Remove(x.virtual(p))
+        return err
+    }
+    return dst.Close()
+}
+
+// encrypt replaces the file with "<name>.enc", AES-256-GCM encrypted with the
+// action's key, or adds it next to the file with KeepOriginal.
+func (x *execution) encrypt(action Action) error {
+    key, err := encryptionKey(action.KeyID)
+    if err != nil {
+        return fmt.Errorf("failed to load key %s: %w", action.KeyID, err)
+    }
+    if err := x.fs.Check(x.virtual(x.path), vfs.ActionRead); err != nil {
+        return err
+    }
+
+    staged, err := os.CreateTemp(stagingDir, "encrypt-*")
+    if err != nil {
+        return err
+    }
+    staged.Close()
+    defer os.Remove(staged.Name())
+    if err := utils.EncryptFile(storageFile(x.namespace, x.path), staged.Name(), key); err != nil {
+        return err
+    }
+
+    target, err := x.freeName(path.Dir(x.path), path.Base(x.path)+".enc")
+    if err != nil {
+        return err
+    }
+    encrypted, err := os.Open(staged.Name())
+    if err != nil {
+        return err
+    }
+    defer encrypted.Close()
+    if err := x.store(encrypted, target); err != nil {
+        return err
+    }
+
+    if !action.KeepOriginal {
+        if err := x.fs.Remove(x.virtual(x.path)); err != nil {
+            return err
+        }
+    }
+    x.path = target
+    return nil
+}
+
+// share shares the file with another group like the share API does: group
+// files need the actor to manage the group.
+func (x *execution) share(action Action) error {
+    sourceGroup, isGroup := strings.CutPrefix(x.namespace, "group:")
+    if !isGroup {
+        sourceGroup = ""
+    }
+    if sourceGroup == action.TargetGroup {
+        return fmt.Errorf("cannot share within the same group")
+    }
+    if sourceGroup != "" {
+        canManage, err := auth.HasGroupPermission(x.fs.Username, sourceGroup, "manage")
+        if err != nil {
+            return err
+        }
+        if !canManage {
+            return fmt.Errorf("%s may not share files of group %s", x.fs.Username, sourceGroup)
+        }
+    }
+    if _, err := auth.GetGroupByID(action.TargetGroup); err != nil {
+        return fmt.Errorf("target group %s not found", action.TargetGroup)
+    }
+
+    share := models.FileShare{
+        ID:          utils.GenerateUUID(),
+        FilePath:    x.path,
+        SourcePath:  events.StoragePath(x.namespace, x.path),
+        SourceGroup: sourceGroup,
+        TargetGroup: action.TargetGroup,
+        Permission:  models.SharePermission(action.Permission),
+        SharedBy:    x.fs.Username,
+        SharedAt:    time.Now(),
+    }
+    if action.ExpiresInDays > 0 {
+        expiresAt := share.SharedAt.AddDate(0, 0, action.ExpiresInDays)
+        share.ExpiresAt = &expiresAt
+    }
+
+    err := models.SaveFileShare(share)
+    if err == models.ErrAlreadyShared {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    events.Publish(events.ShareEvent(events.ShareCreated, x.fs.Username, "localhost", share, ""))
+    return nil
+}
+
+// notify tells the owner of a home folder or every member of the group.
+func (x *execution) notify(action Action) error {
+    message := "Rule {rule} processed {name}"
+    if action.Message != "" {
+        message = action.Message
+    }
+    notification := models.Notification{
+        Type:      models.NoteRuleTriggered,
+        Message:   expandTemplate(message, x.templateData()),
+        Namespace: x.namespace,
+        Path:      x.path,
+        Filename:  path.Base(x.path),
+    }
+
+    groupID, isGroup := strings.CutPrefix(x.namespace, "group:")
+    if !isGroup {
+        utils.NotifyUser(strings.TrimPrefix(x.namespace, "user:"), notification)
+        return nil
+    }
+    members, err := auth.GetGroupMembers(groupID)
+    if err != nil {
+        return err
+    }
+    for _, member := range members {
+        utils.NotifyUser(member.Username, notification)
+    }
+    return nil
+}
+
+// webhook posts rule.triggered to the action's subscription or, without one,
+// to every subscription that asks for it.
+func (x *execution) webhook(action Action) error {
+    var size int64
+    if info, err := os.Stat(storageFile(x.namespace, x.path)); err == nil {
+        size = info.Size()
+    }
+    event := webhooks.Event{
+        Type:      webhooks.EventRuleTriggered,
+        Actor:     x.event.Actor,
+        Namespace: x.namespace,
+        Path:      x.path,
+        Size:      size,
+        RuleID:    x.rule.ID,
+        RuleName:  x.rule.Name,
+    }
+    if action.WebhookID == "" {
+        webhooks.Dispatch(event)
+        return nil
+    }
+    return webhooks.DispatchTo(action.WebhookID, event)
+}
+
+func (x *execution) scheduleDelete(action Action) error {
+    info, err := os.Stat(storageFile(x.namespace, x.path))
+    if err != nil {
+        return err
+    }
+    return addExpiration(expiration{
+        ID:        utils.GenerateUUID(),
+        RuleID:    x.rule.ID,
+        Actor:     x.fs.Username,
+        Namespace: x.namespace,
+        Path:      x.path,
+        ModTime:   info.ModTime(),
+        DeleteAt:  time.Now().AddDate(0, 0, action.Days),
+    })
+}
+
+// as2Send sends the file to the action's partner over AS2. The rule stops
+// unless the partner accepted it.
+func (x *execution) as2Send(action Action) error {
+    partner, err := partners.GetPartner(action.PartnerID)
+    if err != nil {
+        return err
+    }
+    src, err := x.fs.Open(x.virtual(x.path))
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    _, err = as2.Send(partner, path.Base(x.path), src, x.fs.Username)
+    return err
+}
+
+// templateData describes the file for rename templates and messages.
+type templateData struct {
+    name string
+    user string
+    rule string
+    at   time.Time
+}
+
+func (x *execution) templateData() templateData {
+    return templateData{
+        name: path.Base(x.path),
+        user: x.event.Actor,
+        rule: x.rule.Name,
+        at:   time.Now(),
+    }
+}
+
+// expandTemplate fills in {name}, {base}, {ext}, {date}, {time},
+// {timestamp}, {user} and {rule}.
+func expandTemplate(template string, d templateData) string {
+    if d.at.IsZero() {
+        d.at = time.Now()
+    }
+    ext := path.Ext(d.name)
+    return strings.NewReplacer(
+        "{name}", d.name,
+        "{base}", strings.TrimSuffix(d.name, ext),
+        "{ext}", ext,
+        "{date}", d.at.Format("2006-01-02"),
+        "{time}", d.at.Format("150405"),
+        "{timestamp}", strconv.FormatInt(d.at.Unix(), 10),
+        "{user}", d.user,
+        "{rule}", d.rule,
+    ).Replace(template)
+}
@@ -0,0 +1,134 @@
+package rules
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+var expirationsMutex sync.Mutex
+
+// expiration is a file a delete_after action scheduled for deletion. The file
+// is only deleted if it was not changed since, so a new upload under the same
+// name is kept.
+type expiration struct {
+    ID        string    `json:"id"`
+    RuleID    string    `json:"rule_id"`
+    Actor     string    `json:"actor"`
+    Namespace string    `json:"namespace"`
+    Path      string    `json:"path"`
+    ModTime   time.Time `json:"mod_time"`
+    DeleteAt  time.Time `json:"delete_at"`
+}
+
+func loadExpirations() ([]expiration, error) {
+    expirations := []expiration{}
+    err := store.ReadDataFile("rule_expirations.json", &expirations)
+    return expirations, err
+}
+
+// addExpiration schedules a file, replacing an earlier schedule of the same
+// file.
+func addExpiration(e expiration) error {
+    expirationsMutex.Lock()
+    defer expirationsMutex.Unlock()
+
+    expirations, err := loadExpirations()
+    if err != nil {
+        return err
+    }
+    kept := expirations[:0]
+    for _, existing := range expirations {
+        if existing.Namespace != e.Namespace || existing.Path != e.Path {
+            kept = append(kept, existing)
+        }
+    }
+    return store.WriteDataFile("rule_expirations.json", append(kept, e))
+}
+
+func forgetExpirations(ruleID string) {
+    expirationsMutex.Lock()
+    defer expirationsMutex.Unlock()
+
+    expirations, err := loadExpirations()
+    if err != nil {
+        return
+    }
+    kept := expirations[:0]
+    for _, e := range expirations {
+        if e.RuleID != ruleID {
+            kept = append(kept, e)
+        }
+    }
+    store.WriteDataFile("rule_expirations.json", kept)
+}
+
+// sweepExpirations deletes the files that are due. Each schedule is tried
+// once; files that are gone or changed are left alone.
+func sweepExpirations() {
+    expirationsMutex.Lock()
+    expirations, err := loadExpirations()
+    expirationsMutex.Unlock()
+    if err != nil {
+        utils.LogError("RULE_ERROR", err, "system", "Failed to load scheduled deletions")
+        return
+    }
+
+    now := time.Now()
+    done := map[string]bool{}
+    for _, e := range expirations {
+        if e.DeleteAt.After(now) {
+            continue
+        }
+        done[e.ID] = true
+        expire(e)
+    }
+    if len(done) == 0 {
+        return
+    }
+
+    expirationsMutex.Lock()
+    defer expirationsMutex.Unlock()
+    expirations, err = loadExpirations()
+    if err != nil {
+        return
+    }
+    kept := expirations[:0]
+    for _, e := range expirations {
+        if !done[e.ID] {
+            kept = append(kept, e)
+        }
+    }
+    if err := store.WriteDataFile("rule_expirations.json", kept); err != nil {
+        utils.LogError("RULE_ERROR", err, "system", "Failed to save scheduled deletions")
+    }
+}
+
+func expire(e expiration) {
+    info, err := os.Stat(storageFile(e.Namespace, e.Path))
+    if err != nil || !info.ModTime().Equal(e.ModTime) {
+        return
+    }
+
+    // Deleting a rule drops its schedules; the rule still acts as its creator.
+    rule, err := GetRule(e.RuleID)
+    if err != nil {
+        return
+    }
+    x, err := newExecution(rule, events.Event{Namespace: e.Namespace}, e.Path)
+    if err != nil {
+        utils.LogError("RULE_ERROR", err, e.Actor, fmt.Sprintf("Failed to delete %s in %s", e.Path, e.Namespace))
+        return
+    }
+    if err := x.fs.Remove(x.virtual(e.Path)); err != nil {
+        utils.LogError("RULE_ERROR", err, e.Actor,
+            fmt.Sprintf("Rule %s (%s) failed to delete %s in %s", rule.Name, rule.ID, e.Path, e.Namespace))
+        return
+    }
+    utils.LogSystem("RULE_APPLIED", e.Actor, "localhost",
+        fmt.Sprintf("Rule %s (%s) deleted %s in %s after its retention", rule.Name, rule.ID, e.Path, e.Namespace))
+}
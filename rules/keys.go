@@ -0,0 +1,126 @@
+package rules
+
+import (
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+)
+
+var (
+    ErrKeyNotFound = errors.New("key not found")
+
+    keysMutex sync.Mutex
+)
+
+// ruleKey is the AES-256 key of an encrypt action. Keys are kept apart from
+// the rules, which only hold their ID, so rule records never carry them. A
+// key belongs to the rule it was created for and is deleted with it.
+type ruleKey struct {
+    ID        string    `json:"id"`
+    RuleID    string    `json:"rule_id"`
+    Key       string    `json:"key"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+func loadKeys() ([]ruleKey, error) {
+    keys := []ruleKey{}
+    err := store.ReadDataFile("rule_keys.json", &keys)
+    return keys, err
+}
+
+// encryptionKey returns the key an encrypt action refers to.
+func encryptionKey(id string) ([]byte, error) {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range keys {
+        if key.ID == id {
+            return base64.StdEncoding.DecodeString(key.Key)
+        }
+    }
+    return nil, ErrKeyNotFound
+}
+
+// storeKeys moves the keys of rule's encrypt actions to the key store and
+// leaves their IDs in the actions. Actions without a key or key ID get a new
+// key; those are returned by action index. Key IDs must belong to the rule,
+// and keys the rule no longer uses are deleted.
+func storeKeys(rule *Rule) (map[int]string, error) {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return nil, err
+    }
+    owned := map[string]bool{}
+    for _, key := range keys {
+        if key.RuleID == rule.ID {
+            owned[key.ID] = true
+        }
+    }
+
+    generated := map[int]string{}
+    used := map[string]bool{}
+    for i := range rule.Actions {
+        action := &rule.Actions[i]
+        if action.Type != ActionEncrypt {
+            action.Key, action.KeyID = "", ""
+            continue
+        }
+        if action.Key == "" && action.KeyID != "" {
+            if !owned[action.KeyID] {
+                return nil, fmt.Errorf("action %d: %w", i+1, ErrKeyNotFound)
+            }
+            used[action.KeyID] = true
+            continue
+        }
+        if action.Key == "" {
+            key, err := utils.GenerateEncryptionKey()
+            if err != nil {
+                return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+            }
+            action.Key = base64.StdEncoding.EncodeToString(key)
+            generated[i] = action.Key
+        }
+        action.KeyID = utils.GenerateUUID()
+        keys = append(keys, ruleKey{ID: action.KeyID, RuleID: rule.ID, Key: action.Key, CreatedAt: time.Now()})
+        used[action.KeyID] = true
+        action.Key = ""
+    }
+
+    kept := keys[:0]
+    for _, key := range keys {
+        if key.RuleID != rule.ID || used[key.ID] {
+            kept = append(kept, key)
+        }
+    }
+    return generated, store.WriteDataFile("rule_keys.json", kept)
+}
+
+func forgetKeys(ruleID string) {
+    keysMutex.Lock()
+    defer keysMutex.Unlock()
+
+    keys, err := loadKeys()
+    if err != nil {
+        return
+    }
+    kept := keys[:0]
+    for _, key := range keys {
+        if key.RuleID != ruleID {
+            kept = append(kept, key)
+        }
+    }
+    if err := store.WriteDataFile("rule_keys.json", kept); err != nil {
+        utils.LogError("RULE_ERROR", err, "system", fmt.Sprintf("Failed to delete the keys of rule %s", ruleID))
+    }
+}
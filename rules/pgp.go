@@ -0,0 +1,139 @@
+package rules
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/pgp"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "fmt"
+    "io"
+    "os"
+    "path"
+)
+
+// pgpDecrypt decrypts "<name>.pgp" into "<name>" with the keyring of the
+// file's namespace and records the signature check with the plaintext. Files
+// that are not named like OpenPGP messages are left alone. When decryption
+// fails, or RequireSignature is set and the signature is not valid, the
+// result is recorded with the encrypted file and the rule stops.
+func (x *execution) pgpDecrypt(action Action) error {
+    name := path.Base(x.path)
+    if !pgp.IsEncryptedName(name) {
+        return nil
+    }
+    if err := x.fs.Check(x.virtual(x.path), vfs.ActionRead); err != nil {
+        return err
+    }
+
+    src, err := os.Open(storageFile(x.namespace, x.path))
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    staged, err := os.CreateTemp(stagingDir, "decrypt-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(staged.Name())
+    defer staged.Close()
+
+    source := events.StoragePath(x.namespace, x.path)
+    verification, err := pgp.Decrypt(x.namespace, src, staged)
+    verification.SourceFile = name
+    if err == nil && action.RequireSignature && verification.Signature != models.SignatureValid {
+        err = fmt.Errorf("signature is %s", verification.Signature)
+    }
+    if err != nil {
+        if verification.Error == "" {
+            verification.Error = err.Error()
+        }
+        if err := models.SetPGPVerification(source, verification); err != nil {
+            utils.LogError("RULE_ERROR", err, x.fs.Username, "Failed to record PGP verification")
+        }
+        return err
+    }
+
+    target, err := x.freeName(path.Dir(x.path), pgp.PlainName(name))
+    if err != nil {
+        return err
+    }
+    if _, err := staged.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    if err := x.store(staged, target); err != nil {
+        return err
+    }
+    if err := models.SetPGPVerification(events.StoragePath(x.namespace, target), verification); err != nil {
+        utils.LogError("RULE_ERROR", err, x.fs.Username, "Failed to record PGP verification")
+    }
+
+    if !action.KeepOriginal {
+        if err := x.fs.Remove(x.virtual(x.path)); err != nil {
+            return err
+        }
+    }
+    x.path = target
+    return nil
+}
+
+// pgpEncrypt replaces the file with "<name>.pgp" (".asc" when armored),
+// encrypted to the recipients of the namespace's keyring and signed with its
+// first key pair if asked to.
+func (x *execution) pgpEncrypt(action Action) error {
+    recipients, err := pgp.Recipients(x.namespace, action.Recipients)
+    if err != nil {
+        return err
+    }
+    var signer *pgp.Key
+    if action.Sign {
+        key, err := pgp.SigningKey(x.namespace)
+        if err != nil {
+            return err
+        }
+        signer = &key
+    }
+    if err := x.fs.Check(x.virtual(x.path), vfs.ActionRead); err != nil {
+        return err
+    }
+
+    src, err := os.Open(storageFile(x.namespace, x.path))
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    staged, err := os.CreateTemp(stagingDir, "encrypt-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(staged.Name())
+    defer staged.Close()
+
+    name := path.Base(x.path)
+    if err := pgp.Encrypt(recipients, signer, name, action.Armor, src, staged); err != nil {
+        return err
+    }
+
+    ext := ".pgp"
+    if action.Armor {
+        ext = ".asc"
+    }
+    target, err := x.freeName(path.Dir(x.path), name+ext)
+    if err != nil {
+        return err
+    }
+    if _, err := staged.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    if err := x.store(staged, target); err != nil {
+        return err
+    }
+
+    if !action.KeepOriginal {
+        if err := x.fs.Remove(x.virtual(x.path)); err != nil {
+            return err
+        }
+    }
+    x.path = target
+    return nil
+}
@@ -0,0 +1,397 @@
+// Package rules runs hot-folder automation: when a file is uploaded into,
+// moved into or extracted from an archive into a folder, the rules whose
+// conditions it meets apply their actions to it in order. Group rules only
+// see their group's folder; site admins may also write rules for any
+// namespace. Actions go through package vfs as the rule's creator, or as the
+// owner for files in a home folder, so they are checked, logged and
+// published like any other transfer.
+package rules
+
+import (
+    "LunaTransfer/store"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "path"
+    "regexp"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    TriggerUpload  = "upload"
+    TriggerMove    = "move"
+    TriggerExtract = "extract"
+
+    ActionMove        = "move"
+    ActionCopy        = "copy"
+    ActionRename      = "rename"
+    ActionEncrypt     = "encrypt"
+    ActionShare       = "share"
+    ActionNotify      = "notify"
+    ActionWebhook     = "webhook"
+    ActionDeleteAfter = "delete_after"
+    ActionPGPDecrypt  = "pgp_decrypt"
+    ActionPGPEncrypt  = "pgp_encrypt"
+    ActionAS2Send     = "as2_send"
+
+    maxActions = 20
+)
+
+// ActionTypes lists every action a rule can use.
+var ActionTypes = []string{
+    ActionMove, ActionCopy, ActionRename, ActionEncrypt,
+    ActionShare, ActionNotify, ActionWebhook, ActionDeleteAfter,
+    ActionPGPDecrypt, ActionPGPEncrypt, ActionAS2Send,
+}
+
+var (
+    ErrRuleNotFound = errors.New("rule not found")
+
+    // rulesMutex guards rules.json and cachedRules, the stored rules with
+    // their path regexes compiled, loaded on first use.
+    rulesMutex  sync.Mutex
+    cachedRules []Rule
+)
+
+// Action is one step of a rule. Which fields apply depends on Type:
+//
+//   - move, copy: Folder, relative to the namespace of the file
+//   - rename: Template, e.g. "{base}-{date}{ext}"
+//   - encrypt: KeyID of a key kept apart from the rule, and KeepOriginal.
+//     A new action gives Key instead (base64 AES-256, generated when
+//     empty); it is moved to the key store when the rule is saved.
+//   - share: TargetGroup, Permission and ExpiresInDays
+//   - notify: Message, a template sent to the owner or the group members
+//   - webhook: WebhookID, or every subscription to rule.triggered when empty
+//   - delete_after: Days
+//   - pgp_decrypt: KeepOriginal and RequireSignature, with the keyring of the
+//     file's namespace
+//   - pgp_encrypt: Recipients from that keyring, Sign, Armor and KeepOriginal
+//   - as2_send: PartnerID, sent as the partner's AS2 settings say
+type Action struct {
+    Type          string `json:"type"`
+    Folder        string `json:"folder,omitempty"`
+    Template      string `json:"template,omitempty"`
+    Key           string `json:"key,omitempty"`
+    KeyID         string `json:"key_id,omitempty"`
+    KeepOriginal  bool   `json:"keep_original,omitempty"`
+    TargetGroup   string `json:"target_group,omitempty"`
+    Permission    string `json:"permission,omitempty"`
+    ExpiresInDays int    `json:"expires_in_days,omitempty"`
+    Message       string `json:"message,omitempty"`
+    WebhookID     string `json:"webhook_id,omitempty"`
+    Days          int    `json:"days,omitempty"`
+
+    Recipients       []string `json:"recipients,omitempty"`
+    Sign             bool     `json:"sign,omitempty"`
+    Armor            bool     `json:"armor,omitempty"`
+    RequireSignature bool     `json:"require_signature,omitempty"`
+
+    PartnerID string `json:"partner_id,omitempty"`
+}
+
+// Rule matches files by where they land and what they are. PathGlob without
+// a slash matches the file name, otherwise the namespace-relative path, like
+// webhook path globs; PathRegex always matches the namespace-relative path.
+// ContentTypes holds extensions (".csv") or MIME types ("text/csv",
+// "image/*"). Rules are evaluated in the order they were created; Stop ends
+// the evaluation for a file once the rule has applied.
+type Rule struct {
+    ID           string    `json:"id"`
+    Name         string    `json:"name"`
+    Enabled      bool      `json:"enabled"`
+    GroupID      string    `json:"group_id,omitempty"`
+    Namespace    string    `json:"namespace,omitempty"`
+    Events       []string  `json:"events,omitempty"`
+    PathGlob     string    `json:"path_glob,omitempty"`
+    PathRegex    string    `json:"path_regex,omitempty"`
+    MinSize      int64     `json:"min_size,omitempty"`
+    MaxSize      int64     `json:"max_size,omitempty"`
+    ContentTypes []string  `json:"content_types,omitempty"`
+    Actions      []Action  `json:"actions"`
+    Stop         bool      `json:"stop,omitempty"`
+    CreatedBy    string    `json:"created_by"`
+    CreatedAt    time.Time `json:"created_at"`
+    UpdatedAt    time.Time `json:"updated_at"`
+
+    pathRegex *regexp.Regexp
+}
+
+// compile prepares PathRegex for matching. Validate has checked it; a stored
+// regex that no longer compiles leaves the rule matching nothing.
+func (r *Rule) compile() {
+    r.pathRegex = nil
+    if r.PathRegex != "" {
+        r.pathRegex, _ = regexp.Compile(r.PathRegex)
+    }
+}
+
+// clone copies the slices of r so callers can't change the cached rule.
+func (r Rule) clone() Rule {
+    r.Events = slices.Clone(r.Events)
+    r.ContentTypes = slices.Clone(r.ContentTypes)
+    r.Actions = slices.Clone(r.Actions)
+    for i := range r.Actions {
+        r.Actions[i].Recipients = slices.Clone(r.Actions[i].Recipients)
+    }
+    return r
+}
+
+// Normalize cleans names and paths before Validate. A group rule is always
+// scoped to its group's namespace.
+func (r *Rule) Normalize() {
+    if r.GroupID != "" {
+        r.Namespace = "group:" + r.GroupID
+    }
+    for i := range r.Events {
+        r.Events[i] = strings.ToLower(strings.TrimSpace(r.Events[i]))
+    }
+    for i := range r.ContentTypes {
+        r.ContentTypes[i] = strings.ToLower(strings.TrimSpace(r.ContentTypes[i]))
+    }
+    for i := range r.Actions {
+        action := &r.Actions[i]
+        action.Type = strings.ToLower(strings.TrimSpace(action.Type))
+        if action.Folder != "" {
+            action.Folder = cleanFolder(action.Folder)
+        }
+        if action.Type == ActionShare && action.Permission == "" {
+            action.Permission = "read"
+        }
+    }
+}
+
+func cleanFolder(p string) string {
+    return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// Validate checks a rule as supplied by its creator.
+func (r Rule) Validate() error {
+    if strings.TrimSpace(r.Name) == "" {
+        return fmt.Errorf("name is required")
+    }
+    for _, event := range r.Events {
+        if event != TriggerUpload && event != TriggerMove && event != TriggerExtract {
+            return fmt.Errorf("events may only contain %q, %q and %q", TriggerUpload, TriggerMove, TriggerExtract)
+        }
+    }
+    if r.Namespace != "" {
+        if _, err := path.Match(r.Namespace, ""); err != nil {
+            return fmt.Errorf("invalid namespace pattern: %w", err)
+        }
+    }
+    if r.PathGlob != "" {
+        if _, err := path.Match(r.PathGlob, ""); err != nil {
+            return fmt.Errorf("invalid path glob: %w", err)
+        }
+    }
+    if r.PathRegex != "" {
+        if _, err := regexp.Compile(r.PathRegex); err != nil {
+            return fmt.Errorf("invalid path regex: %w", err)
+        }
+    }
+    if r.MinSize < 0 || r.MaxSize < 0 {
+        return fmt.Errorf("sizes may not be negative")
+    }
+    if r.MaxSize > 0 && r.MinSize > r.MaxSize {
+        return fmt.Errorf("min_size is larger than max_size")
+    }
+    for _, contentType := range r.ContentTypes {
+        if contentType == "" || (!strings.HasPrefix(contentType, ".") && !strings.Contains(contentType, "/")) {
+            return fmt.Errorf("content type %q must be an extension like \".csv\" or a MIME type like \"text/csv\"", contentType)
+        }
+    }
+
+    if len(r.Actions) == 0 {
+        return fmt.Errorf("at least one action is required")
+    }
+    if len(r.Actions) > maxActions {
+        return fmt.Errorf("a rule may have at most %d actions", maxActions)
+    }
+    for i, action := range r.Actions {
+        if err := action.validate(); err != nil {
+            return fmt.Errorf("action %d (%s): %w", i+1, action.Type, err)
+        }
+    }
+    return nil
+}
+
+func (a Action) validate() error {
+    switch a.Type {
+    case ActionMove, ActionCopy:
+        if a.Folder == "" {
+            return fmt.Errorf("folder is required")
+        }
+    case ActionRename:
+        name := expandTemplate(a.Template, templateData{name: "file.txt"})
+        if strings.TrimSpace(a.Template) == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+            return fmt.Errorf("template must produce a file name without '/'")
+        }
+    case ActionEncrypt:
+        if a.Key == "" {
+            return nil
+        }
+        if a.KeyID != "" {
+            return fmt.Errorf("give either key or key_id")
+        }
+        key, err := base64.StdEncoding.DecodeString(a.Key)
+        if err != nil || len(key) != 32 {
+            return fmt.Errorf("key must be 32 bytes, base64 encoded")
+        }
+    case ActionShare:
+        if a.TargetGroup == "" {
+            return fmt.Errorf("target_group is required")
+        }
+        if a.Permission != "read" && a.Permission != "write" {
+            return fmt.Errorf("permission must be 'read' or 'write'")
+        }
+        if a.ExpiresInDays < 0 {
+            return fmt.Errorf("expires_in_days may not be negative")
+        }
+    case ActionNotify, ActionWebhook, ActionPGPDecrypt:
+    case ActionPGPEncrypt:
+        if len(a.Recipients) == 0 {
+            return fmt.Errorf("at least one recipient is required")
+        }
+    case ActionAS2Send:
+        if a.PartnerID == "" {
+            return fmt.Errorf("partner_id is required")
+        }
+    case ActionDeleteAfter:
+        if a.Days < 1 {
+            return fmt.Errorf("days must be at least 1")
+        }
+    default:
+        return fmt.Errorf("type must be one of %s", strings.Join(ActionTypes, ", "))
+    }
+    return nil
+}
+
+// loadRules returns the cached rules, reading them on first use. The
+// caller must hold rulesMutex and may not change them.
+func loadRules() ([]Rule, error) {
+    if cachedRules != nil {
+        return cachedRules, nil
+    }
+    rules := []Rule{}
+    if err := store.ReadDataFile("rules.json", &rules); err != nil {
+        return nil, err
+    }
+    for i := range rules {
+        rules[i].compile()
+    }
+    cachedRules = rules
+    return rules, nil
+}
+
+// saveRules writes rules and makes them the cached ones. The caller must
+// hold rulesMutex.
+func saveRules(rules []Rule) error {
+    if err := store.WriteDataFile("rules.json", rules); err != nil {
+        cachedRules = nil
+        return err
+    }
+    cachedRules = rules
+    return nil
+}
+
+func ListRules() ([]Rule, error) {
+    rulesMutex.Lock()
+    defer rulesMutex.Unlock()
+
+    rules, err := loadRules()
+    if err != nil {
+        return nil, err
+    }
+    list := make([]Rule, len(rules))
+    for i, rule := range rules {
+        list[i] = rule.clone()
+    }
+    return list, nil
+}
+
+func GetRule(id string) (Rule, error) {
+    rulesMutex.Lock()
+    defer rulesMutex.Unlock()
+
+    rules, err := loadRules()
+    if err != nil {
+        return Rule{}, err
+    }
+    for _, rule := range rules {
+        if rule.ID == id {
+            return rule.clone(), nil
+        }
+    }
+    return Rule{}, ErrRuleNotFound
+}
+
+// CreateRule stores a new rule. The keys of its encrypt actions go to the
+// key store, generating those that are missing; the stored rule is returned
+// with the generated keys by action index, so the caller can hand them out
+// once.
+func CreateRule(rule Rule) (Rule, map[int]string, error) {
+    rulesMutex.Lock()
+    defer rulesMutex.Unlock()
+
+    rules, err := loadRules()
+    if err != nil {
+        return rule, nil, err
+    }
+    rule = rule.clone()
+    generated, err := storeKeys(&rule)
+    if err != nil {
+        return rule, nil, err
+    }
+    rule.compile()
+    return rule, generated, saveRules(append(slices.Clip(rules), rule))
+}
+
+// UpdateRule replaces the stored rule with the same ID, storing keys like
+// CreateRule. Key IDs must be those of the rule's own keys.
+func UpdateRule(rule Rule) (Rule, map[int]string, error) {
+    rulesMutex.Lock()
+    defer rulesMutex.Unlock()
+
+    rules, err := loadRules()
+    if err != nil {
+        return rule, nil, err
+    }
+    i := slices.IndexFunc(rules, func(stored Rule) bool { return stored.ID == rule.ID })
+    if i < 0 {
+        return rule, nil, ErrRuleNotFound
+    }
+    rule = rule.clone()
+    generated, err := storeKeys(&rule)
+    if err != nil {
+        return rule, nil, err
+    }
+    rule.compile()
+    updated := slices.Clone(rules)
+    updated[i] = rule
+    return rule, generated, saveRules(updated)
+}
+
+func DeleteRule(id string) error {
+    rulesMutex.Lock()
+    defer rulesMutex.Unlock()
+
+    rules, err := loadRules()
+    if err != nil {
+        return err
+    }
+    for i, rule := range rules {
+        if rule.ID == id {
+            if err := saveRules(slices.Delete(slices.Clone(rules), i, i+1)); err != nil {
+                return err
+            }
+            forgetExpirations(id)
+            forgetKeys(id)
+            return nil
+        }
+    }
+    return ErrRuleNotFound
+}
@@ -0,0 +1,96 @@
+package s3api
+
+import (
+    "encoding/xml"
+    "errors"
+    "net/http"
+    "os"
+)
+
+// apiError is an S3 error response.
+type apiError struct {
+    Code    string
+    Message string
+    Status  int
+}
+
+func (e *apiError) Error() string {
+    return e.Code + ": " + e.Message
+}
+
+var (
+    errAccessDenied        = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+    errSignatureVersion    = &apiError{"InvalidRequest", "Only AWS4-HMAC-SHA256 signatures are supported", http.StatusBadRequest}
+    errAuthorizationHeader = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+    errAuthorizationQuery  = &apiError{"AuthorizationQueryParametersError", "The presigned URL parameters are invalid", http.StatusBadRequest}
+    errMissingDate         = &apiError{"AccessDenied", "Missing or invalid X-Amz-Date", http.StatusForbidden}
+    errTimeSkewed          = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+    errRequestExpired      = &apiError{"AccessDenied", "Request has expired", http.StatusForbidden}
+    errInvalidAccessKey    = &apiError{"InvalidAccessKeyId", "The access key ID does not exist", http.StatusForbidden}
+    errSignatureMismatch   = &apiError{"SignatureDoesNotMatch", "The request signature does not match", http.StatusForbidden}
+    errHostNotSigned       = &apiError{"AccessDenied", "The host header must be signed", http.StatusForbidden}
+    errMissingContentSHA   = &apiError{"InvalidRequest", "Missing x-amz-content-sha256", http.StatusBadRequest}
+    errInvalidContentSHA   = &apiError{"InvalidArgument", "Invalid x-amz-content-sha256", http.StatusBadRequest}
+    errContentSHA          = &apiError{"XAmzContentSHA256Mismatch", "The payload does not match x-amz-content-sha256", http.StatusBadRequest}
+    errBadDigest           = &apiError{"BadDigest", "The Content-MD5 does not match the payload", http.StatusBadRequest}
+    errInvalidDigest       = &apiError{"InvalidDigest", "The Content-MD5 is not valid", http.StatusBadRequest}
+    errIncompleteBody      = &apiError{"IncompleteBody", "The request body is incomplete or malformed", http.StatusBadRequest}
+    errEntityTooLarge      = &apiError{"EntityTooLarge", "The upload exceeds the maximum allowed size", http.StatusBadRequest}
+    errNoSuchBucket        = &apiError{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+    errNoSuchKey           = &apiError{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+    errNoSuchUpload        = &apiError{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+    errInvalidKey          = &apiError{"InvalidArgument", "Object keys may not contain empty, '.' or '..' segments", http.StatusBadRequest}
+    errInvalidArgument     = &apiError{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+    errInvalidPart         = &apiError{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+    errInvalidPartOrder    = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+    errMalformedXML        = &apiError{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+    errBucketManaged       = &apiError{"AccessDenied", "Buckets are the home folder and groups and cannot be created or deleted over S3", http.StatusForbidden}
+    errNotImplemented      = &apiError{"NotImplemented", "This operation is not supported", http.StatusNotImplemented}
+    errMethodNotAllowed    = &apiError{"MethodNotAllowed", "The method is not allowed against this resource", http.StatusMethodNotAllowed}
+    errInternal            = &apiError{"InternalError", "We encountered an internal error, please try again", http.StatusInternalServerError}
+)
+
+// fileError maps vfs errors on an object.
+func fileError(err error) *apiError {
+    switch {
+    case errors.Is(err, os.ErrNotExist):
+        return errNoSuchKey
+    case errors.Is(err, os.ErrPermission):
+        return errAccessDenied
+    case errors.Is(err, errContentSHAMismatch):
+        return errContentSHA
+    case errors.Is(err, errChunkSignature):
+        return errSignatureMismatch
+    }
+    return errInternal
+}
+
+type errorResponse struct {
+    XMLName   xml.Name `xml:"Error"`
+    Code      string   `xml:"Code"`
+    Message   string   `xml:"Message"`
+    Resource  string   `xml:"Resource"`
+    RequestID string   `xml:"RequestId"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(e.Status)
+    if r.Method == http.MethodHead {
+        return
+    }
+    w.Write([]byte(xml.Header))
+    xml.NewEncoder(w).Encode(errorResponse{
+        Code:      e.Code,
+        Message:   e.Message,
+        Resource:  r.URL.Path,
+        RequestID: w.Header().Get("X-Amz-Request-Id"),
+    })
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    w.Write([]byte(xml.Header))
+    xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,330 @@
+package s3api
+
+import (
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "context"
+    "crypto/md5"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    maxPartNumber     = 10000
+    uploadExpiry      = 7 * 24 * time.Hour
+    uploadSweepPeriod = time.Hour
+    uploadMetaFile    = "upload.json"
+)
+
+// Multipart uploads are kept below the staging directory until completed:
+// <id>/upload.json describes the upload and <n>-<md5>.part holds part n.
+type uploadMeta struct {
+    Username  string    `json:"username"`
+    Bucket    string    `json:"bucket"`
+    Key       string    `json:"key"`
+    Initiated time.Time `json:"initiated"`
+}
+
+type initiateMultipartUploadResult struct {
+    XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+    Bucket   string   `xml:"Bucket"`
+    Key      string   `xml:"Key"`
+    UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+    Parts []struct {
+        PartNumber int    `xml:"PartNumber"`
+        ETag       string `xml:"ETag"`
+    } `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+    XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+    Location string   `xml:"Location"`
+    Bucket   string   `xml:"Bucket"`
+    Key      string   `xml:"Key"`
+    ETag     string   `xml:"ETag"`
+}
+
+type partEntry struct {
+    PartNumber   int    `xml:"PartNumber"`
+    LastModified string `xml:"LastModified"`
+    ETag         string `xml:"ETag"`
+    Size         int64  `xml:"Size"`
+}
+
+type listPartsResult struct {
+    XMLName     xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+    Bucket      string      `xml:"Bucket"`
+    Key         string      `xml:"Key"`
+    UploadID    string      `xml:"UploadId"`
+    MaxParts    int         `xml:"MaxParts"`
+    IsTruncated bool        `xml:"IsTruncated"`
+    Parts       []partEntry `xml:"Part"`
+}
+
+func (g *gateway) uploadDir(id string) string {
+    return filepath.Join(g.stagingDir, id)
+}
+
+func partFile(number int, etag string) string {
+    return fmt.Sprintf("%05d-%s.part", number, etag)
+}
+
+func (q *request) createMultipartUpload() *apiError {
+    root, apiErr := q.root()
+    if apiErr != nil {
+        return apiErr
+    }
+    if strings.HasSuffix(q.key, "/") {
+        return errInvalidKey
+    }
+    p, apiErr := objectPath(root, q.key)
+    if apiErr != nil {
+        return apiErr
+    }
+    if err := q.fs.Check(p, vfs.ActionWrite); err != nil {
+        return fileError(err)
+    }
+
+    b := make([]byte, 16)
+    rand.Read(b)
+    id := hex.EncodeToString(b)
+    meta, _ := json.Marshal(uploadMeta{Username: q.cred.username, Bucket: q.bucket, Key: q.key, Initiated: time.Now()})
+    if err := os.MkdirAll(q.g.uploadDir(id), 0755); err != nil {
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to create multipart upload")
+        return errInternal
+    }
+    if err := os.WriteFile(filepath.Join(q.g.uploadDir(id), uploadMetaFile), meta, 0600); err != nil {
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to create multipart upload")
+        return errInternal
+    }
+
+    writeXML(q.w, http.StatusOK, initiateMultipartUploadResult{Bucket: q.bucket, Key: q.key, UploadID: id})
+    return nil
+}
+
+// loadUpload finds an upload the caller started for this bucket and key.
+func (q *request) loadUpload(id string) (string, *apiError) {
+    if len(id) != 32 {
+        return "", errNoSuchUpload
+    }
+    if _, err := hex.DecodeString(id); err != nil {
+        return "", errNoSuchUpload
+    }
+    dir := q.g.uploadDir(id)
+    data, err := os.ReadFile(filepath.Join(dir, uploadMetaFile))
+    if err != nil {
+        return "", errNoSuchUpload
+    }
+    var meta uploadMeta
+    if err := json.Unmarshal(data, &meta); err != nil ||
+        meta.Username != q.cred.username || meta.Bucket != q.bucket || meta.Key != q.key {
+        return "", errNoSuchUpload
+    }
+    return dir, nil
+}
+
+func (q *request) uploadPart(id string) *apiError {
+    number, err := strconv.Atoi(q.query.Get("partNumber"))
+    if err != nil || number < 1 || number > maxPartNumber {
+        return errInvalidArgument
+    }
+    dir, apiErr := q.loadUpload(id)
+    if apiErr != nil {
+        return apiErr
+    }
+    if size := uploadSize(q.r); size > maxObjectSize {
+        return errEntityTooLarge
+    }
+
+    body, apiErr := q.cred.body(q.r)
+    if apiErr != nil {
+        return apiErr
+    }
+    staged, sum, apiErr := stageIn(dir, "incoming-*", body, maxObjectSize)
+    if apiErr != nil {
+        return apiErr
+    }
+    staged.Close()
+    if apiErr := checkContentMD5(q.r, sum); apiErr != nil {
+        os.Remove(staged.Name())
+        return apiErr
+    }
+
+    // A part uploaded again replaces the earlier one.
+    etag := hex.EncodeToString(sum)
+    previous, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%05d-*.part", number)))
+    for _, old := range previous {
+        if filepath.Base(old) != partFile(number, etag) {
+            os.Remove(old)
+        }
+    }
+    if err := os.Rename(staged.Name(), filepath.Join(dir, partFile(number, etag))); err != nil {
+        os.Remove(staged.Name())
+        if os.IsNotExist(err) {
+            return errNoSuchUpload
+        }
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to save upload part")
+        return errInternal
+    }
+
+    q.w.Header().Set("ETag", `"`+etag+`"`)
+    q.w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+func (q *request) completeMultipartUpload(id string) *apiError {
+    dir, apiErr := q.loadUpload(id)
+    if apiErr != nil {
+        return apiErr
+    }
+    root, apiErr := q.root()
+    if apiErr != nil {
+        return apiErr
+    }
+    p, apiErr := objectPath(root, q.key)
+    if apiErr != nil {
+        return apiErr
+    }
+
+    body, apiErr := q.cred.body(q.r)
+    if apiErr != nil {
+        return apiErr
+    }
+    data, err := io.ReadAll(io.LimitReader(body, maxDeleteBody))
+    if err != nil {
+        return fileError(err)
+    }
+    var req completeMultipartUpload
+    if err := xml.Unmarshal(data, &req); err != nil || len(req.Parts) == 0 {
+        return errMalformedXML
+    }
+
+    files := make([]string, 0, len(req.Parts))
+    sums := make([]byte, 0, len(req.Parts)*md5.Size)
+    for i, part := range req.Parts {
+        if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+            return errInvalidPartOrder
+        }
+        etag := strings.ToLower(strings.Trim(part.ETag, `"`))
+        sum, err := hex.DecodeString(etag)
+        if err != nil || len(sum) != md5.Size {
+            return errInvalidPart
+        }
+        file := filepath.Join(dir, partFile(part.PartNumber, etag))
+        if _, err := os.Stat(file); err != nil {
+            return errInvalidPart
+        }
+        files = append(files, file)
+        sums = append(sums, sum...)
+    }
+
+    parts := make([]io.Reader, 0, len(files))
+    for _, name := range files {
+        file, err := os.Open(name)
+        if err != nil {
+            return errInvalidPart
+        }
+        defer file.Close()
+        parts = append(parts, file)
+    }
+    if apiErr := q.store(root, p, io.MultiReader(parts...)); apiErr != nil {
+        return apiErr
+    }
+    os.RemoveAll(dir)
+
+    total := md5.Sum(sums)
+    writeXML(q.w, http.StatusOK, completeMultipartUploadResult{
+        Location: "/" + path.Join(q.bucket, q.key),
+        Bucket:   q.bucket,
+        Key:      q.key,
+        ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(total[:]), len(req.Parts)),
+    })
+    return nil
+}
+
+func (q *request) abortMultipartUpload(id string) *apiError {
+    dir, apiErr := q.loadUpload(id)
+    if apiErr != nil {
+        return apiErr
+    }
+    if err := os.RemoveAll(dir); err != nil {
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to abort multipart upload")
+        return errInternal
+    }
+    q.w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+func (q *request) listParts(id string) *apiError {
+    dir, apiErr := q.loadUpload(id)
+    if apiErr != nil {
+        return apiErr
+    }
+    files, err := filepath.Glob(filepath.Join(dir, "*.part"))
+    if err != nil {
+        return errInternal
+    }
+    sort.Strings(files)
+
+    result := listPartsResult{Bucket: q.bucket, Key: q.key, UploadID: id, MaxParts: maxPartNumber}
+    for _, file := range files {
+        name := strings.TrimSuffix(filepath.Base(file), ".part")
+        numberField, etag, _ := strings.Cut(name, "-")
+        number, err := strconv.Atoi(numberField)
+        info, statErr := os.Stat(file)
+        if err != nil || statErr != nil {
+            continue
+        }
+        result.Parts = append(result.Parts, partEntry{
+            PartNumber:   number,
+            LastModified: lastModified(info.ModTime()),
+            ETag:         `"` + etag + `"`,
+            Size:         info.Size(),
+        })
+    }
+    writeXML(q.w, http.StatusOK, result)
+    return nil
+}
+
+// sweepUploads removes multipart uploads that were never completed or
+// aborted, and staging files left behind by interrupted uploads.
+func (g *gateway) sweepUploads(ctx context.Context) {
+    ticker := time.NewTicker(uploadSweepPeriod)
+    defer ticker.Stop()
+    for {
+        entries, err := os.ReadDir(g.stagingDir)
+        if err == nil {
+            for _, entry := range entries {
+                info, err := entry.Info()
+                if err != nil || time.Since(info.ModTime()) < uploadExpiry {
+                    continue
+                }
+                if err := os.RemoveAll(filepath.Join(g.stagingDir, entry.Name())); err == nil {
+                    utils.LogSystem("S3_UPLOAD_EXPIRED", "system", "localhost",
+                        fmt.Sprintf("Removed abandoned S3 upload %s", entry.Name()))
+                }
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
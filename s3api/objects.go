@@ -0,0 +1,635 @@
+package s3api
+
+import (
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "bytes"
+    "crypto/md5"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+    maxListKeys   = 1000
+    maxDeleteBody = 2 << 20
+    emptyETag     = `"d41d8cd98f00b204e9800998ecf8427e"`
+)
+
+var errKeyConflict = &apiError{"InvalidArgument", "The key conflicts with an existing folder or object", http.StatusConflict}
+
+type owner struct {
+    ID          string `xml:"ID"`
+    DisplayName string `xml:"DisplayName"`
+}
+
+type bucketEntry struct {
+    Name         string `xml:"Name"`
+    CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+    XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+    Owner   owner         `xml:"Owner"`
+    Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+func (q *request) listBuckets() *apiError {
+    result := listAllMyBucketsResult{Owner: owner{ID: q.cred.username, DisplayName: q.cred.username}}
+
+    if info, err := q.fs.Stat("/" + vfs.HomeDir); err == nil {
+        result.Buckets = append(result.Buckets, bucketEntry{Name: homeBucket, CreationDate: lastModified(info.ModTime())})
+    }
+    groups, err := q.fs.ReadDir("/" + vfs.GroupsDir)
+    if err != nil {
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to list groups")
+        return errInternal
+    }
+    for _, group := range groups {
+        result.Buckets = append(result.Buckets, bucketEntry{Name: group.Name(), CreationDate: lastModified(group.ModTime())})
+    }
+    writeXML(q.w, http.StatusOK, result)
+    return nil
+}
+
+func (q *request) headBucket() *apiError {
+    if _, apiErr := q.root(); apiErr != nil {
+        return apiErr
+    }
+    q.w.Header().Set("X-Amz-Bucket-Region", q.g.region)
+    q.w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+type locationConstraint struct {
+    XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+    Region  string   `xml:",chardata"`
+}
+
+func (q *request) bucketLocation() *apiError {
+    if _, apiErr := q.root(); apiErr != nil {
+        return apiErr
+    }
+    // us-east-1 is reported as an empty constraint, as S3 does.
+    region := q.g.region
+    if region == "us-east-1" {
+        region = ""
+    }
+    writeXML(q.w, http.StatusOK, locationConstraint{Region: region})
+    return nil
+}
+
+// objectETag identifies a version of a stored file. It is not the MD5 of the
+// content, which would mean reading every file on each listing; the "-1"
+// suffix tells clients so, as for multipart uploads.
+func objectETag(info os.FileInfo) string {
+    sum := md5.Sum([]byte(fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())))
+    return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// stat finds the object for key: a file, or a folder when key is a folder
+// marker ending in "/".
+func (q *request) stat(key string) (string, os.FileInfo, *apiError) {
+    root, apiErr := q.root()
+    if apiErr != nil {
+        return "", nil, apiErr
+    }
+    p, apiErr := objectPath(root, key)
+    if apiErr != nil {
+        return "", nil, apiErr
+    }
+    info, err := q.fs.Stat(p)
+    if err != nil {
+        return "", nil, fileError(err)
+    }
+    if info.IsDir() != strings.HasSuffix(key, "/") {
+        return "", nil, errNoSuchKey
+    }
+    return p, info, nil
+}
+
+func (q *request) setObjectHeaders(info os.FileInfo) {
+    header := q.w.Header()
+    if info.IsDir() {
+        header.Set("Content-Type", "application/x-directory")
+        header.Set("Content-Length", "0")
+        header.Set("ETag", emptyETag)
+    } else {
+        contentType := mime.TypeByExtension(path.Ext(info.Name()))
+        if contentType == "" {
+            contentType = "application/octet-stream"
+        }
+        header.Set("Content-Type", contentType)
+        header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+        header.Set("ETag", objectETag(info))
+    }
+    header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+    header.Set("Accept-Ranges", "bytes")
+}
+
+func (q *request) headObject() *apiError {
+    _, info, apiErr := q.stat(q.key)
+    if apiErr != nil {
+        return apiErr
+    }
+    q.setObjectHeaders(info)
+    q.w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+// responseOverrides are the response-* parameters presigned URLs use to set
+// download headers.
+var responseOverrides = map[string]string{
+    "response-content-type":        "Content-Type",
+    "response-content-disposition": "Content-Disposition",
+    "response-content-encoding":    "Content-Encoding",
+    "response-content-language":    "Content-Language",
+    "response-cache-control":       "Cache-Control",
+    "response-expires":             "Expires",
+}
+
+func (q *request) getObject() *apiError {
+    p, info, apiErr := q.stat(q.key)
+    if apiErr != nil {
+        return apiErr
+    }
+    q.setObjectHeaders(info)
+    for param, header := range responseOverrides {
+        if value := q.query.Get(param); value != "" {
+            q.w.Header().Set(header, value)
+        }
+    }
+    if info.IsDir() {
+        q.w.WriteHeader(http.StatusOK)
+        return nil
+    }
+
+    file, err := q.fs.Open(p)
+    if err != nil {
+        return fileError(err)
+    }
+    defer file.Close()
+    // ServeContent answers Range and conditional requests and sets the
+    // length itself.
+    q.w.Header().Del("Content-Length")
+    http.ServeContent(q.w, q.r, info.Name(), info.ModTime(), file)
+    return nil
+}
+
+func (q *request) putObject() *apiError {
+    root, apiErr := q.root()
+    if apiErr != nil {
+        return apiErr
+    }
+    p, apiErr := objectPath(root, q.key)
+    if apiErr != nil {
+        return apiErr
+    }
+    if err := q.fs.Check(p, vfs.ActionWrite); err != nil {
+        return fileError(err)
+    }
+    if size := uploadSize(q.r); size > maxObjectSize {
+        return errEntityTooLarge
+    }
+
+    // A key ending in "/" is how S3 consoles create folders.
+    if strings.HasSuffix(q.key, "/") {
+        io.Copy(io.Discard, io.LimitReader(q.r.Body, maxDeleteBody))
+        if apiErr := q.mkdirAll(root, p); apiErr != nil {
+            return apiErr
+        }
+        q.w.Header().Set("ETag", emptyETag)
+        q.w.WriteHeader(http.StatusOK)
+        return nil
+    }
+
+    body, apiErr := q.cred.body(q.r)
+    if apiErr != nil {
+        return apiErr
+    }
+    staged, sum, apiErr := q.g.stage(body, "put-*", maxObjectSize)
+    if apiErr != nil {
+        return apiErr
+    }
+    defer discard(staged)
+    if apiErr := checkContentMD5(q.r, sum); apiErr != nil {
+        return apiErr
+    }
+
+    if apiErr := q.store(root, p, staged); apiErr != nil {
+        return apiErr
+    }
+    q.w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+    q.w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+// uploadSize is the announced payload size; aws-chunked bodies carry it in
+// x-amz-decoded-content-length.
+func uploadSize(r *http.Request) int64 {
+    if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+        if size, err := strconv.ParseInt(decoded, 10, 64); err == nil {
+            return size
+        }
+    }
+    return r.ContentLength
+}
+
+func checkContentMD5(r *http.Request, sum []byte) *apiError {
+    header := r.Header.Get("Content-MD5")
+    if header == "" {
+        return nil
+    }
+    expected, err := base64.StdEncoding.DecodeString(header)
+    if err != nil || len(expected) != md5.Size {
+        return errInvalidDigest
+    }
+    if !bytes.Equal(expected, sum) {
+        return errBadDigest
+    }
+    return nil
+}
+
+// stage receives a payload into a temporary file so that a body failing its
+// signature or digest never reaches storage. It returns the file rewound and
+// the payload's MD5.
+func (g *gateway) stage(body io.Reader, pattern string, limit int64) (*os.File, []byte, *apiError) {
+    return stageIn(g.stagingDir, pattern, body, limit)
+}
+
+func stageIn(dir, pattern string, body io.Reader, limit int64) (*os.File, []byte, *apiError) {
+    file, err := os.CreateTemp(dir, pattern)
+    if err != nil {
+        utils.LogError("S3_ERROR", err, "system", "Failed to create staging file")
+        return nil, nil, errInternal
+    }
+
+    hash := md5.New()
+    n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(body, limit+1))
+    if err == nil && n > limit {
+        err = errEntityTooLarge
+    }
+    if err == nil {
+        _, err = file.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        discard(file)
+        var apiErr *apiError
+        switch {
+        case errors.As(err, &apiErr):
+            return nil, nil, apiErr
+        case errors.Is(err, errContentSHAMismatch), errors.Is(err, errChunkSignature):
+            return nil, nil, fileError(err)
+        }
+        return nil, nil, errIncompleteBody
+    }
+    return file, hash.Sum(nil), nil
+}
+
+func discard(file *os.File) {
+    file.Close()
+    os.Remove(file.Name())
+}
+
+// store writes the staged payload to p, creating the folders above it.
+func (q *request) store(root, p string, staged io.Reader) *apiError {
+    if info, err := q.fs.Stat(p); err == nil && info.IsDir() {
+        return errKeyConflict
+    }
+    if apiErr := q.mkdirAll(root, path.Dir(p)); apiErr != nil {
+        return apiErr
+    }
+
+    file, err := q.fs.Create(p, os.O_TRUNC)
+    if err != nil {
+        return fileError(err)
+    }
+    if _, err := io.Copy(file, staged); err != nil {
+        file.Close()
+        utils.LogError("S3_ERROR", err, q.cred.username, "Failed to store "+p)
+        return errInternal
+    }
+    if err := file.Close(); err != nil {
+        return errInternal
+    }
+    return nil
+}
+
+// mkdirAll creates dir and its parents below root, which S3 keys imply.
+func (q *request) mkdirAll(root, dir string) *apiError {
+    rel := strings.TrimPrefix(dir, root)
+    current := root
+    for _, segment := range strings.Split(strings.Trim(rel, "/"), "/") {
+        if segment == "" {
+            continue
+        }
+        current += "/" + segment
+        info, err := q.fs.Stat(current)
+        switch {
+        case err == nil && !info.IsDir():
+            return errKeyConflict
+        case err == nil:
+        case errors.Is(err, os.ErrNotExist):
+            if err := q.fs.Mkdir(current); err != nil && !errors.Is(err, os.ErrExist) {
+                return fileError(err)
+            }
+        default:
+            return fileError(err)
+        }
+    }
+    return nil
+}
+
+func (q *request) deleteObject(key string) *apiError {
+    if apiErr := q.removeKey(key); apiErr != nil {
+        return apiErr
+    }
+    q.w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// removeKey deletes the object at key. Like S3 it succeeds when there is no
+// such object; a folder marker only goes away once the folder is empty.
+func (q *request) removeKey(key string) *apiError {
+    p, info, apiErr := q.stat(key)
+    if apiErr == errNoSuchKey {
+        return nil
+    }
+    if apiErr != nil {
+        return apiErr
+    }
+    if err := q.fs.Remove(p); err != nil {
+        if info.IsDir() && !errors.Is(err, os.ErrPermission) {
+            return nil
+        }
+        return fileError(err)
+    }
+    return nil
+}
+
+type deleteRequest struct {
+    Quiet   bool `xml:"Quiet"`
+    Objects []struct {
+        Key string `xml:"Key"`
+    } `xml:"Object"`
+}
+
+type deletedEntry struct {
+    Key string `xml:"Key"`
+}
+
+type deleteErrorEntry struct {
+    Key     string `xml:"Key"`
+    Code    string `xml:"Code"`
+    Message string `xml:"Message"`
+}
+
+type deleteResult struct {
+    XMLName xml.Name           `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+    Deleted []deletedEntry     `xml:"Deleted"`
+    Errors  []deleteErrorEntry `xml:"Error"`
+}
+
+func (q *request) deleteObjects() *apiError {
+    if _, apiErr := q.root(); apiErr != nil {
+        return apiErr
+    }
+    body, apiErr := q.cred.body(q.r)
+    if apiErr != nil {
+        return apiErr
+    }
+    data, err := io.ReadAll(io.LimitReader(body, maxDeleteBody))
+    if err != nil {
+        return fileError(err)
+    }
+    sum := md5.Sum(data)
+    if apiErr := checkContentMD5(q.r, sum[:]); apiErr != nil {
+        return apiErr
+    }
+    var req deleteRequest
+    if err := xml.Unmarshal(data, &req); err != nil || len(req.Objects) == 0 || len(req.Objects) > maxListKeys {
+        return errMalformedXML
+    }
+
+    var result deleteResult
+    for _, object := range req.Objects {
+        if apiErr := q.removeKey(object.Key); apiErr != nil {
+            result.Errors = append(result.Errors, deleteErrorEntry{Key: object.Key, Code: apiErr.Code, Message: apiErr.Message})
+        } else if !req.Quiet {
+            result.Deleted = append(result.Deleted, deletedEntry{Key: object.Key})
+        }
+    }
+    writeXML(q.w, http.StatusOK, result)
+    return nil
+}
+
+type objectEntry struct {
+    Key          string `xml:"Key"`
+    LastModified string `xml:"LastModified"`
+    ETag         string `xml:"ETag"`
+    Size         int64  `xml:"Size"`
+    StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+    Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+    XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+    Name                  string         `xml:"Name"`
+    Prefix                string         `xml:"Prefix"`
+    Marker                *string        `xml:"Marker"`
+    NextMarker            string         `xml:"NextMarker,omitempty"`
+    ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+    NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+    StartAfter            string         `xml:"StartAfter,omitempty"`
+    KeyCount              *int           `xml:"KeyCount"`
+    MaxKeys               int            `xml:"MaxKeys"`
+    Delimiter             string         `xml:"Delimiter,omitempty"`
+    EncodingType          string         `xml:"EncodingType,omitempty"`
+    IsTruncated           bool           `xml:"IsTruncated"`
+    Contents              []objectEntry  `xml:"Contents"`
+    CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listEntry is an object, or a common prefix when info is nil.
+type listEntry struct {
+    key  string
+    info os.FileInfo
+}
+
+// listObjects answers ListObjectsV2 and, without list-type=2, the original
+// ListObjects.
+func (q *request) listObjects() *apiError {
+    root, apiErr := q.root()
+    if apiErr != nil {
+        return apiErr
+    }
+
+    v2 := q.query.Get("list-type") == "2"
+    prefix := q.query.Get("prefix")
+    delimiter := q.query.Get("delimiter")
+    encodingType := q.query.Get("encoding-type")
+    if encodingType != "" && encodingType != "url" {
+        return errInvalidArgument
+    }
+    maxKeys := maxListKeys
+    if value := q.query.Get("max-keys"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+            return errInvalidArgument
+        }
+        maxKeys = min(n, maxListKeys)
+    }
+
+    after := q.query.Get("marker")
+    if v2 {
+        after = q.query.Get("start-after")
+        if token := q.query.Get("continuation-token"); token != "" {
+            decoded, err := base64.RawURLEncoding.DecodeString(token)
+            if err != nil {
+                return errInvalidArgument
+            }
+            after = string(decoded)
+        }
+    }
+
+    entries, err := q.collect(root, prefix, delimiter)
+    if err != nil {
+        return fileError(err)
+    }
+    start := sort.Search(len(entries), func(i int) bool { return entries[i].key > after })
+    entries = entries[start:]
+    truncated := len(entries) > maxKeys
+    if truncated {
+        entries = entries[:maxKeys]
+    }
+
+    encode := func(s string) string {
+        if encodingType == "url" {
+            return uriEncode(s, false)
+        }
+        return s
+    }
+    result := listBucketResult{
+        Name:         q.bucket,
+        Prefix:       encode(prefix),
+        MaxKeys:      maxKeys,
+        Delimiter:    encode(delimiter),
+        EncodingType: encodingType,
+        IsTruncated:  truncated,
+    }
+    for _, entry := range entries {
+        if entry.info == nil {
+            result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(entry.key)})
+            continue
+        }
+        result.Contents = append(result.Contents, objectEntry{
+            Key:          encode(entry.key),
+            LastModified: lastModified(entry.info.ModTime()),
+            ETag:         objectETag(entry.info),
+            Size:         entry.info.Size(),
+            StorageClass: "STANDARD",
+        })
+    }
+
+    var last string
+    if len(entries) > 0 {
+        last = entries[len(entries)-1].key
+    }
+    if v2 {
+        count := len(entries)
+        result.KeyCount = &count
+        result.ContinuationToken = q.query.Get("continuation-token")
+        result.StartAfter = encode(q.query.Get("start-after"))
+        if truncated {
+            result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+        }
+    } else {
+        marker := encode(after)
+        result.Marker = &marker
+        if truncated {
+            result.NextMarker = encode(last)
+        }
+    }
+    writeXML(q.w, http.StatusOK, result)
+    return nil
+}
+
+// collect lists the keys below root that start with prefix, sorted. Keys
+// containing delimiter after the prefix are rolled up into common prefixes,
+// and folders that cannot hold a match are not read at all.
+func (q *request) collect(root, prefix, delimiter string) ([]listEntry, error) {
+    start := prefix[:strings.LastIndex(prefix, "/")+1]
+    if info, err := q.fs.Stat(path.Join(root, start)); err != nil || !info.IsDir() {
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            return nil, err
+        }
+        return nil, nil
+    }
+
+    var entries []listEntry
+    seen := map[string]bool{}
+    var walk func(dir string) error
+    walk = func(dir string) error {
+        infos, err := q.fs.ReadDir(path.Join(root, dir))
+        if err != nil {
+            return err
+        }
+        for _, info := range infos {
+            key := dir + info.Name()
+            if info.IsDir() {
+                key += "/"
+            }
+            if !strings.HasPrefix(key, prefix) {
+                if info.IsDir() && strings.HasPrefix(prefix, key) {
+                    if err := walk(key); err != nil {
+                        return err
+                    }
+                }
+                continue
+            }
+            if delimiter != "" {
+                if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+                    common := key[:len(prefix)+i+len(delimiter)]
+                    if !seen[common] {
+                        seen[common] = true
+                        entries = append(entries, listEntry{key: common})
+                    }
+                    continue
+                }
+            }
+            if info.IsDir() {
+                if err := walk(key); err != nil {
+                    return err
+                }
+                continue
+            }
+            entries = append(entries, listEntry{key: key, info: info})
+        }
+        return nil
+    }
+    if err := walk(start); err != nil {
+        return nil, err
+    }
+
+    sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+    return entries, nil
+}
+
+func lastModified(t time.Time) string {
+    return t.UTC().Format(s3TimeFormat)
+}
@@ -0,0 +1,259 @@
+// Package s3api serves LunaTransfer storage through an S3-compatible API for
+// tools and pipelines that already speak S3. The bucket "home" is the
+// caller's home folder and every group the caller belongs to is a bucket
+// named by the group ID. Requests are signed with Signature Version 4 using
+// keys derived from the caller's API key (see auth.S3Credentials), and every
+// object operation goes through package vfs, so group roles apply.
+package s3api
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const (
+    homeBucket    = "home"
+    maxObjectSize = 5 << 30
+    maxKeyLength  = 1024
+)
+
+// supportedParams are the query parameters of the implemented operations;
+// anything else names an S3 feature LunaTransfer does not have.
+var supportedParams = map[string]bool{
+    "list-type":          true,
+    "prefix":             true,
+    "delimiter":          true,
+    "max-keys":           true,
+    "continuation-token": true,
+    "start-after":        true,
+    "encoding-type":      true,
+    "fetch-owner":        true,
+    "marker":             true,
+    "location":           true,
+    "delete":             true,
+    "uploads":            true,
+    "uploadId":           true,
+    "partNumber":         true,
+    "max-parts":          true,
+    "part-number-marker": true,
+    "x-id":               true,
+}
+
+type gateway struct {
+    region     string
+    stagingDir string
+}
+
+// Start serves the S3 API until ctx is cancelled. It returns at once when the
+// gateway is disabled.
+func Start(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.S3.Enabled {
+        return
+    }
+
+    g := &gateway{
+        region:     appConfig.S3.Region,
+        stagingDir: filepath.Join(appConfig.GetDataDirectory(), "s3uploads"),
+    }
+    if err := os.MkdirAll(g.stagingDir, 0755); err != nil {
+        utils.LogError("S3_ERROR", err, "system", "Failed to create S3 staging directory")
+        log.Printf("S3 gateway not started: %v", err)
+        return
+    }
+
+    // Transfers may take longer than any fixed timeout, so only the headers
+    // and idle connections are limited.
+    srv := &http.Server{
+        Addr:              fmt.Sprintf(":%d", appConfig.S3.Port),
+        Handler:           g,
+        ReadHeaderTimeout: 30 * time.Second,
+        IdleTimeout:       2 * time.Minute,
+    }
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+        defer cancel()
+        srv.Shutdown(shutdownCtx)
+    }()
+    go g.sweepUploads(ctx)
+
+    utils.LogSystem("S3_START", "system", "localhost",
+        fmt.Sprintf("S3 gateway listening on port %d", appConfig.S3.Port))
+    log.Printf("LunaTransfer S3 gateway is running on :%d", appConfig.S3.Port)
+    if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        utils.LogError("S3_ERROR", err, "system", "S3 gateway stopped")
+        log.Printf("S3 gateway stopped: %v", err)
+    }
+}
+
+// request is one authenticated API call.
+type request struct {
+    w      http.ResponseWriter
+    r      *http.Request
+    g      *gateway
+    fs     *vfs.FS
+    cred   *credential
+    query  url.Values
+    bucket string
+    key    string
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Amz-Request-Id", requestID())
+    w.Header().Set("Server", "LunaTransfer")
+
+    cred, apiErr := authenticate(r)
+    if apiErr != nil {
+        utils.LogSystem("S3_AUTH_FAILED", "unknown", r.RemoteAddr,
+            fmt.Sprintf("%s %s rejected: %s", r.Method, r.URL.Path, apiErr.Code))
+        writeError(w, r, apiErr)
+        return
+    }
+
+    query := r.URL.Query()
+    for name := range query {
+        if !supportedParams[name] && !strings.HasPrefix(name, "X-Amz-") && !strings.HasPrefix(name, "response-") {
+            writeError(w, r, errNotImplemented)
+            return
+        }
+    }
+
+    fs, err := vfs.New(cred.username, r.RemoteAddr, "S3 ("+r.UserAgent()+")")
+    if err != nil {
+        utils.LogError("S3_ERROR", err, cred.username, "Failed to open user storage")
+        writeError(w, r, errInternal)
+        return
+    }
+
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    q := &request{w: w, r: r, g: g, fs: fs, cred: cred, query: query, bucket: bucket, key: key}
+    if apiErr := q.route(); apiErr != nil {
+        writeError(w, r, apiErr)
+    }
+}
+
+func (q *request) route() *apiError {
+    switch {
+    case q.bucket == "":
+        if q.r.Method != http.MethodGet {
+            return errMethodNotAllowed
+        }
+        return q.listBuckets()
+    case q.key == "":
+        return q.routeBucket()
+    }
+    return q.routeObject()
+}
+
+func (q *request) routeBucket() *apiError {
+    switch q.r.Method {
+    case http.MethodHead:
+        return q.headBucket()
+    case http.MethodGet:
+        if q.query.Has("location") {
+            return q.bucketLocation()
+        }
+        if q.query.Has("uploads") {
+            return errNotImplemented
+        }
+        return q.listObjects()
+    case http.MethodPost:
+        if q.query.Has("delete") {
+            return q.deleteObjects()
+        }
+        return errNotImplemented
+    case http.MethodPut, http.MethodDelete:
+        return errBucketManaged
+    }
+    return errMethodNotAllowed
+}
+
+func (q *request) routeObject() *apiError {
+    uploadID := q.query.Get("uploadId")
+    switch q.r.Method {
+    case http.MethodGet:
+        if uploadID != "" {
+            return q.listParts(uploadID)
+        }
+        return q.getObject()
+    case http.MethodHead:
+        return q.headObject()
+    case http.MethodPut:
+        if uploadID != "" {
+            return q.uploadPart(uploadID)
+        }
+        if q.r.Header.Get("X-Amz-Copy-Source") != "" {
+            return errNotImplemented
+        }
+        return q.putObject()
+    case http.MethodPost:
+        if q.query.Has("uploads") {
+            return q.createMultipartUpload()
+        }
+        if uploadID != "" {
+            return q.completeMultipartUpload(uploadID)
+        }
+        return errNotImplemented
+    case http.MethodDelete:
+        if uploadID != "" {
+            return q.abortMultipartUpload(uploadID)
+        }
+        return q.deleteObject(q.key)
+    }
+    return errMethodNotAllowed
+}
+
+// root is the virtual folder behind the bucket; it fails when the bucket
+// does not exist or the caller cannot read it.
+func (q *request) root() (string, *apiError) {
+    root := "/" + path.Join(vfs.GroupsDir, q.bucket)
+    if q.bucket == homeBucket {
+        root = "/" + vfs.HomeDir
+    } else if strings.Contains(q.bucket, "/") || q.bucket == "." || q.bucket == ".." {
+        return "", errNoSuchBucket
+    }
+
+    if _, err := q.fs.Stat(root); err != nil {
+        if errors.Is(err, os.ErrPermission) {
+            return "", errAccessDenied
+        }
+        return "", errNoSuchBucket
+    }
+    return root, nil
+}
+
+// objectPath maps key below root. Keys ending in "/" are folder markers and
+// name the folder itself.
+func objectPath(root, key string) (string, *apiError) {
+    trimmed := strings.TrimSuffix(key, "/")
+    if len(key) > maxKeyLength || trimmed == "" {
+        return "", errInvalidKey
+    }
+    for _, segment := range strings.Split(trimmed, "/") {
+        if segment == "" || segment == "." || segment == ".." {
+            return "", errInvalidKey
+        }
+    }
+    return root + "/" + trimmed, nil
+}
+
+func requestID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return strings.ToUpper(hex.EncodeToString(b))
+}
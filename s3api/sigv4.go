@@ -0,0 +1,429 @@
+package s3api
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/partners"
+    "bufio"
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "net/http"
+    "net/url"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    signingAlgorithm = "AWS4-HMAC-SHA256"
+    amzDateFormat    = "20060102T150405Z"
+    maxClockSkew     = 15 * time.Minute
+    maxPresignExpiry = 7 * 24 * time.Hour
+
+    unsignedPayload          = "UNSIGNED-PAYLOAD"
+    streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+    streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+    streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// The clock and the key lookup are variables so tests can check requests
+// signed in AWS's published examples, with their key and date.
+var (
+    now             = time.Now
+    lookupAccessKey = auth.LookupS3AccessKey
+)
+
+// credential is a verified request signature. Streaming uploads keep
+// checking their chunks against it.
+type credential struct {
+    username   string
+    accessKey  string
+    amzDate    string
+    scope      string
+    signingKey []byte
+    signature  string
+    // payloadHash is x-amz-content-sha256, or UNSIGNED-PAYLOAD.
+    payloadHash string
+}
+
+// authenticate verifies a Signature Version 4 request, signed either in the
+// Authorization header or in the query string of a presigned URL.
+func authenticate(r *http.Request) (*credential, *apiError) {
+    query := r.URL.Query()
+    if query.Get("X-Amz-Algorithm") != "" {
+        return authenticatePresigned(r, query)
+    }
+
+    header := r.Header.Get("Authorization")
+    if header == "" {
+        return nil, errAccessDenied
+    }
+    algorithm, fields, _ := strings.Cut(header, " ")
+    if algorithm != signingAlgorithm {
+        return nil, errSignatureVersion
+    }
+
+    values := map[string]string{}
+    for _, field := range strings.Split(fields, ",") {
+        name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+        values[name] = value
+    }
+
+    amzDate := r.Header.Get("X-Amz-Date")
+    if amzDate == "" {
+        if date, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+            amzDate = date.UTC().Format(amzDateFormat)
+        }
+    }
+    signedAt, err := time.Parse(amzDateFormat, amzDate)
+    if err != nil {
+        return nil, errMissingDate
+    }
+    if skew := now().Sub(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+        return nil, errTimeSkewed
+    }
+
+    payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+    if payloadHash == "" {
+        return nil, errMissingContentSHA
+    }
+
+    return verify(r, query, values["Credential"], values["SignedHeaders"], values["Signature"], amzDate, payloadHash)
+}
+
+func authenticatePresigned(r *http.Request, query url.Values) (*credential, *apiError) {
+    if query.Get("X-Amz-Algorithm") != signingAlgorithm {
+        return nil, errSignatureVersion
+    }
+    amzDate := query.Get("X-Amz-Date")
+    signedAt, err := time.Parse(amzDateFormat, amzDate)
+    if err != nil {
+        return nil, errMissingDate
+    }
+    expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+    if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+        return nil, errAuthorizationQuery
+    }
+    if now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+        return nil, errRequestExpired
+    }
+    if signedAt.Sub(now()) > maxClockSkew {
+        return nil, errTimeSkewed
+    }
+
+    payloadHash := query.Get("X-Amz-Content-Sha256")
+    if payloadHash == "" {
+        payloadHash = unsignedPayload
+    }
+    return verify(r, query, query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"),
+        query.Get("X-Amz-Signature"), amzDate, payloadHash)
+}
+
+func verify(r *http.Request, query url.Values, credentialField, signedHeaders, signature, amzDate, payloadHash string) (*credential, *apiError) {
+    // Credential is <access key>/<date>/<region>/s3/aws4_request.
+    parts := strings.Split(credentialField, "/")
+    if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+        return nil, errAuthorizationHeader
+    }
+    if !strings.HasPrefix(amzDate, parts[1]) {
+        return nil, errAuthorizationHeader
+    }
+
+    // An unsigned host would let a signature captured for another server
+    // be replayed against this one.
+    headerNames := strings.Split(signedHeaders, ";")
+    if !slices.Contains(headerNames, "host") {
+        return nil, errHostNotSigned
+    }
+
+    username, secret, ok := lookupAccessKey(parts[0])
+    if !ok {
+        return nil, errInvalidAccessKey
+    }
+
+    scope := strings.Join(parts[1:], "/")
+    canonical := canonicalRequest(r, query, headerNames, payloadHash)
+    stringToSign := strings.Join([]string{
+        signingAlgorithm,
+        amzDate,
+        scope,
+        sha256Hex([]byte(canonical)),
+    }, "\n")
+
+    key := hmacSHA256([]byte("AWS4"+secret), parts[1])
+    key = hmacSHA256(key, parts[2])
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+    if !hmac.Equal([]byte(expected), []byte(signature)) {
+        return nil, errSignatureMismatch
+    }
+    if err := partners.CheckAccess(username, partners.ProtocolS3, r.RemoteAddr); err != nil {
+        return nil, errAccessDenied
+    }
+
+    return &credential{
+        username:    username,
+        accessKey:   parts[0],
+        amzDate:     amzDate,
+        scope:       scope,
+        signingKey:  key,
+        signature:   signature,
+        payloadHash: payloadHash,
+    }, nil
+}
+
+func canonicalRequest(r *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+    keys := make([]string, 0, len(query))
+    for key := range query {
+        if key != "X-Amz-Signature" {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    var pairs []string
+    for _, key := range keys {
+        values := append([]string(nil), query[key]...)
+        sort.Strings(values)
+        for _, value := range values {
+            pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+        }
+    }
+
+    var headers strings.Builder
+    for _, name := range signedHeaders {
+        var value string
+        switch name {
+        case "host":
+            value = r.Host
+        case "content-length":
+            value = r.Header.Get("Content-Length")
+            if value == "" {
+                value = strconv.FormatInt(r.ContentLength, 10)
+            }
+        case "transfer-encoding":
+            value = strings.Join(r.TransferEncoding, ",")
+        default:
+            values := r.Header.Values(name)
+            for i, v := range values {
+                values[i] = strings.Join(strings.Fields(v), " ")
+            }
+            value = strings.Join(values, ",")
+        }
+        headers.WriteString(name + ":" + value + "\n")
+    }
+
+    return strings.Join([]string{
+        r.Method,
+        uriEncode(r.URL.Path, false),
+        strings.Join(pairs, "&"),
+        headers.String(),
+        strings.Join(signedHeaders, ";"),
+        payloadHash,
+    }, "\n")
+}
+
+// uriEncode escapes everything but unreserved characters, as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+            c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+            b.WriteByte(c)
+        default:
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// body returns the request payload, checked against what was signed: a
+// SHA-256 of the whole body, or signatures of aws-chunked chunks.
+func (c *credential) body(r *http.Request) (io.Reader, *apiError) {
+    switch c.payloadHash {
+    case unsignedPayload:
+        return r.Body, nil
+    case streamingPayload, streamingPayloadTrailer:
+        return &chunkedReader{r: bufio.NewReader(r.Body), cred: c, prevSignature: c.signature, trailer: c.payloadHash == streamingPayloadTrailer}, nil
+    case streamingUnsignedTrailer:
+        return &chunkedReader{r: bufio.NewReader(r.Body), trailer: true}, nil
+    }
+    if _, err := hex.DecodeString(c.payloadHash); err != nil || len(c.payloadHash) != 64 {
+        return nil, errInvalidContentSHA
+    }
+    return &hashReader{r: r.Body, hash: sha256.New(), expected: c.payloadHash}, nil
+}
+
+var (
+    errContentSHAMismatch = errors.New("payload does not match x-amz-content-sha256")
+    errChunkSignature     = errors.New("chunk signature does not match")
+)
+
+// hashReader fails at the end of the body when its SHA-256 is not the
+// signed one.
+type hashReader struct {
+    r        io.Reader
+    hash     hash.Hash
+    expected string
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+    n, err := h.r.Read(p)
+    h.hash.Write(p[:n])
+    if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+        return n, errContentSHAMismatch
+    }
+    return n, err
+}
+
+// chunkedReader decodes an aws-chunked body:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ... 0[;...]\r\n[trailers]\r\n
+//
+// With a credential every chunk's signature is checked, chained to the one
+// before it. Trailing checksums are read and ignored.
+type chunkedReader struct {
+    r             *bufio.Reader
+    cred          *credential
+    prevSignature string
+    trailer       bool
+
+    remaining int64
+    signature string
+    hash      hash.Hash
+    done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+    if c.done {
+        return 0, io.EOF
+    }
+    if c.remaining == 0 {
+        if err := c.nextChunk(); err != nil {
+            return 0, err
+        }
+        if c.done {
+            return 0, io.EOF
+        }
+    }
+
+    if int64(len(p)) > c.remaining {
+        p = p[:c.remaining]
+    }
+    n, err := c.r.Read(p)
+    c.remaining -= int64(n)
+    if c.hash != nil {
+        c.hash.Write(p[:n])
+    }
+    if err == io.EOF {
+        return n, io.ErrUnexpectedEOF
+    }
+    if err != nil {
+        return n, err
+    }
+    if c.remaining == 0 {
+        if err := c.endChunk(); err != nil {
+            return n, err
+        }
+    }
+    return n, nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+    line, err := c.readLine()
+    if err != nil {
+        return err
+    }
+    sizeField, extension, _ := strings.Cut(line, ";")
+    size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+    if err != nil || size < 0 {
+        return fmt.Errorf("invalid chunk size %q", sizeField)
+    }
+    c.signature = strings.TrimPrefix(extension, "chunk-signature=")
+    if c.cred != nil && c.signature == extension {
+        return errChunkSignature
+    }
+    c.remaining = size
+    if c.cred != nil {
+        c.hash = sha256.New()
+    }
+
+    if size > 0 {
+        return nil
+    }
+    // The final, empty chunk is signed like the others.
+    if err := c.checkSignature(); err != nil {
+        return err
+    }
+    c.done = true
+    if !c.trailer {
+        _, err := c.readLine()
+        return err
+    }
+    for {
+        line, err := c.readLine()
+        if err != nil || line == "" {
+            return err
+        }
+    }
+}
+
+func (c *chunkedReader) endChunk() error {
+    if line, err := c.readLine(); err != nil || line != "" {
+        return fmt.Errorf("malformed chunk")
+    }
+    return c.checkSignature()
+}
+
+func (c *chunkedReader) checkSignature() error {
+    if c.cred == nil {
+        return nil
+    }
+    stringToSign := strings.Join([]string{
+        "AWS4-HMAC-SHA256-PAYLOAD",
+        c.cred.amzDate,
+        c.cred.scope,
+        c.prevSignature,
+        emptySHA256,
+        hex.EncodeToString(c.hash.Sum(nil)),
+    }, "\n")
+    expected := hex.EncodeToString(hmacSHA256(c.cred.signingKey, stringToSign))
+    if !hmac.Equal([]byte(expected), []byte(c.signature)) {
+        return errChunkSignature
+    }
+    c.prevSignature = c.signature
+    return nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+    line, err := c.r.ReadSlice('\n')
+    if err != nil {
+        if err == io.EOF {
+            return "", io.ErrUnexpectedEOF
+        }
+        return "", err
+    }
+    return string(bytes.TrimRight(line, "\r\n")), nil
+}
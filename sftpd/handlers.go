@@ -0,0 +1,133 @@
+package sftpd
+
+import (
+    "LunaTransfer/vfs"
+    "errors"
+    "io"
+    "os"
+    "time"
+    "github.com/pkg/sftp"
+)
+
+// handlers adapts a vfs.FS to the request-based sftp server.
+type handlers struct {
+    fs *vfs.FS
+}
+
+func newHandlers(fs *vfs.FS) sftp.Handlers {
+    h := &handlers{fs: fs}
+    return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+    file, err := h.fs.Open(r.Filepath)
+    if err != nil {
+        return nil, translate(err)
+    }
+    return file, nil
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+    flags := r.Pflags()
+    flag := 0
+    if flags.Trunc {
+        flag |= os.O_TRUNC
+    }
+    if flags.Excl {
+        flag |= os.O_EXCL
+    }
+    // Appends arrive as WriteAt at the current size, so O_APPEND is not set
+    // on the file itself.
+    file, err := h.fs.Create(r.Filepath, flag)
+    if err != nil {
+        return nil, translate(err)
+    }
+    return file, nil
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+    var err error
+    switch r.Method {
+    case "Setstat":
+        err = h.setstat(r)
+    case "Rename":
+        err = h.fs.Rename(r.Filepath, r.Target, false)
+    case "Rmdir", "Remove":
+        err = h.fs.Remove(r.Filepath)
+    case "Mkdir":
+        err = h.fs.Mkdir(r.Filepath)
+    default:
+        return sftp.ErrSSHFxOpUnsupported
+    }
+    return translate(err)
+}
+
+// PosixRename replaces an existing target, as the posix-rename extension
+// asks for.
+func (h *handlers) PosixRename(r *sftp.Request) error {
+    return translate(h.fs.Rename(r.Filepath, r.Target, true))
+}
+
+// setstat applies size and time changes; ownership and permission bits have
+// no meaning in LunaTransfer and are ignored so that clients like scp -p work.
+func (h *handlers) setstat(r *sftp.Request) error {
+    flags := r.AttrFlags()
+    attrs := r.Attributes()
+    if flags.Size {
+        if err := h.fs.Truncate(r.Filepath, int64(attrs.Size)); err != nil {
+            return err
+        }
+    }
+    if flags.Acmodtime {
+        atime := time.Unix(int64(attrs.Atime), 0)
+        mtime := time.Unix(int64(attrs.Mtime), 0)
+        if err := h.fs.Chtimes(r.Filepath, atime, mtime); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+    switch r.Method {
+    case "List":
+        infos, err := h.fs.ReadDir(r.Filepath)
+        if err != nil {
+            return nil, translate(err)
+        }
+        return listerAt(infos), nil
+    case "Stat":
+        info, err := h.fs.Stat(r.Filepath)
+        if err != nil {
+            return nil, translate(err)
+        }
+        return listerAt{info}, nil
+    }
+    return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+    if offset >= int64(len(l)) {
+        return 0, io.EOF
+    }
+    n := copy(ls, l[offset:])
+    if n < len(ls) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// translate maps vfs errors to SFTP status codes.
+func translate(err error) error {
+    switch {
+    case err == nil:
+        return nil
+    case errors.Is(err, os.ErrNotExist):
+        return sftp.ErrSSHFxNoSuchFile
+    case errors.Is(err, os.ErrPermission):
+        return sftp.ErrSSHFxPermissionDenied
+    }
+    return err
+}
@@ -0,0 +1,223 @@
+// Package sftpd serves LunaTransfer storage over SFTP. Users log in with their
+// LunaTransfer password or one of their authorized keys and see the tree
+// described in package vfs.
+package sftpd
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/partners"
+    "LunaTransfer/utils"
+    "LunaTransfer/vfs"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// Start listens for SFTP connections until ctx is cancelled. It returns at
+// once when SFTP is disabled.
+func Start(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil || !appConfig.SFTP.Enabled {
+        return
+    }
+
+    serverConfig, err := newServerConfig(appConfig.SFTP)
+    if err != nil {
+        utils.LogError("SFTP_ERROR", err, "system", "Failed to prepare SFTP server")
+        log.Printf("SFTP server not started: %v", err)
+        return
+    }
+
+    listener, err := net.Listen("tcp", fmt.Sprintf(":%d", appConfig.SFTP.Port))
+    if err != nil {
+        utils.LogError("SFTP_ERROR", err, "system", "Failed to listen for SFTP")
+        log.Printf("SFTP server not started: %v", err)
+        return
+    }
+    utils.LogSystem("SFTP_START", "system", "localhost",
+        fmt.Sprintf("SFTP server listening on port %d", appConfig.SFTP.Port))
+    log.Printf("LunaTransfer SFTP server is running on :%d", appConfig.SFTP.Port)
+
+    var wg sync.WaitGroup
+    go func() {
+        <-ctx.Done()
+        listener.Close()
+    }()
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if ctx.Err() != nil {
+                break
+            }
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                time.Sleep(100 * time.Millisecond)
+                continue
+            }
+            utils.LogError("SFTP_ERROR", err, "system", "Failed to accept SFTP connection")
+            break
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            handleConn(ctx, conn, serverConfig)
+        }()
+    }
+    wg.Wait()
+}
+
+func newServerConfig(cfg config.SFTPConfig) (*ssh.ServerConfig, error) {
+    hostKey, err := loadHostKey(cfg.HostKeyFile)
+    if err != nil {
+        return nil, err
+    }
+
+    serverConfig := &ssh.ServerConfig{
+        ServerVersion: "SSH-2.0-LunaTransfer",
+        PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+            if _, err := auth.AuthenticatePublicKey(meta.User(), key); err != nil {
+                return nil, err
+            }
+            if err := partners.CheckAccess(meta.User(), partners.ProtocolSFTP, meta.RemoteAddr().String()); err != nil {
+                return nil, err
+            }
+            return loginPermissions("publickey "+ssh.FingerprintSHA256(key)), nil
+        },
+    }
+    if !cfg.DisablePasswordAuth {
+        serverConfig.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+            if _, _, err := auth.AuthenticateUser(meta.User(), string(password)); err != nil {
+                return nil, err
+            }
+            if err := partners.CheckAccess(meta.User(), partners.ProtocolSFTP, meta.RemoteAddr().String()); err != nil {
+                return nil, err
+            }
+            return loginPermissions("password"), nil
+        }
+    }
+    serverConfig.AuthLogCallback = func(meta ssh.ConnMetadata, method string, err error) {
+        if err != nil && method != "none" {
+            utils.LogSystem("SFTP_LOGIN_FAILED", meta.User(), meta.RemoteAddr().String(),
+                fmt.Sprintf("Failed %s login", method))
+        }
+    }
+    serverConfig.AddHostKey(hostKey)
+    return serverConfig, nil
+}
+
+func loginPermissions(method string) *ssh.Permissions {
+    return &ssh.Permissions{Extensions: map[string]string{"auth-method": method}}
+}
+
+// loadHostKey reads the server's private key, generating an Ed25519 key on
+// first start so the fingerprint stays stable across restarts.
+func loadHostKey(path string) (ssh.Signer, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        _, private, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        block, err := ssh.MarshalPrivateKey(private, "LunaTransfer SFTP host key")
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(block)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            return nil, err
+        }
+        if err := os.WriteFile(path, data, 0600); err != nil {
+            return nil, err
+        }
+        utils.LogSystem("SFTP_HOST_KEY_CREATED", "system", "localhost",
+            fmt.Sprintf("Generated SFTP host key %s", path))
+    } else if err != nil {
+        return nil, err
+    }
+    return ssh.ParsePrivateKey(data)
+}
+
+func handleConn(ctx context.Context, nConn net.Conn, serverConfig *ssh.ServerConfig) {
+    defer nConn.Close()
+    remoteAddr := nConn.RemoteAddr().String()
+
+    nConn.SetDeadline(time.Now().Add(handshakeTimeout))
+    conn, chans, reqs, err := ssh.NewServerConn(nConn, serverConfig)
+    if err != nil {
+        return
+    }
+    nConn.SetDeadline(time.Time{})
+    defer conn.Close()
+
+    username := conn.User()
+    client := fmt.Sprintf("SFTP (%s)", strings.TrimPrefix(string(conn.ClientVersion()), "SSH-2.0-"))
+    utils.LogSystem("SFTP_LOGIN", username, remoteAddr,
+        fmt.Sprintf("Logged in with %s using %s", conn.Permissions.Extensions["auth-method"], client))
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        select {
+        case <-ctx.Done():
+            conn.Close()
+        case <-done:
+        }
+    }()
+    go ssh.DiscardRequests(reqs)
+
+    for newChannel := range chans {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            continue
+        }
+        go serveSession(username, remoteAddr, client, channel, requests)
+    }
+    utils.LogSystem("SFTP_LOGOUT", username, remoteAddr, "SFTP session closed")
+}
+
+// serveSession runs the sftp subsystem; shells and commands are refused.
+func serveSession(username, remoteAddr, client string, channel ssh.Channel, requests <-chan *ssh.Request) {
+    defer channel.Close()
+
+    for req := range requests {
+        if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+            req.Reply(false, nil)
+            continue
+        }
+        req.Reply(true, nil)
+        go ssh.DiscardRequests(requests)
+
+        fs, err := vfs.New(username, remoteAddr, client)
+        if err != nil {
+            utils.LogError("SFTP_ERROR", err, username, "Failed to open user storage")
+            return
+        }
+        server := sftp.NewRequestServer(channel, newHandlers(fs), sftp.WithStartDirectory("/"+vfs.HomeDir))
+        if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+            log.Printf("SFTP session for %s ended: %v", username, err)
+        }
+        server.Close()
+        return
+    }
+}
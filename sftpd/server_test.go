@@ -0,0 +1,213 @@
+package sftpd
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/partners"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "net"
+    "path/filepath"
+    "testing"
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+const testPassword = "Sftp123456"
+
+var clientKey ssh.Signer
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, []testenv.User{
+        {Username: "sftpuser", Password: testPassword, Email: "sftp@example.com", Role: auth.RoleUser},
+        {Username: "partnerlocal", Password: testPassword, Email: "local@example.com", Role: auth.RoleUser},
+        {Username: "partnerremote", Password: testPassword, Email: "remote@example.com", Role: auth.RoleUser},
+        {Username: "partnerftp", Password: testPassword, Email: "ftp@example.com", Role: auth.RoleUser},
+    }, setup)
+}
+
+func setup() error {
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return err
+    }
+    clientKey, err = ssh.NewSignerFromKey(private)
+    if err != nil {
+        return err
+    }
+    if _, err := auth.AddAuthorizedKey("sftpuser", string(ssh.MarshalAuthorizedKey(clientKey.PublicKey()))); err != nil {
+        return err
+    }
+
+    for _, p := range []partners.Partner{
+        {Name: "Local", Users: []string{"partnerlocal"}, Protocols: []string{partners.ProtocolSFTP}, IPRanges: []string{"127.0.0.0/8"}},
+        {Name: "Remote", Users: []string{"partnerremote"}, IPRanges: []string{"192.0.2.0/24"}},
+        {Name: "FTP only", Users: []string{"partnerftp"}, Protocols: []string{partners.ProtocolFTP}},
+    } {
+        p.Normalize()
+        if err := p.Validate(); err != nil {
+            return err
+        }
+        if err := partners.CreatePartner(&p, "admin"); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// startServer serves SFTP on a loopback port until the test ends and
+// returns its address.
+func startServer(t *testing.T, disablePasswordAuth bool) string {
+    t.Helper()
+    serverConfig, err := newServerConfig(config.SFTPConfig{
+        HostKeyFile:         filepath.Join(t.TempDir(), "host_key"),
+        DisablePasswordAuth: disablePasswordAuth,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(func() {
+        cancel()
+        listener.Close()
+    })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go handleConn(ctx, conn, serverConfig)
+        }
+    }()
+    return listener.Addr().String()
+}
+
+func dial(addr, username string, methods ...ssh.AuthMethod) (*ssh.Client, error) {
+    return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+        User:            username,
+        Auth:            methods,
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+    })
+}
+
+func TestPasswordLogin(t *testing.T) {
+    addr := startServer(t, false)
+
+    client, err := dial(addr, "sftpuser", ssh.Password(testPassword))
+    if err != nil {
+        t.Fatalf("login with the right password failed: %v", err)
+    }
+    client.Close()
+
+    if client, err := dial(addr, "sftpuser", ssh.Password("wrong-password")); err == nil {
+        client.Close()
+        t.Fatal("login with a wrong password succeeded")
+    }
+}
+
+func TestDisablePasswordAuth(t *testing.T) {
+    addr := startServer(t, true)
+
+    if client, err := dial(addr, "sftpuser", ssh.Password(testPassword)); err == nil {
+        client.Close()
+        t.Fatal("password login succeeded with password authentication disabled")
+    }
+    client, err := dial(addr, "sftpuser", ssh.PublicKeys(clientKey))
+    if err != nil {
+        t.Fatalf("key login failed with password authentication disabled: %v", err)
+    }
+    client.Close()
+}
+
+func TestPublicKeyLogin(t *testing.T) {
+    addr := startServer(t, false)
+
+    client, err := dial(addr, "sftpuser", ssh.PublicKeys(clientKey))
+    if err != nil {
+        t.Fatalf("login with an authorized key failed: %v", err)
+    }
+    client.Close()
+
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherKey, err := ssh.NewSignerFromKey(private)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if client, err := dial(addr, "sftpuser", ssh.PublicKeys(otherKey)); err == nil {
+        client.Close()
+        t.Fatal("login with an unknown key succeeded")
+    }
+    if client, err := dial(addr, "partnerlocal", ssh.PublicKeys(clientKey)); err == nil {
+        client.Close()
+        t.Fatal("login with another user's key succeeded")
+    }
+}
+
+func TestPartnerAccess(t *testing.T) {
+    addr := startServer(t, false)
+
+    tests := []struct {
+        username string
+        allowed  bool
+    }{
+        {"partnerlocal", true},
+        {"partnerremote", false},
+        {"partnerftp", false},
+    }
+    for _, tt := range tests {
+        client, err := dial(addr, tt.username, ssh.Password(testPassword))
+        if err == nil {
+            client.Close()
+        }
+        if allowed := err == nil; allowed != tt.allowed {
+            t.Errorf("%s: login allowed = %v, want %v (%v)", tt.username, allowed, tt.allowed, err)
+        }
+    }
+}
+
+func TestOnlySFTPSubsystem(t *testing.T) {
+    addr := startServer(t, false)
+    client, err := dial(addr, "sftpuser", ssh.Password(testPassword))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    session, err := client.NewSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := session.RequestSubsystem("netconf"); err == nil {
+        t.Error("netconf subsystem was accepted")
+    }
+    if err := session.Shell(); err == nil {
+        t.Error("shell was accepted")
+    }
+    if err := session.Start("ls"); err == nil {
+        t.Error("command was accepted")
+    }
+    session.Close()
+
+    if _, _, err := client.OpenChannel("direct-tcpip", nil); err == nil {
+        t.Error("direct-tcpip channel was accepted")
+    }
+
+    sftpClient, err := sftp.NewClient(client)
+    if err != nil {
+        t.Fatalf("sftp subsystem was refused: %v", err)
+    }
+    defer sftpClient.Close()
+    if _, err := sftpClient.ReadDir("/home"); err != nil {
+        t.Errorf("failed to list the home folder: %v", err)
+    }
+}
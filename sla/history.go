@@ -0,0 +1,113 @@
+package sla
+
+import (
+    "LunaTransfer/store"
+    "sync"
+    "time"
+)
+
+const maxRecords = 10000
+
+const (
+    // A window is pending until its deadline, then overdue until the file
+    // arrives, late, or the window closes without it, missing. Open windows
+    // of SLAs that are disabled or deleted are cancelled.
+    StatusPending   = "pending"
+    StatusOverdue   = "overdue"
+    StatusOnTime    = "on_time"
+    StatusLate      = "late"
+    StatusMissing   = "missing"
+    StatusCancelled = "cancelled"
+)
+
+var historyMutex sync.Mutex
+
+// Record is one delivery window of an SLA. ClosesAt is when the next window
+// opens, or zero if the schedule never fires again.
+type Record struct {
+    ID        string     `json:"id"`
+    SLAID     string     `json:"sla_id"`
+    SLAName   string     `json:"sla_name"`
+    PartnerID string     `json:"partner_id,omitempty"`
+    Namespace string     `json:"namespace"`
+    Pattern   string     `json:"pattern"`
+    OpensAt   time.Time  `json:"opens_at"`
+    DueAt     time.Time  `json:"due_at"`
+    ClosesAt  time.Time  `json:"closes_at"`
+    Status    string     `json:"status"`
+    ArrivedAt *time.Time `json:"arrived_at,omitempty"`
+    Path      string     `json:"path,omitempty"`
+    Size      int64      `json:"size,omitempty"`
+    Actor     string     `json:"actor,omitempty"`
+}
+
+func (r Record) open() bool {
+    return r.Status == StatusPending || r.Status == StatusOverdue
+}
+
+// contains reports whether t falls within the window.
+func (r Record) contains(t time.Time) bool {
+    return !t.Before(r.OpensAt) && (r.ClosesAt.IsZero() || t.Before(r.ClosesAt))
+}
+
+// Summary counts settled windows by outcome; Open counts those still waiting.
+type Summary struct {
+    OnTime  int `json:"on_time"`
+    Late    int `json:"late"`
+    Missing int `json:"missing"`
+    Open    int `json:"open"`
+}
+
+func Summarize(records []Record) Summary {
+    var s Summary
+    for _, r := range records {
+        switch r.Status {
+        case StatusOnTime:
+            s.OnTime++
+        case StatusLate:
+            s.Late++
+        case StatusMissing:
+            s.Missing++
+        case StatusPending, StatusOverdue:
+            s.Open++
+        }
+    }
+    return s
+}
+
+const historyFile = "sla_history.json"
+
+func loadRecords() ([]Record, error) {
+    records := []Record{}
+    if err := store.ReadDataFile(historyFile, &records); err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+// saveRecords writes the history, dropping the oldest entries beyond
+// maxRecords.
+func saveRecords(records []Record) error {
+    if len(records) > maxRecords {
+        records = records[len(records)-maxRecords:]
+    }
+    return store.WriteDataFile(historyFile, records)
+}
+
+// ListHistory returns the windows match accepts, newest first.
+func ListHistory(match func(Record) bool, limit int) ([]Record, error) {
+    historyMutex.Lock()
+    records, err := loadRecords()
+    historyMutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    result := []Record{}
+    for i := len(records) - 1; i >= 0 && len(result) < limit; i-- {
+        if match(records[i]) {
+            result = append(result, records[i])
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,242 @@
+package sla
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "LunaTransfer/webhooks"
+    "context"
+    "fmt"
+    "time"
+)
+
+const (
+    checkInterval = time.Minute
+
+    // maxCatchUp bounds the windows opened in one pass, e.g. for a
+    // minutely schedule after a long downtime.
+    maxCatchUp = 1000
+)
+
+// alert is a late or missed window to report once the history is saved.
+type alert struct {
+    sla    SLA
+    record Record
+    missed bool
+}
+
+// Start opens windows and raises alerts every minute until ctx is done.
+func Start(ctx context.Context) {
+    ticker := time.NewTicker(checkInterval)
+    defer ticker.Stop()
+
+    for {
+        if err := check(time.Now(), nil); err != nil {
+            utils.LogError("SLA_ERROR", err, "system", "Failed to check SLAs")
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// HandleEvent settles the open window of every SLA an uploaded file matches.
+func HandleEvent(e events.Event) {
+    if e.Type != events.FileUploaded || e.IsDir {
+        return
+    }
+    if err := check(time.Now(), &e); err != nil {
+        utils.LogError("SLA_ERROR", err, e.Actor, fmt.Sprintf("Failed to check SLAs for %s", e.SourcePath))
+    }
+}
+
+// check brings the history up to now and, given an upload, records it as
+// the arrival for the SLAs it matches.
+func check(now time.Time, upload *events.Event) error {
+    slas, err := ListSLAs()
+    if err != nil {
+        return err
+    }
+    enabled := map[string]SLA{}
+    matched := false
+    for _, s := range slas {
+        if !s.Enabled {
+            continue
+        }
+        enabled[s.ID] = s
+        if upload != nil && s.Matches(upload.Namespace, upload.Path) {
+            matched = true
+        }
+    }
+    if upload != nil && !matched {
+        return nil
+    }
+
+    historyMutex.Lock()
+    records, err := loadRecords()
+    if err != nil {
+        historyMutex.Unlock()
+        return err
+    }
+    // Arrivals come before settling, so a file that lands as its deadline
+    // passes is late, not also reported as not there.
+    records, changed := openWindows(records, enabled, now)
+    if upload != nil && arrive(records, enabled, upload) {
+        changed = true
+    }
+    records, alerts, settled := settle(records, enabled, now)
+    changed = changed || settled
+    if changed {
+        err = saveRecords(records)
+    }
+    historyMutex.Unlock()
+    if err != nil {
+        return err
+    }
+
+    for _, a := range alerts {
+        raise(a)
+    }
+    return nil
+}
+
+// openWindows adds a record for every window of an enabled SLA that opened
+// since its last one. Tracking starts after the SLA was last changed, so
+// re-enabling it or changing its schedule does not count missed windows
+// from before.
+func openWindows(records []Record, enabled map[string]SLA, now time.Time) ([]Record, bool) {
+    last := map[string]time.Time{}
+    for _, r := range records {
+        if r.OpensAt.After(last[r.SLAID]) {
+            last[r.SLAID] = r.OpensAt
+        }
+    }
+
+    changed := false
+    for _, s := range enabled {
+        from := s.UpdatedAt
+        if last[s.ID].After(from) {
+            from = last[s.ID]
+        }
+        for i := 0; i < maxCatchUp; i++ {
+            opens, due, ok := s.windowAfter(from)
+            if !ok || opens.After(now) {
+                break
+            }
+            closes, _, _ := s.windowAfter(opens)
+            records = append(records, Record{
+                ID:        utils.GenerateUUID(),
+                SLAID:     s.ID,
+                SLAName:   s.Name,
+                PartnerID: s.PartnerID,
+                Namespace: s.Namespace,
+                Pattern:   s.Pattern,
+                OpensAt:   opens,
+                DueAt:     due,
+                ClosesAt:  closes,
+                Status:    StatusPending,
+            })
+            from = opens
+            changed = true
+        }
+    }
+    return records, changed
+}
+
+// settle marks open windows overdue once their deadline passed and missing
+// once they closed, and cancels those whose SLA is no longer enabled.
+func settle(records []Record, enabled map[string]SLA, now time.Time) ([]Record, []alert, bool) {
+    var alerts []alert
+    changed := false
+    for i := range records {
+        r := &records[i]
+        if !r.open() {
+            continue
+        }
+        s, ok := enabled[r.SLAID]
+        switch {
+        case !ok:
+            r.Status = StatusCancelled
+        case !r.ClosesAt.IsZero() && !now.Before(r.ClosesAt):
+            r.Status = StatusMissing
+            alerts = append(alerts, alert{sla: s, record: *r, missed: true})
+        case r.Status == StatusPending && now.After(r.DueAt):
+            r.Status = StatusOverdue
+            alerts = append(alerts, alert{sla: s, record: *r})
+        default:
+            continue
+        }
+        changed = true
+    }
+    return records, alerts, changed
+}
+
+// arrive records upload as the file of the open windows it falls in. Further
+// matching files in a settled window change nothing.
+func arrive(records []Record, enabled map[string]SLA, upload *events.Event) bool {
+    changed := false
+    for i := range records {
+        r := &records[i]
+        s, ok := enabled[r.SLAID]
+        if !ok || !r.open() || !r.contains(upload.Timestamp) || !s.Matches(upload.Namespace, upload.Path) {
+            continue
+        }
+        arrivedAt := upload.Timestamp
+        r.ArrivedAt = &arrivedAt
+        r.Path = upload.Path
+        r.Size = upload.Size
+        r.Actor = upload.Actor
+        if arrivedAt.After(r.DueAt) {
+            r.Status = StatusLate
+            utils.LogSystem("SLA_LATE_ARRIVAL", upload.Actor, upload.RemoteAddr,
+                fmt.Sprintf("%s arrived in %s for SLA %s (%s), %s after its deadline",
+                    upload.Path, upload.Namespace, s.Name, s.ID, arrivedAt.Sub(r.DueAt).Round(time.Second)))
+        } else {
+            r.Status = StatusOnTime
+            utils.LogSystem("SLA_MET", upload.Actor, upload.RemoteAddr,
+                fmt.Sprintf("%s arrived in %s for SLA %s (%s), due %s",
+                    upload.Path, upload.Namespace, s.Name, s.ID, r.DueAt.Format(time.RFC3339)))
+        }
+        changed = true
+    }
+    return changed
+}
+
+// raise tells the SLA's recipients and the webhooks subscribed to sla.late
+// or sla.missed.
+func raise(a alert) {
+    r := a.record
+    action := "SLA_LATE"
+    noteType := models.NoteSLALate
+    eventType := webhooks.EventSLALate
+    message := fmt.Sprintf("SLA %s: no file matching %s has arrived in %s, due at %s",
+        a.sla.Name, r.Pattern, r.Namespace, r.DueAt.Format(time.RFC3339))
+    if a.missed {
+        action = "SLA_MISSED"
+        noteType = models.NoteSLAMissed
+        eventType = webhooks.EventSLAMissed
+        message = fmt.Sprintf("SLA %s: no file matching %s arrived in %s for the window due at %s",
+            a.sla.Name, r.Pattern, r.Namespace, r.DueAt.Format(time.RFC3339))
+    }
+
+    utils.LogSystem(action, "system", "localhost", fmt.Sprintf("%s (%s)", message, a.sla.ID))
+    for _, username := range a.sla.Recipients() {
+        utils.NotifyUser(username, models.Notification{
+            Type:      noteType,
+            Message:   message,
+            Namespace: r.Namespace,
+        })
+    }
+    dueAt := r.DueAt
+    webhooks.Dispatch(webhooks.Event{
+        Type:      eventType,
+        Namespace: r.Namespace,
+        Reason:    message,
+        SLAID:     a.sla.ID,
+        SLAName:   a.sla.Name,
+        PartnerID: a.sla.PartnerID,
+        DueAt:     &dueAt,
+    })
+}
@@ -0,0 +1,199 @@
+// Package sla watches for files partners are expected to deliver, such as
+// "the daily settlement file by 06:00". An SLA names a namespace, a filename
+// pattern, a schedule on which each delivery window opens and a deadline
+// after the opening. Uploads matching the pattern settle the current window
+// as on time or late; the monitor alerts through notifications and webhooks
+// when the deadline passes without a file and again when the window closes
+// without one. Every window is kept in the history.
+package sla
+
+import (
+    "LunaTransfer/jobs"
+    "LunaTransfer/store"
+    "errors"
+    "fmt"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    ErrSLANotFound = errors.New("SLA not found")
+
+    slasMutex sync.RWMutex
+)
+
+// SLA expects a file matching Pattern, a glob relative to Namespace, in every
+// window that opens on Schedule (a cron expression evaluated in Timezone, the
+// server's when empty) and is due Deadline after the opening. Namespace
+// defaults to the group of PartnerID. Alerts go to Notify, or to the creator
+// when empty.
+type SLA struct {
+    ID        string    `json:"id"`
+    Name      string    `json:"name"`
+    Enabled   bool      `json:"enabled"`
+    PartnerID string    `json:"partner_id,omitempty"`
+    Namespace string    `json:"namespace"`
+    Pattern   string    `json:"pattern"`
+    Schedule  string    `json:"schedule"`
+    Timezone  string    `json:"timezone,omitempty"`
+    Deadline  string    `json:"deadline"`
+    Notify    []string  `json:"notify,omitempty"`
+    CreatedBy string    `json:"created_by"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *SLA) Normalize() {
+    s.Name = strings.TrimSpace(s.Name)
+    s.Namespace = strings.TrimSpace(s.Namespace)
+    s.Pattern = strings.Trim(strings.TrimSpace(s.Pattern), "/")
+    s.Schedule = strings.TrimSpace(s.Schedule)
+    s.Timezone = strings.TrimSpace(s.Timezone)
+    s.Deadline = strings.TrimSpace(s.Deadline)
+}
+
+func (s SLA) Validate() error {
+    if s.Name == "" {
+        return fmt.Errorf("name is required")
+    }
+    if !strings.HasPrefix(s.Namespace, "user:") && !strings.HasPrefix(s.Namespace, "group:") {
+        return fmt.Errorf("namespace must be user:<name> or group:<id>, or partner_id must be given")
+    }
+    if s.Pattern == "" {
+        return fmt.Errorf("pattern is required")
+    }
+    if _, err := path.Match(s.Pattern, ""); err != nil {
+        return fmt.Errorf("invalid pattern: %w", err)
+    }
+    if _, err := jobs.ParseSchedule(s.Schedule); err != nil {
+        return fmt.Errorf("invalid schedule: %w", err)
+    }
+    if _, err := time.LoadLocation(s.Timezone); err != nil {
+        return fmt.Errorf("invalid timezone: %w", err)
+    }
+    deadline, err := time.ParseDuration(s.Deadline)
+    if err != nil || deadline <= 0 {
+        return fmt.Errorf("deadline must be a positive duration such as 6h or 90m")
+    }
+    return nil
+}
+
+// Matches reports whether a file at rel in namespace is one s expects.
+func (s SLA) Matches(namespace, rel string) bool {
+    if namespace != s.Namespace {
+        return false
+    }
+    ok, _ := path.Match(s.Pattern, rel)
+    return ok
+}
+
+// Recipients are the users alerted about s.
+func (s SLA) Recipients() []string {
+    if len(s.Notify) > 0 {
+        return s.Notify
+    }
+    return []string{s.CreatedBy}
+}
+
+// windowAfter returns the first window opening after t and its deadline. The
+// window closes when the next one opens.
+func (s SLA) windowAfter(t time.Time) (opens, due time.Time, ok bool) {
+    schedule, err := jobs.ParseSchedule(s.Schedule)
+    if err != nil {
+        return opens, due, false
+    }
+    location, err := time.LoadLocation(s.Timezone)
+    if err != nil {
+        return opens, due, false
+    }
+    deadline, err := time.ParseDuration(s.Deadline)
+    if err != nil {
+        return opens, due, false
+    }
+    opens = schedule.Next(t.In(location))
+    if opens.IsZero() {
+        return opens, due, false
+    }
+    return opens, opens.Add(deadline), true
+}
+
+const slasFile = "slas.json"
+
+func loadSLAs() ([]SLA, error) {
+    slas := []SLA{}
+    if err := store.ReadDataFile(slasFile, &slas); err != nil {
+        return nil, err
+    }
+    return slas, nil
+}
+
+func saveSLAs(slas []SLA) error {
+    return store.WriteDataFile(slasFile, slas)
+}
+
+func ListSLAs() ([]SLA, error) {
+    slasMutex.RLock()
+    defer slasMutex.RUnlock()
+
+    return loadSLAs()
+}
+
+func GetSLA(id string) (SLA, error) {
+    slas, err := ListSLAs()
+    if err != nil {
+        return SLA{}, err
+    }
+    for _, s := range slas {
+        if s.ID == id {
+            return s, nil
+        }
+    }
+    return SLA{}, ErrSLANotFound
+}
+
+func CreateSLA(s SLA) error {
+    slasMutex.Lock()
+    defer slasMutex.Unlock()
+
+    slas, err := loadSLAs()
+    if err != nil {
+        return err
+    }
+    return saveSLAs(append(slas, s))
+}
+
+func UpdateSLA(s SLA) error {
+    slasMutex.Lock()
+    defer slasMutex.Unlock()
+
+    slas, err := loadSLAs()
+    if err != nil {
+        return err
+    }
+    for i := range slas {
+        if slas[i].ID == s.ID {
+            slas[i] = s
+            return saveSLAs(slas)
+        }
+    }
+    return ErrSLANotFound
+}
+
+// DeleteSLA removes the SLA; its history stays.
+func DeleteSLA(id string) error {
+    slasMutex.Lock()
+    defer slasMutex.Unlock()
+
+    slas, err := loadSLAs()
+    if err != nil {
+        return err
+    }
+    for i, s := range slas {
+        if s.ID == id {
+            return saveSLAs(append(slas[:i], slas[i+1:]...))
+        }
+    }
+    return ErrSLANotFound
+}
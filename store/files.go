@@ -0,0 +1,74 @@
+package store
+
+import (
+    "LunaTransfer/config"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// Records that are not in the database, such as queues, histories and the
+// settings of optional features, are JSON files in the data directory. Each
+// file is read and replaced whole; callers serialize access with their own
+// locks. Files are written through a temporary file and a rename, so a crash
+// leaves either the old or the new version, and are only readable by the
+// server because some of them hold secrets.
+
+// DataFile returns the path of the file name in the data directory.
+func DataFile(name string) (string, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return "", fmt.Errorf("failed to load config: %w", err)
+    }
+    return filepath.Join(appConfig.GetDataDirectory(), name), nil
+}
+
+// ReadDataFile parses the data file name into v. v is left as it is if the
+// file does not exist or is empty.
+func ReadDataFile(name string, v interface{}) error {
+    file, err := DataFile(name)
+    if err != nil {
+        return err
+    }
+    _, err = readJSONFile(file, v)
+    return err
+}
+
+// WriteDataFile replaces the data file name with v.
+func WriteDataFile(name string, v interface{}) error {
+    file, err := DataFile(name)
+    if err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal %s: %w", name, err)
+    }
+    if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+        return fmt.Errorf("failed to create data directory: %w", err)
+    }
+    tempFile := file + ".tmp"
+    if err := os.WriteFile(tempFile, data, 0600); err != nil {
+        return fmt.Errorf("failed to write %s: %w", name, err)
+    }
+    return os.Rename(tempFile, file)
+}
+
+// readJSONFile parses the JSON file at path into v, and reports false if
+// there is no such file.
+func readJSONFile(path string, v interface{}) (bool, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to read %s: %w", path, err)
+    }
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, v); err != nil {
+            return false, fmt.Errorf("failed to parse %s: %w", path, err)
+        }
+    }
+    return true, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+// Before the database, each kind of record was a JSON file. The packages that
+// own the records import those files at startup with these helpers; records
+// already in the database are kept, and imported files are renamed with a
+// ".migrated" suffix so they are not imported again.
+
+// ReadLegacyFile parses the JSON file at path into v, and reports false if
+// there is no such file.
+func ReadLegacyFile(path string, v interface{}) (bool, error) {
+    return readJSONFile(path, v)
+}
+
+// ArchiveLegacyFile renames an imported file out of the way.
+func ArchiveLegacyFile(path string) error {
+    if err := os.Rename(path, path+".migrated"); err != nil {
+        return fmt.Errorf("failed to archive %s: %w", path, err)
+    }
+    return nil
+}
+
+// ImportStats counts what ImportRecords did with the records it was given.
+type ImportStats struct {
+    // Imported records were added, Remapped of them under a new key.
+    Imported int
+    Remapped int
+    // Existing records were in the database already, from an earlier import
+    // of the same file; Duplicates repeated a record of the same import.
+    Existing   int
+    Duplicates int
+    // Skipped records had no key and could not be given one.
+    Skipped int
+}
+
+// ImportRecords adds records to r under the keys key gives them. Nothing is
+// lost: a record without a key, or whose key an earlier, different record of
+// the same import took, is added under a key derived from its contents and
+// set with rekey. Without rekey, such a key conflict fails the import and
+// records without a key are skipped. Since derived keys depend only on the
+// contents, importing a file again adds nothing. It returns the records it
+// added, as stored.
+func ImportRecords[T any](tx *Tx, r Repository[T], records []T, key func(T) string, rekey func(T, string) T) ([]T, ImportStats, error) {
+    var stats ImportStats
+    var added []T
+    seen := map[string][]byte{}
+    for _, record := range records {
+        data, err := json.Marshal(record)
+        if err != nil {
+            return added, stats, err
+        }
+        k := key(record)
+        if previous, taken := seen[k]; k != "" && taken {
+            if bytes.Equal(previous, data) {
+                stats.Duplicates++
+                continue
+            }
+            if rekey == nil {
+                return added, stats, fmt.Errorf("two different records have the key %q", k)
+            }
+            k = ""
+        }
+        remapped := false
+        if k == "" {
+            if rekey == nil {
+                stats.Skipped++
+                continue
+            }
+            k = derivedKey(data)
+            if _, taken := seen[k]; taken {
+                stats.Duplicates++
+                continue
+            }
+            record = rekey(record, k)
+            remapped = true
+        }
+        seen[k] = data
+
+        _, exists, err := r.Get(tx, k)
+        if err != nil {
+            return added, stats, err
+        }
+        if exists {
+            stats.Existing++
+            continue
+        }
+        if err := r.Put(tx, k, record); err != nil {
+            return added, stats, err
+        }
+        added = append(added, record)
+        stats.Imported++
+        if remapped {
+            stats.Remapped++
+        }
+    }
+    return added, stats, nil
+}
+
+// derivedKey makes a key in the form of a UUID from a record's JSON.
+func derivedKey(data []byte) string {
+    sum := sha256.Sum256(data)
+    h := hex.EncodeToString(sum[:16])
+    return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// String sums up stats for the server log.
+func (s ImportStats) String() string {
+    return fmt.Sprintf("%d imported (%d under a new ID), %d already present, %d duplicates, %d without a key skipped",
+        s.Imported, s.Remapped, s.Existing, s.Duplicates, s.Skipped)
+}
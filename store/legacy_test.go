@@ -0,0 +1,93 @@
+package store
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+type testRecord struct {
+    ID   string `json:"id"`
+    Name string `json:"name"`
+}
+
+// openTestStore opens a database in a temporary directory for one test.
+func openTestStore(t *testing.T) {
+    t.Helper()
+    if err := Open(filepath.Join(t.TempDir(), "test.db")); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { Close() })
+}
+
+func importTestRecords(t *testing.T, records []testRecord, rekey func(testRecord, string) testRecord) ([]testRecord, ImportStats, error) {
+    t.Helper()
+    repo := NewRepository[testRecord](FileShares)
+    var added []testRecord
+    var stats ImportStats
+    err := Update(func(tx *Tx) error {
+        var err error
+        added, stats, err = ImportRecords(tx, repo, records, func(r testRecord) string { return r.ID }, rekey)
+        return err
+    })
+    return added, stats, err
+}
+
+func setID(r testRecord, id string) testRecord {
+    r.ID = id
+    return r
+}
+
+func TestImportRecordsKeepsEveryRecord(t *testing.T) {
+    openTestStore(t)
+    records := []testRecord{
+        {ID: "a", Name: "first"},
+        {ID: "a", Name: "first"},  // the same record twice
+        {ID: "a", Name: "second"}, // another record under a taken ID
+        {Name: "no id"},
+        {Name: "no id"},
+    }
+
+    added, stats, err := importTestRecords(t, records, setID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := ImportStats{Imported: 3, Remapped: 2, Duplicates: 2}
+    if stats != want {
+        t.Fatalf("stats = %+v, want %+v", stats, want)
+    }
+    names := map[string]bool{}
+    for _, record := range added {
+        if record.ID == "" {
+            t.Errorf("record %q was added without an ID", record.Name)
+        }
+        names[record.Name] = true
+    }
+    if len(names) != 3 {
+        t.Errorf("added %v, want first, second and no id", added)
+    }
+
+    // The new IDs depend on the contents, so a second import adds nothing.
+    _, stats, err = importTestRecords(t, records, setID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := (ImportStats{Existing: 3, Duplicates: 2}); stats != want {
+        t.Fatalf("second import: stats = %+v, want %+v", stats, want)
+    }
+}
+
+func TestImportRecordsWithoutRekey(t *testing.T) {
+    openTestStore(t)
+
+    _, stats, err := importTestRecords(t, []testRecord{{ID: "a", Name: "first"}, {Name: "no id"}}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := (ImportStats{Imported: 1, Skipped: 1}); stats != want {
+        t.Fatalf("stats = %+v, want %+v", stats, want)
+    }
+
+    if _, _, err := importTestRecords(t, []testRecord{{ID: "b", Name: "first"}, {ID: "b", Name: "second"}}, nil); err == nil {
+        t.Fatal("conflicting records were imported without an error")
+    }
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+const (
+    metaBucket       = "meta"
+    schemaVersionKey = "schema_version"
+)
+
+// A migration brings the schema to version from the one before. Migrations
+// run in order when the database is opened, each in its own transaction
+// together with the version it reaches. Once released a migration must not
+// change; add a new one instead.
+type migration struct {
+    version     int
+    description string
+    apply       func(tx *bolt.Tx) error
+}
+
+// The initial schema has no records to move: the packages that own them
+// import the JSON files they were kept in before when the server starts.
+var migrations = []migration{
+    {1, "create the buckets", func(tx *bolt.Tx) error {
+        for _, name := range buckets {
+            if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }},
+}
+
+// SchemaVersion is the schema version this server brings databases to.
+func SchemaVersion() int {
+    return migrations[len(migrations)-1].version
+}
+
+func migrate(handle *bolt.DB) error {
+    var current int
+    err := handle.Update(func(tx *bolt.Tx) error {
+        meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+        if err != nil {
+            return err
+        }
+        current, err = readVersion(meta)
+        return err
+    })
+    if err != nil {
+        return fmt.Errorf("failed to read the database schema version: %w", err)
+    }
+    if current > SchemaVersion() {
+        return fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, SchemaVersion())
+    }
+
+    for _, m := range migrations {
+        if m.version <= current {
+            continue
+        }
+        err := handle.Update(func(tx *bolt.Tx) error {
+            if err := m.apply(tx); err != nil {
+                return err
+            }
+            version := strconv.Itoa(m.version)
+            return tx.Bucket([]byte(metaBucket)).Put([]byte(schemaVersionKey), []byte(version))
+        })
+        if err != nil {
+            return fmt.Errorf("database migration %d (%s) failed: %w", m.version, m.description, err)
+        }
+        log.Printf("Database migrated to schema version %d: %s", m.version, m.description)
+    }
+    return nil
+}
+
+func readVersion(meta *bolt.Bucket) (int, error) {
+    value := meta.Get([]byte(schemaVersionKey))
+    if value == nil {
+        return 0, nil
+    }
+    version, err := strconv.Atoi(string(value))
+    if err != nil {
+        return 0, fmt.Errorf("invalid schema version %q", value)
+    }
+    return version, nil
+}
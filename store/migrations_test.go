@@ -0,0 +1,128 @@
+package store
+
+import (
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersion reads the version stored in the database file at path.
+func schemaVersion(t *testing.T, path string) int {
+    t.Helper()
+    handle, err := bolt.Open(path, 0600, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer handle.Close()
+    var version int
+    err = handle.View(func(tx *bolt.Tx) error {
+        version, err = readVersion(tx.Bucket([]byte(metaBucket)))
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return version
+}
+
+func TestOpenCreatesTheSchema(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    if err := Open(path); err != nil {
+        t.Fatal(err)
+    }
+    err := View(func(tx *Tx) error {
+        for _, name := range buckets {
+            if _, err := tx.bucket(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if version := schemaVersion(t, path); version != SchemaVersion() {
+        t.Errorf("schema version %d, want %d", version, SchemaVersion())
+    }
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    if err := Open(path); err != nil {
+        t.Fatal(err)
+    }
+    if err := Update(func(tx *Tx) error {
+        return NewRepository[string](Users).Put(tx, "alice", "kept")
+    }); err != nil {
+        t.Fatal(err)
+    }
+    Close()
+
+    // A newer server adds a migration.
+    previous := migrations
+    t.Cleanup(func() { migrations = previous })
+    next := SchemaVersion() + 1
+    migrations = append(migrations[:len(migrations):len(migrations)], migration{next, "add a bucket", func(tx *bolt.Tx) error {
+        _, err := tx.CreateBucketIfNotExists([]byte("added"))
+        return err
+    }})
+
+    if err := Open(path); err != nil {
+        t.Fatal(err)
+    }
+    var value string
+    err := View(func(tx *Tx) error {
+        if _, err := tx.bucket("added"); err != nil {
+            return err
+        }
+        var err error
+        value, _, err = NewRepository[string](Users).Get(tx, "alice")
+        return err
+    })
+    Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if value != "kept" {
+        t.Errorf("got %q after the upgrade, want the record kept", value)
+    }
+    if version := schemaVersion(t, path); version != next {
+        t.Errorf("schema version %d, want %d", version, next)
+    }
+}
+
+func TestNewerSchemaRefused(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    handle, err := bolt.Open(path, 0600, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = handle.Update(func(tx *bolt.Tx) error {
+        meta, err := tx.CreateBucket([]byte(metaBucket))
+        if err != nil {
+            return err
+        }
+        return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(SchemaVersion()+1)))
+    })
+    handle.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = Open(path)
+    if err == nil {
+        Close()
+        t.Fatal("a database with a newer schema was opened")
+    }
+    if !strings.Contains(err.Error(), "newer than this server supports") {
+        t.Errorf("got %v", err)
+    }
+    // The refused database is left closed and untouched.
+    if version := schemaVersion(t, path); version != SchemaVersion()+1 {
+        t.Errorf("schema version %d after the refusal", version)
+    }
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// Repository reads and writes the records of one bucket as values of type T,
+// stored as JSON under string keys. Every call runs in the transaction it is
+// given, so a caller can combine changes to several repositories.
+type Repository[T any] interface {
+    // Get returns the record under key, and false if there is none.
+    Get(tx *Tx, key string) (T, bool, error)
+    Put(tx *Tx, key string, record T) error
+    // Delete removes the record under key, if any.
+    Delete(tx *Tx, key string) error
+    // Scan calls fn for every record whose key starts with prefix, in key
+    // order. fn must not change the repository; collect keys and change
+    // them once Scan returns.
+    Scan(tx *Tx, prefix string, fn func(key string, record T) error) error
+    // ScanReverse is Scan in reverse key order.
+    ScanReverse(tx *Tx, prefix string, fn func(key string, record T) error) error
+}
+
+// NewRepository returns the Repository of bucket.
+func NewRepository[T any](bucket string) Repository[T] {
+    return bucketRepository[T]{bucket: bucket}
+}
+
+// List returns every record of r whose key starts with prefix, in key order.
+func List[T any](tx *Tx, r Repository[T], prefix string) ([]T, error) {
+    var records []T
+    err := r.Scan(tx, prefix, func(key string, record T) error {
+        records = append(records, record)
+        return nil
+    })
+    return records, err
+}
+
+type bucketRepository[T any] struct {
+    bucket string
+}
+
+func (r bucketRepository[T]) Get(tx *Tx, key string) (T, bool, error) {
+    var record T
+    data, err := tx.get(r.bucket, key)
+    if err != nil || data == nil {
+        return record, false, err
+    }
+    if err := json.Unmarshal(data, &record); err != nil {
+        return record, false, fmt.Errorf("failed to parse %s record %q: %w", r.bucket, key, err)
+    }
+    return record, true, nil
+}
+
+func (r bucketRepository[T]) Put(tx *Tx, key string, record T) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return fmt.Errorf("failed to encode %s record %q: %w", r.bucket, key, err)
+    }
+    return tx.put(r.bucket, key, data)
+}
+
+func (r bucketRepository[T]) Delete(tx *Tx, key string) error {
+    return tx.delete(r.bucket, key)
+}
+
+func (r bucketRepository[T]) Scan(tx *Tx, prefix string, fn func(key string, record T) error) error {
+    return tx.scan(r.bucket, prefix, r.decode(fn))
+}
+
+func (r bucketRepository[T]) ScanReverse(tx *Tx, prefix string, fn func(key string, record T) error) error {
+    return tx.scanReverse(r.bucket, prefix, r.decode(fn))
+}
+
+// decode adapts fn to the raw records of the bucket.
+func (r bucketRepository[T]) decode(fn func(key string, record T) error) func(key string, data []byte) error {
+    return func(key string, data []byte) error {
+        var record T
+        if err := json.Unmarshal(data, &record); err != nil {
+            return fmt.Errorf("failed to parse %s record %q: %w", r.bucket, key, err)
+        }
+        return fn(key, record)
+    }
+}
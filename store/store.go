@@ -0,0 +1,214 @@
+// Package store is LunaTransfer's embedded database. Users, groups, group
+// memberships, file access, file metadata, shares, receipts and checksums
+// live in one bbolt file, each kind in its own bucket of JSON records, so a
+// change rewrites only the records it touches and several changes commit
+// together or not at all.
+// The file is locked while a server has it open, so a second server started
+// on the same data directory fails instead of overwriting the first one's
+// changes. Records kept outside the database are JSON files in the data
+// directory, read and written with DataFile, ReadDataFile and WriteDataFile.
+package store
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+// Buckets, one per kind of record.
+const (
+    Users         = "users"
+    UserAPIKeys   = "user_api_keys" // API key -> username
+    Groups        = "groups"
+    GroupMembers  = "group_members" // "<group ID>/<username>"
+    FileAccess    = "file_access"
+    FileMetadata  = "file_metadata"
+    FileShares    = "file_shares"
+    FileShareKeys = "file_share_keys" // "<target group>/<source path>" -> share ID
+    S3AccessKeys  = "s3_access_keys"  // S3 access key ID -> username
+
+    Receipts         = "receipts"          // "<issued at>/<receipt ID>", oldest first
+    ReceiptIDs       = "receipt_ids"       // receipt ID -> key in Receipts
+    ReceiptDownloads = "receipt_downloads" // "<user>/<namespace>/<path>" -> last download receipt
+    Checksums        = "checksums"         // storage-relative path -> checksum
+)
+
+// buckets are all of the above, which the initial schema creates.
+var buckets = []string{
+    Users, UserAPIKeys, Groups, GroupMembers, FileAccess, FileMetadata, FileShares, FileShareKeys, S3AccessKeys,
+    Receipts, ReceiptIDs, ReceiptDownloads, Checksums,
+}
+
+// openTimeout is how long Open waits for another process to release the
+// database file.
+const openTimeout = 5 * time.Second
+
+var (
+    ErrNotOpen = errors.New("database is not open")
+
+    dbMutex sync.RWMutex
+    db      *bolt.DB
+    dbPath  string
+)
+
+// Tx is a transaction. Records are read and written through a Repository.
+type Tx struct {
+    tx *bolt.Tx
+}
+
+// Open opens the database at path, creating it if needed, and brings its
+// schema up to date.
+func Open(path string) error {
+    dbMutex.Lock()
+    defer dbMutex.Unlock()
+
+    if db != nil {
+        return fmt.Errorf("database %s is already open", dbPath)
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("failed to create database directory: %w", err)
+    }
+    handle, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+    if errors.Is(err, bolt.ErrTimeout) {
+        return fmt.Errorf("database %s is in use by another process", path)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to open database %s: %w", path, err)
+    }
+    if err := migrate(handle); err != nil {
+        handle.Close()
+        return err
+    }
+    db = handle
+    dbPath = path
+    return nil
+}
+
+// Close closes the database, waiting for open transactions to finish.
+func Close() error {
+    dbMutex.Lock()
+    defer dbMutex.Unlock()
+
+    if db == nil {
+        return nil
+    }
+    err := db.Close()
+    db = nil
+    return err
+}
+
+// Path is the file of the open database, or empty if none is open.
+func Path() string {
+    dbMutex.RLock()
+    defer dbMutex.RUnlock()
+
+    return dbPath
+}
+
+// View runs fn in a read-only transaction.
+func View(fn func(tx *Tx) error) error {
+    dbMutex.RLock()
+    defer dbMutex.RUnlock()
+
+    if db == nil {
+        return ErrNotOpen
+    }
+    return db.View(func(tx *bolt.Tx) error {
+        return fn(&Tx{tx: tx})
+    })
+}
+
+// Update runs fn in a read-write transaction, committed if fn returns nil
+// and rolled back otherwise. Only one runs at a time; do not call View or
+// Update from within fn.
+func Update(fn func(tx *Tx) error) error {
+    dbMutex.RLock()
+    defer dbMutex.RUnlock()
+
+    if db == nil {
+        return ErrNotOpen
+    }
+    return db.Update(func(tx *bolt.Tx) error {
+        return fn(&Tx{tx: tx})
+    })
+}
+
+func (t *Tx) bucket(name string) (*bolt.Bucket, error) {
+    b := t.tx.Bucket([]byte(name))
+    if b == nil {
+        return nil, fmt.Errorf("bucket %s does not exist", name)
+    }
+    return b, nil
+}
+
+func (t *Tx) get(bucket, key string) ([]byte, error) {
+    b, err := t.bucket(bucket)
+    if err != nil {
+        return nil, err
+    }
+    return b.Get([]byte(key)), nil
+}
+
+func (t *Tx) put(bucket, key string, data []byte) error {
+    if key == "" {
+        return fmt.Errorf("empty key in bucket %s", bucket)
+    }
+    b, err := t.bucket(bucket)
+    if err != nil {
+        return err
+    }
+    return b.Put([]byte(key), data)
+}
+
+func (t *Tx) delete(bucket, key string) error {
+    b, err := t.bucket(bucket)
+    if err != nil {
+        return err
+    }
+    return b.Delete([]byte(key))
+}
+
+// scan calls fn for every key starting with prefix, in key order. The data
+// is only valid until fn returns.
+func (t *Tx) scan(bucket, prefix string, fn func(key string, data []byte) error) error {
+    b, err := t.bucket(bucket)
+    if err != nil {
+        return err
+    }
+    c := b.Cursor()
+    for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+        if err := fn(string(k), v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// scanReverse is scan in reverse key order.
+func (t *Tx) scanReverse(bucket, prefix string, fn func(key string, data []byte) error) error {
+    b, err := t.bucket(bucket)
+    if err != nil {
+        return err
+    }
+    c := b.Cursor()
+    // No key continues prefix with 0xff, which UTF-8 never contains, so
+    // the key before the one Seek finds is the last one starting with it.
+    k, v := c.Seek([]byte(prefix + "\xff"))
+    if k == nil {
+        k, v = c.Last()
+    } else {
+        k, v = c.Prev()
+    }
+    for ; k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Prev() {
+        if err := fn(string(k), v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -8,6 +8,7 @@ import (
     "log"
     "os"
     "path/filepath"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -18,6 +19,7 @@ var (
     errorLogger     *log.Logger
     accessLogger    *log.Logger
     transferLogger  *log.Logger
+    auditLogger     *log.Logger
     logFiles        []*os.File
     transferLogFile string
     logDir string
@@ -51,11 +53,15 @@ func InitLoggers() error {
     if err := initTransferLogger(currentDate); err != nil {
         return err
     }
+    if err := initAuditLogger(currentDate); err != nil {
+        return err
+    }
     
     systemLogger.Println("⚙️ System logger initialized successfully")
     errorLogger.Println("⚠️ Error logger initialized successfully")
     accessLogger.Println("🔍 Access logger initialized successfully")
     transferLogger.Println("📦 Transfer logger initialized successfully")
+    auditLogger.Println("🔏 Audit logger initialized successfully")
     fmt.Println("[INFO] All loggers initialized successfully")
     return nil
 }
@@ -119,6 +125,21 @@ func initTransferLogger(currentDate string) error {
     return nil
 }
 
+func initAuditLogger(currentDate string) error {
+    auditFile, err := os.OpenFile(
+        filepath.Join(logDir, fmt.Sprintf("audit_%s.log", currentDate)),
+        os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+        0644,
+    )
+    if err != nil {
+        closeLogFiles()
+        return fmt.Errorf("failed to open audit log file: %w", err)
+    }
+    logFiles = append(logFiles, auditFile)
+    auditLogger = log.New(auditFile, "AUDIT:  ", log.Ldate|log.Ltime)
+    return nil
+}
+
 func closeLogFiles() {
     for _, f := range logFiles {
         f.Close()
@@ -160,6 +181,18 @@ func LogError(event string, err error, details ...any) {
         event, err, fmt.Sprint(details...))
 }
 
+// LogAudit records security-relevant changes (revocations, deletions of
+// protected data, policy changes) in a dedicated append-only log.
+func LogAudit(event, username, ip string, details ...any) {
+    if auditLogger == nil {
+        fmt.Printf("[WARNING] Audit logger not initialized. Event: %s User: %s Details: %s\n", 
+            event, username, fmt.Sprint(details...))
+        return
+    }
+    auditLogger.Printf("🔏 [%s] [User: %s] [IP: %s] %s", 
+        event, username, ip, fmt.Sprint(details...))
+}
+
 func LogAccess(method, path, username, ip string, statusCode int, duration time.Duration) {
     if accessLogger == nil {
         fmt.Printf("[WARNING] Access logger not initialized. %s %s [%d] User: %s\n", 
@@ -185,6 +218,8 @@ const (
     OpUpload   TransferOperation = "UPLOAD"
     OpDownload TransferOperation = "DOWNLOAD"
     OpDelete   TransferOperation = "DELETE"
+    OpRename   TransferOperation = "RENAME"
+    OpMkdir    TransferOperation = "MKDIR"
 )
 type TransferLog struct {
     Username    string
@@ -216,6 +251,10 @@ func LogTransfer(t TransferLog) {
         icon = "📥" // Download
     } else if t.Action == string(OpDelete) {
         icon = "🗑️" // Delete
+    } else if t.Action == string(OpRename) {
+        icon = "✏️" // Rename
+    } else if t.Action == string(OpMkdir) {
+        icon = "📁" // Directory
     }
     
     transferLogger.Printf("%s %s [%s] [Status: %s] [User: %s] [File: %s] [Size: %s] [IP: %s] [Duration: %v]",
@@ -239,14 +278,63 @@ func formatFileSize(size int64) string {
 }
 
 func GetUserActivity(username string, limit int) ([]models.FileActivity, error) {
+    return GetActivity(func(activity models.FileActivity) bool {
+        return activity.Username == username
+    }, limit)
+}
+
+// GetActivity returns the latest transfers, newest first, that match.
+func GetActivity(match func(models.FileActivity) bool, limit int) ([]models.FileActivity, error) {
     activities := []models.FileActivity{}
-    
-    logFile, err := os.Open(transferLogFile)
+    if limit <= 0 {
+        return activities, nil
+    }
+    err := ScanActivity(func(activity models.FileActivity) bool {
+        if match(activity) {
+            activities = append(activities, activity)
+        }
+        return len(activities) < limit
+    })
+    return activities, err
+}
+
+// ScanActivity passes the transfers to visit, newest first, until it returns
+// false. Every start on a new day begins a new transfer log, so the logs are
+// read from the most recently written back.
+func ScanActivity(visit func(models.FileActivity) bool) error {
+    logs, err := filepath.Glob(filepath.Join(logDir, "transfer_*.log"))
+    if err != nil {
+        return fmt.Errorf("failed to list log files: %w", err)
+    }
+    modified := make(map[string]time.Time, len(logs))
+    for _, name := range logs {
+        if info, err := os.Stat(name); err == nil {
+            modified[name] = info.ModTime()
+        }
+    }
+    sort.SliceStable(logs, func(i, j int) bool {
+        return modified[logs[i]].After(modified[logs[j]])
+    })
+
+    for _, name := range logs {
+        more, err := scanActivityLog(name, visit)
+        if err != nil {
+            return err
+        }
+        if !more {
+            return nil
+        }
+    }
+    return nil
+}
+
+func scanActivityLog(name string, visit func(models.FileActivity) bool) (bool, error) {
+    logFile, err := os.Open(name)
     if err != nil {
         if os.IsNotExist(err) {
-            return activities, nil
+            return true, nil
         }
-        return nil, fmt.Errorf("failed to open log file: %w", err)
+        return false, fmt.Errorf("failed to open log file: %w", err)
     }
     defer logFile.Close()
 
@@ -257,10 +345,10 @@ func GetUserActivity(username string, limit int) ([]models.FileActivity, error)
     }
     
     if err := scanner.Err(); err != nil {
-        return nil, fmt.Errorf("error reading log file: %w", err)
+        return false, fmt.Errorf("error reading log file: %w", err)
     }
     
-    for i := len(lines) - 1; i >= 0 && len(activities) < limit; i-- {
+    for i := len(lines) - 1; i >= 0; i-- {
         line := lines[i]
         
         parts := strings.Split(line, "|")
@@ -274,26 +362,25 @@ func GetUserActivity(username string, limit int) ([]models.FileActivity, error)
         user := strings.TrimSpace(parts[3])
         remoteIP := strings.TrimSpace(parts[4])
         
-        if user != username {
-            continue
-        }
-        
         var fileSize int64 = 0
         if len(parts) > 5 {
             fileSize, _ = strconv.ParseInt(strings.TrimSpace(parts[5]), 10, 64)
         }
         
-        activities = append(activities, models.FileActivity{
+        activity := models.FileActivity{
             Timestamp: timestamp,
             Operation: operation,
             Filename:  fileName,
             Username:  user,
             RemoteIP:  remoteIP,
             Size:      fileSize,
-        })
+        }
+        if !visit(activity) {
+            return false, nil
+        }
     }
 
-    return activities, nil
+    return true, nil
 }
 
 func LogFileTransfer(operation, filename, username, remoteAddr string, fileSize int64) {
@@ -0,0 +1,59 @@
+package utils
+
+import (
+    "LunaTransfer/config"
+    "errors"
+    "os"
+    "path/filepath"
+)
+
+// ErrQuotaExceeded is returned for writes that would take a user's home
+// folder past user_quota.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// DirectorySize returns the total size of the regular files below dir. A
+// missing directory counts as empty.
+func DirectorySize(dir string) (int64, error) {
+    var total int64
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.Mode().IsRegular() {
+            total += info.Size()
+        }
+        return nil
+    })
+    return total, err
+}
+
+// QuotaUsage returns how many bytes username's home folder holds and the
+// configured user_quota. A quota of 0 or less means there is none, and the
+// folder is then not measured.
+func QuotaUsage(username string) (used, quota int64, err error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return 0, 0, err
+    }
+    if appConfig.UserQuota <= 0 {
+        return 0, appConfig.UserQuota, nil
+    }
+    used, err = DirectorySize(filepath.Join(appConfig.StorageDirectory, username))
+    return used, appConfig.UserQuota, err
+}
+
+// QuotaLeft returns how many more bytes username's home folder may take,
+// or -1 if there is no quota.
+func QuotaLeft(username string) (int64, error) {
+    used, quota, err := QuotaUsage(username)
+    if err != nil || quota <= 0 {
+        return -1, err
+    }
+    if used >= quota {
+        return 0, nil
+    }
+    return quota - used, nil
+}
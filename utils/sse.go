@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"LunaTransfer/common"
+	"LunaTransfer/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sseReplaySize     = 100
+	sseKeepAlive      = 25 * time.Second
+	sseRetryMillis    = 5000
+	sseMaxQueryFilter = 50
+)
+
+var (
+	sseMutex      sync.RWMutex
+	sseClients    = make(map[string][]*sseClient)
+	replayBuffers = make(map[string][]models.Notification)
+)
+
+type sseClient struct {
+	username      string
+	send          chan models.Notification
+	done          chan struct{}
+	once          sync.Once
+	subscriptions []WSSubscription
+}
+
+func (c *sseClient) wants(n models.Notification) bool {
+	if n.Namespace == "" || len(c.subscriptions) == 0 {
+		return true
+	}
+	for _, sub := range c.subscriptions {
+		if sub.matches(n.Namespace, n.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *sseClient) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// rememberForReplay keeps the last sseReplaySize notifications of a user so
+// that a reconnecting stream can resume from Last-Event-ID.
+func rememberForReplay(username string, n models.Notification) {
+	sseMutex.Lock()
+	defer sseMutex.Unlock()
+
+	buf := append(replayBuffers[username], n)
+	if len(buf) > sseReplaySize {
+		buf = buf[len(buf)-sseReplaySize:]
+	}
+	replayBuffers[username] = buf
+}
+
+// replaySince returns the buffered notifications after lastID and whether
+// lastID was still in the buffer.
+func replaySince(username, lastID string) ([]models.Notification, bool) {
+	sseMutex.RLock()
+	defer sseMutex.RUnlock()
+
+	buf := replayBuffers[username]
+	for i, n := range buf {
+		if n.ID == lastID {
+			return append([]models.Notification{}, buf[i+1:]...), true
+		}
+	}
+	return append([]models.Notification{}, buf...), false
+}
+
+func notifySSE(username string, n models.Notification) {
+	sseMutex.RLock()
+	streams := append([]*sseClient{}, sseClients[username]...)
+	sseMutex.RUnlock()
+
+	for _, c := range streams {
+		if !c.wants(n) {
+			continue
+		}
+		select {
+		case c.send <- n:
+		case <-c.done:
+		default:
+			log.Printf("SSE send buffer full for %s, closing stream", username)
+			c.close()
+		}
+	}
+}
+
+// HandleSSE streams the same notifications as /ws as Server-Sent Events.
+// Filters come from repeated namespace (and optional path) query parameters;
+// a reconnect with Last-Event-ID resumes from the replay buffer.
+func HandleSSE(w http.ResponseWriter, r *http.Request) {
+	username, ok := common.GetUsernameFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	subscriptions, err := parseSSEFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := maxConnections()
+	sseMutex.Lock()
+	if len(sseClients[username]) >= limit {
+		sseMutex.Unlock()
+		http.Error(w, "Too many event streams", http.StatusTooManyRequests)
+		return
+	}
+	client := &sseClient{
+		username:      username,
+		send:          make(chan models.Notification, wsSendBuffer),
+		done:          make(chan struct{}),
+		subscriptions: subscriptions,
+	}
+	sseClients[username] = append(sseClients[username], client)
+	sseMutex.Unlock()
+
+	defer func() {
+		client.close()
+		sseMutex.Lock()
+		for i, existing := range sseClients[username] {
+			if existing == client {
+				sseClients[username] = append(sseClients[username][:i], sseClients[username][i+1:]...)
+				break
+			}
+		}
+		if len(sseClients[username]) == 0 {
+			delete(sseClients, username)
+		}
+		sseMutex.Unlock()
+	}()
+
+	// The server-wide WriteTimeout would cut the stream off.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("SSE: cannot clear write deadline: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis)
+	writeSSE(w, "", models.Notification{
+		Type:      "CONNECTED",
+		Message:   "Connected to LunaTransfer notifications",
+		Timestamp: time.Now(),
+	})
+
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		missed, found := replaySince(username, lastID)
+		if !found {
+			writeSSE(w, "", models.Notification{
+				Type:      "RESYNC",
+				Message:   "Some notifications are no longer buffered; reload the inbox",
+				Timestamp: time.Now(),
+			})
+		}
+		for _, n := range missed {
+			if client.wants(n) {
+				writeSSE(w, n.ID, n)
+			}
+		}
+	} else {
+		unread, err := models.GetUnread(username)
+		if err != nil {
+			LogError("SSE_ERROR", err, username, "Failed to load unread notifications")
+		}
+		for _, item := range unread {
+			if client.wants(item.Notification) {
+				writeSSE(w, item.ID, item)
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	LogSystem("SSE_CONNECTED", username, r.RemoteAddr, "Opened event stream")
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.done:
+			return
+		case n := <-client.send:
+			writeSSE(w, n.ID, n)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling notification: %v", err)
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: notification\ndata: %s\n\n", data)
+}
+
+func parseSSEFilters(r *http.Request) ([]WSSubscription, error) {
+	namespaces := r.URL.Query()["namespace"]
+	paths := r.URL.Query()["path"]
+	if len(namespaces) > sseMaxQueryFilter {
+		return nil, fmt.Errorf("too many namespace filters")
+	}
+
+	var subscriptions []WSSubscription
+	for i, namespace := range namespaces {
+		if !strings.HasPrefix(namespace, "user:") && !strings.HasPrefix(namespace, "group:") &&
+			!strings.HasPrefix(namespace, "share:") {
+			return nil, fmt.Errorf("namespace must start with user:, group: or share:")
+		}
+		sub := WSSubscription{Namespace: namespace}
+		if i < len(paths) && paths[i] != "" {
+			sub.Path = strings.TrimPrefix(path.Clean("/"+paths[i]), "/")
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, nil
+}
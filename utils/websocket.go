@@ -1,27 +1,38 @@
 package utils
 
 import (
-	"LunaTransfer/models"
 	"LunaTransfer/common"
+	"LunaTransfer/config"
+	"LunaTransfer/models"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"time"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 50 * time.Second
+	wsSendBuffer = 64
+	wsMaxMessage = 4096
+	wsMaxSubs    = 50
+)
+
 var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     checkOrigin,
 	}
 	clientsMutex sync.RWMutex
-	clients      = make(map[string][]*websocket.Conn)
+	clients      = make(map[string][]*wsClient)
 )
 
 type NotificationType string
@@ -39,6 +50,115 @@ type Notification struct {
 	Timestamp time.Time        `json:"timestamp"`
 }
 
+// WSSubscription narrows which notifications a connection receives. Namespace
+// is "user:<name>", "group:<id>" or "share:<id>"; Path limits it to a folder.
+type WSSubscription struct {
+	Namespace string `json:"namespace"`
+	Path      string `json:"path,omitempty"`
+}
+
+func (s WSSubscription) matches(namespace, p string) bool {
+	if s.Namespace != namespace {
+		return false
+	}
+	return s.Path == "" || p == s.Path || strings.HasPrefix(p, s.Path+"/")
+}
+
+// wsClientMessage is what clients send to manage their subscriptions.
+type wsClientMessage struct {
+	Action    string `json:"action"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+}
+
+// wsClient owns one connection. All writes go through send so that only the
+// writer goroutine touches the socket.
+type wsClient struct {
+	conn     *websocket.Conn
+	username string
+	send     chan []byte
+	done     chan struct{}
+	once     sync.Once
+
+	subsMutex     sync.RWMutex
+	subscriptions []WSSubscription
+}
+
+// wants reports whether the client should receive a notification for
+// namespace/path. Without subscriptions a client receives everything it is
+// entitled to; notifications without a namespace are always delivered.
+func (c *wsClient) wants(namespace, p string) bool {
+	if namespace == "" {
+		return true
+	}
+	c.subsMutex.RLock()
+	defer c.subsMutex.RUnlock()
+	if len(c.subscriptions) == 0 {
+		return true
+	}
+	for _, sub := range c.subscriptions {
+		if sub.matches(namespace, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) enqueue(data []byte) {
+	select {
+	case c.send <- data:
+	case <-c.done:
+	default:
+		// A client that cannot keep up is dropped rather than stalling everyone.
+		log.Printf("WebSocket send buffer full for %s, closing connection", c.username)
+		c.close()
+	}
+}
+
+// checkOrigin accepts non-browser clients (no Origin header), same-origin
+// pages and origins listed in websocket_allowed_origins ("*" allows any).
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	appConfig, err := config.LoadConfig()
+	if err != nil {
+		return false
+	}
+	for _, allowed := range appConfig.WebSocketAllowedOrigins {
+		allowed = strings.TrimRight(strings.TrimSpace(allowed), "/")
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	LogSystem("WEBSOCKET_ORIGIN_REJECTED", "unknown", r.RemoteAddr, fmt.Sprintf("Rejected origin %s", origin))
+	return false
+}
+
+func maxConnections() int {
+	appConfig, err := config.LoadConfig()
+	if err != nil {
+		return config.DefaultWebSocketMaxConnections
+	}
+	return appConfig.WebSocketMaxConnections
+}
+
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	username, ok := common.GetUsernameFromContext(r.Context())
 	if !ok {
@@ -46,97 +166,227 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	limit := maxConnections()
+	clientsMutex.RLock()
+	open := len(clients[username])
+	clientsMutex.RUnlock()
+	if open >= limit {
+		LogSystem("WEBSOCKET_LIMIT", username, r.RemoteAddr,
+			fmt.Sprintf("Rejected connection, %d of %d already open", open, limit))
+		http.Error(w, "Too many WebSocket connections", http.StatusTooManyRequests)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading to websocket: %v", err)
 		return
 	}
 
+	client := &wsClient{
+		conn:     conn,
+		username: username,
+		send:     make(chan []byte, wsSendBuffer),
+		done:     make(chan struct{}),
+	}
+
 	clientsMutex.Lock()
-	if clients[username] == nil {
-		clients[username] = make([]*websocket.Conn, 0)
+	if len(clients[username]) >= limit {
+		clientsMutex.Unlock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many connections"),
+			time.Now().Add(wsWriteWait))
+		conn.Close()
+		return
 	}
-	clients[username] = append(clients[username], conn)
+	clients[username] = append(clients[username], client)
 	clientsMutex.Unlock()
 
-	welcomeMsg := Notification{
+	go handleWebSocketWriter(client)
+	go handleWebSocketReader(client)
+
+	sendJSON(client, models.Notification{
 		Type:      "CONNECTED",
 		Message:   "Connected to LunaTransfer notifications",
 		Timestamp: time.Now(),
-	}
+	})
 
-	if err := conn.WriteJSON(welcomeMsg); err != nil {
-		log.Printf("Error sending welcome message: %v", err)
+	// Replay what arrived while the user was away; they stay unread until
+	// marked through the inbox API.
+	unread, err := models.GetUnread(username)
+	if err != nil {
+		LogError("WEBSOCKET_ERROR", err, username, "Failed to load unread notifications")
+		return
 	}
+	for _, item := range unread {
+		data, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		// Block rather than enqueue so a long backlog cannot overflow the buffer.
+		select {
+		case client.send <- data:
+		case <-client.done:
+			return
+		}
+	}
+}
 
-	go handleWebSocketReader(conn, username)
+func handleWebSocketWriter(c *wsClient) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.close()
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Error sending notification: %v", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
 }
 
-func handleWebSocketReader(conn *websocket.Conn, username string) {
+func handleWebSocketReader(c *wsClient) {
 	defer func() {
-		conn.Close()
+		c.close()
 
 		clientsMutex.Lock()
-		for i, c := range clients[username] {
-			if c == conn {
-				clients[username] = append(clients[username][:i], clients[username][i+1:]...)
+		for i, existing := range clients[c.username] {
+			if existing == c {
+				clients[c.username] = append(clients[c.username][:i], clients[c.username][i+1:]...)
 				break
 			}
 		}
+		if len(clients[c.username]) == 0 {
+			delete(clients, c.username)
+		}
 		clientsMutex.Unlock()
 	}()
 
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
 	for {
-		_, _, err := conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var msg wsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			sendJSON(c, map[string]string{"type": "ERROR", "message": "Invalid message"})
+			continue
+		}
+		handleClientMessage(c, msg)
 	}
 }
 
+func handleClientMessage(c *wsClient, msg wsClientMessage) {
+	sub := WSSubscription{Namespace: msg.Namespace}
+	if msg.Path != "" {
+		sub.Path = strings.TrimPrefix(path.Clean("/"+msg.Path), "/")
+	}
+
+	c.subsMutex.Lock()
+	switch msg.Action {
+	case "subscribe":
+		if !strings.HasPrefix(sub.Namespace, "user:") && !strings.HasPrefix(sub.Namespace, "group:") &&
+			!strings.HasPrefix(sub.Namespace, "share:") {
+			c.subsMutex.Unlock()
+			sendJSON(c, map[string]string{"type": "ERROR", "message": "Namespace must start with user:, group: or share:"})
+			return
+		}
+		if len(c.subscriptions) >= wsMaxSubs {
+			c.subsMutex.Unlock()
+			sendJSON(c, map[string]string{"type": "ERROR", "message": "Too many subscriptions"})
+			return
+		}
+		exists := false
+		for _, existing := range c.subscriptions {
+			if existing == sub {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			c.subscriptions = append(c.subscriptions, sub)
+		}
+	case "unsubscribe":
+		for i, existing := range c.subscriptions {
+			if existing == sub {
+				c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+				break
+			}
+		}
+	case "list":
+	default:
+		c.subsMutex.Unlock()
+		sendJSON(c, map[string]string{"type": "ERROR", "message": "Unknown action"})
+		return
+	}
+	subscriptions := append([]WSSubscription{}, c.subscriptions...)
+	c.subsMutex.Unlock()
+
+	sendJSON(c, map[string]interface{}{
+		"type":          "SUBSCRIPTIONS",
+		"subscriptions": subscriptions,
+	})
+}
+
+func sendJSON(c *wsClient, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling notification: %v", err)
+		return
+	}
+	c.enqueue(data)
+}
+
+// NotifyUser stores notification in the user's inbox and pushes it to every
+// connection of username whose subscriptions match its namespace and path.
+// Callers decide who may see it.
 func NotifyUser(username string, notification models.Notification) {
+	notification.ID = GenerateUUID()
+	notification.Timestamp = time.Now()
+	if err := models.AddToInbox(username, notification); err != nil {
+		LogError("INBOX_ERROR", err, username, "Failed to store notification")
+	}
+	rememberForReplay(username, notification)
+	notifySSE(username, notification)
+
 	clientsMutex.RLock()
-	userConns := clients[username]
+	userConns := append([]*wsClient{}, clients[username]...)
 	clientsMutex.RUnlock()
 	if len(userConns) == 0 {
 		return
 	}
-	notification.Timestamp = time.Now()
 	data, err := json.Marshal(notification)
 	if err != nil {
 		log.Printf("Error marshaling notification: %v", err)
 		return
 	}
-	for _, conn := range userConns {
-		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Error sending notification: %v", err)
+	for _, c := range userConns {
+		if c.wants(notification.Namespace, notification.Path) {
+			c.enqueue(data)
 		}
 	}
 }
-
-func NotifyUpload(filename string) {
-	notification := models.Notification{
-		Type:     models.NoteFileUploaded,
-		Filename: filename,
-		Message:  fmt.Sprintf("New file uploaded: %s", filename),
-	}
-
-	clientsMutex.RLock()
-	for username := range clients {
-		NotifyUser(username, notification)
-	}
-	clientsMutex.RUnlock()
-}
-
-func NotifyFileDeleted(username, filename string) {
-    notification := models.Notification{
-        Type:     models.NoteFileDeleted,
-        Filename: filename,
-        Message:  fmt.Sprintf("File deleted: %s", filename),
-    }
-    
-    NotifyUser(username, notification)
-}
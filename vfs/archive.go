@@ -0,0 +1,132 @@
+package vfs
+
+import (
+    "LunaTransfer/config"
+    "archive/zip"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "strings"
+)
+
+// maxArchiveEntries bounds how many files and folders one archive may hold.
+const maxArchiveEntries = 10000
+
+var (
+    ErrInvalidArchive  = errors.New("not a valid zip archive")
+    errExtractTooLarge = fmt.Errorf("%w: the files take more than max_extract_size", ErrInvalidArchive)
+)
+
+// Extract unpacks the zip archive at archive into folder and returns the
+// number of files written. Entries never leave folder, existing files are
+// never replaced, no entry may be larger than max_file_size and all of them
+// together no larger than max_extract_size. Each file is
+// published as an upload that names the archive, so rules can tell
+// extracted files from others.
+func (fs *FS) Extract(archive, folder string) (int, error) {
+    src, err := fs.resolveFor(archive, ActionRead)
+    if err != nil {
+        return 0, err
+    }
+    if src.kind != kindStorage {
+        return 0, ErrInvalidArchive
+    }
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return 0, err
+    }
+
+    // The archive is read directly rather than through Open, which would
+    // publish a download.
+    reader, err := zip.OpenReader(fs.fullPath(src))
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return 0, err
+        }
+        return 0, ErrInvalidArchive
+    }
+    defer reader.Close()
+    if len(reader.File) > maxArchiveEntries {
+        return 0, fmt.Errorf("%w: more than %d entries", ErrInvalidArchive, maxArchiveEntries)
+    }
+    var declared uint64
+    for _, entry := range reader.File {
+        declared += entry.UncompressedSize64
+        if declared > uint64(appConfig.MaxExtractSize) {
+            return 0, errExtractTooLarge
+        }
+    }
+
+    folder = Clean(folder)
+    if err := fs.MkdirAll(folder); err != nil {
+        return 0, err
+    }
+    written := 0
+    budget := appConfig.MaxExtractSize
+    for _, entry := range reader.File {
+        name := strings.TrimPrefix(Clean(entry.Name), "/")
+        if name == "" {
+            continue
+        }
+        target := path.Join(folder, name)
+        if entry.FileInfo().IsDir() {
+            if err := fs.MkdirAll(target); err != nil {
+                return written, err
+            }
+            continue
+        }
+        if !entry.Mode().IsRegular() {
+            continue
+        }
+        if appConfig.MaxFileSize > 0 && entry.UncompressedSize64 > uint64(appConfig.MaxFileSize) {
+            return written, fmt.Errorf("%w: %s is larger than the maximum file size", ErrInvalidArchive, entry.Name)
+        }
+        if err := fs.MkdirAll(path.Dir(target)); err != nil {
+            return written, err
+        }
+        n, err := fs.extractEntry(entry, target, src.rel, appConfig.MaxFileSize, budget)
+        if err != nil {
+            return written, err
+        }
+        budget -= n
+        written++
+    }
+    return written, nil
+}
+
+// extractEntry writes entry to target and returns its size. budget is what
+// is left of max_extract_size for this archive.
+func (fs *FS) extractEntry(entry *zip.File, target, archive string, maxSize, budget int64) (int64, error) {
+    r, err := entry.Open()
+    if err != nil {
+        return 0, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+    }
+    defer r.Close()
+
+    dst, err := fs.Create(target, os.O_EXCL)
+    if err != nil {
+        return 0, err
+    }
+    dst.archive = archive
+    // The sizes in the archive's directory may lie.
+    limit := budget
+    if maxSize > 0 && maxSize < limit {
+        limit = maxSize
+    }
+    n, err := io.Copy(dst, io.LimitReader(r, limit+1))
+    switch {
+    case err != nil:
+    case maxSize > 0 && n > maxSize:
+        err = fmt.Errorf("%w: %s is larger than the maximum file size", ErrInvalidArchive, entry.Name)
+    case n > budget:
+        err = errExtractTooLarge
+    }
+    if err != nil {
+        dst.Close()
+        fs.Remove(target)
+        return 0, err
+    }
+    return n, dst.Close()
+}
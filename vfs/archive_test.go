@@ -0,0 +1,83 @@
+package vfs
+
+import (
+    "LunaTransfer/config"
+    "archive/zip"
+    "errors"
+    "io"
+    "os"
+    "testing"
+)
+
+func writeArchive(t *testing.T, fs *FS, p string, files map[string]string) {
+    t.Helper()
+    file, err := fs.Create(p, os.O_TRUNC)
+    if err != nil {
+        t.Fatal(err)
+    }
+    archive := zip.NewWriter(file)
+    for name, content := range files {
+        entry, err := archive.Create(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        io.WriteString(entry, content)
+    }
+    if err := archive.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := file.Close(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestExtract(t *testing.T) {
+    fs := withQuota(t, 0)
+    writeArchive(t, fs, "/home/quota/batch.zip", map[string]string{
+        "a.csv":         "1,2,3",
+        "sub/b.csv":     "4,5,6",
+        "../escape.txt": "kept inside",
+    })
+
+    written, err := fs.Extract("/home/quota/batch.zip", "/home/quota/batch")
+    if err != nil || written != 3 {
+        t.Fatalf("extract: got %d files, %v", written, err)
+    }
+    for _, p := range []string{"/home/quota/batch/a.csv", "/home/quota/batch/sub/b.csv", "/home/quota/batch/escape.txt"} {
+        if _, err := fs.Stat(p); err != nil {
+            t.Errorf("%s: %v", p, err)
+        }
+    }
+    if _, err := fs.Stat("/home/quota/escape.txt"); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("entry left the folder: %v", err)
+    }
+
+    if _, err := fs.Extract("/home/quota/batch.zip", "/home/quota/batch"); !errors.Is(err, os.ErrExist) {
+        t.Fatalf("extract over existing files: got %v, want ErrExist", err)
+    }
+}
+
+func TestExtractSizeLimit(t *testing.T) {
+    fs := withQuota(t, 0)
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := appConfig.MaxExtractSize
+    appConfig.MaxExtractSize = 10
+    t.Cleanup(func() { appConfig.MaxExtractSize = previous })
+
+    writeArchive(t, fs, "/home/quota/small.zip", map[string]string{"a.csv": "123456", "b.csv": "1234"})
+    if written, err := fs.Extract("/home/quota/small.zip", "/home/quota/small"); err != nil || written != 2 {
+        t.Fatalf("archive of max_extract_size: got %d files, %v", written, err)
+    }
+
+    writeArchive(t, fs, "/home/quota/large.zip", map[string]string{"a.csv": "123456", "b.csv": "12345"})
+    written, err := fs.Extract("/home/quota/large.zip", "/home/quota/large")
+    if !errors.Is(err, ErrInvalidArchive) || written != 0 {
+        t.Fatalf("archive over max_extract_size: got %d files, %v", written, err)
+    }
+    if _, err := fs.Stat("/home/quota/large/a.csv"); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("a file of a rejected archive was extracted: %v", err)
+    }
+}
@@ -0,0 +1,476 @@
+package vfs
+
+import (
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/retention"
+    "LunaTransfer/utils"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// File is an open file. Closing it publishes the download or upload.
+type File struct {
+    *os.File
+
+    fs          *FS
+    loc         location
+    write       bool
+    archive     string
+    start       time.Time
+    transferred atomic.Int64
+    accessed    atomic.Bool
+    closeOnce   sync.Once
+
+    // With limited set, writes may grow the file by quotaLeft more bytes.
+    // size is how large writes have made the file so far.
+    limited    bool
+    append     bool
+    quotaMutex sync.Mutex
+    quotaLeft  int64
+    size       int64
+}
+
+func (f *File) Read(p []byte) (int, error) {
+    n, err := f.File.Read(p)
+    f.accessed.Store(true)
+    f.transferred.Add(int64(n))
+    return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+    n, err := f.File.ReadAt(p, off)
+    f.accessed.Store(true)
+    f.transferred.Add(int64(n))
+    return n, err
+}
+
+func (f *File) Write(p []byte) (int, error) {
+    if f.limited {
+        off := int64(-1)
+        if !f.append {
+            pos, err := f.File.Seek(0, io.SeekCurrent)
+            if err != nil {
+                return 0, err
+            }
+            off = pos
+        }
+        if err := f.reserve(off, len(p)); err != nil {
+            return 0, err
+        }
+    }
+    n, err := f.File.Write(p)
+    f.transferred.Add(int64(n))
+    return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+    if err := f.reserve(off, len(p)); err != nil {
+        return 0, err
+    }
+    n, err := f.File.WriteAt(p, off)
+    f.transferred.Add(int64(n))
+    return n, err
+}
+
+// ReadFrom and WriteTo hide those of os.File, which io.Copy would otherwise
+// use to move data around Read and Write, so past the quota and without
+// counting it.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+    return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+    return io.Copy(w, struct{ io.Reader }{f})
+}
+
+// reserve fails with utils.ErrQuotaExceeded if writing n bytes at off, or at
+// the end of the file if off is negative, would grow the file past the
+// owner's quota.
+func (f *File) reserve(off int64, n int) error {
+    if !f.limited {
+        return nil
+    }
+    f.quotaMutex.Lock()
+    defer f.quotaMutex.Unlock()
+    if off < 0 {
+        off = f.size
+    }
+    growth := off + int64(n) - f.size
+    if growth <= 0 {
+        return nil
+    }
+    if growth > f.quotaLeft {
+        return utils.ErrQuotaExceeded
+    }
+    f.quotaLeft -= growth
+    f.size += growth
+    return nil
+}
+
+func (f *File) Close() error {
+    var err error
+    f.closeOnce.Do(func() {
+        var size int64
+        if info, statErr := f.File.Stat(); statErr == nil {
+            size = info.Size()
+        }
+        err = f.File.Close()
+        if err != nil {
+            utils.LogError("VFS_ERROR", err, f.fs.Username, fmt.Sprintf("Failed to close %s", f.loc.virtual))
+            return
+        }
+
+        event := events.Event{
+            Actor:       f.fs.Username,
+            RemoteAddr:  f.fs.RemoteAddr,
+            UserAgent:   f.fs.Client,
+            SourcePath:  f.loc.rel,
+            ArchivePath: f.archive,
+            Size:        size,
+            Elapsed:     time.Since(f.start),
+        }
+        if f.loc.share != nil {
+            event.ShareID = f.loc.share.ID
+            event.SharedBy = f.loc.share.SharedBy
+        }
+        if f.write {
+            event.Type = events.FileUploaded
+        } else {
+            // Opening a file only to look at it is not a download.
+            if !f.accessed.Load() {
+                return
+            }
+            event.Type = events.FileDownloaded
+        }
+        events.Publish(event)
+    })
+    return err
+}
+
+// Open opens the file at p for reading.
+func (fs *FS) Open(p string) (*File, error) {
+    loc, err := fs.resolveFor(p, ActionRead)
+    if err != nil {
+        return nil, err
+    }
+    if loc.kind != kindStorage {
+        return nil, &os.PathError{Op: "open", Path: loc.virtual, Err: fmt.Errorf("is a directory")}
+    }
+
+    file, err := os.Open(fs.fullPath(loc))
+    if err != nil {
+        return nil, err
+    }
+    return &File{File: file, fs: fs, loc: loc, start: time.Now()}, nil
+}
+
+// Create opens the file at p for writing, creating it if needed. flag may add
+// os.O_TRUNC, os.O_APPEND or os.O_EXCL. Files under legal hold cannot be
+// written, and writes that would take the owner of a home folder past their
+// quota fail with utils.ErrQuotaExceeded.
+func (fs *FS) Create(p string, flag int) (*File, error) {
+    loc, err := fs.resolveFor(p, ActionWrite)
+    if err != nil {
+        return nil, err
+    }
+    if flag&os.O_EXCL == 0 {
+        if err := fs.checkRetention(retention.CheckOverwrite(loc.rel), "overwrite", loc); err != nil {
+            return nil, err
+        }
+    }
+    if err := fs.ensureNamespace(loc); err != nil {
+        return nil, err
+    }
+
+    left, err := fs.quotaLeft(loc)
+    if err != nil {
+        return nil, err
+    }
+    var size int64
+    if info, err := os.Stat(fs.fullPath(loc)); err == nil {
+        if flag&os.O_TRUNC == 0 {
+            size = info.Size()
+        } else if left >= 0 {
+            // Truncating frees what the file holds now.
+            left += info.Size()
+        }
+    }
+
+    flag &= os.O_TRUNC | os.O_APPEND | os.O_EXCL
+    file, err := os.OpenFile(fs.fullPath(loc), os.O_WRONLY|os.O_CREATE|flag, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &File{
+        File:      file,
+        fs:        fs,
+        loc:       loc,
+        write:     true,
+        start:     time.Now(),
+        limited:   left >= 0,
+        append:    flag&os.O_APPEND != 0,
+        quotaLeft: left,
+        size:      size,
+    }, nil
+}
+
+// Mkdir creates the folder at p.
+func (fs *FS) Mkdir(p string) error {
+    loc, err := fs.resolveFor(p, ActionWrite)
+    if err != nil {
+        return err
+    }
+    if loc.top {
+        return os.ErrExist
+    }
+    if err := fs.ensureNamespace(loc); err != nil {
+        return err
+    }
+    if err := os.Mkdir(fs.fullPath(loc), 0755); err != nil {
+        return err
+    }
+
+    events.Publish(events.Event{
+        Type:       events.DirectoryCreated,
+        Actor:      fs.Username,
+        RemoteAddr: fs.RemoteAddr,
+        UserAgent:  fs.Client,
+        SourcePath: loc.rel,
+        IsDir:      true,
+    })
+    return nil
+}
+
+// MkdirAll creates the folder p and any missing parents.
+func (fs *FS) MkdirAll(p string) error {
+    if info, err := fs.Stat(p); err == nil {
+        if !info.IsDir() {
+            return &os.PathError{Op: "mkdir", Path: Clean(p), Err: fmt.Errorf("not a directory")}
+        }
+        return nil
+    }
+    if parent := path.Dir(Clean(p)); parent != Clean(p) {
+        if err := fs.MkdirAll(parent); err != nil {
+            return err
+        }
+    }
+    if err := fs.Mkdir(p); err != nil && !errors.Is(err, os.ErrExist) {
+        return err
+    }
+    return nil
+}
+
+// Remove deletes the file or empty folder at p.
+func (fs *FS) Remove(p string) error {
+    return fs.remove(p, false)
+}
+
+// RemoveAll deletes p and, for folders, everything below it.
+func (fs *FS) RemoveAll(p string) error {
+    return fs.remove(p, true)
+}
+
+func (fs *FS) remove(p string, recursive bool) error {
+    loc, err := fs.resolveFor(p, ActionDelete)
+    if err != nil {
+        return err
+    }
+    if loc.kind != kindStorage || loc.top {
+        return os.ErrPermission
+    }
+
+    full := fs.fullPath(loc)
+    info, err := os.Stat(full)
+    if err != nil {
+        return err
+    }
+    if err := fs.checkRetention(retention.CheckDelete(loc.rel), "delete", loc); err != nil {
+        return err
+    }
+    if recursive {
+        err = os.RemoveAll(full)
+    } else {
+        err = os.Remove(full)
+    }
+    if err != nil {
+        return err
+    }
+
+    events.Publish(events.Event{
+        Type:       events.FileDeleted,
+        Actor:      fs.Username,
+        RemoteAddr: fs.RemoteAddr,
+        UserAgent:  fs.Client,
+        SourcePath: loc.rel,
+        IsDir:      info.IsDir(),
+        Size:       fileSize(info),
+    })
+    fs.revokeShares(loc.rel, "source deleted")
+    return nil
+}
+
+// Rename moves from to to. Moving needs delete permission at the source and
+// write permission at the destination; an existing destination is only
+// replaced when replace is set, and then also needs delete permission.
+func (fs *FS) Rename(from, to string, replace bool) error {
+    src, err := fs.resolveFor(from, ActionDelete)
+    if err != nil {
+        return err
+    }
+    dst, err := fs.resolveFor(to, ActionWrite)
+    if err != nil {
+        return err
+    }
+    if src.kind != kindStorage || src.top || dst.kind != kindStorage || dst.top {
+        return os.ErrPermission
+    }
+
+    info, err := os.Stat(fs.fullPath(src))
+    if err != nil {
+        return err
+    }
+    if _, err := os.Stat(fs.fullPath(dst)); err == nil {
+        if !replace {
+            return os.ErrExist
+        }
+        if err := fs.authorize(dst, ActionDelete); err != nil {
+            return err
+        }
+        if err := fs.checkRetention(retention.CheckDelete(dst.rel), "replace", dst); err != nil {
+            return err
+        }
+    }
+    if err := fs.checkRetention(retention.CheckMove(src.rel, dst.rel), "move", src); err != nil {
+        return err
+    }
+    if err := fs.ensureNamespace(dst); err != nil {
+        return err
+    }
+    if err := os.Rename(fs.fullPath(src), fs.fullPath(dst)); err != nil {
+        return err
+    }
+
+    events.Publish(events.Event{
+        Type:               events.FileRenamed,
+        Actor:              fs.Username,
+        RemoteAddr:         fs.RemoteAddr,
+        UserAgent:          fs.Client,
+        SourcePath:         dst.rel,
+        PreviousSourcePath: src.rel,
+        IsDir:              info.IsDir(),
+        Size:               fileSize(info),
+    })
+    fs.revokeShares(src.rel, "source moved")
+    return nil
+}
+
+// Chtimes sets the modification time of p, as clients do to preserve it.
+func (fs *FS) Chtimes(p string, atime, mtime time.Time) error {
+    loc, err := fs.resolveFor(p, ActionWrite)
+    if err != nil {
+        return err
+    }
+    if loc.kind != kindStorage {
+        return os.ErrPermission
+    }
+    return os.Chtimes(fs.fullPath(loc), atime, mtime)
+}
+
+// Truncate changes the size of the file at p.
+func (fs *FS) Truncate(p string, size int64) error {
+    loc, err := fs.resolveFor(p, ActionWrite)
+    if err != nil {
+        return err
+    }
+    if loc.kind != kindStorage {
+        return os.ErrPermission
+    }
+    if err := fs.checkRetention(retention.CheckOverwrite(loc.rel), "truncate", loc); err != nil {
+        return err
+    }
+    if info, err := os.Stat(fs.fullPath(loc)); err == nil && size > info.Size() {
+        left, err := fs.quotaLeft(loc)
+        if err != nil {
+            return err
+        }
+        if left >= 0 && size-info.Size() > left {
+            return utils.ErrQuotaExceeded
+        }
+    }
+    return os.Truncate(fs.fullPath(loc), size)
+}
+
+// QuotaLeft returns how many more bytes may be stored at p, not counting
+// what a file there holds now, or -1 if there is no limit.
+func (fs *FS) QuotaLeft(p string) (int64, error) {
+    loc, err := fs.resolve(p)
+    if err != nil || loc.kind != kindStorage {
+        return -1, err
+    }
+    return fs.quotaLeft(loc)
+}
+
+// quotaLeft returns how many more bytes may be stored at loc, or -1 if there
+// is no limit. Only home folders have a quota, which also covers what others
+// write there through shares.
+func (fs *FS) quotaLeft(loc location) (int64, error) {
+    namespace, _ := events.SplitStoragePath(loc.rel)
+    owner, ok := strings.CutPrefix(namespace, "user:")
+    if !ok {
+        return -1, nil
+    }
+    left, err := utils.QuotaLeft(owner)
+    if err != nil {
+        utils.LogError("QUOTA_ERROR", err, fs.Username, fmt.Sprintf("Failed to calculate storage usage of %s", owner))
+    }
+    return left, err
+}
+
+func fileSize(info os.FileInfo) int64 {
+    if info.IsDir() {
+        return 0
+    }
+    return info.Size()
+}
+
+// ensureNamespace creates the home or group folder a write lands in; it only
+// exists on disk once something was stored there.
+func (fs *FS) ensureNamespace(loc location) error {
+    if loc.share != nil {
+        return nil
+    }
+    namespace, _ := events.SplitStoragePath(loc.rel)
+    root := filepath.Join(fs.storageDir, filepath.FromSlash(events.StoragePath(namespace, "")))
+    return os.MkdirAll(root, 0755)
+}
+
+// revokeShares drops shares whose source is gone, like the HTTP delete does.
+func (fs *FS) revokeShares(rel, reason string) {
+    removed, err := models.RemoveFileSharesUnder(rel)
+    if err != nil {
+        utils.LogError("VFS_ERROR", err, fs.Username, fmt.Sprintf("Failed to revoke shares of %s", rel))
+        return
+    }
+    for _, share := range removed {
+        events.Publish(events.ShareEvent(events.ShareRemoved, fs.Username, fs.RemoteAddr, share, reason))
+    }
+}
+
+// checkRetention logs a change refused by a retention policy or legal hold
+// and passes err on.
+func (fs *FS) checkRetention(err error, action string, loc location) error {
+    if auditAction := retention.AuditAction(err); auditAction != "" {
+        utils.LogAudit(auditAction, fs.Username, fs.RemoteAddr,
+            fmt.Sprintf("%s: refused to %s %s: %s", fs.Client, action, loc.virtual, err.Error()))
+    }
+    return err
+}
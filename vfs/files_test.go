@@ -0,0 +1,118 @@
+package vfs
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/internal/testenv"
+    "LunaTransfer/utils"
+    "bytes"
+    "errors"
+    "io"
+    "os"
+    "testing"
+)
+
+const testUser = "vfsuser"
+
+func TestMain(m *testing.M) {
+    testenv.Main(m, []testenv.User{
+        {Username: testUser, Password: "Files12345", Email: "vfs@example.com", Role: auth.RoleUser},
+    }, nil)
+}
+
+// withQuota sets user_quota for the test and empties the user's home folder.
+func withQuota(t *testing.T, quota int64) *FS {
+    t.Helper()
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := appConfig.UserQuota
+    appConfig.UserQuota = quota
+    t.Cleanup(func() { appConfig.UserQuota = previous })
+
+    fs, err := New(testUser, "127.0.0.1", "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := fs.RemoveAll("/home/quota"); err != nil && !errors.Is(err, os.ErrNotExist) {
+        t.Fatal(err)
+    }
+    if err := fs.Mkdir("/home/quota"); err != nil {
+        t.Fatal(err)
+    }
+    return fs
+}
+
+func writeFile(t *testing.T, fs *FS, p string, flag, size int) error {
+    t.Helper()
+    file, err := fs.Create(p, flag)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    _, err = io.Copy(file, bytes.NewReader(bytes.Repeat([]byte("x"), size)))
+    return err
+}
+
+func TestQuotaStopsWrites(t *testing.T) {
+    fs := withQuota(t, 1000)
+
+    if err := writeFile(t, fs, "/home/quota/a.bin", os.O_TRUNC, 600); err != nil {
+        t.Fatalf("write within quota: %v", err)
+    }
+    if err := writeFile(t, fs, "/home/quota/b.bin", os.O_TRUNC, 500); !errors.Is(err, utils.ErrQuotaExceeded) {
+        t.Fatalf("write past quota: got %v, want ErrQuotaExceeded", err)
+    }
+    if err := writeFile(t, fs, "/home/quota/b.bin", os.O_TRUNC, 400); err != nil {
+        t.Fatalf("write up to quota: %v", err)
+    }
+    if err := writeFile(t, fs, "/home/quota/c.bin", os.O_TRUNC, 1); !errors.Is(err, utils.ErrQuotaExceeded) {
+        t.Fatalf("write at quota: got %v, want ErrQuotaExceeded", err)
+    }
+
+    // Overwriting a file frees what it held, and rewriting bytes a file
+    // already has takes nothing.
+    if err := writeFile(t, fs, "/home/quota/a.bin", os.O_TRUNC, 600); err != nil {
+        t.Fatalf("overwrite: %v", err)
+    }
+    file, err := fs.Create("/home/quota/a.bin", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    if _, err := file.WriteAt(make([]byte, 100), 500); err != nil {
+        t.Fatalf("rewrite: %v", err)
+    }
+    if _, err := file.WriteAt(make([]byte, 100), 550); !errors.Is(err, utils.ErrQuotaExceeded) {
+        t.Fatalf("write past the end at quota: got %v, want ErrQuotaExceeded", err)
+    }
+}
+
+func TestQuotaStopsAppendsAndTruncate(t *testing.T) {
+    fs := withQuota(t, 1000)
+
+    if err := writeFile(t, fs, "/home/quota/log.txt", os.O_TRUNC, 900); err != nil {
+        t.Fatal(err)
+    }
+    if err := writeFile(t, fs, "/home/quota/log.txt", os.O_APPEND, 100); err != nil {
+        t.Fatalf("append within quota: %v", err)
+    }
+    if err := writeFile(t, fs, "/home/quota/log.txt", os.O_APPEND, 1); !errors.Is(err, utils.ErrQuotaExceeded) {
+        t.Fatalf("append past quota: got %v, want ErrQuotaExceeded", err)
+    }
+    if err := fs.Truncate("/home/quota/log.txt", 2000); !errors.Is(err, utils.ErrQuotaExceeded) {
+        t.Fatalf("grow past quota: got %v, want ErrQuotaExceeded", err)
+    }
+    if err := fs.Truncate("/home/quota/log.txt", 10); err != nil {
+        t.Fatalf("shrink: %v", err)
+    }
+}
+
+func TestNoQuota(t *testing.T) {
+    fs := withQuota(t, 0)
+
+    if err := writeFile(t, fs, "/home/quota/big.bin", os.O_TRUNC, 5000); err != nil {
+        t.Fatalf("write without quota: %v", err)
+    }
+}
@@ -0,0 +1,371 @@
+// Package vfs presents LunaTransfer storage to file protocols as one tree per
+// user:
+//
+//	/home/...              the user's own folder
+//	/groups/<groupId>/...  folders of the groups the user belongs to
+//	/shared/<shareId>/...  items shared with one of the user's groups
+//
+// Every operation is checked with the same rules as the HTTP API and
+// published as a domain event, so protocol servers only translate requests.
+package vfs
+
+import (
+    "LunaTransfer/auth"
+    "LunaTransfer/config"
+    "LunaTransfer/events"
+    "LunaTransfer/models"
+    "LunaTransfer/utils"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const (
+    HomeDir   = "home"
+    GroupsDir = "groups"
+    SharedDir = "shared"
+)
+
+type Action string
+
+const (
+    ActionRead   Action = "read"
+    ActionWrite  Action = "write"
+    ActionDelete Action = "delete"
+)
+
+type kind int
+
+const (
+    kindRoot kind = iota
+    kindGroups
+    kindShared
+    kindStorage
+)
+
+// FS is one user's view of storage. Client identifies the protocol and client
+// software in logs and events, e.g. "SFTP (OpenSSH_9.6)".
+type FS struct {
+    Username   string
+    RemoteAddr string
+    Client     string
+
+    storageDir string
+    role       string
+    isAdmin    bool
+}
+
+func New(username, remoteAddr, client string) (*FS, error) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return nil, err
+    }
+    user, err := auth.GetUserByUsername(username)
+    if err != nil {
+        return nil, err
+    }
+    return &FS{
+        Username:   username,
+        RemoteAddr: remoteAddr,
+        Client:     client,
+        storageDir: appConfig.StorageDirectory,
+        role:       user.Role,
+        isAdmin:    user.Role == auth.RoleAdmin,
+    }, nil
+}
+
+// location is a resolved virtual path.
+type location struct {
+    virtual string
+    kind    kind
+    // rel is the storage-relative path for kindStorage.
+    rel     string
+    groupID string
+    share   *models.FileShare
+    // top is set for /home, /groups/<id> and /shared/<id>, which cannot be
+    // removed or renamed.
+    top     bool
+}
+
+func (l location) name() string {
+    return path.Base(l.virtual)
+}
+
+// Clean turns any client path into an absolute virtual path; ".." never
+// leaves the tree.
+func Clean(p string) string {
+    return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+func (fs *FS) resolve(p string) (location, error) {
+    virtual := Clean(p)
+    parts := strings.SplitN(strings.TrimPrefix(virtual, "/"), "/", 3)
+    loc := location{virtual: virtual}
+
+    switch parts[0] {
+    case "":
+        loc.kind = kindRoot
+        return loc, nil
+    case HomeDir:
+        rest := strings.TrimPrefix(strings.TrimPrefix(virtual, "/"+HomeDir), "/")
+        loc.kind = kindStorage
+        loc.rel = path.Join(fs.Username, rest)
+        loc.top = rest == ""
+        return loc, nil
+    case GroupsDir:
+        if len(parts) == 1 {
+            loc.kind = kindGroups
+            return loc, nil
+        }
+        if _, err := auth.GetGroupByID(parts[1]); err != nil {
+            return loc, os.ErrNotExist
+        }
+        loc.kind = kindStorage
+        loc.groupID = parts[1]
+        loc.rel = path.Join(GroupsDir, parts[1])
+        loc.top = len(parts) == 2
+        if len(parts) == 3 {
+            loc.rel = path.Join(loc.rel, parts[2])
+        }
+        return loc, nil
+    case SharedDir:
+        if len(parts) == 1 {
+            loc.kind = kindShared
+            return loc, nil
+        }
+        share, err := models.GetFileShareByID(parts[1])
+        if err != nil || share.IsExpired(time.Now()) {
+            return loc, os.ErrNotExist
+        }
+        loc.kind = kindStorage
+        loc.share = &share
+        loc.rel = share.SourcePath
+        loc.top = len(parts) == 2
+        if len(parts) == 3 {
+            if !share.IsDir {
+                return loc, os.ErrNotExist
+            }
+            loc.rel = path.Join(share.SourcePath, parts[2])
+        }
+        return loc, nil
+    }
+    return loc, os.ErrNotExist
+}
+
+// authorize applies the HTTP API's rules: the site role must allow the action
+// on files, the home folder belongs to its user, group folders follow the
+// member's group role and shares their permission. The virtual folders above
+// them are read-only.
+func (fs *FS) authorize(loc location, action Action) error {
+    allowed := false
+    var err error
+
+    switch {
+    case loc.kind == kindStorage && !auth.HasPermission(fs.role, string(action), "files"):
+    case loc.kind != kindStorage:
+        allowed = action == ActionRead
+    case loc.share != nil:
+        allowed, err = auth.HasAccessToSharedFile(fs.Username, loc.rel, action != ActionRead)
+    case loc.groupID != "":
+        allowed, err = auth.HasGroupPermission(fs.Username, loc.groupID, string(action))
+    default:
+        allowed = true
+    }
+    if err != nil {
+        utils.LogError("VFS_ERROR", err, fs.Username, fmt.Sprintf("Failed to check access to %s", loc.virtual))
+        return err
+    }
+    if !allowed {
+        utils.LogSystem("ACCESS_DENIED", fs.Username, fs.RemoteAddr,
+            fmt.Sprintf("%s: attempted to %s %s without permission", fs.Client, action, loc.virtual))
+        return os.ErrPermission
+    }
+    return nil
+}
+
+func (fs *FS) resolveFor(p string, action Action) (location, error) {
+    loc, err := fs.resolve(p)
+    if err != nil {
+        return loc, err
+    }
+    return loc, fs.authorize(loc, action)
+}
+
+// Check reports whether the user may perform action at p without doing it,
+// so that protocols can refuse before receiving a file.
+func (fs *FS) Check(p string, action Action) error {
+    _, err := fs.resolveFor(p, action)
+    return err
+}
+
+func (fs *FS) fullPath(loc location) string {
+    return filepath.Join(fs.storageDir, filepath.FromSlash(loc.rel))
+}
+
+// LockName identifies p for locking. Paths of different users that reach the
+// same stored file map to the same name, so their locks conflict.
+func (fs *FS) LockName(p string) string {
+    loc, err := fs.resolve(p)
+    if err != nil || loc.kind != kindStorage {
+        return path.Join("/.vfs", fs.Username, Clean(p))
+    }
+    return "/" + loc.rel
+}
+
+// VirtualPath turns a name from LockName back into this user's path.
+func (fs *FS) VirtualPath(lockName string) string {
+    if rest, ok := strings.CutPrefix(lockName, path.Join("/.vfs", fs.Username)); ok {
+        return Clean(rest)
+    }
+
+    rel := strings.TrimPrefix(lockName, "/")
+    namespace, p := events.SplitStoragePath(rel)
+    if namespace == "user:"+fs.Username {
+        return path.Join("/", HomeDir, p)
+    }
+    if id, ok := strings.CutPrefix(namespace, "group:"); ok {
+        return path.Join("/", GroupsDir, id, p)
+    }
+    if shares, err := models.LoadFileShares(); err == nil {
+        for _, share := range shares {
+            if share.Covers(rel) {
+                return path.Join("/", SharedDir, share.ID, strings.TrimPrefix(rel, share.SourcePath))
+            }
+        }
+    }
+    return lockName
+}
+
+// Stat describes the file or folder at p.
+func (fs *FS) Stat(p string) (os.FileInfo, error) {
+    loc, err := fs.resolveFor(p, ActionRead)
+    if err != nil {
+        return nil, err
+    }
+    if loc.kind != kindStorage {
+        return dirInfo{name: loc.name()}, nil
+    }
+
+    info, err := os.Stat(fs.fullPath(loc))
+    if err != nil {
+        // Home and group folders appear before anything was stored in them.
+        if os.IsNotExist(err) && loc.top && loc.share == nil {
+            return dirInfo{name: loc.name()}, nil
+        }
+        return nil, err
+    }
+    if loc.top {
+        return namedInfo{FileInfo: info, name: loc.name()}, nil
+    }
+    return info, nil
+}
+
+// ReadDir lists the folder at p.
+func (fs *FS) ReadDir(p string) ([]os.FileInfo, error) {
+    loc, err := fs.resolveFor(p, ActionRead)
+    if err != nil {
+        return nil, err
+    }
+
+    switch loc.kind {
+    case kindRoot:
+        return []os.FileInfo{
+            dirInfo{name: HomeDir},
+            dirInfo{name: GroupsDir},
+            dirInfo{name: SharedDir},
+        }, nil
+    case kindGroups:
+        return fs.listGroups()
+    case kindShared:
+        return fs.listShares()
+    }
+
+    entries, err := os.ReadDir(fs.fullPath(loc))
+    if err != nil {
+        if os.IsNotExist(err) && loc.top && loc.share == nil {
+            return []os.FileInfo{}, nil
+        }
+        return nil, err
+    }
+    infos := make([]os.FileInfo, 0, len(entries))
+    for _, entry := range entries {
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        infos = append(infos, info)
+    }
+    return infos, nil
+}
+
+func (fs *FS) listGroups() ([]os.FileInfo, error) {
+    var groups []auth.Group
+    var err error
+    if fs.isAdmin {
+        groups, err = auth.LoadGroups()
+    } else {
+        groups, err = auth.GetUserGroups(fs.Username)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    infos := make([]os.FileInfo, 0, len(groups))
+    for _, group := range groups {
+        infos = append(infos, dirInfo{name: group.ID, modTime: group.CreatedAt})
+    }
+    return infos, nil
+}
+
+func (fs *FS) listShares() ([]os.FileInfo, error) {
+    shares, err := models.LoadFileShares()
+    if err != nil {
+        return nil, err
+    }
+    groups, err := auth.GetUserGroups(fs.Username)
+    if err != nil {
+        return nil, err
+    }
+    member := make(map[string]bool, len(groups))
+    for _, group := range groups {
+        member[group.ID] = true
+    }
+
+    now := time.Now()
+    infos := make([]os.FileInfo, 0)
+    for _, share := range shares {
+        if share.IsExpired(now) || (!fs.isAdmin && !member[share.TargetGroup]) {
+            continue
+        }
+        info, err := os.Stat(filepath.Join(fs.storageDir, filepath.FromSlash(share.SourcePath)))
+        if err != nil {
+            continue
+        }
+        infos = append(infos, namedInfo{FileInfo: info, name: share.ID})
+    }
+    return infos, nil
+}
+
+// dirInfo describes the virtual folders that have no directory on disk.
+type dirInfo struct {
+    name    string
+    modTime time.Time
+}
+
+func (d dirInfo) Name() string       { return d.name }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d dirInfo) ModTime() time.Time { return d.modTime }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
+
+// namedInfo shows a stored file under its virtual name.
+type namedInfo struct {
+    os.FileInfo
+    name string
+}
+
+func (n namedInfo) Name() string { return n.name }
@@ -0,0 +1,316 @@
+package webhooks
+
+import (
+    "LunaTransfer/config"
+    "LunaTransfer/store"
+    "LunaTransfer/utils"
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    pollInterval     = 30 * time.Second
+    retryBaseDelay   = 30 * time.Second
+    retryMaxDelay    = time.Hour
+    requestTimeout   = 10 * time.Second
+    maxLogEntries    = 1000
+    maxResponseBytes = 1024
+)
+
+type DeliveryStatus string
+
+const (
+    DeliveryPending   DeliveryStatus = "pending"
+    DeliverySucceeded DeliveryStatus = "succeeded"
+    DeliveryFailed    DeliveryStatus = "failed"
+)
+
+var (
+    ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+    deliveriesMutex sync.Mutex
+    wake            = make(chan struct{}, 1)
+    httpClient      = &http.Client{Timeout: requestTimeout}
+)
+
+// Delivery is one attempt series of posting an event to a subscription. The
+// same file is both the retry queue (pending entries) and the delivery log.
+type Delivery struct {
+    ID             string          `json:"id"`
+    SubscriptionID string          `json:"subscription_id"`
+    EventID        string          `json:"event_id"`
+    EventType      EventType       `json:"event_type"`
+    Payload        json.RawMessage `json:"payload"`
+    Status         DeliveryStatus  `json:"status"`
+    Attempts       int             `json:"attempts"`
+    NextAttempt    time.Time       `json:"next_attempt"`
+    ResponseStatus int             `json:"response_status,omitempty"`
+    ResponseBody   string          `json:"response_body,omitempty"`
+    LastError      string          `json:"last_error,omitempty"`
+    RedeliveryOf   string          `json:"redelivery_of,omitempty"`
+    CreatedAt      time.Time       `json:"created_at"`
+    CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+}
+
+func newDelivery(sub Subscription, eventID string, eventType EventType, payload []byte) Delivery {
+    now := time.Now()
+    return Delivery{
+        ID:             utils.GenerateUUID(),
+        SubscriptionID: sub.ID,
+        EventID:        eventID,
+        EventType:      eventType,
+        Payload:        payload,
+        Status:         DeliveryPending,
+        NextAttempt:    now,
+        CreatedAt:      now,
+    }
+}
+
+// Sign returns the X-Luna-Signature value for body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const deliveriesFile = "webhook_deliveries.json"
+
+func loadDeliveries() ([]Delivery, error) {
+    deliveries := []Delivery{}
+    if err := store.ReadDataFile(deliveriesFile, &deliveries); err != nil {
+        return nil, err
+    }
+    return deliveries, nil
+}
+
+// saveDeliveries persists the queue, keeping every pending delivery but only
+// the most recent maxLogEntries finished ones.
+func saveDeliveries(deliveries []Delivery) error {
+    finished := 0
+    for _, d := range deliveries {
+        if d.Status != DeliveryPending {
+            finished++
+        }
+    }
+    kept := make([]Delivery, 0, len(deliveries))
+    for _, d := range deliveries {
+        if d.Status != DeliveryPending && finished > maxLogEntries {
+            finished--
+            continue
+        }
+        kept = append(kept, d)
+    }
+
+    return store.WriteDataFile(deliveriesFile, kept)
+}
+
+func enqueue(delivery Delivery) error {
+    deliveriesMutex.Lock()
+    defer deliveriesMutex.Unlock()
+
+    deliveries, err := loadDeliveries()
+    if err != nil {
+        return err
+    }
+    if err := saveDeliveries(append(deliveries, delivery)); err != nil {
+        return err
+    }
+
+    select {
+    case wake <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+// ListDeliveries returns the delivery log of one subscription, newest first.
+func ListDeliveries(subscriptionID string) ([]Delivery, error) {
+    deliveriesMutex.Lock()
+    defer deliveriesMutex.Unlock()
+
+    deliveries, err := loadDeliveries()
+    if err != nil {
+        return nil, err
+    }
+
+    result := []Delivery{}
+    for i := len(deliveries) - 1; i >= 0; i-- {
+        if deliveries[i].SubscriptionID == subscriptionID {
+            result = append(result, deliveries[i])
+        }
+    }
+    return result, nil
+}
+
+// Redeliver queues a fresh copy of an earlier delivery's payload.
+func Redeliver(subscriptionID, deliveryID string) (Delivery, error) {
+    sub, err := GetSubscription(subscriptionID)
+    if err != nil {
+        return Delivery{}, err
+    }
+
+    deliveriesMutex.Lock()
+    deliveries, err := loadDeliveries()
+    deliveriesMutex.Unlock()
+    if err != nil {
+        return Delivery{}, err
+    }
+
+    for _, d := range deliveries {
+        if d.ID != deliveryID || d.SubscriptionID != subscriptionID {
+            continue
+        }
+        redelivery := newDelivery(sub, d.EventID, d.EventType, d.Payload)
+        redelivery.RedeliveryOf = d.ID
+        if err := enqueue(redelivery); err != nil {
+            return Delivery{}, err
+        }
+        return redelivery, nil
+    }
+    return Delivery{}, ErrDeliveryNotFound
+}
+
+// Start sends queued deliveries until ctx is cancelled. New events go out
+// right away; failures are retried with exponential backoff.
+func Start(ctx context.Context) {
+    ticker := time.NewTicker(pollInterval)
+    defer ticker.Stop()
+
+    for {
+        processQueue(ctx)
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        case <-wake:
+        }
+    }
+}
+
+func processQueue(ctx context.Context) {
+    appConfig, err := config.LoadConfig()
+    if err != nil {
+        return
+    }
+
+    deliveriesMutex.Lock()
+    deliveries, err := loadDeliveries()
+    deliveriesMutex.Unlock()
+    if err != nil {
+        utils.LogError("WEBHOOK_QUEUE_ERROR", err, "system", "Failed to load webhook queue")
+        return
+    }
+
+    now := time.Now()
+    for _, d := range deliveries {
+        if ctx.Err() != nil {
+            return
+        }
+        if d.Status != DeliveryPending || d.NextAttempt.After(now) {
+            continue
+        }
+
+        sub, err := GetSubscription(d.SubscriptionID)
+        var status int
+        var body string
+        if err == nil {
+            status, body, err = post(ctx, sub, d)
+        }
+        if err := recordAttempt(d.ID, status, body, err, appConfig.WebhookMaxAttempts); err != nil {
+            utils.LogError("WEBHOOK_QUEUE_ERROR", err, "system", "Failed to update webhook queue")
+            return
+        }
+    }
+}
+
+func post(ctx context.Context, sub Subscription, d Delivery) (int, string, error) {
+    timestamp := time.Now().Unix()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+    if err != nil {
+        return 0, "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "LunaTransfer-Webhooks/1.0")
+    req.Header.Set("X-Luna-Event", string(d.EventType))
+    req.Header.Set("X-Luna-Delivery", d.ID)
+    req.Header.Set("X-Luna-Timestamp", strconv.FormatInt(timestamp, 10))
+    req.Header.Set("X-Luna-Signature", Sign(sub.Secret, timestamp, d.Payload))
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return 0, "", err
+    }
+    defer resp.Body.Close()
+
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return resp.StatusCode, string(body), fmt.Errorf("endpoint returned %s", resp.Status)
+    }
+    return resp.StatusCode, string(body), nil
+}
+
+// recordAttempt stores the outcome of one POST and schedules the next retry.
+func recordAttempt(id string, status int, body string, sendErr error, maxAttempts int) error {
+    deliveriesMutex.Lock()
+    defer deliveriesMutex.Unlock()
+
+    deliveries, err := loadDeliveries()
+    if err != nil {
+        return err
+    }
+
+    for i, d := range deliveries {
+        if d.ID != id {
+            continue
+        }
+        now := time.Now()
+        d.Attempts++
+        d.ResponseStatus = status
+        d.ResponseBody = body
+
+        switch {
+        case sendErr == nil:
+            d.Status = DeliverySucceeded
+            d.LastError = ""
+            d.CompletedAt = &now
+        case errors.Is(sendErr, ErrSubscriptionNotFound) || d.Attempts >= maxAttempts:
+            d.Status = DeliveryFailed
+            d.LastError = sendErr.Error()
+            d.CompletedAt = &now
+            utils.LogError("WEBHOOK_UNDELIVERABLE", sendErr, "system",
+                fmt.Sprintf("Giving up on %s delivery %s after %d attempts", d.EventType, d.ID, d.Attempts))
+        default:
+            d.LastError = sendErr.Error()
+            d.NextAttempt = now.Add(retryDelay(d.Attempts))
+            utils.LogError("WEBHOOK_RETRY", sendErr, "system",
+                fmt.Sprintf("Will retry %s delivery %s at %s", d.EventType, d.ID, d.NextAttempt.Format(time.RFC3339)))
+        }
+        deliveries[i] = d
+        return saveDeliveries(deliveries)
+    }
+    return nil
+}
+
+func retryDelay(attempts int) time.Duration {
+    delay := retryBaseDelay
+    for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+        delay *= 2
+    }
+    if delay > retryMaxDelay {
+        delay = retryMaxDelay
+    }
+    return delay
+}
@@ -0,0 +1,179 @@
+package webhooks
+
+import (
+    "LunaTransfer/store"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+
+    subscriptionsMutex sync.RWMutex
+)
+
+// Subscription is a registered webhook endpoint. Site admins may subscribe to
+// any namespace; group subscriptions only see events of their own group,
+// including shares targeting it.
+type Subscription struct {
+    ID        string      `json:"id"`
+    URL       string      `json:"url"`
+    Secret    string      `json:"secret"`
+    Events    []EventType `json:"events,omitempty"`
+    GroupID   string      `json:"group_id,omitempty"`
+    Namespace string      `json:"namespace,omitempty"`
+    PathGlob  string      `json:"path_glob,omitempty"`
+    Active    bool        `json:"active"`
+    CreatedBy string      `json:"created_by"`
+    CreatedAt time.Time   `json:"created_at"`
+}
+
+// Matches reports whether event should be delivered to s. An empty Events
+// list means every event. A PathGlob without a slash matches the file name,
+// otherwise the whole namespace-relative path.
+func (s Subscription) Matches(event Event) bool {
+    if !s.Active {
+        return false
+    }
+
+    if len(s.Events) > 0 {
+        wanted := false
+        for _, t := range s.Events {
+            if t == event.Type {
+                wanted = true
+                break
+            }
+        }
+        if !wanted {
+            return false
+        }
+    }
+
+    if s.GroupID != "" {
+        if event.Namespace != "group:"+s.GroupID && event.TargetGroup != s.GroupID {
+            return false
+        }
+    } else if s.Namespace != "" {
+        if ok, _ := path.Match(s.Namespace, event.Namespace); !ok {
+            return false
+        }
+    }
+
+    if s.PathGlob != "" {
+        if event.Path == "" {
+            return false
+        }
+        target := event.Path
+        if !strings.Contains(s.PathGlob, "/") {
+            target = path.Base(event.Path)
+        }
+        if ok, _ := path.Match(s.PathGlob, target); !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// Validate checks the fields a caller supplies when creating a subscription.
+func (s Subscription) Validate() error {
+    u, err := url.Parse(s.URL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return fmt.Errorf("url must be an absolute http or https URL")
+    }
+    for _, t := range s.Events {
+        if !IsValidEventType(t) {
+            return fmt.Errorf("unknown event type %q", t)
+        }
+    }
+    if s.Namespace != "" {
+        if _, err := path.Match(s.Namespace, ""); err != nil {
+            return fmt.Errorf("invalid namespace pattern: %w", err)
+        }
+    }
+    if s.PathGlob != "" {
+        if _, err := path.Match(s.PathGlob, ""); err != nil {
+            return fmt.Errorf("invalid path glob: %w", err)
+        }
+    }
+    return nil
+}
+
+func GenerateSecret() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+const subscriptionsFile = "webhooks.json"
+
+func loadSubscriptions() ([]Subscription, error) {
+    subscriptions := []Subscription{}
+    if err := store.ReadDataFile(subscriptionsFile, &subscriptions); err != nil {
+        return nil, err
+    }
+    return subscriptions, nil
+}
+
+func saveSubscriptions(subscriptions []Subscription) error {
+    if subscriptions == nil {
+        subscriptions = []Subscription{}
+    }
+
+    return store.WriteDataFile(subscriptionsFile, subscriptions)
+}
+
+func ListSubscriptions() ([]Subscription, error) {
+    subscriptionsMutex.RLock()
+    defer subscriptionsMutex.RUnlock()
+
+    return loadSubscriptions()
+}
+
+func GetSubscription(id string) (Subscription, error) {
+    subscriptions, err := ListSubscriptions()
+    if err != nil {
+        return Subscription{}, err
+    }
+    for _, sub := range subscriptions {
+        if sub.ID == id {
+            return sub, nil
+        }
+    }
+    return Subscription{}, ErrSubscriptionNotFound
+}
+
+func CreateSubscription(sub Subscription) error {
+    subscriptionsMutex.Lock()
+    defer subscriptionsMutex.Unlock()
+
+    subscriptions, err := loadSubscriptions()
+    if err != nil {
+        return err
+    }
+    return saveSubscriptions(append(subscriptions, sub))
+}
+
+func DeleteSubscription(id string) error {
+    subscriptionsMutex.Lock()
+    defer subscriptionsMutex.Unlock()
+
+    subscriptions, err := loadSubscriptions()
+    if err != nil {
+        return err
+    }
+    for i, sub := range subscriptions {
+        if sub.ID == id {
+            return saveSubscriptions(append(subscriptions[:i], subscriptions[i+1:]...))
+        }
+    }
+    return ErrSubscriptionNotFound
+}
@@ -0,0 +1,126 @@
+package webhooks
+
+import (
+    "LunaTransfer/utils"
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+type EventType string
+
+const (
+    EventUploadCompleted EventType = "upload.completed"
+    EventDownload        EventType = "download.completed"
+    EventFileDeleted     EventType = "file.deleted"
+    EventShareCreated    EventType = "share.created"
+    EventShareRemoved    EventType = "share.removed"
+    EventUserCreated     EventType = "user.created"
+    EventRuleTriggered   EventType = "rule.triggered"
+    EventSLALate         EventType = "sla.late"
+    EventSLAMissed       EventType = "sla.missed"
+)
+
+// EventTypes lists every event a subscription can ask for.
+var EventTypes = []EventType{
+    EventUploadCompleted,
+    EventDownload,
+    EventFileDeleted,
+    EventShareCreated,
+    EventShareRemoved,
+    EventUserCreated,
+    EventRuleTriggered,
+    EventSLALate,
+    EventSLAMissed,
+}
+
+func IsValidEventType(eventType EventType) bool {
+    for _, t := range EventTypes {
+        if t == eventType {
+            return true
+        }
+    }
+    return false
+}
+
+// Event is the JSON body posted to subscribers. Namespace is "user:<name>" or
+// "group:<id>" and Path is relative to it.
+type Event struct {
+    ID          string     `json:"id"`
+    Type        EventType  `json:"type"`
+    Timestamp   time.Time  `json:"timestamp"`
+    Actor       string     `json:"actor,omitempty"`
+    Namespace   string     `json:"namespace,omitempty"`
+    Path        string     `json:"path,omitempty"`
+    Size        int64      `json:"size,omitempty"`
+    IsDir       bool       `json:"is_dir,omitempty"`
+    ShareID     string     `json:"share_id,omitempty"`
+    TargetGroup string     `json:"target_group,omitempty"`
+    Permission  string     `json:"permission,omitempty"`
+    Reason      string     `json:"reason,omitempty"`
+    Username    string     `json:"username,omitempty"`
+    RuleID      string     `json:"rule_id,omitempty"`
+    RuleName    string     `json:"rule_name,omitempty"`
+    SLAID       string     `json:"sla_id,omitempty"`
+    SLAName     string     `json:"sla_name,omitempty"`
+    PartnerID   string     `json:"partner_id,omitempty"`
+    DueAt       *time.Time `json:"due_at,omitempty"`
+}
+
+// Dispatch queues a delivery of event for every matching subscription. It
+// never blocks on the network; the worker started by Start does the sending.
+func Dispatch(event Event) {
+    event, payload, ok := prepare(event)
+    if !ok {
+        return
+    }
+
+    subscriptions, err := ListSubscriptions()
+    if err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, "system", "Failed to load webhook subscriptions")
+        return
+    }
+
+    for _, sub := range subscriptions {
+        if !sub.Matches(event) {
+            continue
+        }
+        if err := enqueue(newDelivery(sub, event.ID, event.Type, payload)); err != nil {
+            utils.LogError("WEBHOOK_ERROR", err, "system",
+                fmt.Sprintf("Failed to queue %s delivery for webhook %s", event.Type, sub.ID))
+        }
+    }
+}
+
+// DispatchTo queues a delivery of event for one active subscription whatever
+// events it asks for, as the webhook action of automation rules does.
+func DispatchTo(subscriptionID string, event Event) error {
+    sub, err := GetSubscription(subscriptionID)
+    if err != nil {
+        return err
+    }
+    if !sub.Active {
+        return fmt.Errorf("webhook %s is not active", subscriptionID)
+    }
+    event, payload, ok := prepare(event)
+    if !ok {
+        return fmt.Errorf("failed to encode %s event", event.Type)
+    }
+    return enqueue(newDelivery(sub, event.ID, event.Type, payload))
+}
+
+func prepare(event Event) (Event, []byte, bool) {
+    if event.ID == "" {
+        event.ID = utils.GenerateUUID()
+    }
+    if event.Timestamp.IsZero() {
+        event.Timestamp = time.Now().UTC()
+    }
+
+    payload, err := json.Marshal(event)
+    if err != nil {
+        utils.LogError("WEBHOOK_ERROR", err, "system", fmt.Sprintf("Failed to encode %s event", event.Type))
+        return event, nil, false
+    }
+    return event, payload, true
+}